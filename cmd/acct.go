@@ -17,7 +17,7 @@ var acctCmd = &cobra.Command{
 	Use:   "acct",
 	Short: "Download account details",
 	Run: func(cmd *cobra.Command, args []string) {
-		api := tradestation.New()
+		api := tradestation.New("")
 		accounts, err := api.GetAccounts()
 		if err != nil {
 			log.Error().Err(err).Msg("account download failed")
@@ -0,0 +1,135 @@
+// Copyright 2022-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(authCmd)
+	authCmd.AddCommand(authLoginCmd)
+	authCmd.AddCommand(authStatusCmd)
+	authCmd.AddCommand(authLogoutCmd)
+}
+
+var authCmd = &cobra.Command{
+	Use:   "auth",
+	Short: "Manage the saved TradeStation login",
+}
+
+var authLoginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Log in to TradeStation and save the token",
+	Long: `Opens the TradeStation login page in a browser and saves the issued token.
+With auth.headless the login URL is printed instead and the redirect URL is
+read from stdin. A saved token is replaced even if it is still valid.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		api := tradestation.New("")
+		if err := api.Login(ctx); err != nil {
+			log.Error().Err(err).Msg("login failed")
+			memguard.SafeExit(1)
+		}
+
+		printAuthStatus(api.Status(ctx))
+	},
+}
+
+var authStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the saved token",
+	Long: `Shows the environment, token store, expiry and scopes of the saved token
+without refreshing it. Exits with status 1 if the token cannot be used without
+logging in again.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		api := tradestation.New("")
+		status := api.Status(ctx)
+		printAuthStatus(status)
+
+		if !status.Healthy() {
+			memguard.SafeExit(1)
+		}
+	},
+}
+
+var authLogoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "Revoke the refresh token and delete the saved token",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		api := tradestation.New("")
+		if err := api.Logout(ctx); err != nil {
+			log.Error().Err(err).Msg("logout failed; the saved token was kept")
+			memguard.SafeExit(1)
+		}
+		fmt.Println("Logged out.")
+	},
+}
+
+// printAuthStatus writes `status` to stdout
+func printAuthStatus(status *tradestation.AuthStatus) {
+	profile := tradestation.CurrentProfile().StoreName()
+
+	fmt.Printf("Profile:        %s\n", profile)
+	fmt.Printf("Environment:    %s\n", status.Environment)
+	fmt.Printf("Token store:    %s\n", status.Store)
+	fmt.Printf("Read only:      %t\n", status.ReadOnly)
+
+	if !status.HasToken() {
+		fmt.Println("Token:          none")
+		fmt.Println("Status:         login required")
+		return
+	}
+
+	if claims := status.Claims; claims != nil {
+		fmt.Printf("User:           %s\n", claims.User)
+		expires := claims.Expiration.Local().Format(time.RFC3339)
+		if status.Expired() {
+			fmt.Printf("Expires:        %s (expired)\n", expires)
+		} else {
+			fmt.Printf("Expires:        %s (in %s)\n", expires, time.Until(claims.Expiration).Round(time.Second))
+		}
+		fmt.Printf("Scopes:         %s\n", strings.Join(claims.Scopes, " "))
+		fmt.Printf("Verified:       %t\n", claims.Verified)
+	}
+	fmt.Printf("Offline access: %t\n", status.OfflineAccess)
+
+	switch {
+	case status.Err != nil:
+		fmt.Printf("Status:         unusable (%s)\n", status.Err)
+	case !status.Healthy():
+		fmt.Println("Status:         expired, login required")
+	case status.Expired():
+		fmt.Println("Status:         expired, renewable with the refresh token")
+	default:
+		fmt.Println("Status:         ok")
+	}
+}
@@ -30,7 +30,7 @@ var balanceCmd = &cobra.Command{
 	Use:   "balance",
 	Short: "Get current ticker balances",
 	Run: func(cmd *cobra.Command, args []string) {
-		api := tradestation.New()
+		api := tradestation.New("")
 
 		accounts, err := api.GetAccounts()
 		if err != nil {
@@ -49,7 +49,7 @@ var balanceCmd = &cobra.Command{
 				continue
 			}
 
-			row := []string{account.AccountID, account.AccountType, fmt.Sprintf("%.2f", balance.CashBalance), fmt.Sprintf("%.2f", balance.BuyingPower)}
+			row := []string{account.AccountID, account.AccountType, balance.CashBalance.StringFixed(2), balance.BuyingPower.StringFixed(2)}
 			table.Append(row)
 		}
 
@@ -0,0 +1,187 @@
+// Copyright 2022-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	barsUnit     string
+	barsInterval int
+	barsBack     int
+	barsFrom     string
+	barsTo       string
+	barsSession  string
+	barsFormat   string
+	barsOutput   string
+)
+
+func init() {
+	rootCmd.AddCommand(barsCmd)
+	barsCmd.Flags().StringVar(&barsUnit, "unit", "daily", "bar unit: minute, daily, weekly or monthly")
+	barsCmd.Flags().IntVar(&barsInterval, "interval", 1, "number of units per bar (minute bars only)")
+	barsCmd.Flags().IntVar(&barsBack, "bars-back", 0, "number of bars ending at --to (cannot be used with --from)")
+	barsCmd.Flags().StringVar(&barsFrom, "from", "", "first date (YYYY-MM-DD or RFC 3339)")
+	barsCmd.Flags().StringVar(&barsTo, "to", "", "last date (YYYY-MM-DD or RFC 3339); defaults to now")
+	barsCmd.Flags().StringVar(&barsSession, "session", string(tradestation.SESSION_DEFAULT), "session template: Default, USEQPre, USEQPost, USEQPreAndPost or USEQ24Hour")
+	barsCmd.Flags().StringVar(&barsFormat, "format", "csv", "output format: csv or json")
+	barsCmd.Flags().StringVarP(&barsOutput, "output", "o", "", "write bars to this file instead of stdout")
+}
+
+var barsCmd = &cobra.Command{
+	Use:   "bars <ticker>",
+	Short: "Download historical bars",
+	Long: `Downloads OHLCV bars of a ticker as CSV or JSON. Dates without a time are in
+America/New_York; --to includes the whole day.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req, err := barsRequest(args[0])
+		if err != nil {
+			log.Error().Err(err).Msg("invalid bars request")
+			return
+		}
+
+		if barsFormat != "csv" && barsFormat != "json" {
+			log.Error().Str("Format", barsFormat).Msg("unknown output format; use csv or json")
+			return
+		}
+
+		ctx := cmd.Context()
+
+		api := tradestation.New("")
+		bars, err := api.GetBarsContext(ctx, req)
+		if err != nil {
+			log.Error().Err(err).Str("Ticker", req.Symbol).Msg("fetching bars failed")
+			return
+		}
+
+		out := io.Writer(os.Stdout)
+		if barsOutput != "" {
+			f, err := os.Create(barsOutput)
+			if err != nil {
+				log.Error().Err(err).Str("FileName", barsOutput).Msg("could not create output file")
+				return
+			}
+			defer f.Close()
+			out = f
+		}
+
+		if barsFormat == "json" {
+			err = writeBarsJSON(out, bars)
+		} else {
+			err = writeBarsCSV(out, bars)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("could not write bars")
+		}
+	},
+}
+
+// barsRequest builds the bars request of `ticker` from the command flags
+func barsRequest(ticker string) (*tradestation.BarsRequest, error) {
+	req := &tradestation.BarsRequest{
+		Symbol:          strings.ToUpper(ticker),
+		Interval:        barsInterval,
+		BarsBack:        barsBack,
+		SessionTemplate: tradestation.SessionTemplate(barsSession),
+	}
+
+	for _, unit := range []tradestation.BarUnit{tradestation.MINUTE, tradestation.DAILY, tradestation.WEEKLY, tradestation.MONTHLY} {
+		if strings.EqualFold(barsUnit, string(unit)) {
+			req.Unit = unit
+		}
+	}
+	if req.Unit == "" {
+		return nil, fmt.Errorf("unknown bar unit %q", barsUnit)
+	}
+
+	var err error
+	if barsFrom != "" {
+		if req.FirstDate, err = parseBarsDate(barsFrom, false); err != nil {
+			return nil, err
+		}
+	}
+	if barsTo != "" {
+		if req.LastDate, err = parseBarsDate(barsTo, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+// parseBarsDate parses an RFC 3339 time or a date in America/New_York; with
+// `endOfDay` a date is the last second of that day
+func parseBarsDate(value string, endOfDay bool) (time.Time, error) {
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+
+	nyc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", value, nyc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: use YYYY-MM-DD or RFC 3339", value)
+	}
+	if endOfDay {
+		date = date.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return date, nil
+}
+
+// writeBarsCSV writes `bars` as CSV with a header row
+func writeBarsCSV(out io.Writer, bars []*tradestation.Bar) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"timestamp", "open", "high", "low", "close", "volume", "up_volume", "down_volume", "open_interest", "status"})
+	for _, bar := range bars {
+		w.Write([]string{
+			bar.TimeStamp.Format(time.RFC3339),
+			bar.Open.String(),
+			bar.High.String(),
+			bar.Low.String(),
+			bar.Close.String(),
+			strconv.FormatInt(bar.TotalVolume, 10),
+			strconv.FormatInt(bar.UpVolume, 10),
+			strconv.FormatInt(bar.DownVolume, 10),
+			strconv.FormatInt(bar.OpenInterest, 10),
+			string(bar.BarStatus),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeBarsJSON writes `bars` as an indented JSON array
+func writeBarsJSON(out io.Writer, bars []*tradestation.Bar) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(bars)
+}
@@ -0,0 +1,434 @@
+// Copyright 2022-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// errConfigLayout is returned by editConfig when the settings to change are
+// not written as key/value lines of a table, e.g. as dotted keys or an
+// inline table
+var errConfigLayout = errors.New("settings cannot be edited in place")
+
+// isBareKeyRune returns true if `r` may be used in a key without quotes
+func isBareKeyRune(r rune) bool {
+	return r == '_' || r == '-' || (r >= '0' && r <= '9') || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z')
+}
+
+// authTable returns the path of the auth table of `profile`; the empty
+// profile is the top level
+func authTable(profile string) []string {
+	if profile == "" {
+		return []string{"auth"}
+	}
+	return []string{"profiles", profile, "auth"}
+}
+
+// authSettings returns the settings to write to an auth table for
+// `settings`. A new key source replaces every setting of the old one.
+func authSettings(settings map[string]string) map[string]string {
+	res := make(map[string]string, len(settings)+2)
+	if _, ok := settings["key_source"]; ok {
+		res["kdf"] = ""
+		res["kdf_salt"] = ""
+	}
+	for key, value := range settings {
+		res[key] = value
+	}
+	return res
+}
+
+// editConfig replaces auth settings in the TOML document `data` like
+// updateConfig. Only the lines of the changed settings are rewritten, so
+// comments and the order of everything else are kept; new settings are
+// added at the end of their table.
+func editConfig(data []byte, updates map[string]map[string]string) ([]byte, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+
+	profiles := make([]string, 0, len(updates))
+	for profile := range updates {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+
+	var err error
+	for _, profile := range profiles {
+		if lines, err = editTable(lines, authTable(profile), authSettings(updates[profile])); err != nil {
+			return nil, err
+		}
+	}
+
+	edited := []byte(strings.Join(lines, ""))
+	if err := checkConfig(edited, updates); err != nil {
+		return nil, err
+	}
+	return edited, nil
+}
+
+// editTable sets the keys of table `path` to `settings` in `lines`; empty
+// values remove the key
+func editTable(lines []string, path []string, settings map[string]string) ([]string, error) {
+	start, end := findTable(lines, path)
+
+	done := make(map[string]bool, len(settings))
+	res := make([]string, 0, len(lines)+len(settings)+2)
+	insertAt := -1
+	for idx, line := range lines {
+		if start == -1 || idx <= start || idx >= end {
+			res = append(res, line)
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		key, ok := lineKey(trimmed)
+		if !ok {
+			res = append(res, line)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				insertAt = len(res)
+			}
+			continue
+		}
+
+		name, value, found := lookupSetting(settings, key)
+		if !found {
+			res = append(res, line)
+			insertAt = len(res)
+			continue
+		}
+		if multiline(trimmed) {
+			return nil, fmt.Errorf("%w: %s.%s is a multi-line string", errConfigLayout, strings.Join(path, "."), key)
+		}
+
+		done[name] = true
+		if value == "" {
+			continue
+		}
+
+		kv, err := tomlKeyValue(key, value)
+		if err != nil {
+			return nil, err
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		res = append(res, indent+kv+trailingComment(trimmed)+lineEnding(line))
+		insertAt = len(res)
+	}
+
+	// settings that are not in the file yet
+	added := make([]string, 0, len(settings))
+	names := make([]string, 0, len(settings))
+	for name, value := range settings {
+		if !done[name] && value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kv, err := tomlKeyValue(name, settings[name])
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, kv+"\n")
+	}
+	if len(added) == 0 {
+		return res, nil
+	}
+
+	if start == -1 {
+		// SplitAfter leaves an empty line after the final newline
+		if len(res) > 0 && res[len(res)-1] == "" {
+			res = res[:len(res)-1]
+		}
+		if len(res) > 0 && !strings.HasSuffix(res[len(res)-1], "\n") {
+			res[len(res)-1] += "\n"
+		}
+		res = append(res, "\n", tableHeader(path)+"\n")
+		return append(res, added...), nil
+	}
+
+	if insertAt == -1 {
+		insertAt = start + 1
+	}
+	if !strings.HasSuffix(res[insertAt-1], "\n") {
+		res[insertAt-1] += "\n"
+	}
+	return append(res[:insertAt], append(added, res[insertAt:]...)...), nil
+}
+
+// findTable returns the index of the header of table `path` and of the
+// line after its last line, or -1 if the table is not declared
+func findTable(lines []string, path []string) (int, int) {
+	start := -1
+	inString := false
+	for idx, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if multiline(trimmed) {
+			inString = !inString
+			continue
+		}
+		if inString || !strings.HasPrefix(trimmed, "[") {
+			continue
+		}
+
+		if start != -1 {
+			return start, idx
+		}
+		if header, ok := headerPath(trimmed); ok && equalPath(header, path) {
+			start = idx
+		}
+	}
+	return start, len(lines)
+}
+
+// headerPath returns the path of the standard table declared by the header
+// `line`; array tables are not matched
+func headerPath(line string) ([]string, bool) {
+	if strings.HasPrefix(line, "[[") {
+		return nil, false
+	}
+	path, rest, ok := dottedKey(line[1:])
+	if !ok || !strings.HasPrefix(rest, "]") {
+		return nil, false
+	}
+	return path, true
+}
+
+// lineKey returns the key of the key/value line `line`; dotted keys are
+// returned joined with dots
+func lineKey(line string) (string, bool) {
+	path, rest, ok := dottedKey(line)
+	if !ok || !strings.HasPrefix(rest, "=") {
+		return "", false
+	}
+	return strings.Join(path, "."), true
+}
+
+// dottedKey parses the bare, quoted or dotted key at the start of `s` and
+// returns its parts and the rest of `s` after any whitespace
+func dottedKey(s string) ([]string, string, bool) {
+	var path []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		var part string
+		switch {
+		case strings.HasPrefix(s, `"`):
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, s, false
+			}
+			unquoted, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, s, false
+			}
+			part, s = unquoted, s[end+1:]
+		case strings.HasPrefix(s, "'"):
+			end := strings.Index(s[1:], "'")
+			if end == -1 {
+				return nil, s, false
+			}
+			part, s = s[1:end+1], s[end+2:]
+		default:
+			end := strings.IndexFunc(s, func(r rune) bool {
+				return !isBareKeyRune(r)
+			})
+			if end == -1 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, s, false
+			}
+			part, s = s[:end], s[end:]
+		}
+
+		path = append(path, part)
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, ".") {
+			return path, s, true
+		}
+		s = s[1:]
+	}
+}
+
+// lookupSetting finds `key` in `settings`; keys are matched
+// case-insensitively like viper does
+func lookupSetting(settings map[string]string, key string) (string, string, bool) {
+	for name, value := range settings {
+		if strings.EqualFold(name, key) {
+			return name, value, true
+		}
+	}
+	return "", "", false
+}
+
+func equalPath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if !strings.EqualFold(a[idx], b[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// multiline returns true if `line` opens or closes a multi-line string
+func multiline(line string) bool {
+	return strings.Count(line, `"""`)%2 == 1 || strings.Count(line, "'''")%2 == 1
+}
+
+// trailingComment returns the comment after the value of the key/value
+// line `line`, with the whitespace before it
+func trailingComment(line string) string {
+	value := strings.TrimLeft(line[strings.Index(line, "=")+1:], " \t")
+	end := 0
+	switch {
+	case strings.HasPrefix(value, `"`):
+		for end = 1; end < len(value) && value[end] != '"'; end++ {
+			if value[end] == '\\' {
+				end++
+			}
+		}
+	case strings.HasPrefix(value, "'"):
+		end = strings.Index(value[1:], "'") + 1
+	}
+	if end <= 0 || end >= len(value) {
+		return ""
+	}
+
+	rest := value[end+1:]
+	if !strings.HasPrefix(strings.TrimLeft(rest, " \t"), "#") {
+		return ""
+	}
+	return rest
+}
+
+// lineEnding returns the line ending of `line`
+func lineEnding(line string) string {
+	return line[len(strings.TrimRight(line, "\r\n")):]
+}
+
+// tableHeader formats the header of table `path`
+func tableHeader(path []string) string {
+	parts := make([]string, len(path))
+	for idx, part := range path {
+		if part != "" && strings.IndexFunc(part, func(r rune) bool { return !isBareKeyRune(r) }) == -1 {
+			parts[idx] = part
+		} else {
+			parts[idx] = strconv.Quote(part)
+		}
+	}
+	return "[" + strings.Join(parts, ".") + "]"
+}
+
+// tomlKeyValue formats `key` = `value` as a TOML key/value line
+func tomlKeyValue(key, value string) (string, error) {
+	data, err := toml.Marshal(map[string]string{key: value})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// checkConfig returns errConfigLayout if the settings of the document
+// `data` do not match `updates`
+func checkConfig(data []byte, updates map[string]map[string]string) error {
+	config := make(map[string]any)
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%w: %w", errConfigLayout, err)
+	}
+
+	for profile, settings := range updates {
+		table := config
+		for _, name := range authTable(profile) {
+			table = lookupTable(table, name)
+		}
+
+		for key, want := range authSettings(settings) {
+			got := ""
+			for name, value := range table {
+				if strings.EqualFold(name, key) {
+					got = fmt.Sprint(value)
+				}
+			}
+			if got != want {
+				return fmt.Errorf("%w: %s.%s", errConfigLayout, strings.Join(authTable(profile), "."), key)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupTable returns the table `name` of `table`, or nil if there is none.
+// Names are matched case-insensitively like viper does.
+func lookupTable(table map[string]any, name string) map[string]any {
+	for key, value := range table {
+		if sub, ok := value.(map[string]any); ok && strings.EqualFold(key, name) {
+			return sub
+		}
+	}
+	return nil
+}
+
+// rewriteConfig replaces auth settings like editConfig but re-encodes the
+// whole document, which drops its comments and reorders its keys
+func rewriteConfig(data []byte, updates map[string]map[string]string) ([]byte, error) {
+	config := make(map[string]any)
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	for profile, settings := range updates {
+		table := config
+		for _, name := range authTable(profile) {
+			table = subTable(table, name)
+		}
+
+		for key, value := range authSettings(settings) {
+			if value == "" {
+				delete(table, key)
+				continue
+			}
+			table[key] = value
+		}
+	}
+
+	return toml.Marshal(config)
+}
+
+// subTable returns the table `name` of `table`, creating it if necessary.
+// Names are matched case-insensitively like viper does.
+func subTable(table map[string]any, name string) map[string]any {
+	if sub := lookupTable(table, name); sub != nil {
+		return sub
+	}
+
+	sub := make(map[string]any)
+	table[name] = sub
+	return sub
+}
@@ -0,0 +1,110 @@
+// Copyright 2022-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"testing"
+)
+
+const testConfig = `# pv-tradestation settings
+[auth]
+# encrypted with the ssh key
+apikey = "old-key"
+secret = "old-secret"   # trailing comment
+key_source = "ssh"
+
+[log]
+level = "debug"
+
+[profiles.work]
+account = "SIM123"
+
+[profiles.work.auth]
+key_source = "passphrase"
+kdf = "scrypt"
+kdf_salt = "c2FsdA=="
+`
+
+func TestEditConfig(t *testing.T) {
+	updates := map[string]map[string]string{
+		"": {
+			"apikey":     "new-key",
+			"secret":     "new-secret",
+			"key_source": "passphrase",
+			"key_file":   "",
+			"kdf":        "argon2id",
+			"kdf_salt":   "bmV3",
+		},
+		"work": {
+			"key_source": "keyfile",
+			"key_file":   "/etc/pv/work.key",
+		},
+		"home": {
+			"key_source": "ssh",
+		},
+	}
+
+	edited, err := editConfig([]byte(testConfig), updates)
+	if err != nil {
+		t.Fatalf("editConfig: %v", err)
+	}
+
+	want := `# pv-tradestation settings
+[auth]
+# encrypted with the ssh key
+apikey = 'new-key'
+secret = 'new-secret'   # trailing comment
+key_source = 'passphrase'
+kdf = 'argon2id'
+kdf_salt = 'bmV3'
+
+[log]
+level = "debug"
+
+[profiles.work]
+account = "SIM123"
+
+[profiles.work.auth]
+key_source = 'keyfile'
+key_file = '/etc/pv/work.key'
+
+[profiles.home.auth]
+key_source = 'ssh'
+`
+	if string(edited) != want {
+		t.Errorf("edited config is\n%s\nwant\n%s", edited, want)
+	}
+}
+
+func TestEditConfigDottedKeys(t *testing.T) {
+	config := "auth.key_source = \"ssh\"\nauth.apikey = \"old-key\"\n"
+	updates := map[string]map[string]string{
+		"": {"key_source": "passphrase", "apikey": "new-key"},
+	}
+
+	if _, err := editConfig([]byte(config), updates); !errors.Is(err, errConfigLayout) {
+		t.Fatalf("editConfig returned %v, want %v", err, errConfigLayout)
+	}
+
+	rewritten, err := rewriteConfig([]byte(config), updates)
+	if err != nil {
+		t.Fatalf("rewriteConfig: %v", err)
+	}
+	if err := checkConfig(rewritten, updates); err != nil {
+		t.Errorf("rewritten config does not hold the new settings: %v\n%s", err, rewritten)
+	}
+}
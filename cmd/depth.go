@@ -0,0 +1,111 @@
+// Copyright 2022-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	depthLevels int
+	depthShares int64
+)
+
+func init() {
+	rootCmd.AddCommand(depthCmd)
+	depthCmd.Flags().IntVar(&depthLevels, "levels", 10, "number of price levels of each side (1 to 100)")
+	depthCmd.Flags().Int64Var(&depthShares, "shares", 0, "estimate the average fill price of buying and selling this many shares")
+}
+
+var depthCmd = &cobra.Command{
+	Use:   "depth <ticker>",
+	Short: "Show the order book of a ticker",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+
+		symbol := strings.ToUpper(args[0])
+		api := tradestation.New("")
+		events, err := api.StreamMarketDepthAggregates(ctx, symbol, depthLevels)
+		if err != nil {
+			log.Error().Err(err).Str("Ticker", symbol).Msg("streaming market depth failed")
+			return
+		}
+
+		var book *tradestation.OrderBook
+		for event := range events {
+			if event.Type == tradestation.STREAM_DATA {
+				book = event.Book
+				break
+			}
+			if event.Type == tradestation.STREAM_ERROR {
+				log.Error().Err(event.Err).Str("Ticker", symbol).Msg("streaming market depth failed")
+				return
+			}
+		}
+		if book == nil {
+			return
+		}
+
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Bid Size", "Bid", "Ask", "Ask Size"})
+		table.SetBorder(false)
+
+		for idx := 0; idx < len(book.Bids) || idx < len(book.Asks); idx++ {
+			row := make([]string, 4)
+			if idx < len(book.Bids) {
+				row[0] = fmt.Sprintf("%d", book.Bids[idx].Size)
+				row[1] = book.Bids[idx].Price.StringFixed(2)
+			}
+			if idx < len(book.Asks) {
+				row[2] = book.Asks[idx].Price.StringFixed(2)
+				row[3] = fmt.Sprintf("%d", book.Asks[idx].Size)
+			}
+			table.Append(row)
+		}
+
+		table.Render()
+		fmt.Printf("\nAs of: %s\n", book.TimeStamp.String())
+
+		if depthShares <= 0 {
+			return
+		}
+
+		fmt.Println()
+		for _, action := range []tradestation.Action{tradestation.BUY, tradestation.SELL} {
+			estimate, err := book.EstimateFill(action, depthShares)
+			if err != nil {
+				log.Error().Err(err).Msg("could not estimate fill")
+				return
+			}
+			if estimate.Quantity == 0 {
+				fmt.Printf("%-4s %d: no liquidity in the book\n", action, depthShares)
+				continue
+			}
+			fmt.Printf("%-4s %d: %d shares at an average of $%s, up to $%s over %d levels\n", action, depthShares,
+				estimate.Quantity, estimate.AveragePrice.StringFixed(4), estimate.WorstPrice.StringFixed(2), estimate.Levels)
+		}
+	},
+}
@@ -63,8 +63,18 @@ var encryptCmd = &cobra.Command{
 			return
 		}
 
-		cryptedApiKey := tradestation.EncryptAES(apiKey)
-		cryptedSecret := tradestation.EncryptAES(secret)
+		cryptedApiKey, err := tradestation.EncryptAES(apiKey)
+		if err != nil {
+			log.Error().Err(err).Msg("could not encrypt api key")
+			return
+		}
+
+		cryptedSecret, err := tradestation.EncryptAES(secret)
+		if err != nil {
+			log.Error().Err(err).Msg("could not encrypt secret")
+			return
+		}
+
 		fmt.Printf("ApiKey: %s\n", cryptedApiKey)
 		fmt.Printf("Secret: %s\n", cryptedSecret)
 	},
@@ -30,7 +30,7 @@ var posCmd = &cobra.Command{
 	Use:   "pos",
 	Short: "Download positions from tradestation",
 	Run: func(cmd *cobra.Command, args []string) {
-		api := tradestation.New()
+		api := tradestation.New("")
 		accounts, err := api.GetAccounts()
 		if err != nil {
 			log.Error().Err(err).Msg("Error getting accounts")
@@ -55,13 +55,13 @@ var posCmd = &cobra.Command{
 			table.SetBorder(false) // Set Border to false
 
 			for _, p := range positions {
-				row := []string{p.Symbol, p.PositionID, p.Timestamp.Format("2006-01-02 15:04:05 EST"), fmt.Sprintf("%d", p.Quantity), fmt.Sprintf("$%.2f", p.MarketValue), fmt.Sprintf("$%.2f", p.TotalCost), fmt.Sprintf("%.2f (%.2f%%)", p.UnrealizedProfitLoss, p.UnrealizedProfitLossPercent), fmt.Sprintf("%.2f", p.TodaysProfitLoss)}
+				row := []string{p.Symbol, p.PositionID, p.Timestamp.Format("2006-01-02 15:04:05 EST"), fmt.Sprintf("%d", p.Quantity), "$" + p.MarketValue.StringFixed(2), "$" + p.TotalCost.StringFixed(2), fmt.Sprintf("%s (%s%%)", p.UnrealizedProfitLoss.StringFixed(2), p.UnrealizedProfitLossPercent.StringFixed(2)), p.TodaysProfitLoss.StringFixed(2)}
 				rowColor := tablewriter.FgGreenColor
 				todaysColor := tablewriter.FgGreenColor
-				if p.UnrealizedProfitLossPercent < 0 {
+				if p.UnrealizedProfitLossPercent.IsNegative() {
 					rowColor = tablewriter.FgRedColor
 				}
-				if p.TodaysProfitLoss < 0 {
+				if p.TodaysProfitLoss.IsNegative() {
 					todaysColor = tablewriter.FgRedColor
 				}
 
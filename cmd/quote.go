@@ -31,7 +31,7 @@ var quoteCmd = &cobra.Command{
 	Short: "Get current ticker quotes",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		api := tradestation.New()
+		api := tradestation.New("")
 		quotes, err := api.GetQuotes(args)
 		if err != nil {
 			log.Error().Err(err).Msg("fetching quotes failed")
@@ -47,8 +47,8 @@ var quoteCmd = &cobra.Command{
 		table.SetBorder(false) // Set Border to false
 
 		for _, q := range quotes {
-			row := []string{q.Symbol, fmt.Sprintf("%.2f/%.2f (%.2f)", q.Bid, q.Ask, q.Ask-q.Bid), fmt.Sprintf("%.2f", q.VWAP), fmt.Sprintf("%.2f%%", q.NetChangePct), fmt.Sprintf("$%.2f", q.Open), fmt.Sprintf("$%.2f", q.High), fmt.Sprintf("$%.2f", q.Low), fmt.Sprintf("$%.2f", q.Close), fmt.Sprintf("%d", q.Volume)}
-			if q.NetChangePct < 0 {
+			row := []string{q.Symbol, fmt.Sprintf("%s/%s (%s)", q.Bid.StringFixed(2), q.Ask.StringFixed(2), q.Ask.Sub(q.Bid).StringFixed(2)), q.VWAP.StringFixed(2), q.NetChangePct.StringFixed(2) + "%", "$" + q.Open.StringFixed(2), "$" + q.High.StringFixed(2), "$" + q.Low.StringFixed(2), "$" + q.Close.StringFixed(2), fmt.Sprintf("%d", q.Volume)}
+			if q.NetChangePct.IsNegative() {
 				table.Rich(row, []tablewriter.Colors{{tablewriter.Normal, tablewriter.FgRedColor}, {tablewriter.Normal, tablewriter.FgRedColor}, {tablewriter.Normal, tablewriter.FgRedColor}, {tablewriter.Normal, tablewriter.FgRedColor}, {tablewriter.Normal, tablewriter.FgRedColor}, {tablewriter.Normal, tablewriter.FgRedColor}, {tablewriter.Normal, tablewriter.FgRedColor}, {tablewriter.Normal, tablewriter.FgRedColor}, {tablewriter.Normal, tablewriter.FgRedColor}})
 			} else {
 				table.Rich(row, []tablewriter.Colors{{tablewriter.Normal, tablewriter.FgGreenColor}, {tablewriter.Normal, tablewriter.FgGreenColor}, {tablewriter.Normal, tablewriter.FgGreenColor}, {tablewriter.Normal, tablewriter.FgGreenColor}, {tablewriter.Normal, tablewriter.FgGreenColor}, {tablewriter.Normal, tablewriter.FgGreenColor}, {tablewriter.Normal, tablewriter.FgGreenColor}, {tablewriter.Normal, tablewriter.FgGreenColor}, {tablewriter.Normal, tablewriter.FgGreenColor}})
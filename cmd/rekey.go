@@ -0,0 +1,283 @@
+// Copyright 2022-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// newPassphraseEnv is consulted for the new passphrase before prompting
+const newPassphraseEnv = "TRADESTATION_NEW_PASSPHRASE"
+
+var (
+	rekeySource  string
+	rekeyKeyFile string
+	rekeyKDF     string
+)
+
+// rekeyer is a token store that can re-encrypt its tokens
+type rekeyer interface {
+	Rekey(oldKey, newKey *tradestation.Key) error
+}
+
+func init() {
+	rootCmd.AddCommand(rekeyCmd)
+	rekeyCmd.Flags().StringVar(&rekeySource, "key-source", "passphrase", "new key source (ssh, passphrase or keyfile)")
+	rekeyCmd.Flags().StringVar(&rekeyKeyFile, "key-file", "", "new ssh or raw key file (ssh defaults to ~/.ssh/id_rsa)")
+	rekeyCmd.Flags().StringVar(&rekeyKDF, "kdf", "argon2id", "key derivation function for passphrases (argon2id or scrypt)")
+}
+
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Re-encrypt the api key, secret and saved tokens with a new key",
+	Long: `Decrypts auth.apikey, auth.secret, the state file and the token database with the
+current key and encrypts them again with a new key. The configuration file is
+updated to use the new key source.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := rekey(); err != nil {
+			log.Error().Err(err).Msg("could not rekey secrets")
+			return err
+		}
+		fmt.Println("Secrets re-encrypted with the new key.")
+		return nil
+	},
+}
+
+// boltRekeyer rekeys the tokens of some profiles of a token database
+type boltRekeyer struct {
+	store    *tradestation.BoltTokenStore
+	profiles []string
+}
+
+func (r *boltRekeyer) Rekey(oldKey, newKey *tradestation.Key) error {
+	return r.store.RekeyProfiles(oldKey, newKey, r.profiles...)
+}
+
+func rekey() error {
+	// tokens of the profile are saved with the key of the profile; see
+	// Profile.TokenStore
+	profile := tradestation.CurrentProfile()
+	oldKey, err := profile.Key()
+	if err != nil {
+		return fmt.Errorf("could not get the current key: %w", err)
+	}
+
+	// profiles without a key of their own share the top level key
+	affected := []*tradestation.Profile{profile}
+	if profile.Name == "" {
+		for _, name := range tradestation.Profiles() {
+			if other := (&tradestation.Profile{Name: name}); !other.OwnKey() {
+				affected = append(affected, other)
+			}
+		}
+	}
+
+	newKey, keySettings, err := newKeySource()
+	if err != nil {
+		return err
+	}
+
+	// auth settings to write, by the table that holds them
+	updates := map[string]map[string]string{
+		profile.Name: keySettings,
+	}
+
+	for _, p := range affected {
+		for _, name := range []string{"apikey", "secret"} {
+			setting := p.Setting("auth." + name)
+			inherited := p.Name != "" && setting == "auth."+name
+
+			// values inherited from the top level are rekeyed there, unless
+			// the profile gets a key of its own
+			if inherited && p != profile {
+				continue
+			}
+
+			if viper.GetString(setting) == "" {
+				continue
+			}
+
+			value, err := tradestation.DecryptAESWithKey(oldKey, viper.GetString(setting))
+			if err != nil {
+				return fmt.Errorf("could not decrypt %s with the current key: %w", setting, err)
+			}
+
+			if updates[p.Name] == nil {
+				updates[p.Name] = make(map[string]string)
+			}
+			if updates[p.Name][name], err = tradestation.EncryptAESWithKey(newKey, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	stores := make([]rekeyer, 0, len(affected))
+	stateFiles := make(map[string]bool)
+	boltStores := make(map[string]*boltRekeyer)
+	for _, p := range affected {
+		if stateFile := p.StateFile(); stateFile != "" && !stateFiles[stateFile] {
+			stateFiles[stateFile] = true
+			stores = append(stores, &tradestation.FileTokenStore{Path: stateFile})
+		}
+
+		if tokenDB := p.GetString("token_db"); tokenDB != "" {
+			store, ok := boltStores[tokenDB]
+			if !ok {
+				store = &boltRekeyer{store: &tradestation.BoltTokenStore{Path: tokenDB}}
+				boltStores[tokenDB] = store
+				stores = append(stores, store)
+			}
+			store.profiles = append(store.profiles, p.StoreName())
+		}
+	}
+
+	// restores the old key on the stores that were already rekeyed
+	rollback := func(done []rekeyer) {
+		for _, store := range done {
+			if err := store.Rekey(newKey, oldKey); err != nil {
+				log.Error().Err(err).Msg("could not restore the old key of a token store")
+			}
+		}
+	}
+
+	for idx, store := range stores {
+		if err := store.Rekey(oldKey, newKey); err != nil {
+			rollback(stores[:idx])
+			return err
+		}
+	}
+
+	if err := updateConfig(updates); err != nil {
+		rollback(stores)
+		return err
+	}
+
+	return nil
+}
+
+// newKeySource returns the key selected by the command line flags along
+// with the auth settings that select it in the configuration file
+func newKeySource() (*tradestation.Key, map[string]string, error) {
+	settings := map[string]string{
+		"key_source": rekeySource,
+		"key_file":   rekeyKeyFile,
+	}
+
+	var src tradestation.KeySource
+	switch tradestation.KeySourceType(rekeySource) {
+	case tradestation.SSH_KEY:
+		src = &tradestation.SSHKeySource{Path: rekeyKeyFile}
+	case tradestation.KEY_FILE:
+		if rekeyKeyFile == "" {
+			return nil, nil, errors.New("--key-file is required by the keyfile key source")
+		}
+		src = &tradestation.KeyFileSource{Path: rekeyKeyFile}
+	case tradestation.PASSPHRASE:
+		salt, err := tradestation.NewSalt()
+		if err != nil {
+			return nil, nil, err
+		}
+		settings["key_file"] = ""
+		settings["kdf"] = rekeyKDF
+		settings["kdf_salt"] = base64.StdEncoding.EncodeToString(salt)
+		src = &tradestation.PassphraseKeySource{
+			KDF:        tradestation.KDF(rekeyKDF),
+			Salt:       salt,
+			Passphrase: newPassphrase,
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown key source %q", rekeySource)
+	}
+
+	key, err := src.Key()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get the new key: %w", err)
+	}
+	return key, settings, nil
+}
+
+// newPassphrase reads the new passphrase from the environment or asks for it
+// twice on the terminal
+func newPassphrase() ([]byte, error) {
+	if passphrase := os.Getenv(newPassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		return nil, fmt.Errorf("no terminal to prompt for the new passphrase; set %s", newPassphraseEnv)
+	}
+
+	fmt.Print("New passphrase: ")
+	passphrase, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Print("Repeat new passphrase: ")
+	repeated, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(passphrase, repeated) {
+		return nil, errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// updateConfig replaces auth settings in the configuration file. `updates`
+// holds the settings of each profile; the empty profile is the top level.
+// Empty values remove the setting. Only the changed lines are rewritten; if
+// the settings cannot be edited in place the whole file is re-encoded, which
+// drops its comments, after warning the user.
+func updateConfig(updates map[string]map[string]string) error {
+	configFile := viper.ConfigFileUsed()
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	edited, err := editConfig(data, updates)
+	if errors.Is(err, errConfigLayout) {
+		log.Warn().Err(err).Str("ConfigFile", configFile).Msg("rewriting the whole configuration file; its comments and key order are not kept")
+		edited, err = rewriteConfig(data, updates)
+	}
+	if err != nil {
+		return fmt.Errorf("could not update config file %s: %w", configFile, err)
+	}
+
+	return tradestation.WriteFileAtomic(configFile, edited, info.Mode().Perm())
+}
@@ -16,9 +16,18 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"time"
 
+	"github.com/awnumar/memguard"
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -27,6 +36,9 @@ import (
 
 var cfgFile string
 
+// metricsJob is the job label of metrics sent to a Pushgateway
+const metricsJob = "pv-tradestation"
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "pv-tradestation",
@@ -37,22 +49,123 @@ var rootCmd = &cobra.Command{
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
-func Execute() {
-	err := rootCmd.Execute()
+// Commands stop when `ctx` is cancelled.
+func Execute(ctx context.Context) {
+	err := rootCmd.ExecuteContext(ctx)
+	pushMetrics()
 	if err != nil {
-		os.Exit(1)
+		memguard.SafeExit(1)
 	}
 }
 
 func init() {
 	cobra.OnInitialize(initConfig)
 	cobra.OnInitialize(initLog)
+	cobra.OnInitialize(initMetrics)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is import-tickers.toml)")
+
+	rootCmd.PersistentFlags().String("profile", "", "use the credentials and settings of [profiles.<name>] in the config file")
+	viper.BindPFlag("profile", rootCmd.PersistentFlags().Lookup("profile"))
+
+	rootCmd.PersistentFlags().String("log-level", "info", "log level (trace, debug, info, warn, error)")
+	viper.BindPFlag("log.level", rootCmd.PersistentFlags().Lookup("log-level"))
+
+	rootCmd.PersistentFlags().String("log-format", "console", "log output format (console or json)")
+	viper.BindPFlag("log.format", rootCmd.PersistentFlags().Lookup("log-format"))
+
+	rootCmd.PersistentFlags().String("log-file", "", "write logs to the given file instead of stderr")
+	viper.BindPFlag("log.file", rootCmd.PersistentFlags().Lookup("log-file"))
+
+	rootCmd.PersistentFlags().Bool("headless", false, "log in without a browser by pasting the redirect url into the terminal")
+	viper.BindPFlag("auth.headless", rootCmd.PersistentFlags().Lookup("headless"))
+
+	rootCmd.PersistentFlags().Bool("unattended", false, "never ask to log in; fail if no usable token is available")
+	viper.BindPFlag("auth.unattended", rootCmd.PersistentFlags().Lookup("unattended"))
+
+	rootCmd.PersistentFlags().String("record", "", "record tradestation requests and responses to the given fixture file")
+	viper.BindPFlag("record", rootCmd.PersistentFlags().Lookup("record"))
+
+	rootCmd.PersistentFlags().String("replay", "", "serve tradestation responses from the given fixture file instead of the network")
+	viper.BindPFlag("replay", rootCmd.PersistentFlags().Lookup("replay"))
+
+	rootCmd.PersistentFlags().String("metrics-listen", "", "serve prometheus metrics on /metrics at the given address (e.g. :9090)")
+	viper.BindPFlag("metrics.listen", rootCmd.PersistentFlags().Lookup("metrics-listen"))
+
+	rootCmd.PersistentFlags().String("metrics-push", "", "push prometheus metrics to the given pushgateway url when the command finishes")
+	viper.BindPFlag("metrics.push", rootCmd.PersistentFlags().Lookup("metrics-push"))
 }
 
 func initLog() {
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	level, err := zerolog.ParseLevel(viper.GetString("log.level"))
+	if err != nil || level == zerolog.NoLevel {
+		level = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(level)
+
+	var out io.Writer = os.Stderr
+	if logFile := viper.GetString("log.file"); logFile != "" {
+		fh, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Error().Err(err).Str("LogFile", logFile).Msg("could not open log file; logging to stderr")
+		} else {
+			out = fh
+		}
+	}
+
+	switch viper.GetString("log.format") {
+	case "json":
+		log.Logger = zerolog.New(out).With().Timestamp().Logger()
+	default:
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: out, NoColor: out != os.Stderr})
+	}
+}
+
+// metricsEnabled returns true if metrics are served or pushed
+func metricsEnabled() bool {
+	return viper.GetString("metrics.listen") != "" || viper.GetString("metrics.push") != ""
+}
+
+// initMetrics serves prometheus metrics in the background if a listen
+// address is configured. The server stops with the command, so a sync
+// that should be scraped pushes its metrics instead (see pushMetrics).
+func initMetrics() {
+	addr := viper.GetString("metrics.listen")
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error().Err(err).Str("Listen", addr).Msg("metrics server stopped")
+		}
+	}()
+}
+
+// pushMetrics sends the metrics of the finished command to a Prometheus
+// Pushgateway if one is configured. The metrics of each profile are kept
+// apart so several households can be synced from one host.
+func pushMetrics() {
+	url := viper.GetString("metrics.push")
+	if url == "" {
+		return
+	}
+
+	profile := viper.GetString("profile")
+	if profile == "" {
+		profile = tradestation.DefaultProfile
+	}
+
+	err := push.New(url, metricsJob).
+		Client(&http.Client{Timeout: 30 * time.Second}).
+		Gatherer(prometheus.DefaultGatherer).
+		Grouping("profile", profile).
+		Push()
+	if err != nil {
+		log.Error().Err(err).Str("Pushgateway", url).Msg("could not push metrics")
+	}
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -80,6 +193,11 @@ func initConfig() {
 		log.Info().Str("ConfigFile", viper.ConfigFileUsed()).Msg("Loaded config file")
 	} else {
 		log.Error().Stack().Err(err).Msg("error reading config file")
-		os.Exit(1)
+		memguard.SafeExit(1)
+	}
+
+	if _, err := tradestation.LookupProfile(""); err != nil {
+		log.Error().Err(err).Strs("Profiles", tradestation.Profiles()).Msg("invalid --profile")
+		memguard.SafeExit(1)
 	}
 }
@@ -0,0 +1,63 @@
+// Copyright 2022-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestPushMetrics(t *testing.T) {
+	type pushed struct {
+		method string
+		path   string
+		body   string
+	}
+	requests := make(chan pushed, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- pushed{r.Method, r.URL.Path, string(body)}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	viper.Set("metrics.push", srv.URL)
+	viper.Set("profile", "smith")
+	defer viper.Set("metrics.push", "")
+	defer viper.Set("profile", "")
+
+	pushMetrics()
+
+	select {
+	case req := <-requests:
+		if req.method != http.MethodPut {
+			t.Errorf("metrics were sent with %s, want %s", req.method, http.MethodPut)
+		}
+		if want := "/metrics/job/pv-tradestation/profile/smith"; req.path != want {
+			t.Errorf("metrics were sent to %s, want %s", req.path, want)
+		}
+		if !strings.Contains(req.body, "go_goroutines") {
+			t.Error("pushed metrics do not include the registered collectors")
+		}
+	default:
+		t.Fatal("no metrics were pushed")
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/pelletier/go-toml/v2"
 	"github.com/penny-vault/tradestation/pvts"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
@@ -44,7 +45,15 @@ var syncCmd = &cobra.Command{
 			return
 		}
 
-		if err := tl.Sync(confirm); err != nil {
+		if metricsEnabled() {
+			tl.Metrics = pvts.NewSyncMetrics(prometheus.DefaultRegisterer)
+		}
+
+		// cancelled when the process is asked to shut down; orders that were
+		// already sent are still submitted (see main)
+		ctx := cmd.Context()
+
+		if err := tl.SyncContext(ctx, confirm); err != nil {
 			log.Error().Err(err).Str("Sync Config", args[0]).Msg("could not sync tradestation account with pv api")
 			return
 		}
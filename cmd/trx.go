@@ -33,7 +33,7 @@ var trxCmd = &cobra.Command{
 	Use:   "trx",
 	Short: "Download transactions from tradestation",
 	Run: func(cmd *cobra.Command, args []string) {
-		api := tradestation.New()
+		api := tradestation.New("")
 		accounts, err := api.GetAccounts()
 		if err != nil {
 			log.Error().Err(err).Msg("Error getting accounts")
@@ -63,7 +63,7 @@ var trxCmd = &cobra.Command{
 			table.SetBorder(false) // Set Border to false
 
 			for _, o := range orders {
-				row := []string{o.ClosedDateTime.Format("2006-01-02 15:04:05 EST"), o.Legs[0].BuyOrSell, o.Legs[0].Symbol, o.StatusDescription, o.OrderID, fmt.Sprintf("$%.2f", o.FilledPrice), fmt.Sprintf("%d", o.Legs[0].ExecQuantity), fmt.Sprintf("%d", o.Legs[0].QuantityOrdered), fmt.Sprintf("%.2f", o.CommissionFee)}
+				row := []string{o.ClosedDateTime.Format("2006-01-02 15:04:05 EST"), o.Legs[0].BuyOrSell, o.Legs[0].Symbol, o.StatusDescription, o.OrderID, "$" + o.FilledPrice.StringFixed(2), fmt.Sprintf("%d", o.Legs[0].ExecQuantity), fmt.Sprintf("%d", o.Legs[0].QuantityOrdered), o.CommissionFee.StringFixed(2)}
 				table.Append(row)
 			}
 
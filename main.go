@@ -15,15 +15,41 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/awnumar/memguard"
 	"github.com/penny-vault/tradestation/cmd"
 )
 
+// shutdownTimeout is how long a command may take to stop after an interrupt;
+// it is longer than the time allowed to submit orders that were already sent
+const shutdownTimeout = time.Minute
+
 func main() {
-	// Safely terminate memory in case of an interrupt signal
-	memguard.CatchInterrupt()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	// Cancel the running command on an interrupt and let it finish, e.g. a
+	// sync submitting its orders, before memory is wiped and the process
+	// exits. A second interrupt exits straight away.
+	memguard.CatchSignal(func(_ os.Signal) {
+		again := make(chan os.Signal, 1)
+		signal.Notify(again, os.Interrupt, syscall.SIGTERM)
+
+		cancel()
+		select {
+		case <-done:
+		case <-again:
+		case <-time.After(shutdownTimeout):
+		}
+	}, os.Interrupt, syscall.SIGTERM)
 	// Purge the session when we return
 	defer memguard.Purge()
 
-	cmd.Execute()
+	cmd.Execute(ctx)
+	close(done)
 }
@@ -0,0 +1,85 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pvts
+
+import (
+	"time"
+
+	"github.com/penny-vault/tradestation/internal/promutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SyncOutcome is the result of a sync run
+type SyncOutcome string
+
+const (
+	SYNC_SUCCESS       SyncOutcome = "success"
+	SYNC_SKIPPED       SyncOutcome = "skipped"
+	SYNC_NOT_CONFIRMED SyncOutcome = "not_confirmed"
+	SYNC_ERROR         SyncOutcome = "error"
+)
+
+// SyncMetrics are the Prometheus metrics of TradeLink.Sync
+type SyncMetrics struct {
+	// Runs counts sync runs by portfolio and outcome
+	Runs *prometheus.CounterVec
+
+	// Duration observes how long sync runs take by portfolio
+	Duration *prometheus.HistogramVec
+
+	// LastSuccess is the unix time of the last successful sync by portfolio
+	LastSuccess *prometheus.GaugeVec
+}
+
+// NewSyncMetrics creates the sync metrics and registers them with `reg`.
+// Metrics that are already registered with `reg` are reused.
+func NewSyncMetrics(reg prometheus.Registerer) *SyncMetrics {
+	return &SyncMetrics{
+		Runs: promutil.Register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pvts",
+			Name:      "sync_runs_total",
+			Help:      "Number of sync runs by outcome.",
+		}, []string{"portfolio", "outcome"})),
+		Duration: promutil.Register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "pvts",
+			Name:      "sync_duration_seconds",
+			Help:      "Duration of sync runs.",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600},
+		}, []string{"portfolio"})),
+		LastSuccess: promutil.Register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "pvts",
+			Name:      "sync_last_success_timestamp_seconds",
+			Help:      "Unix time of the last successful sync.",
+		}, []string{"portfolio"})),
+	}
+}
+
+// observe records a sync run of `portfolioID`; it is a no-op on nil metrics
+func (m *SyncMetrics) observe(portfolioID string, outcome SyncOutcome, err error, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	if err != nil && outcome == SYNC_SUCCESS {
+		outcome = SYNC_ERROR
+	}
+
+	m.Runs.WithLabelValues(portfolioID, string(outcome)).Inc()
+	m.Duration.WithLabelValues(portfolioID).Observe(duration.Seconds())
+	if outcome == SYNC_SUCCESS {
+		m.LastSuccess.WithLabelValues(portfolioID).SetToCurrentTime()
+	}
+}
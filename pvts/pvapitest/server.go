@@ -0,0 +1,205 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pvapitest provides an in-memory stand-in for the pv-api endpoints
+// used by pvts, so a sync can be run against tradestationtest without any
+// network access.
+package pvapitest
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/penny-vault/tradestation/pvts"
+)
+
+// cashFIGI identifies the cash position in rebalance requests
+const cashFIGI = "$CASH"
+
+// Server is a fake pv-api. Its methods are safe for concurrent use with
+// requests being served.
+type Server struct {
+	*httptest.Server
+
+	// NextTradeDate is returned with every rebalance plan
+	NextTradeDate string
+
+	mu         sync.Mutex
+	securities map[string]*pvts.PVSecurity // ticker and composite FIGI -> security
+	allocation map[string]float64          // composite FIGI -> weight
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	srv := &Server{
+		securities: make(map[string]*pvts.PVSecurity),
+		allocation: make(map[string]float64),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/security/", srv.handleSecurity)
+	mux.HandleFunc("/v1/portfolio/", srv.handleRebalance)
+
+	srv.Server = httptest.NewServer(mux)
+	return srv
+}
+
+// AddSecurity makes `ticker` known under `compositeFIGI`
+func (srv *Server) AddSecurity(ticker, compositeFIGI string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	security := &pvts.PVSecurity{CompositeFIGI: compositeFIGI, Ticker: ticker}
+	srv.securities[ticker] = security
+	srv.securities[compositeFIGI] = security
+}
+
+// SetAllocation sets the target weight of each ticker of the strategy;
+// tickers must have been added with AddSecurity. Every portfolio uses the
+// same allocation.
+func (srv *Server) SetAllocation(weights map[string]float64) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.allocation = make(map[string]float64, len(weights))
+	for ticker, weight := range weights {
+		if security, ok := srv.securities[ticker]; ok {
+			srv.allocation[security.CompositeFIGI] = weight
+		}
+	}
+}
+
+// writeJSON writes `body` as the JSON response of a request
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// handleSecurity serves GET /v1/security/{ticker or composite FIGI}/;
+// pvts sends share classes with a slash, e.g. BRK/B
+func (srv *Server) handleSecurity(w http.ResponseWriter, r *http.Request) {
+	query := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/security/"), "/")
+	query = strings.ReplaceAll(query, "/", ".")
+
+	srv.mu.Lock()
+	security, ok := srv.securities[query]
+	srv.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "security not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, security)
+}
+
+// rebalanceRequest is the body of a rebalance request
+type rebalanceRequest struct {
+	AllocationOnly bool
+	Positions      []*pvts.PVPosition
+	PriceData      map[string]float64
+}
+
+// handleRebalance serves POST /v1/portfolio/{id}/rebalance. The plan buys
+// and sells whole shares at the given prices so that each security reaches
+// its target weight of the value of the portfolio; sells come first.
+func (srv *Server) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/rebalance") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	var req rebalanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	plan := &pvts.PVRebalance{
+		Allocation:    &pvts.Allocation{Members: srv.allocation},
+		NextTradeDate: srv.NextTradeDate,
+		Transactions:  make([]*pvts.Transaction, 0),
+	}
+	if req.AllocationOnly {
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
+
+	held := make(map[string]float64)
+	total := 0.0
+	for _, pos := range req.Positions {
+		if pos.CompositeFIGI == cashFIGI {
+			total += pos.Shares
+			continue
+		}
+		held[pos.CompositeFIGI] += pos.Shares
+		total += pos.Shares * req.PriceData[pos.CompositeFIGI]
+	}
+
+	targets := make(map[string]float64, len(held)+len(srv.allocation))
+	for figi := range held {
+		targets[figi] = 0
+	}
+	for figi, weight := range srv.allocation {
+		price := req.PriceData[figi]
+		if price <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing price of " + figi})
+			return
+		}
+		targets[figi] = math.Floor(total * weight / price)
+	}
+
+	for figi, target := range targets {
+		shares := target - held[figi]
+		if shares == 0 {
+			continue
+		}
+
+		trx := &pvts.Transaction{
+			CompositeFIGI: figi,
+			Kind:          "BUY",
+			PricePerShare: req.PriceData[figi],
+			Shares:        math.Abs(shares),
+			Ticker:        figi,
+		}
+		if security, ok := srv.securities[figi]; ok {
+			trx.Ticker = security.Ticker
+		}
+		if shares < 0 {
+			trx.Kind = "SELL"
+		}
+		trx.TotalValue = trx.Shares * trx.PricePerShare
+		plan.Transactions = append(plan.Transactions, trx)
+	}
+
+	sort.Slice(plan.Transactions, func(i, j int) bool {
+		a, b := plan.Transactions[i], plan.Transactions[j]
+		if a.Kind != b.Kind {
+			return a.Kind == "SELL"
+		}
+		return a.Ticker < b.Ticker
+	})
+
+	writeJSON(w, http.StatusOK, plan)
+}
@@ -16,6 +16,7 @@
 package pvts
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -25,7 +26,9 @@ import (
 	"github.com/go-resty/resty/v2"
 	"github.com/olekukonko/tablewriter"
 	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
 	"github.com/spf13/viper"
 )
 
@@ -34,6 +37,26 @@ type TradeLink struct {
 	AccountID     string
 	LastTradeDate time.Time
 	NextTradeDate time.Time
+
+	// Profile selects the TradeStation login used to sync the account;
+	// defaults to the profile chosen with --profile
+	Profile string
+
+	// API is the TradeStation client used to sync the account; if nil a
+	// client is created with tradestation.New for Profile
+	API *tradestation.API `toml:"-"`
+
+	// Logger receives all log output of the sync; defaults to the global
+	// zerolog logger
+	Logger *zerolog.Logger `toml:"-"`
+
+	// Metrics records the outcome and duration of each sync; if nil no
+	// metrics are recorded
+	Metrics *SyncMetrics `toml:"-"`
+
+	// PVAPIURL is the base URL of pv-api; overrides the pv.url setting of
+	// the profile, which defaults to https://api.pennyvault.com
+	PVAPIURL string `toml:"-"`
 }
 
 type Transaction struct {
@@ -76,6 +99,41 @@ type PVSecurity struct {
 	Ticker        string `json:"ticker"`
 }
 
+// logger returns the logger of the trade link with the account and
+// portfolio IDs attached
+func (tl *TradeLink) logger() zerolog.Logger {
+	logger := log.Logger
+	if tl.Logger != nil {
+		logger = *tl.Logger
+	}
+	return logger.With().Str("AccountID", tl.AccountID).Str("PortfolioID", tl.PortfolioID).Logger()
+}
+
+// pvSetting returns the pv-api setting `key` of the trade link's profile;
+// a profile may hold the pv-api key of its household
+func (tl *TradeLink) pvSetting(key string) string {
+	return (&tradestation.Profile{Name: tl.Profile}).GetString(key)
+}
+
+// pvAPIURL returns the base URL of pv-api
+func (tl *TradeLink) pvAPIURL() string {
+	if tl.PVAPIURL != "" {
+		return tl.PVAPIURL
+	}
+	if pvApiUrl := tl.pvSetting("pv.url"); pvApiUrl != "" {
+		return pvApiUrl
+	}
+	return "https://api.pennyvault.com"
+}
+
+// tradestationAPI returns the client used to communicate with TradeStation
+func (tl *TradeLink) tradestationAPI() *tradestation.API {
+	if tl.API == nil {
+		tl.API = tradestation.New(tl.Profile)
+	}
+	return tl.API
+}
+
 func pvTicker2TradeStation(ticker string) string {
 	ticker = strings.ReplaceAll(ticker, "/", ".")
 	if ticker == "BRK.A" {
@@ -85,29 +143,32 @@ func pvTicker2TradeStation(ticker string) string {
 }
 
 // securityFromSymbol given `symbol` get a security object from PV-API
-func securityFromSymbol(client *resty.Client, symbol string) (*PVSecurity, error) {
+func (tl *TradeLink) securityFromSymbol(ctx context.Context, client *resty.Client, symbol string) (*PVSecurity, error) {
+	subLog := tl.logger()
 	security := &PVSecurity{}
 	query := strings.ReplaceAll(symbol, ".", "%2F")
 
 	resp, err := client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetResult(security).
 		Get(fmt.Sprintf("/v1/security/%s/", query))
 	if err != nil {
-		log.Error().Err(err).Str("Ticker", symbol).Msg("could not get security")
+		subLog.Error().Err(err).Str("Ticker", symbol).Msg("could not get security")
 		return nil, err
 	}
 	if resp.StatusCode() >= 400 {
-		log.Error().Int("StatusCode", resp.StatusCode()).Str("URI", resp.RawResponse.Request.RequestURI).Str("Body", string(resp.Body())).Msg("HTTP error returned when communicating with pv-api")
+		subLog.Error().Int("StatusCode", resp.StatusCode()).Str("URI", resp.RawResponse.Request.RequestURI).Str("Body", string(resp.Body())).Msg("HTTP error returned when communicating with pv-api")
 		return nil, fmt.Errorf("%d status code returned from pvapi", resp.StatusCode())
 	}
 
 	return security, nil
 }
 
-func (tl *TradeLink) convertPositionsToPV(positions []*tradestation.Position) ([]*PVPosition, error) {
+func (tl *TradeLink) convertPositionsToPV(ctx context.Context, positions []*tradestation.Position) ([]*PVPosition, error) {
+	subLog := tl.logger()
 	client := resty.New()
-	client.SetHeader("X-Pv-Api", viper.GetString("pv.apikey"))
+	client.SetHeader("X-Pv-Api", tl.pvSetting("pv.apikey"))
 	client.SetDebug(viper.GetBool("debug"))
 	pvPos := make([]*PVPosition, len(positions))
 
@@ -117,20 +178,17 @@ func (tl *TradeLink) convertPositionsToPV(positions []*tradestation.Position) ([
 		}
 		security := &PVSecurity{}
 		symbol := strings.ReplaceAll(pos.Symbol, ".", "%2F")
-		pvApiUrl := viper.GetString("pv.url")
-		if pvApiUrl == "" {
-			pvApiUrl = "https://api.pennyvault.com"
-		}
 		resp, err := client.R().
+			SetContext(ctx).
 			SetHeader("Content-Type", "application/json").
 			SetResult(security).
-			Get(fmt.Sprintf("%s/v1/security/%s/", pvApiUrl, symbol))
+			Get(fmt.Sprintf("%s/v1/security/%s/", tl.pvAPIURL(), symbol))
 		if err != nil {
-			log.Error().Err(err).Str("Ticker", pos.Symbol).Msg("could not get security")
+			subLog.Error().Err(err).Str("Ticker", pos.Symbol).Msg("could not get security")
 			return nil, err
 		}
 		if resp.StatusCode() >= 400 {
-			log.Error().Str("PortfolioID", tl.PortfolioID).Int("StatusCode", resp.StatusCode()).Str("URI", resp.RawResponse.Request.RequestURI).Str("Body", string(resp.Body())).Msg("HTTP error returned when communicating with pv-api")
+			subLog.Error().Int("StatusCode", resp.StatusCode()).Str("URI", resp.RawResponse.Request.RequestURI).Str("Body", string(resp.Body())).Msg("HTTP error returned when communicating with pv-api")
 			return nil, fmt.Errorf("%d status code returned from pvapi", resp.StatusCode())
 		}
 
@@ -143,6 +201,7 @@ func (tl *TradeLink) convertPositionsToPV(positions []*tradestation.Position) ([
 }
 
 func (tl *TradeLink) createOrderRequests(strategyPlan *PVRebalance, balance *tradestation.Balance) []*tradestation.OrderRequest {
+	subLog := tl.logger()
 	orders := make([]*tradestation.OrderRequest, 0, len(strategyPlan.Transactions))
 
 	// create tradestation orders
@@ -150,7 +209,7 @@ func (tl *TradeLink) createOrderRequests(strategyPlan *PVRebalance, balance *tra
 		ticker := pvTicker2TradeStation(trx.Ticker)
 		o := &tradestation.OrderRequest{
 			AccountID:      tl.AccountID,
-			LimitPrice:     trx.PricePerShare,
+			LimitPrice:     decimal.NewFromFloat(trx.PricePerShare),
 			OrderType:      tradestation.LIMIT,
 			Quantity:       int64(trx.Shares),
 			Symbol:         ticker,
@@ -163,7 +222,7 @@ func (tl *TradeLink) createOrderRequests(strategyPlan *PVRebalance, balance *tra
 		case "BUY":
 			o.TradeAction = tradestation.BUY
 		default:
-			log.Warn().Str("TradeKind", trx.Kind).Msg("skipping transaction due to unknown transaction kind")
+			subLog.Warn().Str("TradeKind", trx.Kind).Msg("skipping transaction due to unknown transaction kind")
 		}
 
 		orders = append(orders, o)
@@ -173,7 +232,8 @@ func (tl *TradeLink) createOrderRequests(strategyPlan *PVRebalance, balance *tra
 }
 
 // pvApiRebalanceRequest calls the pv-api rebalance REST endpoint
-func pvApiRebalanceRequest(client *resty.Client, portfolioID string, allocationOnly bool, positions []*PVPosition, prices map[string]float64) (*PVRebalance, error) {
+func (tl *TradeLink) pvApiRebalanceRequest(ctx context.Context, client *resty.Client, allocationOnly bool, positions []*PVPosition, prices map[string]float64) (*PVRebalance, error) {
+	subLog := tl.logger()
 	result := &PVRebalance{
 		Allocation: &Allocation{
 			Members: make(map[string]float64),
@@ -181,6 +241,7 @@ func pvApiRebalanceRequest(client *resty.Client, portfolioID string, allocationO
 		Transactions: make([]*Transaction, 0, 100),
 	}
 	resp, err := client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetBody(map[string]any{
 			"AllocationOnly": allocationOnly,
@@ -189,13 +250,13 @@ func pvApiRebalanceRequest(client *resty.Client, portfolioID string, allocationO
 			"PriceData":      prices,
 		}).
 		SetResult(result).
-		Post(fmt.Sprintf("/v1/portfolio/%s/rebalance", portfolioID))
+		Post(fmt.Sprintf("/v1/portfolio/%s/rebalance", tl.PortfolioID))
 	if err != nil {
-		log.Error().Err(err).Str("PortfolioID", portfolioID).Msg("could not get strategy rebalance")
+		subLog.Error().Err(err).Msg("could not get strategy rebalance")
 		return nil, err
 	}
 	if resp.StatusCode() >= 400 {
-		log.Error().Str("PortfolioID", portfolioID).Int("StatusCode", resp.StatusCode()).Str("Body", string(resp.Body())).Str("URI", resp.RawResponse.Request.RequestURI).Msg("HTTP error returned when communicating with pv-api")
+		subLog.Error().Int("StatusCode", resp.StatusCode()).Str("Body", string(resp.Body())).Str("URI", resp.RawResponse.Request.RequestURI).Msg("HTTP error returned when communicating with pv-api")
 		return nil, fmt.Errorf("%d status code returned from pvapi", resp.StatusCode())
 	}
 	return result, nil
@@ -203,40 +264,43 @@ func pvApiRebalanceRequest(client *resty.Client, portfolioID string, allocationO
 
 // GetStrategy communicates with pv-api and gets the list of transactions that TradeStation should execute
 func (tl *TradeLink) GetStrategy(positions []*PVPosition, balance *tradestation.Balance) (*PVRebalance, error) {
+	return tl.GetStrategyContext(context.Background(), positions, balance)
+}
+
+// GetStrategyContext is like GetStrategy but carries `ctx` into every request it makes
+func (tl *TradeLink) GetStrategyContext(ctx context.Context, positions []*PVPosition, balance *tradestation.Balance) (*PVRebalance, error) {
+	subLog := tl.logger()
+
 	positions = append(positions, &PVPosition{
 		CompositeFIGI: "$CASH",
 		Ticker:        "$CASH",
-		Shares:        balance.CashBalance,
+		Shares:        balance.CashBalance.InexactFloat64(),
 	})
 
 	// create resty client
 	client := resty.New()
-	client.SetHeader("X-Pv-Api", viper.GetString("pv.apikey"))
+	client.SetHeader("X-Pv-Api", tl.pvSetting("pv.apikey"))
 	client.SetDebug(viper.GetBool("debug"))
-	pvApiUrl := viper.GetString("pv.url")
-	if pvApiUrl == "" {
-		pvApiUrl = "https://api.pennyvault.com"
-	}
-	client.SetBaseURL(pvApiUrl)
+	client.SetBaseURL(tl.pvAPIURL())
 
 	// get list of allocations that portfolio will transition to
-	log.Info().Msg("getting allocation from pvapi")
-	result, err := pvApiRebalanceRequest(client, tl.PortfolioID, true, make([]*PVPosition, 0), make(map[string]float64))
+	subLog.Info().Msg("getting allocation from pvapi")
+	result, err := tl.pvApiRebalanceRequest(ctx, client, true, make([]*PVPosition, 0), make(map[string]float64))
 	if err != nil {
 		// error logged by sender
 		return nil, err
 	}
 
-	log.Info().Int("Num assets in allocation", len(result.Allocation.Members)).Msg("got allocation guidance from pv-api")
+	subLog.Info().Int("Num assets in allocation", len(result.Allocation.Members)).Msg("got allocation guidance from pv-api")
 
 	// get price list for all positions and future allocations
-	log.Info().Msg("getting price data from tradestation")
-	api := tradestation.New()
+	subLog.Info().Msg("getting price data from tradestation")
+	api := tl.tradestationAPI()
 	tickerMap := make(map[string]bool)
 	for figi := range result.Allocation.Members {
-		security, err := securityFromSymbol(client, figi)
+		security, err := tl.securityFromSymbol(ctx, client, figi)
 		if err != nil {
-			log.Error().Str("FIGI", figi).Msg("could not find security for given figi")
+			subLog.Error().Str("FIGI", figi).Msg("could not find security for given figi")
 			return nil, err
 		}
 		ticker := pvTicker2TradeStation(security.Ticker)
@@ -252,82 +316,103 @@ func (tl *TradeLink) GetStrategy(positions []*PVPosition, balance *tradestation.
 	for t := range tickerMap {
 		tickers = append(tickers, t)
 	}
-	quotes, err := api.GetQuotes(tickers)
+	quotes, err := api.GetQuotesContext(ctx, tickers)
 	if err != nil {
-		log.Error().Err(err).Strs("tickers", tickers).Msg("could not get quotes for tickers")
+		subLog.Error().Err(err).Strs("tickers", tickers).Msg("could not get quotes for tickers")
 		return nil, err
 	}
 
 	// Get rebalance plan with current prices
-	log.Info().Msg("translating tickers to figi's")
+	subLog.Info().Msg("translating tickers to figi's")
 	prices := make(map[string]float64)
 	for _, q := range quotes {
-		security, err := securityFromSymbol(client, q.Symbol)
+		security, err := tl.securityFromSymbol(ctx, client, q.Symbol)
 		if err != nil {
-			log.Error().Err(err).Str("ticker", q.Symbol).Msg("could not translate ticker to figi")
+			subLog.Error().Err(err).Str("ticker", q.Symbol).Msg("could not translate ticker to figi")
 			return nil, err
 		}
-		prices[security.CompositeFIGI] = q.Bid + ((q.Ask - q.Bid) / 2)
+		midpoint := q.Bid.Add(q.Ask).Div(decimal.NewFromInt(2)).InexactFloat64()
+		prices[security.CompositeFIGI] = midpoint
 		if q.Symbol == "BRK.B" {
 			// use BRK.B price for BRK.A
-			security, err := securityFromSymbol(client, "BRK.A")
+			security, err := tl.securityFromSymbol(ctx, client, "BRK.A")
 			if err != nil {
-				log.Error().Err(err).Str("ticker", q.Symbol).Msg("could not translate ticker to figi")
+				subLog.Error().Err(err).Str("ticker", q.Symbol).Msg("could not translate ticker to figi")
 				return nil, err
 			}
-			prices[security.CompositeFIGI] = q.Bid + ((q.Ask - q.Bid) / 2)
+			prices[security.CompositeFIGI] = midpoint
 		}
 	}
-	result, err = pvApiRebalanceRequest(client, tl.PortfolioID, false, positions, prices)
+	result, err = tl.pvApiRebalanceRequest(ctx, client, false, positions, prices)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to get rebalance plan from pvapi")
+		subLog.Error().Err(err).Msg("failed to get rebalance plan from pvapi")
 		return nil, err
 	}
 
-	log.Info().Int("NumTransactions", len(result.Transactions)).Msg("got transaction plan from pv-api")
+	subLog.Info().Int("NumTransactions", len(result.Transactions)).Msg("got transaction plan from pv-api")
 
 	return result, nil
 }
 
 // Sync gets a list of transactions from penny-vault and executes them in Trade Station
 func (tl *TradeLink) Sync(autoConfirm bool) error {
-	subLog := log.With().Str("AccountID", tl.AccountID).Str("PortfolioID", tl.PortfolioID).Logger()
+	return tl.SyncContext(context.Background(), autoConfirm)
+}
+
+// SyncContext is like Sync but stops as soon as `ctx` is cancelled. Orders that
+// have already been sent to TradeStation are allowed to complete.
+func (tl *TradeLink) SyncContext(ctx context.Context, autoConfirm bool) (err error) {
+	subLog := tl.logger()
+
+	start := time.Now()
+	outcome := SYNC_SUCCESS
+	defer func() {
+		tl.Metrics.observe(tl.PortfolioID, outcome, err, time.Since(start))
+	}()
 
 	// check if the account should be synchronized
 	now := time.Now()
 	if (!tl.LastTradeDate.Equal(time.Time{}) && now.Before(tl.NextTradeDate)) {
-		log.Info().Msg("no trades necessary - next trade date has not arrived")
+		subLog.Info().Msg("no trades necessary - next trade date has not arrived")
+		outcome = SYNC_SKIPPED
 		return nil
 	}
 
+	profile, err := tradestation.LookupProfile(tl.Profile)
+	if err != nil {
+		subLog.Error().Err(err).Str("Profile", tl.Profile).Msg("could not find tradestation profile")
+		return err
+	}
+	tl.Profile = profile.Name
+
 	// get current positions in account
-	api := tradestation.New()
-	account, err := api.GetAccount(tl.AccountID)
+	api := tl.tradestationAPI()
+	account, err := api.GetAccountContext(ctx, tl.AccountID)
 	if err != nil {
 		subLog.Error().Err(err).Msg("could not get account from tradestation")
 		return err
 	}
 
-	positions, err := account.GetPositions()
+	positions, err := account.GetPositionsContext(ctx)
 	if err != nil {
 		subLog.Error().Err(err).Msg("could not load account positions")
 		return err
 	}
 
-	pvPositions, err := tl.convertPositionsToPV(positions)
+	pvPositions, err := tl.convertPositionsToPV(ctx, positions)
 	if err != nil {
 		subLog.Error().Err(err).Msg("could not convert positions to pv api format")
 		return err
 	}
 
-	balance, err := account.GetBalances()
+	balance, err := account.GetBalancesContext(ctx)
 	if err != nil {
-		subLog.Error().Err(err).Str("AccountID", account.AccountID).Msg("could not get account balances")
+		subLog.Error().Err(err).Msg("could not get account balances")
 		return err
 	}
 
 	// get instructions from pv-api
-	strategyPlan, err := tl.GetStrategy(pvPositions, balance)
+	strategyPlan, err := tl.GetStrategyContext(ctx, pvPositions, balance)
 	if err != nil {
 		subLog.Error().Err(err).Msg("could not get strategy instructions")
 		return err
@@ -342,17 +427,18 @@ func (tl *TradeLink) Sync(autoConfirm bool) error {
 
 	cashLeft := balance.CashBalance
 	for idx, o := range orderReqs {
+		cost := o.LimitPrice.Mul(decimal.NewFromInt(o.Quantity))
 		if o.TradeAction == "BUY" {
-			cashLeft -= (o.LimitPrice * float64(o.Quantity))
+			cashLeft = cashLeft.Sub(cost)
 		} else {
-			cashLeft += (o.LimitPrice * float64(o.Quantity))
+			cashLeft = cashLeft.Add(cost)
 		}
-		row := []string{fmt.Sprintf("%d", idx), o.Symbol, string(o.TradeAction), fmt.Sprintf("%d", o.Quantity), fmt.Sprintf("%.2f", o.LimitPrice), fmt.Sprintf("%.2f", o.LimitPrice*float64(o.Quantity))}
+		row := []string{fmt.Sprintf("%d", idx), o.Symbol, string(o.TradeAction), fmt.Sprintf("%d", o.Quantity), o.LimitPrice.String(), cost.StringFixed(2)}
 		table.Append(row)
 	}
 
 	table.Render()
-	fmt.Printf("Cash Left: %.2f\n", cashLeft)
+	fmt.Printf("Cash Left: %s\n", cashLeft.StringFixed(2))
 
 	confirmed := false
 	if autoConfirm {
@@ -368,12 +454,21 @@ func (tl *TradeLink) Sync(autoConfirm bool) error {
 	}
 
 	if !confirmed {
+		outcome = SYNC_NOT_CONFIRMED
 		return errors.New("user did not confirm transactions")
 	}
 
-	orders, err := account.PlaceGroupOrder(orderReqs)
+	orders, err := account.PlaceGroupOrderContext(ctx, orderReqs)
 	if err != nil {
-		log.Error().Err(err).Msg("error placing orders")
+		switch {
+		case errors.Is(err, tradestation.ErrOrderRejected):
+			subLog.Error().Err(err).Msg("tradestation rejected the order group")
+		case errors.Is(err, tradestation.ErrUnauthorized):
+			subLog.Error().Err(err).Msg("tradestation access token is no longer valid; re-authenticate before syncing again")
+		default:
+			subLog.Error().Err(err).Msg("error placing orders; verify order status in tradestation before syncing again")
+		}
+		return err
 	}
 
 	table = tablewriter.NewWriter(os.Stdout)
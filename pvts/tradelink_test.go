@@ -0,0 +1,69 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pvts_test
+
+import (
+	"testing"
+
+	"github.com/penny-vault/tradestation/pvts"
+	"github.com/penny-vault/tradestation/pvts/pvapitest"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+)
+
+func TestSyncEndToEnd(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	pv := pvapitest.NewServer()
+	defer pv.Close()
+
+	srv.AddAccount("SIM123", 10000)
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 400, Ask: 400})
+	srv.SetQuotes("QQQ", tradestationtest.Quote{Bid: 300, Ask: 300})
+	srv.SetQuotes("IWM", tradestationtest.Quote{Bid: 200, Ask: 200})
+	if err := srv.SetPosition("SIM123", "SPY", 10, 380); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetPosition("SIM123", "IWM", 10, 210); err != nil {
+		t.Fatal(err)
+	}
+
+	pv.AddSecurity("SPY", "BBG000BDTBL9")
+	pv.AddSecurity("QQQ", "BBG000BSWKH7")
+	pv.AddSecurity("IWM", "BBG000CGC9C4")
+	pv.SetAllocation(map[string]float64{"SPY": 0.5, "QQQ": 0.5})
+
+	tl := &pvts.TradeLink{
+		AccountID:   "SIM123",
+		PortfolioID: "test-portfolio",
+		API:         srv.NewAPI(),
+		PVAPIURL:    pv.URL,
+	}
+
+	if err := tl.Sync(true); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	// the portfolio is worth 16000: 8000 buys 20 SPY and 26 QQQ, IWM is sold
+	for symbol, want := range map[string]int64{"SPY": 20, "QQQ": 26, "IWM": 0} {
+		if got := srv.Position("SIM123", symbol); got != want {
+			t.Errorf("position of %s is %d shares, want %d", symbol, got, want)
+		}
+	}
+	if cash := srv.Cash("SIM123"); cash != 200 {
+		t.Errorf("cash is %.2f, want 200.00", cash)
+	}
+}
@@ -16,26 +16,389 @@
 package tradestation
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awnumar/memguard"
 	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+type Environment string
+
+const (
+	SIM  Environment = "sim"
+	LIVE Environment = "live"
+)
+
+const (
+	SimURL    = "https://sim-api.tradestation.com/v3"
+	LiveURL   = "https://api.tradestation.com/v3"
+	SigninURL = "https://signin.tradestation.com"
+
+	// DefaultRedirectURL is the OAuth redirect URL TradeStation registers
+	// for API keys by default
+	DefaultRedirectURL = "http://localhost:31022"
 )
 
+// Options configures an API client without consulting the global viper
+// registry. Zero values fall back to sensible defaults.
+type Options struct {
+	// BaseURL overrides the URL implied by Environment
+	BaseURL string
+
+	// Environment selects between the simulated and live trading
+	// environments; defaults to SIM
+	Environment Environment
+
+	// SigninURL overrides the TradeStation OAuth server; defaults to
+	// SigninURL
+	SigninURL string
+
+	// ClientID and ClientSecret are the API key and secret issued by
+	// TradeStation (in plain text). They are copied into enclaves when the
+	// client is created.
+	ClientID     string
+	ClientSecret string
+
+	// SealedClientID and SealedClientSecret hold the API key and secret in
+	// memguard enclaves and take precedence over ClientID and ClientSecret
+	SealedClientID     *memguard.Enclave
+	SealedClientSecret *memguard.Enclave
+
+	// OfflineAccess requests a refresh token during authentication
+	OfflineAccess bool
+
+	// Scopes are the API scopes requested during authentication; defaults
+	// to DefaultScopes. openid, profile and, with OfflineAccess,
+	// offline_access are always requested.
+	Scopes []string
+
+	// ReadOnly clients never request TradeScope and fail order placement
+	// with ErrReadOnly before sending anything. A saved token that grants
+	// TradeScope is not used; the user has to log in again.
+	ReadOnly bool
+
+	// RedirectURL is the OAuth redirect URL registered for the API key;
+	// defaults to DefaultRedirectURL. Unless Headless is set, a callback
+	// server listens on its host and port during login.
+	RedirectURL string
+
+	// Headless logs in without a browser or callback server: the authorize
+	// URL is written to LoginOutput and the redirect URL the user was sent
+	// to is read from LoginInput
+	Headless    bool
+	LoginInput  io.Reader // defaults to os.Stdin
+	LoginOutput io.Writer // defaults to os.Stderr
+
+	// LoginTimeout is how long a login waits for the user to sign in;
+	// defaults to DefaultLoginTimeout
+	LoginTimeout time.Duration
+
+	// Unattended clients never ask the user to log in; when no usable
+	// token is available requests fail with ErrLoginRequired
+	Unattended bool
+
+	// PKCE protects the authorization code with a proof key (RFC 7636).
+	// ClientSecret may be left empty if the API key does not have one.
+	PKCE bool
+
+	// HTTPClient is the underlying http client used for all requests. If
+	// Transport is also set it replaces the transport of HTTPClient.
+	HTTPClient *http.Client
+	Transport  http.RoundTripper
+
+	// TokenStore persists OAuth tokens between runs; if nil tokens are only
+	// held in memory
+	TokenStore TokenStore
+
+	// Logger receives all log output of the client; defaults to the global
+	// zerolog logger
+	Logger *zerolog.Logger
+
+	// RetryPolicy controls how failed requests are retried; defaults to
+	// DefaultRetryPolicy. Set MaxRetries to 0 to disable retries.
+	RetryPolicy *RetryPolicy
+
+	// RateLimits throttles requests per endpoint group on the client side;
+	// defaults to DefaultRateLimits. Groups without an entry are not
+	// throttled.
+	RateLimits map[EndpointGroup]RateLimit
+
+	// StreamPolicy controls how streams detect stalls and reconnect;
+	// defaults to DefaultStreamPolicy
+	StreamPolicy *StreamPolicy
+
+	// VerifyToken checks the signature, issuer, audience and scopes of
+	// access tokens against the signing keys published by the signin
+	// server before they are used
+	VerifyToken bool
+
+	// JWKSURL is where the signing keys are fetched from; defaults to
+	// SigninURL + "/.well-known/jwks.json"
+	JWKSURL string
+
+	// Metrics receives request, token refresh and order metrics; if nil
+	// the client is not instrumented
+	Metrics *Metrics
+
+	// Debug enables request / response logging in the http client
+	Debug bool
+}
+
+// API is a client of the TradeStation v3 API. An API is safe for concurrent
+// use by multiple goroutines.
 type API struct {
-	token   *OAuthToken
-	baseUrl string
-	client  *resty.Client
+	authMu  sync.Mutex   // serializes token checks and refreshes
+	tokenMu sync.RWMutex // guards token
+	token   *sealedToken
+
+	baseUrl      string
+	signinUrl    string
+	environment  Environment
+	clientID     *memguard.Enclave
+	clientSecret *memguard.Enclave
+	offline      bool
+	scopes       []string
+	readOnly     bool
+	redirectURL  string
+	headless     bool
+	loginInput   io.Reader
+	loginOutput  io.Writer
+	loginTimeout time.Duration
+	pkce         bool
+	unattended   bool
+	verify       bool
+	jwks         *jwksCache
+	store        TokenStore
+	logger       zerolog.Logger
+	limiters     map[EndpointGroup]*rate.Limiter
+	streamPolicy StreamPolicy
+	client       *resty.Client
+
+	metrics       *Metrics
+	ordersMu      sync.Mutex      // guards pendingOrders
+	pendingOrders map[string]bool // placed orders not yet filled or rejected
+}
+
+// New creates an API client configured from the global viper registry with
+// the settings of `profile` (see Profile). An empty profile selects the
+// profile chosen with --profile, or the top level settings if there is none.
+func New(profile string) *API {
+	p, err := LookupProfile(profile)
+	if err != nil {
+		// never fall back to the credentials of another profile
+		log.Error().Err(err).Str("Profile", profile).Msg("could not create tradestation client")
+		return NewWithOptions(Options{Unattended: true})
+	}
+
+	opts := p.Options()
+	if opts.SealedClientID, err = p.ApiKey(); err != nil {
+		log.Error().Err(err).Str("Profile", p.Name).Str("KeySource", p.GetString("auth.key_source")).Msg("could not decrypt api key")
+	}
+	if opts.SealedClientSecret, err = p.Secret(); err != nil {
+		log.Error().Err(err).Str("Profile", p.Name).Str("KeySource", p.GetString("auth.key_source")).Msg("could not decrypt api secret")
+	}
+
+	switch {
+	case viper.GetString("replay") != "":
+		replayer, err := NewReplayer(viper.GetString("replay"))
+		if err != nil {
+			// never fall back to the network when asked to replay
+			log.Error().Err(err).Str("Fixture", viper.GetString("replay")).Msg("could not load fixture file")
+			replayer = &Replayer{}
+		}
+		opts.Transport = replayer
+	case viper.GetString("record") != "":
+		opts.Transport = NewRecorder(viper.GetString("record"))
+	}
+
+	if viper.GetString("metrics.listen") != "" || viper.GetString("metrics.push") != "" {
+		opts.Metrics = NewMetrics(prometheus.DefaultRegisterer)
+	}
+
+	return NewWithOptions(opts)
 }
 
-func New() *API {
+// NewWithOptions creates an API client that is configured entirely by
+// `opts`. Clients created with NewWithOptions share no state and may be
+// used side by side in the same process.
+func NewWithOptions(opts Options) *API {
+	if opts.Environment == "" {
+		opts.Environment = SIM
+	}
+
+	if opts.BaseURL == "" {
+		opts.BaseURL = SimURL
+		if opts.Environment == LIVE {
+			opts.BaseURL = LiveURL
+		}
+	}
+
+	if opts.SigninURL == "" {
+		opts.SigninURL = SigninURL
+	}
+
+	if opts.RedirectURL == "" {
+		opts.RedirectURL = DefaultRedirectURL
+	}
+
+	if opts.LoginInput == nil {
+		opts.LoginInput = os.Stdin
+	}
+
+	if opts.LoginOutput == nil {
+		opts.LoginOutput = os.Stderr
+	}
+
+	if opts.LoginTimeout <= 0 {
+		opts.LoginTimeout = DefaultLoginTimeout
+	}
+
+	if opts.JWKSURL == "" {
+		opts.JWKSURL = strings.TrimSuffix(opts.SigninURL, "/") + jwksPath
+	}
+
+	if len(opts.Scopes) == 0 {
+		opts.Scopes = DefaultScopes
+	}
+
+	scopes := make([]string, 0, len(opts.Scopes))
+	for _, scope := range opts.Scopes {
+		if opts.ReadOnly && scope == TradeScope {
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+
+	if opts.SealedClientID == nil {
+		opts.SealedClientID = sealString(opts.ClientID)
+	}
+
+	if opts.SealedClientSecret == nil {
+		opts.SealedClientSecret = sealString(opts.ClientSecret)
+	}
+
 	api := &API{
-		token:   nil,
-		baseUrl: viper.GetString("sim"),
-		client:  resty.New(),
+		token:        nil,
+		baseUrl:      opts.BaseURL,
+		signinUrl:    strings.TrimSuffix(opts.SigninURL, "/"),
+		environment:  opts.Environment,
+		clientID:     opts.SealedClientID,
+		clientSecret: opts.SealedClientSecret,
+		offline:      opts.OfflineAccess,
+		scopes:       scopes,
+		readOnly:     opts.ReadOnly,
+		redirectURL:  opts.RedirectURL,
+		headless:     opts.Headless,
+		loginInput:   opts.LoginInput,
+		loginOutput:  opts.LoginOutput,
+		loginTimeout: opts.LoginTimeout,
+		pkce:         opts.PKCE,
+		unattended:   opts.Unattended,
+		verify:       opts.VerifyToken,
+		store:        opts.TokenStore,
+		logger:       log.Logger,
+		metrics:      opts.Metrics,
+	}
+
+	if opts.Logger != nil {
+		api.logger = *opts.Logger
+	}
+
+	if opts.HTTPClient != nil {
+		api.client = resty.NewWithClient(opts.HTTPClient)
+	} else {
+		api.client = resty.New()
 	}
-	if viper.GetString("mode") == "live" {
-		api.baseUrl = viper.GetString("live")
+	if opts.Transport != nil {
+		api.client.SetTransport(opts.Transport)
 	}
+
 	api.client = api.client.SetBaseURL(api.baseUrl)
-	api.client.SetDebug(viper.GetBool("debug"))
+	api.jwks = &jwksCache{url: opts.JWKSURL, client: api.client.GetClient()}
+	api.client.SetDebug(opts.Debug)
+	api.client.OnBeforeRequest(api.authorize)
+
+	policy := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		policy = *opts.RetryPolicy
+	}
+
+	api.streamPolicy = DefaultStreamPolicy
+	if opts.StreamPolicy != nil {
+		api.streamPolicy = *opts.StreamPolicy
+		if api.streamPolicy.HeartbeatTimeout <= 0 {
+			api.streamPolicy.HeartbeatTimeout = DefaultStreamPolicy.HeartbeatTimeout
+		}
+		if api.streamPolicy.MaxWaitTime < api.streamPolicy.WaitTime {
+			api.streamPolicy.MaxWaitTime = api.streamPolicy.WaitTime
+		}
+	}
+
+	limits := opts.RateLimits
+	if limits == nil {
+		limits = DefaultRateLimits
+	}
+
+	api.limiters = newLimiters(limits)
+	api.configureRetries(policy)
+	api.instrument()
+
 	return api
 }
+
+// RequestIDHeader carries the ID assigned to each request sent to
+// TradeStation; the same ID is logged as RequestID
+const RequestIDHeader = "X-Request-ID"
+
+// newRequestID returns a random ID used to correlate log messages of a
+// request
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// newRequest creates a request that carries `ctx` and a new request ID. The
+// returned logger includes the request ID.
+func (api *API) newRequest(ctx context.Context) (*resty.Request, zerolog.Logger) {
+	requestID := newRequestID()
+	req := api.client.R().
+		SetContext(ctx).
+		SetHeader(RequestIDHeader, requestID)
+	return req, api.logger.With().Str("RequestID", requestID).Logger()
+}
+
+// Logger returns the logger used by the client
+func (api *API) Logger() zerolog.Logger {
+	return api.logger
+}
+
+// ReadOnly returns true if the client cannot place orders
+func (api *API) ReadOnly() bool {
+	return api.readOnly
+}
+
+// Environment returns the trading environment the client is connected to
+func (api *API) Environment() Environment {
+	return api.environment
+}
+
+// BaseURL returns the root URL of the TradeStation API used by the client
+func (api *API) BaseURL() string {
+	return api.baseUrl
+}
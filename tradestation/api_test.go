@@ -0,0 +1,255 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+)
+
+// TestConcurrentUse shares one client between goroutines whose first
+// requests all find the access token about to expire. Run with -race.
+func TestConcurrentUse(t *testing.T) {
+	const workers = 8
+
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	// a rotated refresh token is revoked, so a second refresh with the
+	// token of the first fails
+	srv.RotateRefreshTokens = true
+	srv.AddAccount("SIM123", 100000)
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	opts := srv.Options()
+	opts.TokenStore = tradestation.NewMemoryTokenStore(srv.ExpiringToken(30 * time.Second))
+	api := tradestation.NewWithOptions(opts)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for idx := 0; idx < workers; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			account, err := api.GetAccount("SIM123")
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := api.GetQuotes([]string{"SPY"}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := account.PlaceOrder(&tradestation.OrderRequest{
+				AccountID:      account.AccountID,
+				OrderType:      tradestation.MARKET,
+				Quantity:       1,
+				Symbol:         "SPY",
+				TimeInForceDur: tradestation.DAY,
+				TradeAction:    tradestation.BUY,
+			}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := account.GetBalances(); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := account.GetOrders(); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := account.GetPositions(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if refreshes := srv.Refreshes(); refreshes != 1 {
+		t.Errorf("token was refreshed %d times, want 1", refreshes)
+	}
+	if shares := srv.Position("SIM123", "SPY"); shares != workers {
+		t.Errorf("position of SPY is %d shares, want %d", shares, workers)
+	}
+
+	token, err := opts.TokenStore.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if token.ExpiresIn <= 60 {
+		t.Errorf("saved token expires in %d seconds, want the refreshed token", token.ExpiresIn)
+	}
+}
+
+// faultTransport answers the requests for which `fault` returns a response
+// or an error itself and sends all others to `next`
+type faultTransport struct {
+	next  http.RoundTripper
+	fault func(req *http.Request) (*http.Response, error)
+}
+
+func (tr *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if resp, err := tr.fault(req); resp != nil || err != nil {
+		return resp, err
+	}
+	return tr.next.RoundTrip(req)
+}
+
+// closeBody is a response body that records if it was closed
+type closeBody struct {
+	io.Reader
+	closed atomic.Bool
+}
+
+func (body *closeBody) Close() error {
+	body.closed.Store(true)
+	return nil
+}
+
+// faultResponse returns a response to `req` with status `code` and a JSON
+// error message
+func faultResponse(req *http.Request, code int, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		Header:     header,
+		Body:       &closeBody{Reader: strings.NewReader(`{"Error":"Fault","Message":"injected by the test"}`)},
+		Request:    req,
+	}
+}
+
+// TestRetryAfterHonored checks that a rate limited request waits as long as
+// the Retry-After header asks, although the backoff would retry sooner
+func TestRetryAfterHonored(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	var mu sync.Mutex
+	var attempts []time.Time
+	opts := srv.Options()
+	opts.RetryPolicy = &tradestation.RetryPolicy{MaxRetries: 3, WaitTime: time.Millisecond, MaxWaitTime: 5 * time.Second}
+	opts.Transport = &faultTransport{
+		next: srv.Client().Transport,
+		fault: func(req *http.Request) (*http.Response, error) {
+			if !strings.Contains(req.URL.Path, "/marketdata/quotes/") {
+				return nil, nil
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, time.Now())
+			if len(attempts) == 1 {
+				return faultResponse(req, http.StatusTooManyRequests, http.Header{"Retry-After": []string{"1"}}), nil
+			}
+			return nil, nil
+		},
+	}
+	api := tradestation.NewWithOptions(opts)
+
+	if _, err := api.GetQuotes([]string{"SPY"}); err != nil {
+		t.Fatalf("GetQuotes: %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("quotes were requested %d times, want 2", len(attempts))
+	}
+	if wait := attempts[1].Sub(attempts[0]); wait < time.Second {
+		t.Errorf("retried after %v, want at least the 1s of Retry-After", wait)
+	}
+}
+
+// TestOrderRetries checks that an order is only sent again when TradeStation
+// refused it because of the rate limit
+func TestOrderRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     int
+		attempts int
+		shares   int64
+	}{
+		{"rate limited", http.StatusTooManyRequests, 2, 1},
+		{"server error", http.StatusInternalServerError, 1, 0},
+		{"bad gateway", http.StatusBadGateway, 1, 0},
+		{"unavailable", http.StatusServiceUnavailable, 1, 0},
+		{"gateway timeout", http.StatusGatewayTimeout, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := tradestationtest.NewServer()
+			defer srv.Close()
+			srv.AddAccount("SIM123", 100000)
+			srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+			var attempts atomic.Int32
+			opts := srv.Options()
+			opts.RetryPolicy = &tradestation.RetryPolicy{MaxRetries: 3, WaitTime: time.Millisecond, MaxWaitTime: 10 * time.Millisecond}
+			opts.Transport = &faultTransport{
+				next: srv.Client().Transport,
+				fault: func(req *http.Request) (*http.Response, error) {
+					if !strings.HasSuffix(req.URL.Path, "/orderexecution/orders") {
+						return nil, nil
+					}
+					if attempts.Add(1) == 1 {
+						return faultResponse(req, tt.code, nil), nil
+					}
+					return nil, nil
+				},
+			}
+			api := tradestation.NewWithOptions(opts)
+
+			account, err := api.GetAccount("SIM123")
+			if err != nil {
+				t.Fatalf("GetAccount: %v", err)
+			}
+			_, err = account.PlaceOrder(&tradestation.OrderRequest{
+				AccountID:      account.AccountID,
+				OrderType:      tradestation.MARKET,
+				Quantity:       1,
+				Symbol:         "SPY",
+				TimeInForceDur: tradestation.DAY,
+				TradeAction:    tradestation.BUY,
+			})
+			if (err == nil) != (tt.shares == 1) {
+				t.Errorf("PlaceOrder returned %v", err)
+			}
+			if got := int(attempts.Load()); got != tt.attempts {
+				t.Errorf("order was sent %d times, want %d", got, tt.attempts)
+			}
+			if shares := srv.Position("SIM123", "SPY"); shares != tt.shares {
+				t.Errorf("position of SPY is %d shares, want %d", shares, tt.shares)
+			}
+		})
+	}
+}
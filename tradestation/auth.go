@@ -16,29 +16,14 @@
 package tradestation
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"math/big"
-	"net"
-	"net/http"
-	"os"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/awnumar/memguard"
 	"github.com/go-resty/resty/v2"
-	"github.com/hydrogen18/stoppableListener"
-	"github.com/lestrrat-go/jwx/v2/jwt"
-	"github.com/pkg/browser"
-	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
-	"lukechampine.com/blake3"
 )
 
 type OAuthToken struct {
@@ -50,303 +35,272 @@ type OAuthToken struct {
 	ExpiresIn    int    `json:"expires_in"`
 }
 
-func EncryptAES(plaintext string) string {
-	// create cipher
-	key := encryptionKey()
-	if len(key) != 32 {
-		log.Error().Msg("encryption key invalid length")
-		return ""
-	}
-	c, err := aes.NewCipher(key)
-	if err != nil {
-		log.Error().Err(err).Msg("could not create AES cipher for encryption")
-	}
-
-	// gcm or Galois/Counter Mode, is a mode of operation
-	// for symmetric key cryptographic block ciphers
-	// - https://en.wikipedia.org/wiki/Galois/Counter_Mode
-	gcm, err := cipher.NewGCM(c)
-	// if any error generating new GCM
-	// handle them
-	if err != nil {
-		log.Error().Err(err).Msg("error creating gcm")
-		return ""
-	}
-
-	// creates a new byte array the size of the nonce
-	// which must be passed to Seal
-	nonce := make([]byte, gcm.NonceSize())
-	// populates our nonce with a cryptographically secure
-	// random sequence
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		log.Error().Err(err).Msg("error populating nonce")
-		return ""
-	}
+// ApiKey decrypts auth.apikey of the profile chosen with --profile into an
+// enclave
+func ApiKey() (*memguard.Enclave, error) {
+	return CurrentProfile().ApiKey()
+}
 
-	// encrypt
-	out := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+// Secret decrypts auth.secret of the profile chosen with --profile into an
+// enclave
+func Secret() (*memguard.Enclave, error) {
+	return CurrentProfile().Secret()
+}
 
-	// return hex string
-	return base64.StdEncoding.EncodeToString(out)
+// CheckAuth checks if there is a token that is not expired available. Errors
+// caused by an unusable token match ErrUnauthorized.
+func (api *API) CheckAuth() error {
+	return api.CheckAuthContext(context.Background())
 }
 
-func DecryptAES(ct string) string {
-	ciphertext, _ := base64.StdEncoding.DecodeString(ct)
-	key := encryptionKey()
-	if len(key) != 32 {
-		log.Error().Msg("encryption key invalid length")
-		return ""
-	}
-	c, err := aes.NewCipher(key)
-	if err != nil {
-		log.Error().Err(err).Msg("could not create AES cipher for decryption")
-		return ""
+// CheckAuthContext is like CheckAuth but carries `ctx` into the OAuth token
+// exchange. Concurrent callers are serialized so that only one of them
+// refreshes the token; the others use the refreshed token once it is ready.
+func (api *API) CheckAuthContext(ctx context.Context) error {
+	api.authMu.Lock()
+	defer api.authMu.Unlock()
+
+	if api.currentToken() == nil {
+		api.loadStateFile()
 	}
 
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		log.Error().Err(err).Msg("could not create gcm")
-		return ""
+	// if access token is still blank then authenticate
+	if api.currentToken() == nil {
+		if err := api.login(ctx); err != nil {
+			return err
+		}
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(ciphertext) < nonceSize {
-		log.Error().Int("CipherTextSize", len(ciphertext)).Int("NonceSize", nonceSize).Msg("encrypted text is smaller than the nonce")
-		return ""
+	current := api.currentToken()
+	if current.parseErr != nil {
+		api.logger.Error().Err(current.parseErr).Msg("could not verify access token")
+		return fmt.Errorf("%w: %w", ErrUnauthorized, current.parseErr)
 	}
 
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	var err error
+	switch {
+	case !current.claims.Expiration.After(time.Now()):
+		if hasRefreshToken(current) {
+			api.logger.Info().Msg("Access token is expired; requesting new one with refresh token.")
+			err = api.refreshAuth(ctx, current)
+		} else {
+			// unattended clients fail with ErrLoginRequired
+			api.logger.Info().Msg("Access token is expired and there is no refresh token; logging in again.")
+			err = api.login(ctx)
+		}
+	case current.claims.Expiration.Before(time.Now().Add(time.Minute * 1)):
+		api.logger.Info().Time("Expiration", current.claims.Expiration).Msg("refreshing access token")
+		if hasRefreshToken(current) {
+			err = api.refreshAuth(ctx, current)
+		} else {
+			err = api.login(ctx)
+		}
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("unable to decrypt text")
+		return err
+	}
+
+	// the expiration checked above is not verified yet; a forged token
+	// fails here
+	if api.verify {
+		verified, err := api.verifyToken(ctx, api.currentToken())
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+		}
+		api.setToken(verified)
 	}
 
-	return string(plaintext)
+	return nil
 }
 
-func ApiKey() string {
-	username := viper.GetString("auth.apikey")
-	return DecryptAES(username)
+// login authenticates interactively unless the client is unattended
+func (api *API) login(ctx context.Context) error {
+	if api.unattended {
+		api.logger.Error().Msg("no usable token and interactive login is disabled in unattended mode")
+		return ErrLoginRequired
+	}
+	return api.authenticate(ctx)
 }
 
-func Secret() string {
-	secret := viper.GetString("auth.secret")
-	return DecryptAES(secret)
+// hasRefreshToken returns true if `token` can be refreshed without user
+// interaction
+func hasRefreshToken(token *sealedToken) bool {
+	return token != nil && token.refresh != nil
 }
 
-func encryptionKey() []byte {
-	encryptionKeyPath := viper.GetString("auth.key_file")
-	if encryptionKeyPath == "" {
-		userHomeDir, err := os.UserHomeDir()
-		if err != nil {
-			log.Error().Err(err).Msg("cannot get home directory")
-			return []byte{}
-		}
-		encryptionKeyPath = fmt.Sprintf("%s/.ssh/id_rsa", userHomeDir)
+// tokenExpiration returns the expiration time of the access token in
+// `token`
+func tokenExpiration(token *sealedToken) (time.Time, error) {
+	if token == nil {
+		return time.Time{}, ErrNoToken
 	}
-	key, err := os.ReadFile(encryptionKeyPath)
-	if err != nil {
-		log.Error().Err(err).Str("EncryptionKey", encryptionKeyPath).Msg("could not read encryption key")
-		return []byte{}
+	if token.parseErr != nil {
+		return time.Time{}, token.parseErr
 	}
+	return token.claims.Expiration, nil
+}
 
-	key32 := blake3.Sum256(key)
-	return key32[:]
+// currentToken returns the token used to authorize requests. Tokens are
+// never modified once set, callers must not modify the returned token.
+func (api *API) currentToken() *sealedToken {
+	api.tokenMu.RLock()
+	defer api.tokenMu.RUnlock()
+	return api.token
 }
 
-func stateCode() string {
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	b := make([]rune, 6)
-	for i := range b {
-		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
-		if err != nil {
-			log.Panic().Err(err).Msg("could not get random digit")
-		}
-		b[i] = letters[idx.Int64()]
-	}
-	return string(b)
+func (api *API) setToken(token *sealedToken) {
+	api.tokenMu.Lock()
+	defer api.tokenMu.Unlock()
+	api.token = token
 }
 
-// CheckAuth checks if there is a token that is not expired available
-func (api *API) CheckAuth() {
-	if api.token == nil || api.token.AccessToken == "" {
-		api.loadStateFile()
+// authorize is a request middleware that adds the current access token to
+// each request. The token is only opened while the header is set.
+func (api *API) authorize(c *resty.Client, req *resty.Request) error {
+	token := api.currentToken()
+	if token == nil {
+		return nil
 	}
 
-	// if access token is still blank then authenticate
-	if api.token == nil || api.token.AccessToken == "" {
-		api.authenticate()
-	}
+	opened := &openedSecrets{}
+	defer opened.destroy()
 
-	token, err := jwt.Parse([]byte(api.token.AccessToken), jwt.WithVerify(false))
+	accessToken, err := opened.open(token.access)
 	if err != nil {
-		if errors.Is(err, jwt.ErrTokenExpired()) {
-			log.Info().Msg("Access token is expired; requesting new one with refresh token.")
-			if api.token.RefreshToken != "" && api.token.RefreshToken != "EOF" {
-				api.refreshAuth()
-			}
-			return
-		} else {
-			log.Error().Err(err).Msg("could not verify access token")
-		}
+		api.logger.Error().Err(err).Msg("could not open access token")
+		return err
 	}
 
-	if token.Expiration().Before(time.Now().Add(time.Minute * 1)) {
-		log.Info().Time("Expiration", token.Expiration()).Msg("refreshing access token")
-		api.authenticate()
-	}
+	// the concatenation copies the token before the buffer is wiped
+	req.SetHeader("Authorization", "Bearer "+accessToken)
+	return nil
 }
 
-func (api *API) loadStateFile() {
-	stateFn := viper.GetString("state_file")
-	state, err := os.ReadFile(stateFn)
-	if err != nil {
-		log.Warn().Err(err).Str("StateFile", stateFn).Msg("could not read state file")
-		return
+// loadStateFile loads the saved token and uses it. The saved token is
+// returned, also when a read-only client does not use it.
+func (api *API) loadStateFile() *sealedToken {
+	if api.store == nil {
+		return nil
+	}
+
+	token, err := api.store.Load()
+	if errors.Is(err, ErrNoToken) {
+		api.logger.Debug().Msg("no saved token")
+		return nil
 	}
-	stateData := DecryptAES(string(state))
-	var token OAuthToken
-	err = json.Unmarshal([]byte(stateData), &token)
 	if err != nil {
-		log.Error().Err(err).Msg("could not unmarshal state json")
-		return
+		api.logger.Warn().Err(err).Msg("could not load saved token")
+		return nil
 	}
 
-	api.client.SetAuthScheme("Bearer")
-	api.client.SetAuthToken(token.AccessToken)
+	sealed := sealToken(token)
+
+	// the client only enforces read-only mode itself; a token that still
+	// grants TradeScope is replaced by logging in with the narrowed scopes
+	if api.readOnly && grantsScope(sealed, TradeScope) {
+		api.logger.Warn().Msg("saved token grants the Trade scope to a read-only client; a new login is required")
+		return sealed
+	}
 
-	api.token = &token
-	log.Debug().Msg("loaded state from file")
+	api.setToken(sealed)
+	api.logger.Debug().Msg("loaded state from file")
+	return sealed
 }
 
-func (api *API) writeStateFile() {
-	stateFn := viper.GetString("state_file")
-	data, err := json.Marshal(api.token)
-	if err != nil {
-		log.Error().Err(err).Msg("could not marshal token to json")
-		return
+// grantsScope returns true if `token` grants `scope`, according to either
+// its claims or the scope returned with it
+func grantsScope(token *sealedToken, scope string) bool {
+	if token == nil {
+		return false
 	}
-
-	encryptedData := EncryptAES(string(data))
-	err = os.WriteFile(stateFn, []byte(encryptedData), 0600)
-	if err != nil {
-		log.Error().Err(err).Str("StateFile", stateFn).Msg("could not write state file")
+	if token.claims != nil && token.claims.HasScope(scope) {
+		return true
 	}
-	log.Debug().Msg("wrote state to file")
+	for _, granted := range strings.Fields(token.scope) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
 }
 
-func (api *API) authenticate() {
-	// generate a unique stateKey to identify this request
-	stateKey := stateCode()
-
-	var oauthCode string
-	var oauthState string
-
-	// Setup and start HTTP server for OAUTH2 redirects
-	httpListener, err := net.Listen("tcp", "127.0.0.1:31022")
-	if err != nil {
-		log.Panic().Err(err).Msg("cannot create http server listener")
+func (api *API) writeStateFile(sealed *sealedToken) {
+	if api.store == nil {
+		return
 	}
 
-	listener, err := stoppableListener.New(httpListener)
+	token, err := sealed.open()
 	if err != nil {
-		log.Panic().Err(err).Msg("cannot create stoppable listener")
+		api.logger.Error().Err(err).Msg("could not open token to save it")
+		return
 	}
 
-	// API routes
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.RequestURI == "/favicon.ico" {
-			w.WriteHeader(404)
-			return
-		}
-		// extract parameters
-		params := r.URL.Query()
-		oauthCode = params.Get("code")
-		oauthState = params.Get("state")
-
-		// write response to server
-		if oauthState != stateKey {
-			w.WriteHeader(400)
-			io.WriteString(w, "state does not match - authentication failed")
-			log.Panic().Msg("state key does not match - exiting authentication attempt")
-		} else {
-			w.WriteHeader(200)
-			io.WriteString(w, "You can close this window; successfully authenticated with TradeStation!\n")
-		}
-
-		listener.Stop()
-	})
+	if err := api.store.Save(token); err != nil {
+		api.logger.Error().Err(err).Msg("could not save token")
+		return
+	}
+	api.logger.Debug().Msg("wrote state to file")
+}
 
-	// Start server on port specified above
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		http.Serve(listener, nil)
-	}()
+func (api *API) refreshAuth(ctx context.Context, current *sealedToken) error {
+	opened := &openedSecrets{}
+	defer opened.destroy()
 
-	scopes := []string{"openid", "profile", "MarketData", "ReadAccount", "Trade"}
-	if viper.GetBool("auth.offline_access") {
-		scopes = append(scopes, "offline_access")
+	form := map[string]string{
+		"grant_type": "refresh_token",
+	}
+	for field, enclave := range map[string]*memguard.Enclave{
+		"client_id":     api.clientID,
+		"client_secret": api.clientSecret,
+		"refresh_token": current.refresh,
+	} {
+		value, err := opened.open(enclave)
+		if err != nil {
+			api.logger.Error().Err(err).Str("Field", field).Msg("could not open secret for token refresh")
+			return err
+		}
+		form[field] = value
 	}
-	authUrl := fmt.Sprintf("https://signin.tradestation.com/authorize?response_type=code&client_id=%s&redirect_uri=%s&audience=https://api.tradestation.com&state=%s&scope=%s", ApiKey(), "http://localhost:31022", stateKey, strings.Join(scopes, "%20"))
-	log.Debug().Str("Auth URL", authUrl).Msg("authorization url")
-
-	browser.OpenURL(authUrl)
-	wg.Wait()
 
-	// exchange code for a token
 	token := OAuthToken{}
-	curl := resty.New()
+	curl := resty.NewWithClient(api.client.GetClient())
 	resp, err := curl.R().
-		SetFormData(map[string]string{
-			"grant_type":    "authorization_code",
-			"client_id":     ApiKey(),
-			"client_secret": Secret(),
-			"code":          oauthCode,
-			"redirect_uri":  "http://localhost:31022",
-		}).
+		SetContext(ctx).
+		SetFormData(form).
 		SetResult(&token).
-		Post("https://signin.tradestation.com/oauth/token")
+		Post(api.signinUrl + "/oauth/token")
 	if err != nil {
-		log.Panic().Err(err).Msg("err exchanging oauth code for a token")
+		api.logger.Error().Err(err).Msg("err exchanging refresh token for an access token")
+		api.countTokenRefresh(err)
+		return err
 	}
-	if resp.StatusCode() >= 300 {
-		log.Panic().Int("StatusCode", resp.StatusCode()).Msg("request failed")
+	if err := checkResponse(resp, nil); err != nil {
+		api.logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("refresh token request failed")
+		api.countTokenRefresh(err)
+		return fmt.Errorf("%w: %w", ErrUnauthorized, err)
 	}
+	api.countTokenRefresh(nil)
 
-	api.client.SetAuthScheme("Bearer")
-	api.client.SetAuthToken(token.AccessToken)
-
-	api.token = &token
-
-	api.writeStateFile()
-}
+	updated := sealToken(&token)
+	if updated == nil {
+		api.logger.Error().Msg("refresh response does not contain an access token")
+		return fmt.Errorf("%w: refresh response does not contain an access token", ErrUnauthorized)
+	}
 
-func (api *API) refreshAuth() {
-	token := OAuthToken{}
-	curl := resty.New()
-	resp, err := curl.R().
-		SetFormData(map[string]string{
-			"grant_type":    "refresh_token",
-			"client_id":     ApiKey(),
-			"client_secret": Secret(),
-			"refresh_token": api.token.RefreshToken,
-		}).
-		SetResult(&token).
-		Post("https://signin.tradestation.com/oauth/token")
-	if err != nil {
-		log.Panic().Err(err).Msg("err exchanging oauth code for a token")
+	// TradeStation may rotate the refresh token; the old one stops working
+	// as soon as a new one is issued
+	if updated.refresh == nil {
+		updated.refresh = current.refresh
+	}
+	if updated.scope == "" {
+		updated.scope = current.scope
 	}
-	if resp.StatusCode() >= 300 {
-		log.Panic().Int("StatusCode", resp.StatusCode()).Msg("request failed")
+	if updated.tokenType == "" {
+		updated.tokenType = current.tokenType
 	}
 
-	api.client.SetAuthScheme("Bearer")
-	api.client.SetAuthToken(token.AccessToken)
+	api.setToken(updated)
+	api.writeStateFile(updated)
 
-	api.token.AccessToken = token.AccessToken
-	api.token.ExpiresIn = token.ExpiresIn
-	api.token.IDToken = token.IDToken
-	api.writeStateFile()
+	return nil
 }
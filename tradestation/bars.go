@@ -0,0 +1,529 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shopspring/decimal"
+)
+
+// BarUnit is the unit of the interval of bars
+type BarUnit string
+
+const (
+	MINUTE  BarUnit = "Minute"
+	DAILY   BarUnit = "Daily"
+	WEEKLY  BarUnit = "Weekly"
+	MONTHLY BarUnit = "Monthly"
+)
+
+// SessionTemplate selects the trading sessions included in intraday bars
+type SessionTemplate string
+
+const (
+	SESSION_DEFAULT   SessionTemplate = "Default"
+	USEQ_PRE          SessionTemplate = "USEQPre"
+	USEQ_POST         SessionTemplate = "USEQPost"
+	USEQ_PRE_AND_POST SessionTemplate = "USEQPreAndPost"
+	USEQ_24_HOUR      SessionTemplate = "USEQ24Hour"
+)
+
+const (
+	// maxBarsPerRequest is the most bars TradeStation returns for a single
+	// barcharts request
+	maxBarsPerRequest = 57600
+
+	// maxMinuteInterval is the longest interval of minute bars
+	maxMinuteInterval = 1440
+
+	timeStampFormat = "2006-01-02T15:04:05Z"
+)
+
+// BarStatus is CLOSED once a bar is complete
+type BarStatus string
+
+const (
+	BAR_OPEN   BarStatus = "Open"
+	BAR_CLOSED BarStatus = "Closed"
+)
+
+// BarsRequest selects the bars returned by GetBars. Either BarsBack or
+// FirstDate may be set; if neither is, only the most recent bar is returned.
+type BarsRequest struct {
+	Symbol string
+
+	// Interval is the number of units in each bar; defaults to 1. Minute
+	// bars may span up to 1440 minutes, other units only 1.
+	Interval int
+
+	// Unit defaults to DAILY
+	Unit BarUnit
+
+	// BarsBack is the number of bars to return, ending at LastDate
+	BarsBack int
+
+	// FirstDate and LastDate limit the bars returned; LastDate defaults to
+	// now
+	FirstDate time.Time
+	LastDate  time.Time
+
+	// SessionTemplate defaults to SESSION_DEFAULT
+	SessionTemplate SessionTemplate
+}
+
+type tsBar struct {
+	High            string
+	Low             string
+	Open            string
+	Close           string
+	TimeStamp       string
+	TotalVolume     string
+	DownTicks       int64
+	DownVolume      int64
+	OpenInterest    string
+	IsRealtime      bool
+	IsEndOfHistory  bool
+	TotalTicks      int64
+	UnchangedTicks  int64
+	UnchangedVolume int64
+	UpTicks         int64
+	UpVolume        int64
+	BarStatus       BarStatus
+}
+
+type barResponse struct {
+	Bars []*tsBar
+}
+
+// Bar is a single OHLCV bar. TimeStamp is the end of the bar in
+// America/New_York time.
+type Bar struct {
+	TimeStamp       time.Time
+	Open            decimal.Decimal
+	High            decimal.Decimal
+	Low             decimal.Decimal
+	Close           decimal.Decimal
+	TotalVolume     int64
+	UpVolume        int64
+	DownVolume      int64
+	UnchangedVolume int64
+	TotalTicks      int64
+	UpTicks         int64
+	DownTicks       int64
+	UnchangedTicks  int64
+	OpenInterest    int64
+	IsRealtime      bool
+	IsEndOfHistory  bool
+	BarStatus       BarStatus
+}
+
+// normalize validates `req` and returns a copy with defaults applied
+func (req *BarsRequest) normalize() (*BarsRequest, error) {
+	query := *req
+
+	if query.Symbol == "" {
+		return nil, errors.New("tradestation: bars request has no symbol")
+	}
+
+	if query.Unit == "" {
+		query.Unit = DAILY
+	}
+
+	if query.Interval == 0 {
+		query.Interval = 1
+	}
+
+	if query.SessionTemplate == "" {
+		query.SessionTemplate = SESSION_DEFAULT
+	}
+
+	switch query.Unit {
+	case MINUTE:
+		if query.Interval < 1 || query.Interval > maxMinuteInterval {
+			return nil, fmt.Errorf("tradestation: minute bars interval must be between 1 and %d", maxMinuteInterval)
+		}
+	case DAILY, WEEKLY, MONTHLY:
+		if query.Interval != 1 {
+			return nil, fmt.Errorf("tradestation: %s bars interval must be 1", query.Unit)
+		}
+	default:
+		return nil, fmt.Errorf("tradestation: unknown bar unit %q", query.Unit)
+	}
+
+	switch {
+	case query.BarsBack < 0:
+		return nil, errors.New("tradestation: BarsBack must not be negative")
+	case query.BarsBack > 0 && !query.FirstDate.IsZero():
+		return nil, errors.New("tradestation: BarsBack and FirstDate are mutually exclusive")
+	case !query.FirstDate.IsZero() && !query.LastDate.IsZero() && query.LastDate.Before(query.FirstDate):
+		return nil, errors.New("tradestation: LastDate is before FirstDate")
+	case query.BarsBack == 0 && query.FirstDate.IsZero():
+		query.BarsBack = 1
+	}
+
+	return &query, nil
+}
+
+// span returns the longest time a single bar of `query` can cover
+func (query *BarsRequest) span() time.Duration {
+	switch query.Unit {
+	case MINUTE:
+		return time.Duration(query.Interval) * time.Minute
+	case WEEKLY:
+		return 7 * 24 * time.Hour
+	case MONTHLY:
+		return 31 * 24 * time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+// GetBars returns the bars of `req` in chronological order. Requests for
+// more bars than TradeStation returns at once are split into several
+// requests.
+func (api *API) GetBars(req *BarsRequest) ([]*Bar, error) {
+	return api.GetBarsContext(context.Background(), req)
+}
+
+// GetBarsContext is like GetBars but carries `ctx` into every request it makes
+func (api *API) GetBarsContext(ctx context.Context, req *BarsRequest) ([]*Bar, error) {
+	query, err := req.normalize()
+	if err != nil {
+		api.logger.Error().Err(err).Str("Symbol", req.Symbol).Msg("invalid bars request")
+		return nil, err
+	}
+
+	if err := api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
+	if query.FirstDate.IsZero() {
+		return api.barsBack(ctx, query)
+	}
+	return api.barsBetween(ctx, query)
+}
+
+// barsBack pages backwards from LastDate until BarsBack bars are collected
+// or the history of the symbol ends
+func (api *API) barsBack(ctx context.Context, query *BarsRequest) ([]*Bar, error) {
+	pages := make([][]*Bar, 0, query.BarsBack/maxBarsPerRequest+1)
+	remaining := query.BarsBack
+	lastDate := query.LastDate
+	var earliest time.Time
+
+	for remaining > 0 {
+		count := min(remaining, maxBarsPerRequest)
+		params := map[string]string{"barsback": strconv.Itoa(count)}
+		if !lastDate.IsZero() {
+			params["lastdate"] = lastDate.UTC().Format(timeStampFormat)
+		}
+
+		page, err := api.barsPage(ctx, query, params)
+		if err != nil {
+			return nil, err
+		}
+
+		// drop bars already returned by the previous page
+		if !earliest.IsZero() {
+			end := len(page)
+			for end > 0 && !page[end-1].TimeStamp.Before(earliest) {
+				end--
+			}
+			page = page[:end]
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		pages = append(pages, page)
+		remaining -= len(page)
+		earliest = page[0].TimeStamp
+		if len(page) < count || page[0].IsEndOfHistory {
+			break
+		}
+		lastDate = earliest.Add(-time.Second)
+	}
+
+	bars := make([]*Bar, 0, query.BarsBack-remaining)
+	for idx := len(pages) - 1; idx >= 0; idx-- {
+		bars = append(bars, pages[idx]...)
+	}
+	return bars, nil
+}
+
+// barsBetween splits the range from FirstDate to LastDate into windows
+// that cannot hold more bars than a single request returns
+func (api *API) barsBetween(ctx context.Context, query *BarsRequest) ([]*Bar, error) {
+	lastDate := query.LastDate
+	if lastDate.IsZero() {
+		lastDate = time.Now()
+	}
+
+	span := query.span()
+	var bars []*Bar
+
+	// the first window includes the bar ending at FirstDate; later windows
+	// start after the last bar of the previous one and hold one more bar
+	from, count := query.FirstDate, time.Duration(maxBarsPerRequest-1)
+	for start := query.FirstDate; !start.After(lastDate); {
+		// windows are counted in bars; a window of weekly or monthly bars
+		// does not fit in a time.Duration
+		end := lastDate
+		if lastDate.Sub(from)/span >= count {
+			end = from.Add(span * count)
+		}
+
+		page, err := api.barsPage(ctx, query, map[string]string{
+			"firstdate": start.UTC().Format(timeStampFormat),
+			"lastdate":  end.UTC().Format(timeStampFormat),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, bar := range page {
+			if len(bars) == 0 || bar.TimeStamp.After(bars[len(bars)-1].TimeStamp) {
+				bars = append(bars, bar)
+			}
+		}
+
+		start = end.Add(time.Second)
+		from, count = end, maxBarsPerRequest
+	}
+
+	return bars, nil
+}
+
+// barsPage requests a single page of bars; `params` select the page
+func (api *API) barsPage(ctx context.Context, query *BarsRequest, params map[string]string) ([]*Bar, error) {
+	result := barResponse{
+		Bars: make([]*tsBar, 0),
+	}
+
+	req, logger := api.newRequest(ctx)
+	logger = logger.With().Str("Symbol", query.Symbol).Logger()
+	resp, err := req.
+		SetQueryParams(params).
+		SetQueryParam("interval", strconv.Itoa(query.Interval)).
+		SetQueryParam("unit", string(query.Unit)).
+		SetQueryParam("sessiontemplate", string(query.SessionTemplate)).
+		SetResult(&result).
+		Get("/marketdata/barcharts/" + url.PathEscape(query.Symbol))
+	if err != nil {
+		logger.Error().Err(err).Msg("bars request failed")
+		return nil, err
+	}
+	if err := checkResponse(resp, nil); err != nil {
+		logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("invalid response from /marketdata/barcharts")
+		return nil, err
+	}
+
+	return convertBars(result.Bars, logger)
+}
+
+// convertBars converts bars returned by TradeStation to America/New_York
+// time
+func convertBars(bars []*tsBar, logger zerolog.Logger) ([]*Bar, error) {
+	nyc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		logger.Error().Err(err).Msg("cannot load America/New_York timezone")
+		return nil, err
+	}
+
+	res := make([]*Bar, len(bars))
+	for idx, bar := range bars {
+		b, err := convertBar(bar, nyc, logger)
+		if err != nil {
+			return nil, err
+		}
+		res[idx] = b
+	}
+
+	return res, nil
+}
+
+// convertBar converts a single bar to America/New_York time
+func convertBar(bar *tsBar, nyc *time.Location, logger zerolog.Logger) (*Bar, error) {
+	b := &Bar{
+		UpVolume:        bar.UpVolume,
+		DownVolume:      bar.DownVolume,
+		UnchangedVolume: bar.UnchangedVolume,
+		TotalTicks:      bar.TotalTicks,
+		UpTicks:         bar.UpTicks,
+		DownTicks:       bar.DownTicks,
+		UnchangedTicks:  bar.UnchangedTicks,
+		IsRealtime:      bar.IsRealtime,
+		IsEndOfHistory:  bar.IsEndOfHistory,
+		BarStatus:       bar.BarStatus,
+	}
+
+	var err error
+	if b.TimeStamp, err = time.Parse(timeStampFormat, bar.TimeStamp); err != nil {
+		logger.Error().Err(err).Msg("error converting TimeStamp to time")
+		return nil, err
+	}
+	b.TimeStamp = b.TimeStamp.In(nyc)
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *decimal.Decimal
+	}{
+		{"Open", bar.Open, &b.Open},
+		{"High", bar.High, &b.High},
+		{"Low", bar.Low, &b.Low},
+		{"Close", bar.Close, &b.Close},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if *field.dest, err = decimal.NewFromString(field.value); err != nil {
+			logger.Error().Err(err).Msgf("error converting %s to decimal", field.name)
+			return nil, err
+		}
+	}
+
+	if bar.TotalVolume != "" {
+		if b.TotalVolume, err = strconv.ParseInt(bar.TotalVolume, 10, 64); err != nil {
+			logger.Error().Err(err).Msg("error converting TotalVolume to int64")
+			return nil, err
+		}
+	}
+
+	if bar.OpenInterest != "" {
+		if b.OpenInterest, err = strconv.ParseInt(bar.OpenInterest, 10, 64); err != nil {
+			logger.Error().Err(err).Msg("error converting OpenInterest to int64")
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// BarEvent is delivered by StreamBars
+type BarEvent struct {
+	Type StreamEventType
+
+	// Bar is set for STREAM_DATA events, which update the current bar, and
+	// STREAM_BAR_CLOSED events, which complete it
+	Bar *Bar
+
+	// Err is set for STREAM_DISCONNECTED and STREAM_ERROR events
+	Err error
+}
+
+// StreamBars streams the bars of `req`, starting with the last BarsBack
+// bars. Updates of the current bar are STREAM_DATA events and completed
+// bars STREAM_BAR_CLOSED events, so indicators can run on closed bars only.
+// After a reconnect the bars closed while disconnected are delivered first;
+// no closed bar is delivered twice. FirstDate and LastDate are not
+// supported. The returned channel is closed when `ctx` is cancelled or the
+// stream fails permanently.
+func (api *API) StreamBars(ctx context.Context, req *BarsRequest) (<-chan *BarEvent, error) {
+	query, err := req.normalize()
+	if err == nil && (!query.FirstDate.IsZero() || !query.LastDate.IsZero()) {
+		err = errors.New("tradestation: bar streams do not support FirstDate and LastDate")
+	}
+	if err != nil {
+		api.logger.Error().Err(err).Str("Symbol", req.Symbol).Msg("invalid bars request")
+		return nil, err
+	}
+
+	nyc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		api.logger.Error().Err(err).Msg("cannot load America/New_York timezone")
+		return nil, err
+	}
+
+	if err := api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
+	events := make(chan *BarEvent, 16)
+	send := func(ctx context.Context, event *BarEvent) error {
+		select {
+		case events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	logger := api.logger.With().Str("Symbol", query.Symbol).Logger()
+
+	// lastClosed is the end of the last closed bar delivered
+	var lastClosed time.Time
+
+	s := &stream{
+		api:    api,
+		path:   "/marketdata/stream/barcharts/" + url.PathEscape(query.Symbol),
+		logger: logger,
+		query: func() map[string]string {
+			barsBack := query.BarsBack
+			if !lastClosed.IsZero() {
+				// backfill the bars closed while disconnected; duplicates
+				// are dropped below
+				barsBack = min(int(time.Since(lastClosed)/query.span())+2, maxBarsPerRequest)
+			}
+			return map[string]string{
+				"interval":        strconv.Itoa(query.Interval),
+				"unit":            string(query.Unit),
+				"barsback":        strconv.Itoa(barsBack),
+				"sessiontemplate": string(query.SessionTemplate),
+			}
+		},
+		onData: func(ctx context.Context, raw json.RawMessage) error {
+			var tsb tsBar
+			if err := json.Unmarshal(raw, &tsb); err != nil {
+				logger.Warn().Err(err).Msg("ignoring malformed bar")
+				return nil
+			}
+
+			bar, err := convertBar(&tsb, nyc, logger)
+			if err != nil {
+				return send(ctx, &BarEvent{Type: STREAM_ERROR, Err: err})
+			}
+
+			if !bar.TimeStamp.After(lastClosed) {
+				return nil
+			}
+
+			if bar.BarStatus == BAR_CLOSED {
+				lastClosed = bar.TimeStamp
+				return send(ctx, &BarEvent{Type: STREAM_BAR_CLOSED, Bar: bar})
+			}
+			return send(ctx, &BarEvent{Type: STREAM_DATA, Bar: bar})
+		},
+		onEvent: func(ctx context.Context, eventType StreamEventType, err error) {
+			send(ctx, &BarEvent{Type: eventType, Err: err})
+		},
+	}
+
+	go func() {
+		defer close(events)
+		s.run(ctx)
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+)
+
+// nextBar returns the next event of `events`
+func nextBar(t *testing.T, events <-chan *tradestation.BarEvent) *tradestation.BarEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("bar stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no bar event within 5s")
+		return nil
+	}
+}
+
+// TestStreamBarsBackfill reconnects a bar stream after a bar closed while
+// no data was sent. The backfill of the new connection overlaps the bars
+// that were already delivered; each closed bar must still be delivered
+// exactly once and in order.
+func TestStreamBarsBackfill(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	minute := func(offset int) time.Time {
+		return now.Add(time.Duration(offset) * time.Minute)
+	}
+	bar := func(offset int) tradestationtest.Bar {
+		price := 400 + float64(offset)
+		return tradestationtest.Bar{Time: minute(offset), Open: price, High: price + 1, Low: price - 1, Close: price, Volume: 1000}
+	}
+
+	history := make([]tradestationtest.Bar, 0, 10)
+	for offset := -10; offset < 0; offset++ {
+		history = append(history, bar(offset))
+	}
+	srv.SetBars("SPY", history...)
+	srv.SetOpenBar("SPY", bar(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	api := srv.NewAPI()
+	events, err := api.StreamBars(ctx, &tradestation.BarsRequest{Symbol: "SPY", Unit: tradestation.MINUTE, BarsBack: 3})
+	if err != nil {
+		t.Fatalf("StreamBars: %v", err)
+	}
+
+	var closed []time.Time
+	var lastOpen time.Time
+	record := func(event *tradestation.BarEvent) {
+		t.Helper()
+
+		switch event.Type {
+		case tradestation.STREAM_BAR_CLOSED:
+			if len(closed) > 0 && !event.Bar.TimeStamp.After(closed[len(closed)-1]) {
+				t.Errorf("closed bar %v delivered after closed bar %v", event.Bar.TimeStamp, closed[len(closed)-1])
+			}
+			closed = append(closed, event.Bar.TimeStamp)
+		case tradestation.STREAM_DATA:
+			if len(closed) > 0 && !event.Bar.TimeStamp.After(closed[len(closed)-1]) {
+				t.Errorf("open bar %v delivered after closed bar %v", event.Bar.TimeStamp, closed[len(closed)-1])
+			}
+			lastOpen = event.Bar.TimeStamp
+		default:
+			t.Fatalf("received %s event (%v)", event.Type, event.Err)
+		}
+	}
+
+	for !lastOpen.Equal(minute(0)) {
+		record(nextBar(t, events))
+	}
+
+	// the bar closes while the stream is silent, so only the backfill of
+	// the next connection delivers it
+	srv.PauseStreams(true)
+	srv.CloseBar("SPY")
+	srv.SetOpenBar("SPY", bar(1))
+	srv.GoAwayStreams()
+	if event := nextBar(t, events); event.Type != tradestation.STREAM_GO_AWAY {
+		t.Fatalf("received %s event (%v), want %s", event.Type, event.Err, tradestation.STREAM_GO_AWAY)
+	}
+	srv.PauseStreams(false)
+
+	for !lastOpen.Equal(minute(1)) {
+		record(nextBar(t, events))
+	}
+
+	want := []time.Time{minute(-3), minute(-2), minute(-1), minute(0)}
+	if len(closed) != len(want) {
+		t.Fatalf("received closed bars %v, want %v", closed, want)
+	}
+	for idx := range want {
+		if !closed[idx].Equal(want[idx]) {
+			t.Errorf("closed bar %d is %v, want %v", idx, closed[idx], want[idx])
+		}
+	}
+}
+
+// maxBars is the most bars TradeStation returns for a single request
+const maxBars = 57600
+
+// minuteBars returns `n` consecutive minute bars, the first ending at
+// `first`
+func minuteBars(first time.Time, n int) []tradestationtest.Bar {
+	bars := make([]tradestationtest.Bar, n)
+	for idx := range bars {
+		bars[idx] = tradestationtest.Bar{Time: first.Add(time.Duration(idx) * time.Minute), Open: 400, High: 401, Low: 399, Close: 400, Volume: 100}
+	}
+	return bars
+}
+
+// requireMinutes fails the test unless `bars` are `n` consecutive minute
+// bars, the first ending at `first`
+func requireMinutes(t *testing.T, bars []*tradestation.Bar, first time.Time, n int) {
+	t.Helper()
+
+	if len(bars) != n {
+		t.Fatalf("received %d bars, want %d", len(bars), n)
+	}
+	for idx, bar := range bars {
+		if want := first.Add(time.Duration(idx) * time.Minute); !bar.TimeStamp.Equal(want) {
+			t.Fatalf("bar %d ends at %v, want %v", idx, bar.TimeStamp.UTC(), want)
+		}
+	}
+}
+
+// countBarRequests returns options for `srv` that count the requests of
+// historical bars in `requests`
+func countBarRequests(srv *tradestationtest.Server, requests *atomic.Int32) tradestation.Options {
+	opts := srv.Options()
+	opts.Transport = &faultTransport{
+		next: srv.Client().Transport,
+		fault: func(req *http.Request) (*http.Response, error) {
+			if strings.HasPrefix(req.URL.Path, "/v3/marketdata/barcharts/") {
+				requests.Add(1)
+			}
+			return nil, nil
+		},
+	}
+	return opts
+}
+
+func TestGetBarsBack(t *testing.T) {
+	const history = 2*maxBars + 10
+
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	first := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	last := first.Add((history - 1) * time.Minute)
+	srv.SetBars("SPY", minuteBars(first, history)...)
+
+	var requests atomic.Int32
+	api := tradestation.NewWithOptions(countBarRequests(srv, &requests))
+
+	tests := []struct {
+		name     string
+		barsBack int
+		want     int
+		requests int32
+	}{
+		{"under the limit", maxBars - 1, maxBars - 1, 1},
+		{"at the limit", maxBars, maxBars, 1},
+		{"over the limit", maxBars + 1, maxBars + 1, 2},
+		{"twice the limit", 2 * maxBars, 2 * maxBars, 2},
+		{"the whole history", history, history, 3},
+		{"more than the history", history + 100, history, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			bars, err := api.GetBars(&tradestation.BarsRequest{Symbol: "SPY", Unit: tradestation.MINUTE, BarsBack: tt.barsBack, LastDate: last})
+			if err != nil {
+				t.Fatalf("GetBars: %v", err)
+			}
+			requireMinutes(t, bars, last.Add(-time.Duration(tt.want-1)*time.Minute), tt.want)
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("sent %d requests, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestGetBarsBetween(t *testing.T) {
+	const history = 2*maxBars + 10
+
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	first := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	srv.SetBars("SPY", minuteBars(first, history)...)
+
+	var requests atomic.Int32
+	api := tradestation.NewWithOptions(countBarRequests(srv, &requests))
+
+	tests := []struct {
+		name     string
+		offset   time.Duration // of FirstDate from the end of the first bar
+		bars     int
+		requests int32
+	}{
+		{"under the limit", 0, maxBars - 1, 1},
+		{"at the limit", 0, maxBars, 1},
+		{"over the limit", 0, maxBars + 1, 2},
+		{"twice the limit", 0, 2 * maxBars, 2},
+		{"twice the limit and one", 0, 2*maxBars + 1, 3},
+		{"first date between bars", -30 * time.Second, maxBars + 1, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			start := first.Add(5 * time.Minute)
+			bars, err := api.GetBars(&tradestation.BarsRequest{
+				Symbol:    "SPY",
+				Unit:      tradestation.MINUTE,
+				FirstDate: start.Add(tt.offset),
+				LastDate:  start.Add(time.Duration(tt.bars-1) * time.Minute),
+			})
+			if err != nil {
+				t.Fatalf("GetBars: %v", err)
+			}
+			requireMinutes(t, bars, start, tt.bars)
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("sent %d requests, want %d", n, tt.requests)
+			}
+		})
+	}
+}
@@ -16,12 +16,14 @@
 package tradestation
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"strconv"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog"
+	"github.com/shopspring/decimal"
 )
 
 type accountResponse struct {
@@ -37,12 +39,6 @@ type Account struct {
 	api         *API
 }
 
-type tsError struct {
-	AccountID string
-	Error     string
-	Message   string
-}
-
 type tsBalance struct {
 	AccountID     string
 	AccountType   string
@@ -67,31 +63,31 @@ type tsBalance struct {
 
 type balanceResponse struct {
 	Balances []*tsBalance
-	Errors   []*tsError
+	Errors   []*ErrorDetail
 }
 
 type Balance struct {
 	AccountID            string
 	AccountType          string
-	BuyingPower          float64
-	CashBalance          float64
-	Commission           float64
-	CostOfPositions      float64
+	BuyingPower          decimal.Decimal
+	CashBalance          decimal.Decimal
+	Commission           decimal.Decimal
+	CostOfPositions      decimal.Decimal
 	DayTrades            float64
-	Equity               float64
-	MaintenanceRate      float64
-	MarketValue          float64
-	OvernightBuyingPower float64
-	TodaysProfitLoss     float64
-	RealizedProfitLoss   float64
-	RequiredMargin       float64
-	UnclearedDeposit     float64
-	UnrealizedProfitLoss float64
+	Equity               decimal.Decimal
+	MaintenanceRate      decimal.Decimal
+	MarketValue          decimal.Decimal
+	OvernightBuyingPower decimal.Decimal
+	TodaysProfitLoss     decimal.Decimal
+	RealizedProfitLoss   decimal.Decimal
+	RequiredMargin       decimal.Decimal
+	UnclearedDeposit     decimal.Decimal
+	UnrealizedProfitLoss decimal.Decimal
 }
 
 type orderResponse struct {
 	Orders    []*tsOrder
-	Errors    []*tsError
+	Errors    []*ErrorDetail
 	NextToken string
 }
 
@@ -226,7 +222,7 @@ type MarketRule struct {
 	Symbol     string
 	Predicate  MarketRulePredicate
 	TriggerKey MarketRuleTrigger
-	Price      float64
+	Price      decimal.Decimal
 }
 
 type TimeRule struct {
@@ -237,10 +233,10 @@ type Order struct {
 	AccountID               string
 	AdvancedOptions         string
 	ClosedDateTime          time.Time
-	CommissionFee           float64
+	CommissionFee           decimal.Decimal
 	ConditionalOrders       []*LinkedOrder
 	Duration                string
-	FilledPrice             float64
+	FilledPrice             decimal.Decimal
 	GoodTillDate            time.Time
 	GroupName               string
 	Legs                    []*OrderLeg
@@ -248,13 +244,13 @@ type Order struct {
 	OrderID                 string
 	OpenedDateTime          time.Time
 	OrderType               string
-	PriceUsedForBuyingPower float64
+	PriceUsedForBuyingPower decimal.Decimal
 	RejectReason            string
 	Routing                 string
 	Status                  OrderStatus
 	StatusDescription       string
 	TimeActivationRules     []*TimeRule
-	UnbundledRouteFee       float64
+	UnbundledRouteFee       decimal.Decimal
 }
 
 type tsPosition struct {
@@ -280,34 +276,52 @@ type tsPosition struct {
 
 type positionResponse struct {
 	Positions []*tsPosition
-	Errors    []*tsError
+	Errors    []*ErrorDetail
 }
 
 type Position struct {
 	AccountID                   string
-	AveragePrice                float64
+	AveragePrice                decimal.Decimal
 	AssetType                   string
-	Last                        float64
-	Bid                         float64
-	Ask                         float64
+	Last                        decimal.Decimal
+	Bid                         decimal.Decimal
+	Ask                         decimal.Decimal
 	PositionID                  string
 	LongShort                   string
 	Quantity                    int64
 	Symbol                      string
 	Timestamp                   time.Time
-	TodaysProfitLoss            float64
-	TotalCost                   float64
-	MarketValue                 float64
-	MarkToMarketPrice           float64
-	UnrealizedProfitLoss        float64
-	UnrealizedProfitLossPercent float64
-	UnrealizedProfitLossQty     float64
+	TodaysProfitLoss            decimal.Decimal
+	TotalCost                   decimal.Decimal
+	MarketValue                 decimal.Decimal
+	MarkToMarketPrice           decimal.Decimal
+	UnrealizedProfitLoss        decimal.Decimal
+	UnrealizedProfitLossPercent decimal.Decimal
+	UnrealizedProfitLossQty     decimal.Decimal
+}
+
+// logger returns the client logger with the account ID attached
+func (account *Account) logger() zerolog.Logger {
+	return account.api.logger.With().Str("AccountID", account.AccountID).Logger()
+}
+
+// newRequest is like API.newRequest but also attaches the account ID to the
+// returned logger
+func (account *Account) newRequest(ctx context.Context) (*resty.Request, zerolog.Logger) {
+	req, logger := account.api.newRequest(ctx)
+	return req, logger.With().Str("AccountID", account.AccountID).Logger()
 }
 
+// GetAccount returns the account with the given `accountID`
 func (api *API) GetAccount(accountID string) (*Account, error) {
-	accounts, err := api.GetAccounts()
+	return api.GetAccountContext(context.Background(), accountID)
+}
+
+// GetAccountContext is like GetAccount but carries `ctx` into every request it makes
+func (api *API) GetAccountContext(ctx context.Context, accountID string) (*Account, error) {
+	accounts, err := api.GetAccountsContext(ctx)
 	if err != nil {
-		log.Error().Err(err).Str("Requested AccountID", accountID).Msg("error retrieving account")
+		api.logger.Error().Err(err).Str("Requested AccountID", accountID).Msg("error retrieving account")
 		return nil, err
 	}
 	for _, account := range accounts {
@@ -315,23 +329,34 @@ func (api *API) GetAccount(accountID string) (*Account, error) {
 			return account, nil
 		}
 	}
-	return nil, nil
+	return nil, ErrAccountNotFound
 }
 
+// GetAccounts returns all accounts available to the authenticated user
 func (api *API) GetAccounts() ([]*Account, error) {
-	api.CheckAuth()
+	return api.GetAccountsContext(context.Background())
+}
+
+// GetAccountsContext is like GetAccounts but carries `ctx` into every request it makes
+func (api *API) GetAccountsContext(ctx context.Context) ([]*Account, error) {
+	if err := api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
 	accounts := accountResponse{
 		Accounts: make([]*Account, 0, 5),
 	}
-	resp, err := api.client.R().
+	req, logger := api.newRequest(ctx)
+	resp, err := req.
 		SetResult(&accounts).
 		Get("/brokerage/accounts")
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		return nil, fmt.Errorf("/brokerage/accounts %d", resp.StatusCode())
+	if err := checkResponse(resp, nil); err != nil {
+		logger.Error().Err(err).Msg("account request failed")
+		return nil, err
 	}
 
 	// set api on returned accounts
@@ -342,54 +367,73 @@ func (api *API) GetAccounts() ([]*Account, error) {
 	return accounts.Accounts, nil
 }
 
+// GetBalances returns the current balances of the account
 func (account *Account) GetBalances() (*Balance, error) {
-	account.api.CheckAuth()
+	return account.GetBalancesContext(context.Background())
+}
+
+// GetBalancesContext is like GetBalances but carries `ctx` into every request it makes
+func (account *Account) GetBalancesContext(ctx context.Context) (*Balance, error) {
+	if err := account.api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
 	balances := balanceResponse{
 		Balances: make([]*tsBalance, 0, 1),
-		Errors:   make([]*tsError, 0, 1),
+		Errors:   make([]*ErrorDetail, 0, 1),
 	}
 
-	resp, err := account.api.client.R().
+	req, logger := account.newRequest(ctx)
+	resp, err := req.
 		SetResult(&balances).
 		Get(fmt.Sprintf("/brokerage/accounts/%s/balances", account.AccountID))
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		return nil, fmt.Errorf("/brokerage/accounts/balances %d", resp.StatusCode())
+	if err := checkResponse(resp, balances.Errors); err != nil {
+		logger.Error().Err(err).Msg("balance request failed")
+		return nil, err
 	}
 
-	return parseBalances(balances)
+	return parseBalances(balances, logger)
 }
 
+// GetBalancesBOD returns the beginning of day balances of the account
 func (account *Account) GetBalancesBOD() (*Balance, error) {
-	account.api.CheckAuth()
+	return account.GetBalancesBODContext(context.Background())
+}
+
+// GetBalancesBODContext is like GetBalancesBOD but carries `ctx` into every request it makes
+func (account *Account) GetBalancesBODContext(ctx context.Context) (*Balance, error) {
+	if err := account.api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
 
 	balances := balanceResponse{
 		Balances: make([]*tsBalance, 0, 1),
-		Errors:   make([]*tsError, 0, 1),
+		Errors:   make([]*ErrorDetail, 0, 1),
 	}
 
-	resp, err := account.api.client.R().
+	req, logger := account.newRequest(ctx)
+	resp, err := req.
 		SetResult(&balances).
 		Get(fmt.Sprintf("/brokerage/accounts/%s/bodbalances", account.AccountID))
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		return nil, fmt.Errorf("/brokerage/accounts %d", resp.StatusCode())
+	if err := checkResponse(resp, balances.Errors); err != nil {
+		logger.Error().Err(err).Msg("balance request failed")
+		return nil, err
 	}
 
-	return parseBalances(balances)
+	return parseBalances(balances, logger)
 }
 
-func parseBalances(balances balanceResponse) (*Balance, error) {
+func parseBalances(balances balanceResponse, logger zerolog.Logger) (*Balance, error) {
 	if len(balances.Errors) > 0 {
-		for _, err := range balances.Errors {
-			return nil, fmt.Errorf("%s: %s", err.Error, err.Message)
-		}
+		return nil, &APIError{Errors: balances.Errors}
 	}
 
 	// convert struct to proper types
@@ -402,99 +446,99 @@ func parseBalances(balances balanceResponse) (*Balance, error) {
 		}
 
 		if balance.BuyingPower != "" {
-			if b.BuyingPower, err = strconv.ParseFloat(balance.BuyingPower, 64); err != nil {
-				log.Error().Err(err).Msg("error converting BuyingPower to float64")
+			if b.BuyingPower, err = decimal.NewFromString(balance.BuyingPower); err != nil {
+				logger.Error().Err(err).Msg("error converting BuyingPower to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.CashBalance != "" {
-			if b.CashBalance, err = strconv.ParseFloat(balance.CashBalance, 64); err != nil {
-				log.Error().Err(err).Msg("error converting CashBalance to float64")
+			if b.CashBalance, err = decimal.NewFromString(balance.CashBalance); err != nil {
+				logger.Error().Err(err).Msg("error converting CashBalance to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.Commission != "" {
-			if b.Commission, err = strconv.ParseFloat(balance.Commission, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Commission to float64")
+			if b.Commission, err = decimal.NewFromString(balance.Commission); err != nil {
+				logger.Error().Err(err).Msg("error converting Commission to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.BalanceDetail.CostOfPositions != "" {
-			if b.CostOfPositions, err = strconv.ParseFloat(balance.BalanceDetail.CostOfPositions, 64); err != nil {
-				log.Error().Err(err).Msg("error converting CostOfPositions to float64")
+			if b.CostOfPositions, err = decimal.NewFromString(balance.BalanceDetail.CostOfPositions); err != nil {
+				logger.Error().Err(err).Msg("error converting CostOfPositions to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.BalanceDetail.DayTrades != "" {
 			if b.DayTrades, err = strconv.ParseFloat(balance.BalanceDetail.DayTrades, 64); err != nil {
-				log.Error().Err(err).Msg("error converting DayTrades to float64")
+				logger.Error().Err(err).Msg("error converting DayTrades to float64")
 				return nil, err
 			}
 		}
 
 		if balance.Equity != "" {
-			if b.Equity, err = strconv.ParseFloat(balance.Equity, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Equity to float64")
+			if b.Equity, err = decimal.NewFromString(balance.Equity); err != nil {
+				logger.Error().Err(err).Msg("error converting Equity to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.BalanceDetail.MaintenanceRate != "" {
-			if b.MaintenanceRate, err = strconv.ParseFloat(balance.BalanceDetail.MaintenanceRate, 64); err != nil {
-				log.Error().Err(err).Msg("error converting MaintenanceRate to float64")
+			if b.MaintenanceRate, err = decimal.NewFromString(balance.BalanceDetail.MaintenanceRate); err != nil {
+				logger.Error().Err(err).Msg("error converting MaintenanceRate to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.MarketValue != "" {
-			if b.MarketValue, err = strconv.ParseFloat(balance.MarketValue, 64); err != nil {
-				log.Error().Err(err).Msg("error converting MarketValue to float64")
+			if b.MarketValue, err = decimal.NewFromString(balance.MarketValue); err != nil {
+				logger.Error().Err(err).Msg("error converting MarketValue to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.BalanceDetail.OvernightBuyingPower != "" {
-			if b.OvernightBuyingPower, err = strconv.ParseFloat(balance.BalanceDetail.OvernightBuyingPower, 64); err != nil {
-				log.Error().Err(err).Msg("error converting OvernightBuyingPower to float64")
+			if b.OvernightBuyingPower, err = decimal.NewFromString(balance.BalanceDetail.OvernightBuyingPower); err != nil {
+				logger.Error().Err(err).Msg("error converting OvernightBuyingPower to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.BalanceDetail.RealizedProfitLoss != "" {
-			if b.RealizedProfitLoss, err = strconv.ParseFloat(balance.BalanceDetail.RealizedProfitLoss, 64); err != nil {
-				log.Error().Err(err).Msg("error converting RealizedProfitLoss to float64")
+			if b.RealizedProfitLoss, err = decimal.NewFromString(balance.BalanceDetail.RealizedProfitLoss); err != nil {
+				logger.Error().Err(err).Msg("error converting RealizedProfitLoss to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.BalanceDetail.RequiredMargin != "" {
-			if b.RequiredMargin, err = strconv.ParseFloat(balance.BalanceDetail.RequiredMargin, 64); err != nil {
-				log.Error().Err(err).Msg("error converting RequiredMargin to float64")
+			if b.RequiredMargin, err = decimal.NewFromString(balance.BalanceDetail.RequiredMargin); err != nil {
+				logger.Error().Err(err).Msg("error converting RequiredMargin to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.TodaysProfitLoss != "" {
-			if b.TodaysProfitLoss, err = strconv.ParseFloat(balance.TodaysProfitLoss, 64); err != nil {
-				log.Error().Err(err).Msg("error converting TodaysProfitLoss to float64")
+			if b.TodaysProfitLoss, err = decimal.NewFromString(balance.TodaysProfitLoss); err != nil {
+				logger.Error().Err(err).Msg("error converting TodaysProfitLoss to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.UnclearedDeposit != "" {
-			if b.UnclearedDeposit, err = strconv.ParseFloat(balance.UnclearedDeposit, 64); err != nil {
-				log.Error().Err(err).Msg("error converting UnclearedDeposit to float64")
+			if b.UnclearedDeposit, err = decimal.NewFromString(balance.UnclearedDeposit); err != nil {
+				logger.Error().Err(err).Msg("error converting UnclearedDeposit to decimal")
 				return nil, err
 			}
 		}
 
 		if balance.BalanceDetail.UnrealizedProfitLoss != "" {
-			if b.UnrealizedProfitLoss, err = strconv.ParseFloat(balance.BalanceDetail.UnrealizedProfitLoss, 64); err != nil {
-				log.Error().Err(err).Msg("error converting UnrealizedProfitLoss to float64")
+			if b.UnrealizedProfitLoss, err = decimal.NewFromString(balance.BalanceDetail.UnrealizedProfitLoss); err != nil {
+				logger.Error().Err(err).Msg("error converting UnrealizedProfitLoss to decimal")
 				return nil, err
 			}
 		}
@@ -505,42 +549,76 @@ func parseBalances(balances balanceResponse) (*Balance, error) {
 	return resBalance[0], nil
 }
 
-func (account *Account) ordersRequest(url string, nextToken string) (*orderResponse, error) {
-	account.api.CheckAuth()
+// maxOrderPages is the most pages of orders pagedOrders requests
+const maxOrderPages = 1000
+
+// pagedOrders requests every page of orders of `path` and returns them
+// converted and tracked. It stops with ErrOrderPages if a page token repeats
+// or there are more than maxOrderPages pages.
+func (account *Account) pagedOrders(ctx context.Context, path string, params map[string]string) ([]*Order, error) {
+	allOrders := make([]*tsOrder, 0, 100)
+	nextToken := ""
+	seen := make(map[string]bool)
+	for page := 1; ; page++ {
+		orders, err := account.ordersRequest(ctx, path, params, nextToken)
+		if err != nil {
+			return nil, err
+		}
+		allOrders = append(allOrders, orders.Orders...)
+
+		if orders.NextToken == "" {
+			break
+		}
+		if seen[orders.NextToken] || page >= maxOrderPages {
+			err := fmt.Errorf("%w: %s after %d pages", ErrOrderPages, path, page)
+			logger := account.logger()
+			logger.Error().Err(err).Str("NextToken", orders.NextToken).Msg("orders request failed")
+			return nil, err
+		}
+		seen[orders.NextToken] = true
+		nextToken = orders.NextToken
+	}
+
+	res, err := convertOrders(allOrders, account.logger())
+	if err != nil {
+		return nil, err
+	}
+	account.api.trackOrders(res)
+	return res, nil
+}
+
+// ordersRequest requests a single page of orders of `path`
+func (account *Account) ordersRequest(ctx context.Context, path string, params map[string]string, nextToken string) (*orderResponse, error) {
+	if err := account.api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
 
 	orders := orderResponse{
 		Orders: make([]*tsOrder, 0, 100),
-		Errors: make([]*tsError, 0, 1),
+		Errors: make([]*ErrorDetail, 0, 1),
 	}
 
+	req, logger := account.newRequest(ctx)
+	req.SetQueryParams(params)
 	if nextToken != "" {
-		url = fmt.Sprintf("%s&nextToken=%s", url, nextToken)
+		req.SetQueryParam("nextToken", nextToken)
 	}
-
-	resp, err := account.api.client.R().
+	resp, err := req.
 		SetResult(&orders).
-		Get(url)
+		Get(path)
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		log.Error().Int("StatusCode", resp.StatusCode()).Msg("Received invalid status code")
-		return nil, fmt.Errorf("/brokerage/accounts %d", resp.StatusCode())
-	}
-	if len(orders.Errors) != 0 {
-		errorMsgs := make([]string, len(orders.Errors))
-		for idx, errMsg := range orders.Errors {
-			errorMsgs[idx] = errMsg.Message
-		}
-		log.Error().Strs("Errors", errorMsgs).Msg("errors returned by tradestation api")
-		return nil, errors.New("tradestation api returned errors")
+	if err := checkResponse(resp, orders.Errors); err != nil {
+		logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("errors returned by tradestation api")
+		return nil, err
 	}
 
 	return &orders, nil
 }
 
-func convertOrders(orders []*tsOrder) ([]*Order, error) {
+func convertOrders(orders []*tsOrder, logger zerolog.Logger) ([]*Order, error) {
 	var err error
 	nyc, err := time.LoadLocation("America/New_York")
 	if err != nil {
@@ -571,29 +649,29 @@ func convertOrders(orders []*tsOrder) ([]*Order, error) {
 
 		if order.ClosedDateTime != "" {
 			if o.ClosedDateTime, err = time.Parse("2006-01-02T15:04:05Z", order.ClosedDateTime); err != nil {
-				log.Error().Err(err).Msg("error converting ClosedDateTime to time")
+				logger.Error().Err(err).Msg("error converting ClosedDateTime to time")
 				return nil, err
 			}
 			o.ClosedDateTime = o.ClosedDateTime.In(nyc)
 		}
 
 		if order.CommissionFee != "" {
-			if o.CommissionFee, err = strconv.ParseFloat(order.CommissionFee, 64); err != nil {
-				log.Error().Err(err).Msg("error converting CommissionFee to float64")
+			if o.CommissionFee, err = decimal.NewFromString(order.CommissionFee); err != nil {
+				logger.Error().Err(err).Msg("error converting CommissionFee to decimal")
 				return nil, err
 			}
 		}
 
 		if order.FilledPrice != "" {
-			if o.FilledPrice, err = strconv.ParseFloat(order.FilledPrice, 64); err != nil {
-				log.Error().Err(err).Msg("error converting FilledPrice to float64")
+			if o.FilledPrice, err = decimal.NewFromString(order.FilledPrice); err != nil {
+				logger.Error().Err(err).Msg("error converting FilledPrice to decimal")
 				return nil, err
 			}
 		}
 
 		if order.GoodTillDate != "" {
 			if o.GoodTillDate, err = time.Parse("2006-01-02T15:04:05Z", order.GoodTillDate); err != nil {
-				log.Error().Err(err).Msg("error converting GoodTillDate to time")
+				logger.Error().Err(err).Msg("error converting GoodTillDate to time")
 				return nil, err
 			}
 			o.GoodTillDate = o.GoodTillDate.In(nyc)
@@ -610,21 +688,21 @@ func convertOrders(orders []*tsOrder) ([]*Order, error) {
 
 			if leg.QuantityOrdered != "" {
 				if l.QuantityOrdered, err = strconv.ParseInt(leg.QuantityOrdered, 0, 64); err != nil {
-					log.Error().Err(err).Msg("error converting QuantityOrdered to float64")
+					logger.Error().Err(err).Msg("error converting QuantityOrdered to float64")
 					return nil, err
 				}
 			}
 
 			if leg.ExecQuantity != "" {
 				if l.ExecQuantity, err = strconv.ParseInt(leg.ExecQuantity, 0, 64); err != nil {
-					log.Error().Err(err).Msg("error converting ExecQuantity to float64")
+					logger.Error().Err(err).Msg("error converting ExecQuantity to float64")
 					return nil, err
 				}
 			}
 
 			if leg.QuantityRemaining != "" {
 				if l.QuantityRemaining, err = strconv.ParseInt(leg.QuantityRemaining, 0, 64); err != nil {
-					log.Error().Err(err).Msg("error converting QuantityRemaining to float64")
+					logger.Error().Err(err).Msg("error converting QuantityRemaining to float64")
 					return nil, err
 				}
 			}
@@ -642,8 +720,8 @@ func convertOrders(orders []*tsOrder) ([]*Order, error) {
 			}
 
 			if rule.Price != "" {
-				if r.Price, err = strconv.ParseFloat(rule.Price, 64); err != nil {
-					log.Error().Err(err).Msg("error converting Price to float64")
+				if r.Price, err = decimal.NewFromString(rule.Price); err != nil {
+					logger.Error().Err(err).Msg("error converting Price to decimal")
 					return nil, err
 				}
 			}
@@ -653,15 +731,15 @@ func convertOrders(orders []*tsOrder) ([]*Order, error) {
 
 		if order.OpenedDateTime != "" {
 			if o.OpenedDateTime, err = time.Parse("2006-01-02T15:04:05Z", order.OpenedDateTime); err != nil {
-				log.Error().Err(err).Msg("error converting OpenedDateTime to time")
+				logger.Error().Err(err).Msg("error converting OpenedDateTime to time")
 				return nil, err
 			}
 			o.OpenedDateTime = o.OpenedDateTime.In(nyc)
 		}
 
 		if order.PriceUsedForBuyingPower != "" {
-			if o.PriceUsedForBuyingPower, err = strconv.ParseFloat(order.PriceUsedForBuyingPower, 64); err != nil {
-				log.Error().Err(err).Msg("error converting PriceUsedForBuyingPower to float64")
+			if o.PriceUsedForBuyingPower, err = decimal.NewFromString(order.PriceUsedForBuyingPower); err != nil {
+				logger.Error().Err(err).Msg("error converting PriceUsedForBuyingPower to decimal")
 				return nil, err
 			}
 		}
@@ -672,7 +750,7 @@ func convertOrders(orders []*tsOrder) ([]*Order, error) {
 		for ii, rule := range order.TimeActivationRules {
 			myTime, err := time.Parse("2006-01-02T15:04:05Z", rule.TimeUtc)
 			if err != nil {
-				log.Error().Err(err).Msg("error converting time activation rule")
+				logger.Error().Err(err).Msg("error converting time activation rule")
 			}
 			t := &TimeRule{
 				TimeUtc: myTime,
@@ -681,8 +759,8 @@ func convertOrders(orders []*tsOrder) ([]*Order, error) {
 		}
 
 		if order.UnbundledRouteFee != "" {
-			if o.UnbundledRouteFee, err = strconv.ParseFloat(order.UnbundledRouteFee, 64); err != nil {
-				log.Error().Err(err).Msg("error converting UnbundledRouteFee to float64")
+			if o.UnbundledRouteFee, err = decimal.NewFromString(order.UnbundledRouteFee); err != nil {
+				logger.Error().Err(err).Msg("error converting UnbundledRouteFee to decimal")
 				return nil, err
 			}
 		}
@@ -697,72 +775,56 @@ func convertOrders(orders []*tsOrder) ([]*Order, error) {
 //
 // since is the earliest date to retrieve orders for
 func (account *Account) GetHistoricalOrders(since time.Time) ([]*Order, error) {
-	allOrders := make([]*tsOrder, 0, 100)
-	url := fmt.Sprintf("/brokerage/accounts/%s/historicalorders?since=%s", account.AccountID, since.Format("2006-01-02"))
-	orders, err := account.ordersRequest(url, "")
-	if err != nil {
-		return nil, err
-	}
-	allOrders = append(allOrders, orders.Orders...)
-
-	for orders.NextToken != "" {
-		orders, err := account.ordersRequest(url, orders.NextToken)
-		if err != nil {
-			return nil, err
-		}
-		allOrders = append(allOrders, orders.Orders...)
-	}
+	return account.GetHistoricalOrdersContext(context.Background(), since)
+}
 
-	return convertOrders(allOrders)
+// GetHistoricalOrdersContext is like GetHistoricalOrders but carries `ctx` into every request it makes
+func (account *Account) GetHistoricalOrdersContext(ctx context.Context, since time.Time) ([]*Order, error) {
+	path := fmt.Sprintf("/brokerage/accounts/%s/historicalorders", account.AccountID)
+	return account.pagedOrders(ctx, path, map[string]string{"since": since.Format("2006-01-02")})
 }
 
 // GetOrders retrieves todays orders from tradestation
 func (account *Account) GetOrders() ([]*Order, error) {
-	allOrders := make([]*tsOrder, 0, 100)
-	url := fmt.Sprintf("/brokerage/accounts/%s/orders", account.AccountID)
-	orders, err := account.ordersRequest(url, "")
-	if err != nil {
-		return nil, err
-	}
-	allOrders = append(allOrders, orders.Orders...)
+	return account.GetOrdersContext(context.Background())
+}
 
-	for orders.NextToken != "" {
-		orders, err := account.ordersRequest(url, orders.NextToken)
-		if err != nil {
-			return nil, err
-		}
-		allOrders = append(allOrders, orders.Orders...)
-	}
-	return convertOrders(allOrders)
+// GetOrdersContext is like GetOrders but carries `ctx` into every request it makes
+func (account *Account) GetOrdersContext(ctx context.Context) ([]*Order, error) {
+	path := fmt.Sprintf("/brokerage/accounts/%s/orders", account.AccountID)
+	return account.pagedOrders(ctx, path, nil)
 }
 
+// GetPositions returns the positions currently held in the account
 func (account *Account) GetPositions() ([]*Position, error) {
-	account.api.CheckAuth()
+	return account.GetPositionsContext(context.Background())
+}
+
+// GetPositionsContext is like GetPositions but carries `ctx` into every request it makes
+func (account *Account) GetPositionsContext(ctx context.Context) ([]*Position, error) {
+	if err := account.api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
 	nyc, err := time.LoadLocation("America/New_York")
 	if err != nil {
 		return nil, err
 	}
 	positions := positionResponse{
 		Positions: make([]*tsPosition, 0, 5),
-		Errors:    make([]*tsError, 0, 1),
+		Errors:    make([]*ErrorDetail, 0, 1),
 	}
-	resp, err := account.api.client.R().
+	req, logger := account.newRequest(ctx)
+	resp, err := req.
 		SetResult(&positions).
 		Get(fmt.Sprintf("/brokerage/accounts/%s/positions", account.AccountID))
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		return nil, fmt.Errorf("/brokerage/accounts %d", resp.StatusCode())
-	}
-	if len(positions.Errors) != 0 {
-		errorMsgs := make([]string, len(positions.Errors))
-		for idx, errMsg := range positions.Errors {
-			errorMsgs[idx] = errMsg.Message
-		}
-		log.Error().Strs("Errors", errorMsgs).Msg("errors returned by tradestation api")
-		return nil, errors.New("tradestation api returned errors")
+	if err := checkResponse(resp, positions.Errors); err != nil {
+		logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("errors returned by tradestation api")
+		return nil, err
 	}
 
 	// convert positions to native types
@@ -777,93 +839,93 @@ func (account *Account) GetPositions() ([]*Position, error) {
 		}
 
 		if position.AveragePrice != "" {
-			if p.AveragePrice, err = strconv.ParseFloat(position.AveragePrice, 64); err != nil {
-				log.Error().Err(err).Msg("error converting AveragePrice to float64")
+			if p.AveragePrice, err = decimal.NewFromString(position.AveragePrice); err != nil {
+				logger.Error().Err(err).Msg("error converting AveragePrice to decimal")
 				return nil, err
 			}
 		}
 
 		if position.Last != "" {
-			if p.Last, err = strconv.ParseFloat(position.Last, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Last to float64")
+			if p.Last, err = decimal.NewFromString(position.Last); err != nil {
+				logger.Error().Err(err).Msg("error converting Last to decimal")
 				return nil, err
 			}
 		}
 
 		if position.Bid != "" {
-			if p.Bid, err = strconv.ParseFloat(position.Bid, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Bid to float64")
+			if p.Bid, err = decimal.NewFromString(position.Bid); err != nil {
+				logger.Error().Err(err).Msg("error converting Bid to decimal")
 				return nil, err
 			}
 		}
 
 		if position.Ask != "" {
-			if p.Ask, err = strconv.ParseFloat(position.Ask, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Ask to float64")
+			if p.Ask, err = decimal.NewFromString(position.Ask); err != nil {
+				logger.Error().Err(err).Msg("error converting Ask to decimal")
 				return nil, err
 			}
 		}
 
 		if position.Quantity != "" {
 			if p.Quantity, err = strconv.ParseInt(position.Quantity, 0, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Ask to float64")
+				logger.Error().Err(err).Msg("error converting Ask to float64")
 				return nil, err
 			}
 		}
 
 		if position.Timestamp != "" {
 			if p.Timestamp, err = time.Parse("2006-01-02T15:04:05Z", position.Timestamp); err != nil {
-				log.Error().Err(err).Msg("error converting Timestamp to time")
+				logger.Error().Err(err).Msg("error converting Timestamp to time")
 				return nil, err
 			}
 			p.Timestamp = p.Timestamp.In(nyc)
 		}
 
 		if position.TodaysProfitLoss != "" {
-			if p.TodaysProfitLoss, err = strconv.ParseFloat(position.TodaysProfitLoss, 64); err != nil {
-				log.Error().Err(err).Msg("error converting TodaysProfitLoss to float64")
+			if p.TodaysProfitLoss, err = decimal.NewFromString(position.TodaysProfitLoss); err != nil {
+				logger.Error().Err(err).Msg("error converting TodaysProfitLoss to decimal")
 				return nil, err
 			}
 		}
 
 		if position.TotalCost != "" {
-			if p.TotalCost, err = strconv.ParseFloat(position.TotalCost, 64); err != nil {
-				log.Error().Err(err).Msg("error converting TotalCost to float64")
+			if p.TotalCost, err = decimal.NewFromString(position.TotalCost); err != nil {
+				logger.Error().Err(err).Msg("error converting TotalCost to decimal")
 				return nil, err
 			}
 		}
 
 		if position.MarketValue != "" {
-			if p.MarketValue, err = strconv.ParseFloat(position.MarketValue, 64); err != nil {
-				log.Error().Err(err).Msg("error converting MarketValue to float64")
+			if p.MarketValue, err = decimal.NewFromString(position.MarketValue); err != nil {
+				logger.Error().Err(err).Msg("error converting MarketValue to decimal")
 				return nil, err
 			}
 		}
 
 		if position.MarkToMarketPrice != "" {
-			if p.MarkToMarketPrice, err = strconv.ParseFloat(position.MarkToMarketPrice, 64); err != nil {
-				log.Error().Err(err).Msg("error converting MarkToMarketPrice to float64")
+			if p.MarkToMarketPrice, err = decimal.NewFromString(position.MarkToMarketPrice); err != nil {
+				logger.Error().Err(err).Msg("error converting MarkToMarketPrice to decimal")
 				return nil, err
 			}
 		}
 
 		if position.UnrealizedProfitLoss != "" {
-			if p.UnrealizedProfitLoss, err = strconv.ParseFloat(position.UnrealizedProfitLoss, 64); err != nil {
-				log.Error().Err(err).Msg("error converting UnrealizedProfitLoss to float64")
+			if p.UnrealizedProfitLoss, err = decimal.NewFromString(position.UnrealizedProfitLoss); err != nil {
+				logger.Error().Err(err).Msg("error converting UnrealizedProfitLoss to decimal")
 				return nil, err
 			}
 		}
 
 		if position.UnrealizedProfitLossPercent != "" {
-			if p.UnrealizedProfitLossPercent, err = strconv.ParseFloat(position.UnrealizedProfitLossPercent, 64); err != nil {
-				log.Error().Err(err).Msg("error converting UnrealizedProfitLossPercent to float64")
+			if p.UnrealizedProfitLossPercent, err = decimal.NewFromString(position.UnrealizedProfitLossPercent); err != nil {
+				logger.Error().Err(err).Msg("error converting UnrealizedProfitLossPercent to decimal")
 				return nil, err
 			}
 		}
 
 		if position.UnrealizedProfitLossQty != "" {
-			if p.UnrealizedProfitLossQty, err = strconv.ParseFloat(position.UnrealizedProfitLossQty, 64); err != nil {
-				log.Error().Err(err).Msg("error converting UnrealizedProfitLossQty to float64")
+			if p.UnrealizedProfitLossQty, err = decimal.NewFromString(position.UnrealizedProfitLossQty); err != nil {
+				logger.Error().Err(err).Msg("error converting UnrealizedProfitLossQty to decimal")
 				return nil, err
 			}
 		}
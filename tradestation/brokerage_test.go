@@ -0,0 +1,176 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+	"github.com/shopspring/decimal"
+)
+
+// placeOrders places `count` market orders for one share of SPY
+func placeOrders(t *testing.T, account *tradestation.Account, count int) {
+	t.Helper()
+
+	for idx := 0; idx < count; idx++ {
+		_, err := account.PlaceOrder(&tradestation.OrderRequest{
+			AccountID:      account.AccountID,
+			OrderType:      tradestation.MARKET,
+			Quantity:       1,
+			Symbol:         "SPY",
+			TimeInForceDur: tradestation.DAY,
+			TradeAction:    tradestation.BUY,
+		})
+		if err != nil {
+			t.Fatalf("PlaceOrder: %v", err)
+		}
+	}
+}
+
+func newOrdersServer(t *testing.T) (*tradestationtest.Server, *tradestation.Account) {
+	t.Helper()
+
+	srv := tradestationtest.NewServer()
+	t.Cleanup(srv.Close)
+
+	srv.OrdersPageSize = 2
+	srv.AddAccount("SIM123", 10000)
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	account, err := srv.NewAPI().GetAccount("SIM123")
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	return srv, account
+}
+
+func TestGetOrdersPaginates(t *testing.T) {
+	_, account := newOrdersServer(t)
+	placeOrders(t, account, 5)
+
+	orders, err := account.GetOrders()
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(orders) != 5 {
+		t.Fatalf("GetOrders returned %d orders, want 5", len(orders))
+	}
+
+	seen := make(map[string]bool)
+	for _, order := range orders {
+		if seen[order.OrderID] {
+			t.Errorf("order %s returned twice", order.OrderID)
+		}
+		seen[order.OrderID] = true
+
+		if order.Status != tradestation.FILLED {
+			t.Errorf("order %s has status %s, want %s", order.OrderID, order.Status, tradestation.FILLED)
+		}
+		if !order.FilledPrice.Equal(decimal.RequireFromString("400.02")) {
+			t.Errorf("order %s filled at %s, want 400.02", order.OrderID, order.FilledPrice)
+		}
+	}
+}
+
+// TestGetOrdersPagesEnd checks that paging stops with ErrOrderPages when
+// the page tokens never run out
+func TestGetOrdersPagesEnd(t *testing.T) {
+	tests := []struct {
+		name  string
+		token func(page int) string
+		pages int
+	}{
+		{"repeated token", func(page int) string { return "2" }, 2},
+		{"endless tokens", func(page int) string { return fmt.Sprint(page * 2) }, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := tradestationtest.NewServer()
+			defer srv.Close()
+			srv.AddAccount("SIM123", 10000)
+
+			pages := 0
+			opts := srv.Options()
+			opts.Transport = &faultTransport{
+				next: srv.Client().Transport,
+				fault: func(req *http.Request) (*http.Response, error) {
+					if !strings.HasSuffix(req.URL.Path, "/orders") {
+						return nil, nil
+					}
+					pages++
+					body := fmt.Sprintf(`{"Orders":[],"NextToken":%q}`, tt.token(pages))
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Status:     http.StatusText(http.StatusOK),
+						Header:     http.Header{"Content-Type": []string{"application/json"}},
+						Body:       io.NopCloser(strings.NewReader(body)),
+						Request:    req,
+					}, nil
+				},
+			}
+			account, err := tradestation.NewWithOptions(opts).GetAccount("SIM123")
+			if err != nil {
+				t.Fatalf("GetAccount: %v", err)
+			}
+
+			if _, err := account.GetOrders(); !errors.Is(err, tradestation.ErrOrderPages) {
+				t.Fatalf("GetOrders returned %v, want ErrOrderPages", err)
+			}
+			if pages != tt.pages {
+				t.Errorf("GetOrders requested %d pages, want %d", pages, tt.pages)
+			}
+		})
+	}
+}
+
+func TestGetHistoricalOrdersPaginates(t *testing.T) {
+	srv, account := newOrdersServer(t)
+	placeOrders(t, account, 3)
+	srv.AgeOrders(2)
+
+	orders, err := account.GetHistoricalOrders(time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatalf("GetHistoricalOrders: %v", err)
+	}
+	if len(orders) != 3 {
+		t.Fatalf("GetHistoricalOrders returned %d orders, want 3", len(orders))
+	}
+
+	orders, err = account.GetHistoricalOrders(time.Now().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatalf("GetHistoricalOrders: %v", err)
+	}
+	if len(orders) != 0 {
+		t.Fatalf("GetHistoricalOrders since yesterday returned %d orders, want 0", len(orders))
+	}
+
+	orders, err = account.GetOrders()
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(orders) != 0 {
+		t.Fatalf("GetOrders returned %d orders placed before today, want 0", len(orders))
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	// envelopePrefix marks values in the envelope format; values without
+	// it are legacy base64 encoded nonce and ciphertext
+	envelopePrefix = "tsenc."
+
+	envelopeVersion = 1
+	algAES256GCM    = "A256GCM"
+)
+
+// Key is an encryption key along with a description of how it was derived
+type Key struct {
+	secret []byte
+
+	// KDF and KDFParams describe how the key was derived from a passphrase
+	// or key file; KDF is empty for raw keys
+	KDF       KDF
+	KDFParams string
+	Salt      []byte
+}
+
+// NewKey wraps a raw 32 byte key
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != keySize {
+		return nil, fmt.Errorf("tradestation: encryption key must be %d bytes", keySize)
+	}
+	return &Key{secret: secret}, nil
+}
+
+// Fingerprint identifies the key without revealing it
+func (key *Key) Fingerprint() string {
+	hasher := blake3.New(32, nil)
+	hasher.Write([]byte("tradestation key fingerprint"))
+	hasher.Write(key.secret)
+	return hex.EncodeToString(hasher.Sum(nil)[:8])
+}
+
+// envelope is the self-describing format of encrypted values
+type envelope struct {
+	Version    int    `json:"v"`
+	Algorithm  string `json:"alg"`
+	KDF        KDF    `json:"kdf,omitempty"`
+	KDFParams  string `json:"kdfp,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	KeyID      string `json:"kid"`
+	Nonce      []byte `json:"n"`
+	Ciphertext []byte `json:"ct"`
+}
+
+// additionalData binds the envelope header to the ciphertext so that it
+// cannot be modified
+func (env *envelope) additionalData() []byte {
+	return []byte(fmt.Sprintf("%d|%s|%s|%s|%s|%s", env.Version, env.Algorithm, env.KDF, env.KDFParams,
+		base64.StdEncoding.EncodeToString(env.Salt), env.KeyID))
+}
+
+// EncryptAES encrypts `plaintext` with the key of the profile chosen with
+// --profile (see ConfiguredKeySource)
+func EncryptAES(plaintext string) (string, error) {
+	key, err := CurrentProfile().encryptionKey()
+	if err != nil {
+		return "", err
+	}
+	return EncryptAESWithKey(key, plaintext)
+}
+
+// DecryptAES decrypts a value encrypted by EncryptAES with the key of the
+// profile chosen with --profile. Values written by earlier versions are
+// read transparently.
+func DecryptAES(ct string) (string, error) {
+	key, err := CurrentProfile().encryptionKey()
+	if err != nil {
+		return "", err
+	}
+	return DecryptAESWithKey(key, ct)
+}
+
+// EncryptAESWithKey encrypts `plaintext` with AES-GCM using `key` and
+// returns an envelope that records the version, algorithm, key derivation
+// and key fingerprint alongside the ciphertext
+func EncryptAESWithKey(key *Key, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	env := &envelope{
+		Version:   envelopeVersion,
+		Algorithm: algAES256GCM,
+		KDF:       key.KDF,
+		KDFParams: key.KDFParams,
+		Salt:      key.Salt,
+		KeyID:     key.Fingerprint(),
+		Nonce:     make([]byte, gcm.NonceSize()),
+	}
+
+	// populates our nonce with a cryptographically secure
+	// random sequence
+	if _, err = io.ReadFull(rand.Reader, env.Nonce); err != nil {
+		return "", err
+	}
+
+	env.Ciphertext = gcm.Seal(nil, env.Nonce, []byte(plaintext), env.additionalData())
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+
+	return envelopePrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecryptAESWithKey decrypts a value encrypted by EncryptAESWithKey or by
+// earlier versions that wrote bare base64 encoded nonce and ciphertext.
+// Errors match ErrMalformedCiphertext, ErrUnsupportedEnvelope, ErrWrongKey
+// or ErrDecryptFailed.
+func DecryptAESWithKey(key *Key, ct string) (string, error) {
+	plaintext, err := openAES(key, ct)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// openAES is DecryptAESWithKey returning the plaintext as a slice the
+// caller may wipe
+func openAES(key *Key, ct string) ([]byte, error) {
+	if !strings.HasPrefix(ct, envelopePrefix) {
+		return decryptLegacy(key, ct)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(ct, envelopePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedCiphertext, err)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedCiphertext, err)
+	}
+
+	if env.Version != envelopeVersion || env.Algorithm != algAES256GCM {
+		return nil, fmt.Errorf("%w: version %d, algorithm %s", ErrUnsupportedEnvelope, env.Version, env.Algorithm)
+	}
+
+	if env.KeyID != key.Fingerprint() {
+		return nil, fmt.Errorf("%w: encrypted with key %s, have key %s", ErrWrongKey, env.KeyID, key.Fingerprint())
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(env.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid nonce size %d", ErrMalformedCiphertext, len(env.Nonce))
+	}
+
+	plaintext, err := gcm.Open(nil, env.Nonce, env.Ciphertext, env.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptFailed, err)
+	}
+
+	return plaintext, nil
+}
+
+// decryptLegacy decrypts the base64 encoded nonce and ciphertext written
+// before the envelope format was introduced
+func decryptLegacy(key *Key, ct string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(ct)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedCiphertext, err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("%w: encrypted text is smaller than the nonce (%d < %d bytes)", ErrMalformedCiphertext, len(ciphertext), nonceSize)
+	}
+
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptFailed, err)
+	}
+
+	return plaintext, nil
+}
+
+// newGCM creates an AES-GCM cipher with `key`
+func newGCM(key *Key) (cipher.AEAD, error) {
+	// gcm or Galois/Counter Mode, is a mode of operation
+	// for symmetric key cryptographic block ciphers
+	// - https://en.wikipedia.org/wiki/Galois/Counter_Mode
+	c, err := aes.NewCipher(key.secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
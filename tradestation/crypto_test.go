@@ -0,0 +1,261 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/penny-vault/tradestation/tradestation"
+)
+
+// testKey returns a raw key filled with `b`
+func testKey(t *testing.T, b byte) *tradestation.Key {
+	t.Helper()
+
+	key, err := tradestation.NewKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	return key
+}
+
+// editEnvelope decodes the envelope `ct`, lets `edit` change its fields and
+// encodes it again
+func editEnvelope(t *testing.T, ct string, edit func(env map[string]any)) string {
+	t.Helper()
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(ct, "tsenc."))
+	if err != nil {
+		t.Fatalf("envelope is not base64: %v", err)
+	}
+	env := make(map[string]any)
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatalf("envelope is not JSON: %v", err)
+	}
+
+	edit(env)
+
+	if data, err = json.Marshal(env); err != nil {
+		t.Fatal(err)
+	}
+	return "tsenc." + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// flipByte flips the first bit of the base64 encoded byte slice `field`
+func flipByte(t *testing.T, field any) string {
+	t.Helper()
+
+	data, err := base64.StdEncoding.DecodeString(field.(string))
+	if err != nil || len(data) == 0 {
+		t.Fatalf("field is not a base64 byte slice: %v", field)
+	}
+	data[0] ^= 1
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	key := testKey(t, 1)
+
+	for _, plaintext := range []string{"", "api-key", strings.Repeat("secret ", 1000)} {
+		ct, err := tradestation.EncryptAESWithKey(key, plaintext)
+		if err != nil {
+			t.Fatalf("EncryptAESWithKey: %v", err)
+		}
+		if !strings.HasPrefix(ct, "tsenc.") {
+			t.Fatalf("ciphertext %q does not start with tsenc.", ct)
+		}
+		if plaintext != "" && strings.Contains(ct, plaintext) {
+			t.Fatal("ciphertext contains the plaintext")
+		}
+
+		got, err := tradestation.DecryptAESWithKey(key, ct)
+		if err != nil {
+			t.Fatalf("DecryptAESWithKey: %v", err)
+		}
+		if got != plaintext {
+			t.Errorf("decrypted %q, want %q", got, plaintext)
+		}
+	}
+
+	// every value gets its own nonce
+	first, _ := tradestation.EncryptAESWithKey(key, "api-key")
+	second, _ := tradestation.EncryptAESWithKey(key, "api-key")
+	if first == second {
+		t.Error("encrypting the same value twice returned the same ciphertext")
+	}
+}
+
+func TestEnvelopeRecordsKeyDerivation(t *testing.T) {
+	src := &tradestation.PassphraseKeySource{
+		KDF:        tradestation.SCRYPT,
+		Salt:       []byte("0123456789abcdef"),
+		Passphrase: func() ([]byte, error) { return []byte("correct horse"), nil },
+	}
+	key, err := src.Key()
+	if err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+
+	ct, err := tradestation.EncryptAESWithKey(key, "api-key")
+	if err != nil {
+		t.Fatalf("EncryptAESWithKey: %v", err)
+	}
+	editEnvelope(t, ct, func(env map[string]any) {
+		if env["kdf"] != "scrypt" || env["kid"] != key.Fingerprint() {
+			t.Errorf("envelope records kdf %v and key %v, want scrypt and %s", env["kdf"], env["kid"], key.Fingerprint())
+		}
+	})
+
+	got, err := tradestation.DecryptAESWithKey(key, ct)
+	if err != nil || got != "api-key" {
+		t.Errorf("DecryptAESWithKey returned %q, %v", got, err)
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, 32)
+	key := testKey(t, 1)
+
+	// earlier versions wrote base64(nonce || ciphertext) without additional
+	// data
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := bytes.Repeat([]byte{7}, gcm.NonceSize())
+	legacy := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("api-key"), nil))
+
+	got, err := tradestation.DecryptAESWithKey(key, legacy)
+	if err != nil {
+		t.Fatalf("DecryptAESWithKey: %v", err)
+	}
+	if got != "api-key" {
+		t.Errorf("decrypted %q, want api-key", got)
+	}
+
+	// legacy values do not record the key, so a wrong key fails to decrypt
+	if _, err := tradestation.DecryptAESWithKey(testKey(t, 2), legacy); !errors.Is(err, tradestation.ErrDecryptFailed) {
+		t.Errorf("legacy value with the wrong key returned %v, want %v", err, tradestation.ErrDecryptFailed)
+	}
+
+	if _, err := tradestation.DecryptAESWithKey(key, "AAAA"); !errors.Is(err, tradestation.ErrMalformedCiphertext) {
+		t.Errorf("short legacy value returned %v, want %v", err, tradestation.ErrMalformedCiphertext)
+	}
+	if _, err := tradestation.DecryptAESWithKey(key, "not base64!"); !errors.Is(err, tradestation.ErrMalformedCiphertext) {
+		t.Errorf("invalid legacy value returned %v, want %v", err, tradestation.ErrMalformedCiphertext)
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	key := testKey(t, 1)
+	ct, err := tradestation.EncryptAESWithKey(key, "api-key")
+	if err != nil {
+		t.Fatalf("EncryptAESWithKey: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		key  *tradestation.Key
+		ct   string
+		want error
+	}{
+		{
+			name: "wrong key",
+			key:  testKey(t, 2),
+			ct:   ct,
+			want: tradestation.ErrWrongKey,
+		},
+		{
+			name: "tampered ciphertext",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["ct"] = flipByte(t, env["ct"]) }),
+			want: tradestation.ErrDecryptFailed,
+		},
+		{
+			name: "tampered nonce",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["n"] = flipByte(t, env["n"]) }),
+			want: tradestation.ErrDecryptFailed,
+		},
+		{
+			name: "tampered kdf",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["kdf"] = "scrypt" }),
+			want: tradestation.ErrDecryptFailed,
+		},
+		{
+			name: "tampered kdf parameters",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["kdfp"] = "N=2,r=1,p=1" }),
+			want: tradestation.ErrDecryptFailed,
+		},
+		{
+			name: "tampered salt",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["salt"] = base64.StdEncoding.EncodeToString([]byte("salt")) }),
+			want: tradestation.ErrDecryptFailed,
+		},
+		{
+			name: "key ID of another key",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["kid"] = testKey(t, 2).Fingerprint() }),
+			want: tradestation.ErrWrongKey,
+		},
+		{
+			name: "unsupported version",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["v"] = 2 }),
+			want: tradestation.ErrUnsupportedEnvelope,
+		},
+		{
+			name: "unsupported algorithm",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["alg"] = "A128CBC-HS256" }),
+			want: tradestation.ErrUnsupportedEnvelope,
+		},
+		{
+			name: "truncated nonce",
+			ct:   editEnvelope(t, ct, func(env map[string]any) { env["n"] = base64.StdEncoding.EncodeToString([]byte("short")) }),
+			want: tradestation.ErrMalformedCiphertext,
+		},
+		{
+			name: "not JSON",
+			ct:   "tsenc." + base64.RawURLEncoding.EncodeToString([]byte("{")),
+			want: tradestation.ErrMalformedCiphertext,
+		},
+		{
+			name: "not base64",
+			ct:   "tsenc.!!!",
+			want: tradestation.ErrMalformedCiphertext,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decryptKey := tt.key
+			if decryptKey == nil {
+				decryptKey = key
+			}
+			got, err := tradestation.DecryptAESWithKey(decryptKey, tt.ct)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("DecryptAESWithKey returned %q, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+}
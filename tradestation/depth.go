@@ -0,0 +1,472 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// defaultDepthLevels is the number of price levels streamed when none
+	// is requested
+	defaultDepthLevels = 20
+
+	// maxDepthLevels is the most price levels a market depth stream may
+	// request
+	maxDepthLevels = 100
+)
+
+// tsDepthQuote is a single participant quote of the market depth quotes
+// stream
+type tsDepthQuote struct {
+	TimeStamp  string
+	Side       string
+	Price      string
+	Size       string
+	OrderCount int64
+	Name       string
+}
+
+// tsDepthAggregate is a price level of the market depth aggregates stream
+type tsDepthAggregate struct {
+	EarliestTime    string
+	LatestTime      string
+	Side            string
+	Price           string
+	TotalSize       string
+	BiggestSize     string
+	SmallestSize    string
+	NumParticipants int64
+	TotalOrderCount int64
+}
+
+// BookLevel is the liquidity offered at a single price
+type BookLevel struct {
+	Price        decimal.Decimal
+	Size         int64
+	Orders       int64
+	Participants int64
+
+	// TimeStamp is the time of the latest update of the level
+	TimeStamp time.Time
+}
+
+// OrderBook is a snapshot of the market depth of a symbol. Bids are sorted
+// from the highest price down and asks from the lowest price up, so the
+// first level of each side is the top of the book.
+type OrderBook struct {
+	Symbol    string
+	TimeStamp time.Time
+	Bids      []*BookLevel
+	Asks      []*BookLevel
+}
+
+// FillEstimate is the result of walking an order book with an order
+type FillEstimate struct {
+	// Quantity is the number of shares the book can fill; less than the
+	// requested quantity if the book is too thin
+	Quantity int64
+
+	// AveragePrice is the volume weighted price of the filled shares
+	AveragePrice decimal.Decimal
+
+	// WorstPrice is the price of the last level the order reaches; a limit
+	// order at this price fills Quantity shares if the book does not change
+	WorstPrice decimal.Decimal
+
+	// Levels is the number of price levels the order reaches
+	Levels int
+}
+
+// BestBid returns the highest bid or nil if there are no bids
+func (book *OrderBook) BestBid() *BookLevel {
+	if len(book.Bids) == 0 {
+		return nil
+	}
+	return book.Bids[0]
+}
+
+// BestAsk returns the lowest ask or nil if there are no asks
+func (book *OrderBook) BestAsk() *BookLevel {
+	if len(book.Asks) == 0 {
+		return nil
+	}
+	return book.Asks[0]
+}
+
+// EstimateFill estimates the fill of a market order for `quantity` shares.
+// Buy orders take liquidity from the asks and sell orders from the bids.
+// Only the levels of the book are considered; hidden liquidity is not.
+func (book *OrderBook) EstimateFill(action Action, quantity int64) (*FillEstimate, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("tradestation: cannot estimate the fill of %d shares", quantity)
+	}
+
+	levels := book.Bids
+	if action == BUY || action == BUYTOCOVER {
+		levels = book.Asks
+	}
+
+	estimate := &FillEstimate{}
+	cost := decimal.Zero
+	for _, level := range levels {
+		if estimate.Quantity == quantity {
+			break
+		}
+		size := level.Size
+		if remaining := quantity - estimate.Quantity; size > remaining {
+			size = remaining
+		}
+		if size <= 0 {
+			continue
+		}
+
+		cost = cost.Add(level.Price.Mul(decimal.NewFromInt(size)))
+		estimate.Quantity += size
+		estimate.WorstPrice = level.Price
+		estimate.Levels++
+	}
+
+	if estimate.Quantity > 0 {
+		estimate.AveragePrice = cost.Div(decimal.NewFromInt(estimate.Quantity))
+	}
+
+	return estimate, nil
+}
+
+// DepthEvent is delivered by StreamMarketDepth and
+// StreamMarketDepthAggregates
+type DepthEvent struct {
+	Type StreamEventType
+
+	// Book is the order book after an update; set for STREAM_DATA events
+	Book *OrderBook
+
+	// Err is set for STREAM_DISCONNECTED and STREAM_ERROR events
+	Err error
+}
+
+// StreamMarketDepth streams the order book of `symbol` built from the
+// individual quotes of market participants. Quotes at the same price are
+// combined into a single level. `maxLevels` limits the number of levels of
+// each side; 0 streams 20 levels. The returned channel is closed when `ctx`
+// is cancelled or the stream fails permanently.
+func (api *API) StreamMarketDepth(ctx context.Context, symbol string, maxLevels int) (<-chan *DepthEvent, error) {
+	return api.streamDepth(ctx, symbol, maxLevels, "quotes", func(raw json.RawMessage, nyc *time.Location, logger zerolog.Logger) (*OrderBook, error) {
+		var msg struct {
+			Bids []*tsDepthQuote
+			Asks []*tsDepthQuote
+		}
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			logger.Error().Err(err).Msg("could not parse market depth")
+			return nil, err
+		}
+
+		book := &OrderBook{Symbol: symbol}
+		var err error
+		if book.Bids, err = convertDepthQuotes(msg.Bids, nyc, logger); err != nil {
+			return nil, err
+		}
+		if book.Asks, err = convertDepthQuotes(msg.Asks, nyc, logger); err != nil {
+			return nil, err
+		}
+		return book, nil
+	})
+}
+
+// StreamMarketDepthAggregates streams the order book of `symbol` as
+// aggregated by TradeStation. `maxLevels` limits the number of levels of
+// each side; 0 streams 20 levels. The returned channel is closed when `ctx`
+// is cancelled or the stream fails permanently.
+func (api *API) StreamMarketDepthAggregates(ctx context.Context, symbol string, maxLevels int) (<-chan *DepthEvent, error) {
+	return api.streamDepth(ctx, symbol, maxLevels, "aggregates", func(raw json.RawMessage, nyc *time.Location, logger zerolog.Logger) (*OrderBook, error) {
+		var msg struct {
+			Bids []*tsDepthAggregate
+			Asks []*tsDepthAggregate
+		}
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			logger.Error().Err(err).Msg("could not parse market depth")
+			return nil, err
+		}
+
+		book := &OrderBook{Symbol: symbol}
+		var err error
+		if book.Bids, err = convertDepthAggregates(msg.Bids, nyc, logger); err != nil {
+			return nil, err
+		}
+		if book.Asks, err = convertDepthAggregates(msg.Asks, nyc, logger); err != nil {
+			return nil, err
+		}
+		return book, nil
+	})
+}
+
+// streamDepth streams `/marketdata/stream/marketdepth/{kind}/{symbol}`;
+// every message is a full snapshot of the book and is converted by
+// `convert`
+func (api *API) streamDepth(ctx context.Context, symbol string, maxLevels int, kind string,
+	convert func(raw json.RawMessage, nyc *time.Location, logger zerolog.Logger) (*OrderBook, error)) (<-chan *DepthEvent, error) {
+	if maxLevels == 0 {
+		maxLevels = defaultDepthLevels
+	}
+	if symbol == "" || maxLevels < 1 || maxLevels > maxDepthLevels {
+		err := fmt.Errorf("tradestation: market depth streams need a symbol and 1 to %d levels, got %d", maxDepthLevels, maxLevels)
+		api.logger.Error().Err(err).Str("Symbol", symbol).Msg("invalid market depth request")
+		return nil, err
+	}
+
+	nyc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		api.logger.Error().Err(err).Msg("cannot load America/New_York timezone")
+		return nil, err
+	}
+
+	if err := api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
+	events := make(chan *DepthEvent, 1)
+	send := func(ctx context.Context, event *DepthEvent) error {
+		select {
+		case events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	logger := api.logger.With().Str("Symbol", symbol).Str("Depth", kind).Logger()
+
+	s := &stream{
+		api:    api,
+		path:   "/marketdata/stream/marketdepth/" + kind + "/" + url.PathEscape(symbol),
+		logger: logger,
+		query: func() map[string]string {
+			return map[string]string{"maxlevels": strconv.Itoa(maxLevels)}
+		},
+		onData: func(ctx context.Context, raw json.RawMessage) error {
+			book, err := convert(raw, nyc, logger)
+			if err != nil {
+				return send(ctx, &DepthEvent{Type: STREAM_ERROR, Err: err})
+			}
+			book.sort()
+			return send(ctx, &DepthEvent{Type: STREAM_DATA, Book: book})
+		},
+		onEvent: func(ctx context.Context, eventType StreamEventType, err error) {
+			send(ctx, &DepthEvent{Type: eventType, Err: err})
+		},
+	}
+
+	go func() {
+		defer close(events)
+		s.run(ctx)
+	}()
+
+	return events, nil
+}
+
+// sort orders the levels of the book best price first and sets the
+// timestamp of the book to its latest update
+func (book *OrderBook) sort() {
+	sort.SliceStable(book.Bids, func(i, j int) bool { return book.Bids[i].Price.GreaterThan(book.Bids[j].Price) })
+	sort.SliceStable(book.Asks, func(i, j int) bool { return book.Asks[i].Price.LessThan(book.Asks[j].Price) })
+
+	for _, levels := range [][]*BookLevel{book.Bids, book.Asks} {
+		for _, level := range levels {
+			if level.TimeStamp.After(book.TimeStamp) {
+				book.TimeStamp = level.TimeStamp
+			}
+		}
+	}
+}
+
+// convertDepthQuotes combines participant quotes into one level per price
+func convertDepthQuotes(quotes []*tsDepthQuote, nyc *time.Location, logger zerolog.Logger) ([]*BookLevel, error) {
+	levels := make([]*BookLevel, 0, len(quotes))
+	byPrice := make(map[string]*BookLevel, len(quotes))
+
+	for _, quote := range quotes {
+		price, err := decimal.NewFromString(quote.Price)
+		if err != nil {
+			logger.Error().Err(err).Str("Price", quote.Price).Msg("error converting Price to decimal")
+			return nil, err
+		}
+
+		size, err := strconv.ParseInt(quote.Size, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Str("Size", quote.Size).Msg("error converting Size to int64")
+			return nil, err
+		}
+
+		timeStamp, err := parseDepthTime(quote.TimeStamp, nyc, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		key := price.String()
+		level, ok := byPrice[key]
+		if !ok {
+			level = &BookLevel{Price: price}
+			byPrice[key] = level
+			levels = append(levels, level)
+		}
+
+		level.Size += size
+		level.Orders += quote.OrderCount
+		level.Participants++
+		if timeStamp.After(level.TimeStamp) {
+			level.TimeStamp = timeStamp
+		}
+	}
+
+	return levels, nil
+}
+
+// convertDepthAggregates converts aggregated price levels
+func convertDepthAggregates(aggregates []*tsDepthAggregate, nyc *time.Location, logger zerolog.Logger) ([]*BookLevel, error) {
+	levels := make([]*BookLevel, len(aggregates))
+
+	for idx, aggregate := range aggregates {
+		level := &BookLevel{
+			Orders:       aggregate.TotalOrderCount,
+			Participants: aggregate.NumParticipants,
+		}
+
+		var err error
+		if level.Price, err = decimal.NewFromString(aggregate.Price); err != nil {
+			logger.Error().Err(err).Str("Price", aggregate.Price).Msg("error converting Price to decimal")
+			return nil, err
+		}
+
+		if level.Size, err = strconv.ParseInt(aggregate.TotalSize, 10, 64); err != nil {
+			logger.Error().Err(err).Str("TotalSize", aggregate.TotalSize).Msg("error converting TotalSize to int64")
+			return nil, err
+		}
+
+		if level.TimeStamp, err = parseDepthTime(aggregate.LatestTime, nyc, logger); err != nil {
+			return nil, err
+		}
+
+		levels[idx] = level
+	}
+
+	return levels, nil
+}
+
+// parseDepthTime parses a market depth timestamp in America/New_York time;
+// an empty timestamp is the zero time
+func parseDepthTime(value string, nyc *time.Location, logger zerolog.Logger) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	timeStamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		logger.Error().Err(err).Str("TimeStamp", value).Msg("error converting market depth TimeStamp to time")
+		return time.Time{}, err
+	}
+	return timeStamp.In(nyc), nil
+}
+
+// OrderBooks keeps the current order book of every symbol it watches. A
+// book is dropped after any stream event other than an update, such as a
+// disconnect, until the next update arrives, so estimates are never based on
+// a stale book.
+type OrderBooks struct {
+	mu    sync.RWMutex
+	books map[string]*OrderBook
+}
+
+// WatchOrderBooks streams the aggregated market depth of `symbols` until
+// `ctx` is cancelled. Each symbol uses a stream of its own. `maxLevels`
+// limits the number of levels of each side; 0 streams 20 levels.
+func (api *API) WatchOrderBooks(ctx context.Context, symbols []string, maxLevels int) (*OrderBooks, error) {
+	books := &OrderBooks{books: make(map[string]*OrderBook, len(symbols))}
+
+	ctx, cancel := context.WithCancel(ctx)
+	streams := make([]<-chan *DepthEvent, len(symbols))
+	for idx, symbol := range symbols {
+		events, err := api.StreamMarketDepthAggregates(ctx, symbol, maxLevels)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		streams[idx] = events
+	}
+
+	var wg sync.WaitGroup
+	for idx, symbol := range symbols {
+		wg.Add(1)
+		go func(symbol string, events <-chan *DepthEvent) {
+			defer wg.Done()
+			for event := range events {
+				if event.Type == STREAM_DATA {
+					books.set(symbol, event.Book)
+				} else {
+					books.set(symbol, nil)
+				}
+			}
+		}(symbol, streams[idx])
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
+
+	return books, nil
+}
+
+// set replaces the book of `symbol`; a nil book removes it
+func (books *OrderBooks) set(symbol string, book *OrderBook) {
+	books.mu.Lock()
+	defer books.mu.Unlock()
+
+	if book == nil {
+		delete(books.books, symbol)
+		return
+	}
+	books.books[symbol] = book
+}
+
+// Book returns the current order book of `symbol` or nil if there is none.
+// The returned book is not modified by later updates.
+func (books *OrderBooks) Book(symbol string) *OrderBook {
+	books.mu.RLock()
+	defer books.mu.RUnlock()
+
+	return books.books[symbol]
+}
+
+// EstimateFill estimates the fill of a market order for `quantity` shares
+// of `symbol` against its current order book
+func (books *OrderBooks) EstimateFill(symbol string, action Action, quantity int64) (*FillEstimate, error) {
+	book := books.Book(symbol)
+	if book == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoOrderBook, symbol)
+	}
+	return book.EstimateFill(action, quantity)
+}
@@ -0,0 +1,175 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+	"github.com/shopspring/decimal"
+)
+
+// testBook returns a book of SPY with three levels on each side
+func testBook() *tradestation.OrderBook {
+	level := func(price string, size int64) *tradestation.BookLevel {
+		return &tradestation.BookLevel{Price: decimal.RequireFromString(price), Size: size}
+	}
+	return &tradestation.OrderBook{
+		Symbol: "SPY",
+		Bids:   []*tradestation.BookLevel{level("99.90", 100), level("99.80", 300), level("99.50", 100)},
+		Asks:   []*tradestation.BookLevel{level("100.00", 100), level("100.10", 100), level("100.20", 200)},
+	}
+}
+
+func TestEstimateFill(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   tradestation.Action
+		quantity int64
+		want     tradestation.FillEstimate
+	}{
+		{"buy part of the top level", tradestation.BUY, 50, tradestation.FillEstimate{Quantity: 50, AveragePrice: decimal.RequireFromString("100"), WorstPrice: decimal.RequireFromString("100"), Levels: 1}},
+		{"buy the top level", tradestation.BUY, 100, tradestation.FillEstimate{Quantity: 100, AveragePrice: decimal.RequireFromString("100"), WorstPrice: decimal.RequireFromString("100"), Levels: 1}},
+		{"buy two levels", tradestation.BUY, 200, tradestation.FillEstimate{Quantity: 200, AveragePrice: decimal.RequireFromString("100.05"), WorstPrice: decimal.RequireFromString("100.10"), Levels: 2}},
+		{"buy the whole book", tradestation.BUY, 400, tradestation.FillEstimate{Quantity: 400, AveragePrice: decimal.RequireFromString("100.125"), WorstPrice: decimal.RequireFromString("100.20"), Levels: 3}},
+		{"buy more than the book", tradestation.BUY, 1000, tradestation.FillEstimate{Quantity: 400, AveragePrice: decimal.RequireFromString("100.125"), WorstPrice: decimal.RequireFromString("100.20"), Levels: 3}},
+		{"buy to cover takes the asks", tradestation.BUYTOCOVER, 200, tradestation.FillEstimate{Quantity: 200, AveragePrice: decimal.RequireFromString("100.05"), WorstPrice: decimal.RequireFromString("100.10"), Levels: 2}},
+
+		{"sell the top level", tradestation.SELL, 100, tradestation.FillEstimate{Quantity: 100, AveragePrice: decimal.RequireFromString("99.90"), WorstPrice: decimal.RequireFromString("99.90"), Levels: 1}},
+		{"sell two levels", tradestation.SELL, 400, tradestation.FillEstimate{Quantity: 400, AveragePrice: decimal.RequireFromString("99.825"), WorstPrice: decimal.RequireFromString("99.80"), Levels: 2}},
+		{"sell more than the book", tradestation.SELL, 600, tradestation.FillEstimate{Quantity: 500, AveragePrice: decimal.RequireFromString("99.76"), WorstPrice: decimal.RequireFromString("99.50"), Levels: 3}},
+		{"sell short takes the bids", tradestation.SELLSHORT, 250, tradestation.FillEstimate{Quantity: 250, AveragePrice: decimal.RequireFromString("99.84"), WorstPrice: decimal.RequireFromString("99.80"), Levels: 2}},
+	}
+
+	for _, tt := range tests {
+		got, err := testBook().EstimateFill(tt.action, tt.quantity)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.Quantity != tt.want.Quantity || !got.AveragePrice.Equal(tt.want.AveragePrice) || !got.WorstPrice.Equal(tt.want.WorstPrice) || got.Levels != tt.want.Levels {
+			t.Errorf("%s: EstimateFill(%s, %d) = %d @ %s (worst %s, %d levels), want %d @ %s (worst %s, %d levels)", tt.name, tt.action, tt.quantity,
+				got.Quantity, got.AveragePrice, got.WorstPrice, got.Levels,
+				tt.want.Quantity, tt.want.AveragePrice, tt.want.WorstPrice, tt.want.Levels)
+		}
+	}
+}
+
+func TestEstimateFillEmptySide(t *testing.T) {
+	book := testBook()
+	book.Asks = nil
+
+	got, err := book.EstimateFill(tradestation.BUY, 100)
+	if err != nil {
+		t.Fatalf("EstimateFill: %v", err)
+	}
+	if got.Quantity != 0 || !got.AveragePrice.IsZero() || got.Levels != 0 {
+		t.Errorf("EstimateFill on a book without asks = %+v, want nothing filled", got)
+	}
+
+	for _, quantity := range []int64{0, -100} {
+		if _, err := book.EstimateFill(tradestation.SELL, quantity); err == nil {
+			t.Errorf("EstimateFill of %d shares succeeded", quantity)
+		}
+	}
+}
+
+// waitForBook returns the book of `symbol` once its best bid is `bid`
+func waitForBook(t *testing.T, books *tradestation.OrderBooks, symbol string, bid string) *tradestation.OrderBook {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if book := books.Book(symbol); book != nil && book.BestBid() != nil && book.BestBid().Price.Equal(decimal.RequireFromString(bid)) {
+			return book
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no book of %s with a best bid of %s within 5s", symbol, bid)
+	return nil
+}
+
+func TestWatchOrderBooks(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	// quotes at the same price are aggregated into one level
+	srv.SetDepth("SPY",
+		[]tradestationtest.DepthQuote{{Price: 399.99, Size: 100, Orders: 1, Name: "NSDQ"}, {Price: 399.99, Size: 200, Orders: 2, Name: "ARCX"}, {Price: 399.98, Size: 500, Orders: 3, Name: "NSDQ"}},
+		[]tradestationtest.DepthQuote{{Price: 400.01, Size: 100, Orders: 1, Name: "NSDQ"}, {Price: 400.02, Size: 300, Orders: 2, Name: "ARCX"}})
+	srv.SetDepth("QQQ",
+		[]tradestationtest.DepthQuote{{Price: 299.99, Size: 50, Orders: 1, Name: "NSDQ"}},
+		[]tradestationtest.DepthQuote{{Price: 300.01, Size: 50, Orders: 1, Name: "NSDQ"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	books, err := srv.NewAPI().WatchOrderBooks(ctx, []string{"SPY", "QQQ"}, 0)
+	if err != nil {
+		t.Fatalf("WatchOrderBooks: %v", err)
+	}
+	spy := waitForBook(t, books, "SPY", "399.99")
+	waitForBook(t, books, "QQQ", "299.99")
+
+	tests := []struct {
+		symbol   string
+		action   tradestation.Action
+		quantity int64
+		filled   int64
+		worst    string
+		levels   int
+	}{
+		{"SPY", tradestation.BUY, 100, 100, "400.01", 1},
+		{"SPY", tradestation.BUY, 400, 400, "400.02", 2},
+		{"SPY", tradestation.BUY, 1000, 400, "400.02", 2},
+		{"SPY", tradestation.SELL, 300, 300, "399.99", 1},
+		{"SPY", tradestation.SELL, 301, 301, "399.98", 2},
+		{"SPY", tradestation.SELLSHORT, 2000, 800, "399.98", 2},
+		{"QQQ", tradestation.BUY, 100, 50, "300.01", 1},
+		{"QQQ", tradestation.SELL, 10, 10, "299.99", 1},
+	}
+	for _, tt := range tests {
+		got, err := books.EstimateFill(tt.symbol, tt.action, tt.quantity)
+		if err != nil {
+			t.Errorf("EstimateFill(%s, %s, %d): %v", tt.symbol, tt.action, tt.quantity, err)
+			continue
+		}
+		if got.Quantity != tt.filled || !got.WorstPrice.Equal(decimal.RequireFromString(tt.worst)) || got.Levels != tt.levels {
+			t.Errorf("EstimateFill(%s, %s, %d) = %d shares up to %s in %d levels, want %d shares up to %s in %d levels", tt.symbol, tt.action, tt.quantity,
+				got.Quantity, got.WorstPrice, got.Levels, tt.filled, tt.worst, tt.levels)
+		}
+	}
+
+	if _, err := books.EstimateFill("IWM", tradestation.BUY, 100); !errors.Is(err, tradestation.ErrNoOrderBook) {
+		t.Errorf("EstimateFill of a symbol without a book returned %v, want %v", err, tradestation.ErrNoOrderBook)
+	}
+
+	// updates replace the book but not the snapshots returned before
+	srv.SetDepth("SPY",
+		[]tradestationtest.DepthQuote{{Price: 399.95, Size: 100, Orders: 1, Name: "NSDQ"}},
+		[]tradestationtest.DepthQuote{{Price: 400.05, Size: 100, Orders: 1, Name: "NSDQ"}})
+	updated := waitForBook(t, books, "SPY", "399.95")
+	if len(updated.Bids) != 1 || len(updated.Asks) != 1 {
+		t.Errorf("updated book has %d bids and %d asks, want 1 of each", len(updated.Bids), len(updated.Asks))
+	}
+	if best := spy.BestBid(); !best.Price.Equal(decimal.RequireFromString("399.99")) || best.Size != 300 {
+		t.Errorf("earlier snapshot changed to a best bid of %d @ %s", best.Size, best.Price)
+	}
+}
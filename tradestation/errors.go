@@ -0,0 +1,224 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+var (
+	// ErrUnauthorized is matched by errors caused by a missing, expired or
+	// rejected access token
+	ErrUnauthorized = errors.New("tradestation: unauthorized")
+
+	// ErrRateLimited is matched by errors caused by exceeding the API quota
+	ErrRateLimited = errors.New("tradestation: rate limited")
+
+	// ErrOrderRejected is matched by errors returned when TradeStation
+	// refuses to accept one or more orders
+	ErrOrderRejected = errors.New("tradestation: order rejected")
+
+	// ErrAccountNotFound is returned by GetAccount when the requested account
+	// is not available to the authenticated user
+	ErrAccountNotFound = errors.New("tradestation: account not found")
+
+	// ErrStateMismatch is returned when the state of an OAuth redirect does
+	// not match the login attempt it claims to answer
+	ErrStateMismatch = errors.New("tradestation: oauth state does not match")
+
+	// ErrLoginTimeout is returned when the user does not sign in to
+	// TradeStation before the login timeout expires
+	ErrLoginTimeout = errors.New("tradestation: timed out waiting for login")
+
+	// ErrLoginRequired is returned by unattended clients that would have to
+	// ask the user to log in; it matches ErrUnauthorized
+	ErrLoginRequired = fmt.Errorf("%w: interactive login required", ErrUnauthorized)
+
+	// ErrMalformedCiphertext is returned when a value is neither a valid
+	// envelope nor legacy ciphertext
+	ErrMalformedCiphertext = errors.New("tradestation: malformed ciphertext")
+
+	// ErrUnsupportedEnvelope is returned for envelopes written by a newer
+	// version or with an unknown algorithm
+	ErrUnsupportedEnvelope = errors.New("tradestation: unsupported envelope")
+
+	// ErrWrongKey is returned when a value was encrypted with a different
+	// key than the one used to decrypt it
+	ErrWrongKey = errors.New("tradestation: value was encrypted with a different key")
+
+	// ErrDecryptFailed is returned when a value cannot be authenticated; it
+	// was either modified or, for legacy values, encrypted with another key
+	ErrDecryptFailed = errors.New("tradestation: decryption failed")
+
+	// ErrReadOnly is returned by read-only clients for requests that would
+	// place, replace or cancel orders; no request is sent
+	ErrReadOnly = errors.New("tradestation: read-only client")
+
+	// ErrTradeScope is the AuthStatus.Err of a read-only client whose saved
+	// token grants the Trade scope; it is not used until the user logs in
+	// again with the narrowed scopes
+	ErrTradeScope = errors.New("tradestation: saved token grants the Trade scope to a read-only client")
+
+	// ErrStreamStalled is the cause of a STREAM_DISCONNECTED event when a
+	// stream sent no message or heartbeat within the heartbeat timeout
+	ErrStreamStalled = errors.New("tradestation: stream stalled")
+
+	// ErrNoOrderBook is returned by OrderBooks when no current order book of
+	// a symbol has been received
+	ErrNoOrderBook = errors.New("tradestation: no order book")
+
+	// ErrOrderPages is returned when TradeStation repeats a page token or
+	// keeps returning pages of orders past maxOrderPages
+	ErrOrderPages = errors.New("tradestation: order pages do not end")
+)
+
+// ErrorDetail is a single entry of the Errors array returned by the
+// TradeStation API
+type ErrorDetail struct {
+	AccountID string
+	Error     string
+	Message   string
+}
+
+// APIError is returned when the TradeStation API responds with an error
+// status code or reports errors in the response body
+type APIError struct {
+	StatusCode int
+	Method     string
+	Endpoint   string
+	Message    string
+	Errors     []*ErrorDetail
+
+	rejected bool
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if len(e.Errors) > 0 {
+		msgs := make([]string, len(e.Errors))
+		for idx, detail := range e.Errors {
+			msgs[idx] = fmt.Sprintf("%s: %s", detail.Error, detail.Message)
+		}
+		msg = strings.Join(msgs, "; ")
+	}
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("tradestation: %s %s returned %d: %s", e.Method, e.Endpoint, e.StatusCode, msg)
+}
+
+// Is reports whether the error matches one of the package sentinel errors
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrOrderRejected:
+		return e.rejected
+	}
+	return false
+}
+
+// QuoteError describes a symbol that TradeStation could not quote
+type QuoteError struct {
+	Symbol  string
+	Message string
+}
+
+func (e *QuoteError) Error() string {
+	return fmt.Sprintf("tradestation: quote for %s failed: %s", e.Symbol, e.Message)
+}
+
+// StreamError is an error message sent by TradeStation on a stream. It is
+// delivered with a STREAM_ERROR event; the stream continues.
+type StreamError struct {
+	Symbol  string
+	Code    string
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	msg := e.Code
+	if e.Message != "" {
+		msg = fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	if e.Symbol != "" {
+		return fmt.Sprintf("tradestation: stream error for %s: %s", e.Symbol, msg)
+	}
+	return fmt.Sprintf("tradestation: stream error: %s", msg)
+}
+
+// tsErrorBody is the body returned by TradeStation along with an error status
+type tsErrorBody struct {
+	Error   string
+	Message string
+}
+
+// newAPIError builds an APIError from a response; `details` are the decoded
+// Errors array of the response body (if any)
+func newAPIError(resp *resty.Response, details []*ErrorDetail) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode(),
+		Errors:     details,
+	}
+
+	if resp.Request != nil {
+		apiErr.Method = resp.Request.Method
+		apiErr.Endpoint = resp.Request.URL
+	}
+
+	if apiErr.StatusCode >= 400 {
+		apiErr.Message = errorMessage(resp.Body())
+	}
+
+	return apiErr
+}
+
+// errorMessage returns the message of an error response body
+func errorMessage(body []byte) string {
+	var errBody tsErrorBody
+	if err := json.Unmarshal(body, &errBody); err == nil && errBody.Message != "" {
+		return errBody.Message
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// checkResponse returns an APIError if `resp` has an error status code or
+// `details` is non-empty
+func checkResponse(resp *resty.Response, details []*ErrorDetail) error {
+	if resp.StatusCode() >= 400 || len(details) > 0 {
+		return newAPIError(resp, details)
+	}
+	return nil
+}
+
+// checkOrderResponse is like checkResponse but marks errors reported in
+// `details` as rejected orders
+func checkOrderResponse(resp *resty.Response, details []*ErrorDetail) error {
+	if resp.StatusCode() >= 400 || len(details) > 0 {
+		apiErr := newAPIError(resp, details)
+		apiErr.rejected = len(details) > 0 || resp.StatusCode() == http.StatusBadRequest
+		return apiErr
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const (
+	// TokenAudience is the audience of access tokens for the v3 API
+	TokenAudience = "https://api.tradestation.com"
+
+	// jwksPath is where the signin server publishes its signing keys
+	jwksPath = "/.well-known/jwks.json"
+
+	// jwksTTL is how long fetched signing keys are used before they are
+	// fetched again; jwksMinRefetch limits refetches caused by tokens signed
+	// with an unknown key
+	jwksTTL        = 12 * time.Hour
+	jwksMinRefetch = time.Minute
+
+	// TradeScope grants placing, replacing and cancelling orders; it is
+	// never requested by read-only clients
+	TradeScope = "Trade"
+)
+
+// DefaultScopes are the v3 API scopes requested when Options.Scopes is
+// empty
+var DefaultScopes = []string{"MarketData", "ReadAccount", TradeScope}
+
+// TokenClaims are the claims of the current access token
+type TokenClaims struct {
+	// User is the subject of the token, the TradeStation user
+	User       string
+	Issuer     string
+	Audience   []string
+	Scopes     []string
+	IssuedAt   time.Time
+	Expiration time.Time
+
+	// Verified is true if the signature, issuer, audience and scopes of
+	// the token were checked against the signin server's signing keys
+	Verified bool
+}
+
+// HasScope returns true if the token grants `scope`
+func (claims *TokenClaims) HasScope(scope string) bool {
+	for _, granted := range claims.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// newTokenClaims reads the claims of a parsed token
+func newTokenClaims(token jwt.Token) *TokenClaims {
+	claims := &TokenClaims{
+		User:       token.Subject(),
+		Issuer:     token.Issuer(),
+		Audience:   token.Audience(),
+		IssuedAt:   token.IssuedAt(),
+		Expiration: token.Expiration(),
+	}
+
+	// the scope claim is a space separated string, some issuers use a list
+	if scope, ok := token.Get("scope"); ok {
+		switch scope := scope.(type) {
+		case string:
+			claims.Scopes = strings.Fields(scope)
+		case []any:
+			for _, s := range scope {
+				if s, ok := s.(string); ok {
+					claims.Scopes = append(claims.Scopes, s)
+				}
+			}
+		}
+	}
+
+	return claims
+}
+
+// Claims returns the claims of the access token, authenticating first if
+// necessary. With Options.VerifyToken the claims have been verified.
+func (api *API) Claims() (*TokenClaims, error) {
+	return api.ClaimsContext(context.Background())
+}
+
+// ClaimsContext is like Claims but carries `ctx` into authentication
+func (api *API) ClaimsContext(ctx context.Context) (*TokenClaims, error) {
+	if err := api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
+	current := api.currentToken()
+	if current == nil || current.claims == nil {
+		return nil, ErrNoToken
+	}
+
+	claims := *current.claims
+	return &claims, nil
+}
+
+// jwksCache fetches and caches the signing keys of the signin server
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	set       jwk.Set
+	fetched   time.Time
+	refetched time.Time // last fetch requested by a caller
+}
+
+// keySet returns the cached signing keys, fetching them if they are
+// missing or stale. `refetch` fetches the keys again, at most once every
+// jwksMinRefetch; use it when a token is signed with an unknown key.
+func (cache *jwksCache) keySet(ctx context.Context, refetch bool) (jwk.Set, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	refetch = refetch && time.Since(cache.refetched) >= jwksMinRefetch
+	if cache.set != nil && time.Since(cache.fetched) < jwksTTL && !refetch {
+		return cache.set, nil
+	}
+	if refetch {
+		cache.refetched = time.Now()
+	}
+
+	set, err := jwk.Fetch(ctx, cache.url, jwk.WithHTTPClient(cache.client))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch signing keys from %s: %w", cache.url, err)
+	}
+
+	cache.set = set
+	cache.fetched = time.Now()
+	return set, nil
+}
+
+// verifyToken checks the signature, issuer, audience and scopes of `token`
+// (it must grant every scope the client requests) and returns a copy of it
+// that carries the verified claims
+func (api *API) verifyToken(ctx context.Context, token *sealedToken) (*sealedToken, error) {
+	if token.claims != nil && token.claims.Verified {
+		return token, nil
+	}
+
+	opened := &openedSecrets{}
+	defer opened.destroy()
+
+	accessToken, err := opened.open(token.access)
+	if err != nil {
+		return nil, err
+	}
+
+	parse := func(refetch bool) (jwt.Token, error) {
+		set, err := api.jwks.keySet(ctx, refetch)
+		if err != nil {
+			return nil, err
+		}
+		// keys that do not name their algorithm are skipped, so a token
+		// cannot choose how it is verified
+		return jwt.Parse([]byte(accessToken),
+			jwt.WithKeySet(set),
+			jwt.WithIssuer(api.signinUrl+"/"),
+			jwt.WithAudience(TokenAudience),
+			jwt.WithValidate(true),
+		)
+	}
+
+	parsed, err := parse(false)
+	if err != nil {
+		// the signing keys may have been rotated since they were fetched
+		api.logger.Debug().Err(err).Msg("access token did not verify with cached signing keys")
+		parsed, err = parse(true)
+	}
+	if err != nil {
+		api.logger.Error().Err(err).Msg("could not verify access token")
+		return nil, err
+	}
+
+	claims := newTokenClaims(parsed)
+	for _, scope := range api.scopes {
+		if !claims.HasScope(scope) {
+			api.logger.Error().Str("Scope", scope).Strs("Granted", claims.Scopes).Msg("access token does not grant a required scope")
+			return nil, fmt.Errorf("access token does not grant the %s scope", scope)
+		}
+	}
+	claims.Verified = true
+
+	verified := *token
+	verified.claims = claims
+	verified.parseErr = nil
+	return &verified, nil
+}
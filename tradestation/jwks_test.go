@@ -0,0 +1,233 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/penny-vault/tradestation/tradestation"
+)
+
+const testSigninURL = "https://signin.example.com"
+
+// jwksServer publishes signing keys and counts how often they are fetched
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []jwk.Key
+	next    []jwk.Key // replace keys once they were fetched
+	fetches int
+}
+
+func newJWKSServer(t *testing.T, keys ...jwk.Key) *jwksServer {
+	t.Helper()
+
+	srv := &jwksServer{keys: publicKeys(t, keys)}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		srv.fetches++
+		set := jwk.NewSet()
+		for _, key := range srv.keys {
+			set.AddKey(key)
+		}
+		if srv.next != nil {
+			srv.keys, srv.next = srv.next, nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// rotate publishes `keys` after the current keys were fetched once more
+func (srv *jwksServer) rotate(t *testing.T, keys ...jwk.Key) {
+	t.Helper()
+
+	public := publicKeys(t, keys)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.next = public
+}
+
+func (srv *jwksServer) Fetches() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.fetches
+}
+
+// publicKeys returns the public halves of `keys`
+func publicKeys(t *testing.T, keys []jwk.Key) []jwk.Key {
+	t.Helper()
+
+	public := make([]jwk.Key, len(keys))
+	for idx, key := range keys {
+		var err error
+		if public[idx], err = key.PublicKey(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return public
+}
+
+// newSigningKey returns an ES256 key with key id `kid`; the key only names
+// its algorithm if `alg` is true
+func newSigningKey(t *testing.T, kid string, alg bool) jwk.Key {
+	t.Helper()
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.FromRaw(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Set(jwk.KeyIDKey, kid)
+	if alg {
+		key.Set(jwk.AlgorithmKey, jwa.ES256)
+	}
+	return key
+}
+
+// tokenClaims are the claims of a test access token
+type tokenClaims struct {
+	issuer   string
+	audience string
+	scope    string
+}
+
+var validClaims = tokenClaims{
+	issuer:   testSigninURL + "/",
+	audience: tradestation.TokenAudience,
+	scope:    "openid MarketData ReadAccount Trade offline_access",
+}
+
+// signToken returns an access token with `claims` signed by `key`
+func signToken(t *testing.T, key jwk.Key, claims tokenClaims) *tradestation.OAuthToken {
+	t.Helper()
+
+	now := time.Now()
+	tok, err := jwt.NewBuilder().
+		Issuer(claims.issuer).
+		Audience([]string{claims.audience}).
+		Subject("test|user").
+		IssuedAt(now).
+		Expiration(now.Add(20*time.Minute)).
+		Claim("scope", claims.scope).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.ES256, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tradestation.OAuthToken{AccessToken: string(signed), TokenType: "Bearer", Scope: claims.scope, ExpiresIn: 1200}
+}
+
+// verifyingAPI returns a client that verifies `token` with the keys of `jwks`
+func verifyingAPI(jwks *jwksServer, token *tradestation.OAuthToken) *tradestation.API {
+	return tradestation.NewWithOptions(tradestation.Options{
+		SigninURL:   testSigninURL,
+		JWKSURL:     jwks.URL,
+		VerifyToken: true,
+		Unattended:  true,
+		TokenStore:  tradestation.NewMemoryTokenStore(token),
+		RetryPolicy: &tradestation.RetryPolicy{},
+	})
+}
+
+func TestVerifyToken(t *testing.T) {
+	key := newSigningKey(t, "key1", true)
+	jwks := newJWKSServer(t, key)
+
+	claims, err := verifyingAPI(jwks, signToken(t, key, validClaims)).Claims()
+	if err != nil {
+		t.Fatalf("Claims: %v", err)
+	}
+	if !claims.Verified || claims.User != "test|user" || claims.Issuer != testSigninURL+"/" || !claims.HasScope(tradestation.TradeScope) {
+		t.Errorf("Claims returned %+v, want the verified claims of the token", claims)
+	}
+}
+
+func TestVerifyTokenRejects(t *testing.T) {
+	key := newSigningKey(t, "key1", true)
+	noAlg := newSigningKey(t, "key3", false)
+
+	wrongIssuer := validClaims
+	wrongIssuer.issuer = "https://signin.attacker.example/"
+	wrongAudience := validClaims
+	wrongAudience.audience = "https://api.attacker.example"
+	noTrade := validClaims
+	noTrade.scope = "openid MarketData ReadAccount offline_access"
+
+	tests := []struct {
+		name  string
+		keys  []jwk.Key
+		token *tradestation.OAuthToken
+	}{
+		{"wrong issuer", []jwk.Key{key}, signToken(t, key, wrongIssuer)},
+		{"wrong audience", []jwk.Key{key}, signToken(t, key, wrongAudience)},
+		{"missing scope", []jwk.Key{key}, signToken(t, key, noTrade)},
+		{"unknown key", []jwk.Key{key}, signToken(t, newSigningKey(t, "key2", true), validClaims)},
+		{"forged with the key id of a published key", []jwk.Key{key}, signToken(t, newSigningKey(t, "key1", true), validClaims)},
+		{"key without an algorithm", []jwk.Key{noAlg}, signToken(t, noAlg, validClaims)},
+	}
+
+	for _, tt := range tests {
+		jwks := newJWKSServer(t, tt.keys...)
+		if claims, err := verifyingAPI(jwks, tt.token).Claims(); !errors.Is(err, tradestation.ErrUnauthorized) {
+			t.Errorf("%s: Claims returned %+v, %v; want %v", tt.name, claims, err, tradestation.ErrUnauthorized)
+		}
+	}
+}
+
+// TestVerifyTokenRotatedKey checks that a token signed with a key that is
+// not among the cached keys is verified after the keys are fetched again
+func TestVerifyTokenRotatedKey(t *testing.T) {
+	oldKey, newKey := newSigningKey(t, "key1", true), newSigningKey(t, "key2", true)
+	jwks := newJWKSServer(t, oldKey)
+	jwks.rotate(t, oldKey, newKey)
+
+	claims, err := verifyingAPI(jwks, signToken(t, newKey, validClaims)).Claims()
+	if err != nil {
+		t.Fatalf("Claims: %v", err)
+	}
+	if !claims.Verified {
+		t.Error("claims of a token signed with the new key are not verified")
+	}
+	if n := jwks.Fetches(); n != 2 {
+		t.Errorf("signing keys were fetched %d times, want 2", n)
+	}
+}
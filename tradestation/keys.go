@@ -0,0 +1,270 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"lukechampine.com/blake3"
+)
+
+// KeySourceType selects where the key that encrypts secrets comes from
+type KeySourceType string
+
+const (
+	SSH_KEY    KeySourceType = "ssh"
+	PASSPHRASE KeySourceType = "passphrase"
+	KEY_FILE   KeySourceType = "keyfile"
+)
+
+// KDF is the key derivation function used to turn a passphrase into a key
+type KDF string
+
+const (
+	ARGON2ID KDF = "argon2id"
+	SCRYPT   KDF = "scrypt"
+
+	// BLAKE3 hashes a key file into a key; it is only used by SSHKeySource
+	BLAKE3 KDF = "blake3"
+)
+
+// PassphraseEnv is the environment variable consulted for the passphrase
+// before prompting for it
+const PassphraseEnv = "TRADESTATION_PASSPHRASE"
+
+const (
+	keySize  = 32
+	saltSize = 16
+
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// KeySource provides the 32 byte AES key used to encrypt secrets
+type KeySource interface {
+	Key() (*Key, error)
+}
+
+// SSHKeySource hashes a private key file (by default ~/.ssh/id_rsa) into a
+// key. Replacing the file makes every secret unreadable; use the rekey
+// command before doing so.
+type SSHKeySource struct {
+	Path string
+}
+
+func (src *SSHKeySource) Key() (*Key, error) {
+	path := src.Path
+	if path == "" {
+		userHomeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(userHomeDir, ".ssh", "id_rsa")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := blake3.Sum256(data)
+	return &Key{secret: secret[:], KDF: BLAKE3}, nil
+}
+
+// KeyFileSource reads a key from a file that holds exactly 32 bytes, either
+// raw or hex encoded
+type KeyFileSource struct {
+	Path string
+}
+
+func (src *KeyFileSource) Key() (*Key, error) {
+	data, err := os.ReadFile(src.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == keySize {
+		return NewKey(data)
+	}
+
+	secret, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(secret) != keySize {
+		return nil, fmt.Errorf("tradestation: key file %s must contain %d raw or hex encoded bytes", src.Path, keySize)
+	}
+	return NewKey(secret)
+}
+
+// PassphraseKeySource derives a key from a passphrase with Argon2id or
+// scrypt
+type PassphraseKeySource struct {
+	KDF  KDF
+	Salt []byte
+
+	// Passphrase returns the passphrase; defaults to ReadPassphrase
+	Passphrase func() ([]byte, error)
+}
+
+func (src *PassphraseKeySource) Key() (*Key, error) {
+	if len(src.Salt) == 0 {
+		return nil, errors.New("tradestation: passphrase key source requires a salt (auth.kdf_salt)")
+	}
+
+	readPassphrase := src.Passphrase
+	if readPassphrase == nil {
+		readPassphrase = func() ([]byte, error) {
+			return ReadPassphrase("Passphrase: ")
+		}
+	}
+
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("tradestation: empty passphrase")
+	}
+
+	kdf := src.KDF
+	if kdf == "" {
+		kdf = ARGON2ID
+	}
+
+	secret, err := DeriveKey(kdf, passphrase, src.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{secret: secret, KDF: kdf, KDFParams: kdfParams(kdf), Salt: src.Salt}, nil
+}
+
+// DeriveKey derives a 32 byte key from `passphrase` and `salt` with `kdf`;
+// an empty `kdf` selects Argon2id
+func DeriveKey(kdf KDF, passphrase, salt []byte) ([]byte, error) {
+	switch kdf {
+	case ARGON2ID, "":
+		return argon2.IDKey(passphrase, salt, argon2Time, argon2Memory, argon2Threads, keySize), nil
+	case SCRYPT:
+		return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keySize)
+	default:
+		return nil, fmt.Errorf("tradestation: unknown kdf %q", kdf)
+	}
+}
+
+// kdfParams describes the parameters DeriveKey uses for `kdf`; they are
+// recorded in encrypted values
+func kdfParams(kdf KDF) string {
+	switch kdf {
+	case ARGON2ID:
+		return fmt.Sprintf("m=%d,t=%d,p=%d", argon2Memory, argon2Time, argon2Threads)
+	case SCRYPT:
+		return fmt.Sprintf("N=%d,r=%d,p=%d", scryptN, scryptR, scryptP)
+	default:
+		return ""
+	}
+}
+
+// NewSalt returns a random salt for DeriveKey
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// ReadPassphrase returns the passphrase in the PassphraseEnv environment
+// variable, or prompts for it on the terminal
+func ReadPassphrase(prompt string) ([]byte, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("tradestation: no terminal to prompt for the passphrase; set %s", PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// ConfiguredKeySource returns the key source of the profile chosen with
+// --profile
+func ConfiguredKeySource() (KeySource, error) {
+	return CurrentProfile().KeySource()
+}
+
+// keyCache holds the keys of profiles so a passphrase is only asked for and
+// derived once per process
+var keyCache struct {
+	sync.Mutex
+	keys map[string]*Key // key settings -> key
+}
+
+// Key returns the key of the key source of the profile, so a profile is the
+// KeySource of its own secrets. The key is derived once per process.
+func (p *Profile) Key() (*Key, error) {
+	return p.encryptionKey()
+}
+
+// encryptionKey returns the key of the key source of the profile
+func (p *Profile) encryptionKey() (*Key, error) {
+	settings := make([]string, len(keySettings))
+	for idx, key := range keySettings {
+		settings[idx] = p.GetString(key)
+	}
+	config := strings.Join(settings, "|")
+
+	keyCache.Lock()
+	defer keyCache.Unlock()
+
+	if key, ok := keyCache.keys[config]; ok {
+		return key, nil
+	}
+
+	src, err := p.KeySource()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := src.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	if keyCache.keys == nil {
+		keyCache.keys = make(map[string]*Key)
+	}
+	keyCache.keys[config] = key
+	return key, nil
+}
@@ -0,0 +1,387 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/browser"
+)
+
+// DefaultLoginTimeout is how long a login waits for the user to sign in
+const DefaultLoginTimeout = 5 * time.Minute
+
+// oauthLogin holds the secrets of a single login attempt
+type oauthLogin struct {
+	state string
+
+	// verifier is the PKCE code verifier; empty if PKCE is disabled
+	verifier string
+}
+
+// randomString returns `n` random bytes encoded as unpadded base64url
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// newLogin creates the state and, if enabled, the PKCE code verifier of a
+// login attempt
+func (api *API) newLogin() (*oauthLogin, error) {
+	state, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	login := &oauthLogin{state: state}
+	if api.pkce {
+		if login.verifier, err = randomString(32); err != nil {
+			return nil, err
+		}
+	}
+
+	return login, nil
+}
+
+// codeChallenge returns the S256 PKCE code challenge of `verifier`
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authenticate logs in to TradeStation and stores the issued token. The
+// user has until the login timeout to sign in.
+func (api *API) authenticate(ctx context.Context) error {
+	login, err := api.newLogin()
+	if err != nil {
+		api.logger.Error().Err(err).Msg("could not generate oauth state")
+		return err
+	}
+
+	authUrl, err := api.authorizeURL(login)
+	if err != nil {
+		api.logger.Error().Err(err).Msg("could not open client id")
+		return err
+	}
+	api.logger.Debug().Str("Auth URL", authUrl).Msg("authorization url")
+
+	loginCtx, cancel := context.WithTimeout(ctx, api.loginTimeout)
+	defer cancel()
+
+	var oauthCode string
+	if api.headless {
+		oauthCode, err = api.readAuthCode(loginCtx, authUrl, login)
+	} else {
+		oauthCode, err = api.listenForAuthCode(loginCtx, authUrl, login)
+	}
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			api.logger.Error().Dur("Timeout", api.loginTimeout).Msg("timed out waiting for login")
+			return ErrLoginTimeout
+		}
+		return err
+	}
+
+	return api.exchangeCode(ctx, oauthCode, login)
+}
+
+// authorizeURL returns the URL of the TradeStation login page
+func (api *API) authorizeURL(login *oauthLogin) (string, error) {
+	scopes := append([]string{"openid", "profile"}, api.scopes...)
+	if api.offline {
+		scopes = append(scopes, "offline_access")
+	}
+
+	opened := &openedSecrets{}
+	defer opened.destroy()
+
+	clientID, err := opened.open(api.clientID)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", clientID)
+	params.Set("redirect_uri", api.redirectURL)
+	params.Set("audience", TokenAudience)
+	params.Set("state", login.state)
+	params.Set("scope", strings.Join(scopes, " "))
+	if login.verifier != "" {
+		params.Set("code_challenge", codeChallenge(login.verifier))
+		params.Set("code_challenge_method", "S256")
+	}
+
+	return fmt.Sprintf("%s/authorize?%s", api.signinUrl, strings.ReplaceAll(params.Encode(), "+", "%20")), nil
+}
+
+// callbackAddr returns the local address and path the callback server
+// listens on to receive the OAuth redirect
+func (api *API) callbackAddr() (string, string, error) {
+	redirect, err := url.Parse(api.redirectURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid redirect url %q: %w", api.redirectURL, err)
+	}
+
+	host := redirect.Hostname()
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+
+	port := redirect.Port()
+	if port == "" {
+		port = "80"
+		if redirect.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	path := redirect.Path
+	if path == "" {
+		path = "/"
+	}
+
+	return net.JoinHostPort(host, port), path, nil
+}
+
+// listenForAuthCode opens the login page in a browser and waits for
+// TradeStation to redirect the browser back to a callback server. The
+// server only lives for the duration of the login.
+func (api *API) listenForAuthCode(ctx context.Context, authUrl string, login *oauthLogin) (string, error) {
+	addr, path, err := api.callbackAddr()
+	if err != nil {
+		api.logger.Error().Err(err).Msg("cannot determine callback server address")
+		return "", err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		api.logger.Error().Err(err).Str("Addr", addr).Msg("cannot listen for oauth redirect")
+		return "", err
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+
+		code, err := parseAuthParams(r.URL.Query(), login.state)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Authentication with TradeStation failed; return to the terminal for details.\n")
+		} else {
+			io.WriteString(w, "You can close this window; successfully authenticated with TradeStation!\n")
+		}
+
+		// only the first redirect counts
+		select {
+		case results <- result{code: code, err: err}:
+		default:
+		}
+	})
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	defer func() {
+		// let the browser receive its response before closing the server
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := browser.OpenURL(authUrl); err != nil {
+		api.logger.Warn().Err(err).Msg("could not open browser")
+		fmt.Fprintf(api.loginOutput, "Open the following URL in a browser and sign in to TradeStation:\n\n%s\n\n", authUrl)
+	}
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			api.logger.Error().Err(res.err).Msg("invalid oauth redirect")
+		}
+		return res.code, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// readAuthCode prints the login page URL and reads the URL the browser was
+// redirected to from the login input. It is used on machines without a
+// browser.
+func (api *API) readAuthCode(ctx context.Context, authUrl string, login *oauthLogin) (string, error) {
+	fmt.Fprintf(api.loginOutput, "Open the following URL in a browser and sign in to TradeStation:\n\n%s\n\n", authUrl)
+	fmt.Fprintf(api.loginOutput, "Then paste the whole URL you were redirected to: ")
+
+	type result struct {
+		line string
+		err  error
+	}
+
+	// the read cannot be interrupted; if `ctx` is cancelled first the
+	// goroutine finishes with the next line of input
+	lines := make(chan result, 1)
+	go func() {
+		line, err := bufio.NewReader(api.loginInput).ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		lines <- result{line: line, err: err}
+	}()
+
+	select {
+	case res := <-lines:
+		if res.err != nil {
+			api.logger.Error().Err(res.err).Msg("could not read oauth redirect")
+			return "", res.err
+		}
+		code, err := parseAuthResponse(res.line, login.state)
+		if err != nil {
+			api.logger.Error().Err(err).Msg("invalid oauth redirect")
+			return "", err
+		}
+		return code, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// parseAuthResponse extracts the authorization code from `input`, which is
+// either the redirect URL or its query string. A bare code is rejected: its
+// state cannot be checked against `stateKey`.
+func parseAuthResponse(input, stateKey string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", fmt.Errorf("%w: no redirect URL entered", ErrUnauthorized)
+	}
+
+	if !strings.Contains(input, "code=") && !strings.Contains(input, "error=") {
+		return "", fmt.Errorf("%w: paste the whole redirect URL, not just the code, so its state can be checked", ErrUnauthorized)
+	}
+
+	query := input
+	if idx := strings.Index(input, "?"); idx != -1 {
+		query = input[idx+1:]
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not parse redirect: %w", ErrUnauthorized, err)
+	}
+
+	return parseAuthParams(params, stateKey)
+}
+
+// parseAuthParams extracts the authorization code from the query
+// parameters of an OAuth redirect
+func parseAuthParams(params url.Values, stateKey string) (string, error) {
+	if params.Get("error") != "" {
+		return "", fmt.Errorf("%w: %s: %s", ErrUnauthorized, params.Get("error"), params.Get("error_description"))
+	}
+
+	if params.Get("state") != stateKey {
+		return "", ErrStateMismatch
+	}
+
+	if params.Get("code") == "" {
+		return "", fmt.Errorf("%w: redirect does not contain an authorization code", ErrUnauthorized)
+	}
+
+	return params.Get("code"), nil
+}
+
+// exchangeCode trades an authorization code for a token
+func (api *API) exchangeCode(ctx context.Context, oauthCode string, login *oauthLogin) error {
+	opened := &openedSecrets{}
+	defer opened.destroy()
+
+	clientID, err := opened.open(api.clientID)
+	if err != nil {
+		api.logger.Error().Err(err).Msg("could not open client id")
+		return err
+	}
+
+	form := map[string]string{
+		"grant_type":   "authorization_code",
+		"client_id":    clientID,
+		"code":         oauthCode,
+		"redirect_uri": api.redirectURL,
+	}
+	if api.clientSecret != nil {
+		clientSecret, err := opened.open(api.clientSecret)
+		if err != nil {
+			api.logger.Error().Err(err).Msg("could not open client secret")
+			return err
+		}
+		form["client_secret"] = clientSecret
+	}
+	if login.verifier != "" {
+		form["code_verifier"] = login.verifier
+	}
+
+	token := OAuthToken{}
+	curl := resty.NewWithClient(api.client.GetClient())
+	resp, err := curl.R().
+		SetContext(ctx).
+		SetFormData(form).
+		SetResult(&token).
+		Post(api.signinUrl + "/oauth/token")
+	if err != nil {
+		api.logger.Error().Err(err).Msg("err exchanging oauth code for a token")
+		return err
+	}
+	if err := checkResponse(resp, nil); err != nil {
+		api.logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("oauth code exchange failed")
+		return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	}
+
+	sealed := sealToken(&token)
+	if sealed == nil {
+		api.logger.Error().Msg("token response does not contain an access token")
+		return fmt.Errorf("%w: token response does not contain an access token", ErrUnauthorized)
+	}
+
+	api.setToken(sealed)
+	api.writeStateFile(sealed)
+
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+)
+
+// headlessLogin logs in to `srv` without a browser and answers the prompt
+// for the redirect with `answer` of the URL the login page redirected to.
+// `setup`, if not nil, changes the options of the client.
+func headlessLogin(t *testing.T, srv *tradestationtest.Server, setup func(*tradestation.Options), answer func(redirect *url.URL) string) error {
+	t.Helper()
+
+	input, answerWriter := io.Pipe()
+	promptReader, output := io.Pipe()
+	defer answerWriter.Close()
+	defer promptReader.Close()
+
+	opts := srv.Options()
+	opts.TokenStore = tradestation.NewMemoryTokenStore(nil)
+	opts.Headless = true
+	opts.LoginInput = input
+	opts.LoginOutput = output
+	if setup != nil {
+		setup(&opts)
+	}
+	api := tradestation.NewWithOptions(opts)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- api.CheckAuth()
+		output.Close()
+	}()
+
+	// the login page URL is printed on a line of its own
+	authURL := ""
+	scanner := bufio.NewScanner(promptReader)
+	for authURL == "" && scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), srv.SigninURL()) {
+			authURL = scanner.Text()
+		}
+	}
+	go io.Copy(io.Discard, promptReader)
+	if authURL == "" {
+		t.Fatalf("login URL was not printed: %v", <-done)
+	}
+
+	client := *srv.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", authURL, err)
+	}
+	resp.Body.Close()
+
+	redirect, err := resp.Location()
+	if err != nil {
+		t.Fatalf("login page did not redirect: %v", err)
+	}
+
+	io.WriteString(answerWriter, answer(redirect)+"\n")
+	return <-done
+}
+
+func TestHeadlessLogin(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		answer func(redirect *url.URL) string
+		want   error
+	}{
+		{
+			name:   "redirect URL",
+			answer: func(redirect *url.URL) string { return redirect.String() },
+		},
+		{
+			name:   "query string",
+			answer: func(redirect *url.URL) string { return redirect.RawQuery },
+		},
+		{
+			name:   "bare code",
+			answer: func(redirect *url.URL) string { return redirect.Query().Get("code") },
+			want:   tradestation.ErrUnauthorized,
+		},
+		{
+			name: "wrong state",
+			answer: func(redirect *url.URL) string {
+				return "code=" + url.QueryEscape(redirect.Query().Get("code")) + "&state=forged"
+			},
+			want: tradestation.ErrStateMismatch,
+		},
+		{
+			name: "missing state",
+			answer: func(redirect *url.URL) string {
+				return "code=" + url.QueryEscape(redirect.Query().Get("code"))
+			},
+			want: tradestation.ErrStateMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := headlessLogin(t, srv, nil, tt.answer)
+			if tt.want == nil && err != nil {
+				t.Fatalf("login failed: %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("login returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOnlyLoginNarrowsSavedToken(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	// the saved token was issued before read-only mode was turned on
+	store := tradestation.NewMemoryTokenStore(srv.Token())
+
+	opts := srv.Options()
+	opts.TokenStore = store
+	opts.ReadOnly = true
+	opts.Unattended = true
+	if err := tradestation.NewWithOptions(opts).CheckAuth(); !errors.Is(err, tradestation.ErrLoginRequired) {
+		t.Fatalf("unattended CheckAuth returned %v, want %v", err, tradestation.ErrLoginRequired)
+	}
+
+	setup := func(opts *tradestation.Options) {
+		opts.TokenStore = store
+		opts.ReadOnly = true
+	}
+	answer := func(redirect *url.URL) string { return redirect.String() }
+	if err := headlessLogin(t, srv, setup, answer); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	token, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for _, scope := range strings.Fields(token.Scope) {
+		if scope == tradestation.TradeScope {
+			t.Fatalf("saved token grants %q, want no %s scope", token.Scope, tradestation.TradeScope)
+		}
+	}
+}
+
+func TestExpiredTokenWithoutRefreshLogsIn(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	// issued without offline access
+	expired := srv.ExpiringToken(-time.Minute)
+	expired.RefreshToken = ""
+	store := tradestation.NewMemoryTokenStore(expired)
+
+	opts := srv.Options()
+	opts.TokenStore = store
+	opts.Unattended = true
+	if err := tradestation.NewWithOptions(opts).CheckAuth(); !errors.Is(err, tradestation.ErrLoginRequired) {
+		t.Fatalf("unattended CheckAuth returned %v, want %v", err, tradestation.ErrLoginRequired)
+	}
+
+	setup := func(opts *tradestation.Options) {
+		opts.TokenStore = store
+	}
+	answer := func(redirect *url.URL) string { return redirect.String() }
+	if err := headlessLogin(t, srv, setup, answer); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	token, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if token.AccessToken == expired.AccessToken {
+		t.Fatal("expired token was not replaced by the login")
+	}
+}
+
+func TestReadOnlyStatus(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	// the saved token was issued before read-only mode was turned on
+	store := tradestation.NewMemoryTokenStore(srv.Token())
+
+	opts := srv.Options()
+	opts.TokenStore = store
+	opts.ReadOnly = true
+	status := tradestation.NewWithOptions(opts).Status(context.Background())
+	if !status.HasToken() || status.Claims == nil {
+		t.Fatalf("Status reports no token, want the saved one")
+	}
+	if !errors.Is(status.Err, tradestation.ErrTradeScope) {
+		t.Errorf("Status.Err is %v, want %v", status.Err, tradestation.ErrTradeScope)
+	}
+	if status.Healthy() {
+		t.Errorf("Status is healthy, want a login to be required")
+	}
+
+	setup := func(opts *tradestation.Options) {
+		opts.TokenStore = store
+		opts.ReadOnly = true
+	}
+	answer := func(redirect *url.URL) string { return redirect.String() }
+	if err := headlessLogin(t, srv, setup, answer); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	status = tradestation.NewWithOptions(opts).Status(context.Background())
+	if status.Err != nil || !status.Healthy() {
+		t.Errorf("Status after login has error %v and healthy %t, want a healthy token", status.Err, status.Healthy())
+	}
+}
@@ -16,13 +16,16 @@
 package tradestation
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"github.com/shopspring/decimal"
 )
 
 type MarketFlags struct {
@@ -76,27 +79,27 @@ type quoteResponse struct {
 }
 
 type Quote struct {
-	Ask                 float64
+	Ask                 decimal.Decimal
 	AskSize             int64
-	Bid                 float64
+	Bid                 decimal.Decimal
 	BidSize             int64
-	Close               float64
-	High                float64
-	Low                 float64
-	High52Week          float64
+	Close               decimal.Decimal
+	High                decimal.Decimal
+	Low                 decimal.Decimal
+	High52Week          decimal.Decimal
 	High52WeekTimestamp time.Time
-	Last                float64
-	MinPrice            float64
-	MaxPrice            float64
+	Last                decimal.Decimal
+	MinPrice            decimal.Decimal
+	MaxPrice            decimal.Decimal
 	FirstNoticeDate     time.Time
 	LastTradingDate     time.Time
-	Low52Week           float64
+	Low52Week           decimal.Decimal
 	Low52WeekTimestamp  time.Time
 	Flags               *MarketFlags
-	NetChange           float64
-	NetChangePct        float64
-	Open                float64
-	PreviousClose       float64
+	NetChange           decimal.Decimal
+	NetChangePct        decimal.Decimal
+	Open                decimal.Decimal
+	PreviousClose       decimal.Decimal
 	PreviousVolume      int64
 	Restrictions        []string
 	Symbol              string
@@ -105,7 +108,7 @@ type Quote struct {
 	Volume              int64
 	LastSize            int64
 	LastVenue           string
-	VWAP                float64
+	VWAP                decimal.Decimal
 }
 
 func min(a, b int) int {
@@ -115,11 +118,20 @@ func min(a, b int) int {
 	return b
 }
 
+// GetQuotes returns the current quotes for the given `tickers`
 func (api *API) GetQuotes(tickers []string) ([]*Quote, error) {
-	api.CheckAuth()
+	return api.GetQuotesContext(context.Background(), tickers)
+}
+
+// GetQuotesContext is like GetQuotes but carries `ctx` into every request it makes
+func (api *API) GetQuotesContext(ctx context.Context, tickers []string) ([]*Quote, error) {
+	if err := api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
 	nyc, err := time.LoadLocation("America/New_York")
 	if err != nil {
-		log.Error().Err(err).Msg("cannot load America/New_York timezone")
+		api.logger.Error().Err(err).Msg("cannot load America/New_York timezone")
 		return nil, err
 	}
 
@@ -133,205 +145,339 @@ func (api *API) GetQuotes(tickers []string) ([]*Quote, error) {
 			Quotes: make([]*tsQuote, 0, len(batch)),
 			Errors: make([]*tsQuoteError, 0, len(batch)),
 		}
-		resp, err := api.client.R().
+		req, logger := api.newRequest(ctx)
+		resp, err := req.
 			SetResult(&quotes).
 			Get(fmt.Sprintf("/marketdata/quotes/%s", strings.Join(batch, ",")))
 		if err != nil {
-			log.Error().Err(err).Msg("account request failed")
+			logger.Error().Err(err).Msg("account request failed")
 			return nil, err
 		}
-		if resp.StatusCode() >= 400 {
-			log.Error().Int("StatusCode", resp.StatusCode()).Strs("Tickers", tickers).Msg("invalid response from /marketdata/quotes")
-			return nil, fmt.Errorf("%s %d", string(resp.Body()), resp.StatusCode())
+		if err := checkResponse(resp, nil); err != nil {
+			logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Strs("Tickers", tickers).Msg("invalid response from /marketdata/quotes")
+			return nil, err
 		}
 		if len(quotes.Errors) > 0 {
-			for _, err := range quotes.Errors {
-				log.Error().Str("ErrorMsg", err.Error).Str("Ticker", err.Symbol).Msg("quote request failed")
+			errs := make([]error, len(quotes.Errors))
+			for idx, err := range quotes.Errors {
+				logger.Error().Str("ErrorMsg", err.Error).Str("Ticker", err.Symbol).Msg("quote request failed")
+				errs[idx] = &QuoteError{Symbol: err.Symbol, Message: err.Error}
 			}
-			return nil, errors.New("quote download failed")
+			return nil, errors.Join(errs...)
 		}
 
 		myQuotes = append(myQuotes, quotes.Quotes...)
 	}
 
-	// set api on returned accounts
 	res := make([]*Quote, len(myQuotes))
 	for idx, quote := range myQuotes {
-		q := &Quote{
-			Flags:        quote.Flags,
-			Restrictions: quote.Restrictions,
-			Symbol:       quote.Symbol,
-			LastVenue:    quote.LastVenue,
+		if res[idx], err = convertQuote(quote, nyc, api.logger); err != nil {
+			return nil, err
 		}
+	}
 
-		if quote.Ask != "" {
-			if q.Ask, err = strconv.ParseFloat(quote.Ask, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Ask to float64")
-				return nil, err
-			}
+	return res, nil
+}
+
+// convertQuote converts a quote returned by TradeStation to America/New_York
+// time
+func convertQuote(quote *tsQuote, nyc *time.Location, logger zerolog.Logger) (*Quote, error) {
+	var err error
+
+	q := &Quote{
+		Flags:        quote.Flags,
+		Restrictions: quote.Restrictions,
+		Symbol:       quote.Symbol,
+		LastVenue:    quote.LastVenue,
+	}
+
+	if quote.Ask != "" {
+		if q.Ask, err = decimal.NewFromString(quote.Ask); err != nil {
+			logger.Error().Err(err).Msg("error converting Ask to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.AskSize != "" {
-			if q.AskSize, err = strconv.ParseInt(quote.AskSize, 10, 64); err != nil {
-				log.Error().Err(err).Msg("error converting AskSize to int64")
-				return nil, err
-			}
+	if quote.AskSize != "" {
+		if q.AskSize, err = strconv.ParseInt(quote.AskSize, 10, 64); err != nil {
+			logger.Error().Err(err).Msg("error converting AskSize to int64")
+			return nil, err
 		}
+	}
 
-		if quote.Bid != "" {
-			if q.Bid, err = strconv.ParseFloat(quote.Bid, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Bid to float64")
-				return nil, err
-			}
+	if quote.Bid != "" {
+		if q.Bid, err = decimal.NewFromString(quote.Bid); err != nil {
+			logger.Error().Err(err).Msg("error converting Bid to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.BidSize != "" {
-			if q.BidSize, err = strconv.ParseInt(quote.BidSize, 10, 64); err != nil {
-				log.Error().Err(err).Msg("error converting BidSize to int64")
-				return nil, err
-			}
+	if quote.BidSize != "" {
+		if q.BidSize, err = strconv.ParseInt(quote.BidSize, 10, 64); err != nil {
+			logger.Error().Err(err).Msg("error converting BidSize to int64")
+			return nil, err
 		}
+	}
 
-		if quote.Close != "" {
-			if q.Close, err = strconv.ParseFloat(quote.Close, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Close to float64")
-				return nil, err
-			}
+	if quote.Close != "" {
+		if q.Close, err = decimal.NewFromString(quote.Close); err != nil {
+			logger.Error().Err(err).Msg("error converting Close to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.High != "" {
-			if q.High, err = strconv.ParseFloat(quote.High, 64); err != nil {
-				log.Error().Err(err).Msg("error converting High to float64")
-				return nil, err
-			}
+	if quote.High != "" {
+		if q.High, err = decimal.NewFromString(quote.High); err != nil {
+			logger.Error().Err(err).Msg("error converting High to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.Low != "" {
-			if q.Low, err = strconv.ParseFloat(quote.Low, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Low to float64")
-				return nil, err
-			}
+	if quote.Low != "" {
+		if q.Low, err = decimal.NewFromString(quote.Low); err != nil {
+			logger.Error().Err(err).Msg("error converting Low to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.High52Week != "" {
-			if q.High52Week, err = strconv.ParseFloat(quote.High52Week, 64); err != nil {
-				log.Error().Err(err).Msg("error converting High52Week to float64")
-				return nil, err
-			}
+	if quote.High52Week != "" {
+		if q.High52Week, err = decimal.NewFromString(quote.High52Week); err != nil {
+			logger.Error().Err(err).Msg("error converting High52Week to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.Last != "" {
-			if q.Last, err = strconv.ParseFloat(quote.Last, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Last to float64")
-				return nil, err
-			}
+	if quote.Last != "" {
+		if q.Last, err = decimal.NewFromString(quote.Last); err != nil {
+			logger.Error().Err(err).Msg("error converting Last to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.MinPrice != "" {
-			if q.MinPrice, err = strconv.ParseFloat(quote.MinPrice, 64); err != nil {
-				log.Error().Err(err).Msg("error converting MinPrice to float64")
-				return nil, err
-			}
+	if quote.MinPrice != "" {
+		if q.MinPrice, err = decimal.NewFromString(quote.MinPrice); err != nil {
+			logger.Error().Err(err).Msg("error converting MinPrice to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.MaxPrice != "" {
-			if q.MaxPrice, err = strconv.ParseFloat(quote.MaxPrice, 64); err != nil {
-				log.Error().Err(err).Msg("error converting MaxPrice to float64")
-				return nil, err
-			}
+	if quote.MaxPrice != "" {
+		if q.MaxPrice, err = decimal.NewFromString(quote.MaxPrice); err != nil {
+			logger.Error().Err(err).Msg("error converting MaxPrice to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.Low52Week != "" {
-			if q.Low52Week, err = strconv.ParseFloat(quote.Low52Week, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Low52Week to float64")
-				return nil, err
-			}
+	if quote.Low52Week != "" {
+		if q.Low52Week, err = decimal.NewFromString(quote.Low52Week); err != nil {
+			logger.Error().Err(err).Msg("error converting Low52Week to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.NetChange != "" {
-			if q.NetChange, err = strconv.ParseFloat(quote.NetChange, 64); err != nil {
-				log.Error().Err(err).Msg("error converting NetChange to float64")
-				return nil, err
-			}
+	if quote.NetChange != "" {
+		if q.NetChange, err = decimal.NewFromString(quote.NetChange); err != nil {
+			logger.Error().Err(err).Msg("error converting NetChange to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.NetChangePct != "" {
-			if q.NetChangePct, err = strconv.ParseFloat(quote.NetChangePct, 64); err != nil {
-				log.Error().Err(err).Msg("error converting NetChangePct to float64")
-				return nil, err
-			}
+	if quote.NetChangePct != "" {
+		if q.NetChangePct, err = decimal.NewFromString(quote.NetChangePct); err != nil {
+			logger.Error().Err(err).Msg("error converting NetChangePct to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.Open != "" {
-			if q.Open, err = strconv.ParseFloat(quote.Open, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Open to float64")
-				return nil, err
-			}
+	if quote.Open != "" {
+		if q.Open, err = decimal.NewFromString(quote.Open); err != nil {
+			logger.Error().Err(err).Msg("error converting Open to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.PreviousClose != "" {
-			if q.PreviousClose, err = strconv.ParseFloat(quote.PreviousClose, 64); err != nil {
-				log.Error().Err(err).Msg("error converting PreviousClose to float64")
-				return nil, err
-			}
+	if quote.PreviousClose != "" {
+		if q.PreviousClose, err = decimal.NewFromString(quote.PreviousClose); err != nil {
+			logger.Error().Err(err).Msg("error converting PreviousClose to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.VWAP != "" {
-			if q.VWAP, err = strconv.ParseFloat(quote.VWAP, 64); err != nil {
-				log.Error().Err(err).Msg("error converting VWAP to float64")
-				return nil, err
-			}
+	if quote.VWAP != "" {
+		if q.VWAP, err = decimal.NewFromString(quote.VWAP); err != nil {
+			logger.Error().Err(err).Msg("error converting VWAP to decimal")
+			return nil, err
 		}
+	}
 
-		if quote.PreviousVolume != "" {
-			if q.PreviousVolume, err = strconv.ParseInt(quote.PreviousVolume, 10, 64); err != nil {
-				log.Error().Err(err).Msg("error converting PreviousVolume to int64")
-				return nil, err
-			}
+	if quote.Volume != "" {
+		if q.Volume, err = strconv.ParseInt(quote.Volume, 10, 64); err != nil {
+			logger.Error().Err(err).Msg("error converting Volume to int64")
+			return nil, err
 		}
+	}
 
-		if quote.High52WeekTimestamp != "" {
-			if q.High52WeekTimestamp, err = time.Parse("2006-01-02T15:04:05Z", quote.High52WeekTimestamp); err != nil {
-				log.Error().Err(err).Msg("error converting High52WeekTimestamp to time")
-				return nil, err
-			}
-			q.High52WeekTimestamp = q.High52WeekTimestamp.In(nyc)
+	if quote.LastSize != "" {
+		if q.LastSize, err = strconv.ParseInt(quote.LastSize, 10, 64); err != nil {
+			logger.Error().Err(err).Msg("error converting LastSize to int64")
+			return nil, err
 		}
+	}
 
-		if quote.FirstNoticeDate != "" {
-			if q.FirstNoticeDate, err = time.Parse("2006-01-02T15:04:05Z", quote.FirstNoticeDate); err != nil {
-				log.Error().Err(err).Msg("error converting FirstNoticeDate to time")
-				return nil, err
-			}
-			q.FirstNoticeDate = q.FirstNoticeDate.In(nyc)
+	if quote.PreviousVolume != "" {
+		if q.PreviousVolume, err = strconv.ParseInt(quote.PreviousVolume, 10, 64); err != nil {
+			logger.Error().Err(err).Msg("error converting PreviousVolume to int64")
+			return nil, err
 		}
+	}
 
-		if quote.LastTradingDate != "" {
-			if q.LastTradingDate, err = time.Parse("2006-01-02T15:04:05Z", quote.LastTradingDate); err != nil {
-				log.Error().Err(err).Msg("error converting LastTradingDate to time")
-				return nil, err
-			}
-			q.LastTradingDate = q.LastTradingDate.In(nyc)
+	if quote.High52WeekTimestamp != "" {
+		if q.High52WeekTimestamp, err = time.Parse("2006-01-02T15:04:05Z", quote.High52WeekTimestamp); err != nil {
+			logger.Error().Err(err).Msg("error converting High52WeekTimestamp to time")
+			return nil, err
 		}
+		q.High52WeekTimestamp = q.High52WeekTimestamp.In(nyc)
+	}
 
-		if quote.Low52WeekTimestamp != "" {
-			if q.Low52WeekTimestamp, err = time.Parse("2006-01-02T15:04:05Z", quote.Low52WeekTimestamp); err != nil {
-				log.Error().Err(err).Msg("error converting Low52WeekTimestamp to time")
-				return nil, err
-			}
-			q.Low52WeekTimestamp = q.Low52WeekTimestamp.In(nyc)
+	if quote.FirstNoticeDate != "" {
+		if q.FirstNoticeDate, err = time.Parse("2006-01-02T15:04:05Z", quote.FirstNoticeDate); err != nil {
+			logger.Error().Err(err).Msg("error converting FirstNoticeDate to time")
+			return nil, err
 		}
+		q.FirstNoticeDate = q.FirstNoticeDate.In(nyc)
+	}
+
+	if quote.LastTradingDate != "" {
+		if q.LastTradingDate, err = time.Parse("2006-01-02T15:04:05Z", quote.LastTradingDate); err != nil {
+			logger.Error().Err(err).Msg("error converting LastTradingDate to time")
+			return nil, err
+		}
+		q.LastTradingDate = q.LastTradingDate.In(nyc)
+	}
+
+	if quote.Low52WeekTimestamp != "" {
+		if q.Low52WeekTimestamp, err = time.Parse("2006-01-02T15:04:05Z", quote.Low52WeekTimestamp); err != nil {
+			logger.Error().Err(err).Msg("error converting Low52WeekTimestamp to time")
+			return nil, err
+		}
+		q.Low52WeekTimestamp = q.Low52WeekTimestamp.In(nyc)
+	}
+
+	if quote.TradeTime != "" {
+		if q.TradeTime, err = time.Parse("2006-01-02T15:04:05Z", quote.TradeTime); err != nil {
+			logger.Error().Err(err).Msg("error converting TradeTime to time")
+			return nil, err
+		}
+		q.TradeTime = q.TradeTime.In(nyc)
+	}
+
+	return q, nil
+}
+
+// maxStreamSymbols is the most symbols a single quote stream may subscribe to
+const maxStreamSymbols = 100
 
-		if quote.TradeTime != "" {
-			if q.TradeTime, err = time.Parse("2006-01-02T15:04:05Z", quote.TradeTime); err != nil {
-				log.Error().Err(err).Msg("error converting TradeTime to time")
-				return nil, err
+// QuoteEvent is delivered by StreamQuotes
+type QuoteEvent struct {
+	Type StreamEventType
+
+	// Quote is the full quote of a symbol after an update; set for
+	// STREAM_DATA events
+	Quote *Quote
+
+	// Err is set for STREAM_DISCONNECTED and STREAM_ERROR events
+	Err error
+}
+
+// StreamQuotes streams the quotes of `symbols`. TradeStation sends only the
+// fields that changed; they are merged into the last quote of the symbol so
+// every STREAM_DATA event carries a full quote. The stream reconnects when
+// it stalls or is disconnected. The returned channel is closed when `ctx`
+// is cancelled or the stream fails permanently.
+func (api *API) StreamQuotes(ctx context.Context, symbols []string) (<-chan *QuoteEvent, error) {
+	if len(symbols) == 0 || len(symbols) > maxStreamSymbols {
+		return nil, fmt.Errorf("tradestation: quote streams need 1 to %d symbols, got %d", maxStreamSymbols, len(symbols))
+	}
+
+	nyc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		api.logger.Error().Err(err).Msg("cannot load America/New_York timezone")
+		return nil, err
+	}
+
+	if err := api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
+
+	events := make(chan *QuoteEvent, len(symbols))
+	send := func(ctx context.Context, event *QuoteEvent) error {
+		select {
+		case events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	logger := api.logger.With().Strs("Symbols", symbols).Logger()
+	quotes := make(map[string]*tsQuote, len(symbols))
+
+	s := &stream{
+		api:    api,
+		path:   "/marketdata/stream/quotes/" + strings.Join(symbols, ","),
+		logger: logger,
+		onData: func(ctx context.Context, raw json.RawMessage) error {
+			merged, err := mergeQuote(quotes, raw)
+			if err != nil {
+				logger.Warn().Err(err).Msg("ignoring malformed quote")
+				return nil
+			}
+
+			quote, err := convertQuote(merged, nyc, logger)
+			if err != nil {
+				return send(ctx, &QuoteEvent{Type: STREAM_ERROR, Err: err})
 			}
-			q.TradeTime = q.TradeTime.In(nyc)
+			return send(ctx, &QuoteEvent{Type: STREAM_DATA, Quote: quote})
+		},
+		onEvent: func(ctx context.Context, eventType StreamEventType, err error) {
+			send(ctx, &QuoteEvent{Type: eventType, Err: err})
+		},
+	}
+
+	go func() {
+		defer close(events)
+		s.run(ctx)
+	}()
+
+	return events, nil
+}
+
+// mergeQuote applies the quote update `raw` to the last quote of its symbol
+// in `quotes` and returns the merged quote
+func mergeQuote(quotes map[string]*tsQuote, raw json.RawMessage) (*tsQuote, error) {
+	var update struct {
+		Symbol string
+	}
+	if err := json.Unmarshal(raw, &update); err != nil {
+		return nil, err
+	}
+
+	// copy the last quote; quotes already delivered share its flags and
+	// restrictions
+	merged := &tsQuote{}
+	if last, ok := quotes[update.Symbol]; ok {
+		*merged = *last
+		if last.Flags != nil {
+			flags := *last.Flags
+			merged.Flags = &flags
 		}
+		merged.Restrictions = append([]string(nil), last.Restrictions...)
+	}
 
-		res[idx] = q
+	if err := json.Unmarshal(raw, merged); err != nil {
+		return nil, err
 	}
 
-	return res, nil
+	quotes[update.Symbol] = merged
+	return merged, nil
 }
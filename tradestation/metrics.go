@@ -0,0 +1,192 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/penny-vault/tradestation/internal/promutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are the Prometheus metrics of an API client. Pass them to the
+// client with Options.Metrics; several clients may share the same Metrics.
+type Metrics struct {
+	// Requests counts every request attempt by endpoint group, method and
+	// status code. Requests that failed without a response have the status
+	// "error".
+	Requests *prometheus.CounterVec
+
+	// RequestDuration observes the latency of every request attempt
+	RequestDuration *prometheus.HistogramVec
+
+	// Retries counts requests that were retried by endpoint group
+	Retries *prometheus.CounterVec
+
+	// TokenRefreshes counts access token refreshes by result
+	TokenRefreshes *prometheus.CounterVec
+
+	// Orders counts orders by lifecycle event: placed, filled and rejected
+	Orders *prometheus.CounterVec
+}
+
+// NewMetrics creates the client metrics and registers them with `reg`.
+// Metrics that are already registered with `reg` are reused, so calling
+// NewMetrics more than once with the same registry is safe.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	return &Metrics{
+		Requests: promutil.Register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "tradestation",
+			Name:      "requests_total",
+			Help:      "Number of requests sent to the TradeStation API.",
+		}, []string{"endpoint", "method", "status"})),
+		RequestDuration: promutil.Register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "tradestation",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of requests sent to the TradeStation API.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"endpoint", "method"})),
+		Retries: promutil.Register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "tradestation",
+			Name:      "retries_total",
+			Help:      "Number of TradeStation API requests that were retried.",
+		}, []string{"endpoint"})),
+		TokenRefreshes: promutil.Register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "tradestation",
+			Name:      "token_refreshes_total",
+			Help:      "Number of access token refreshes.",
+		}, []string{"result"})),
+		Orders: promutil.Register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "tradestation",
+			Name:      "orders_total",
+			Help:      "Number of orders by lifecycle event.",
+		}, []string{"event"})),
+	}
+}
+
+// instrument installs the request and retry metrics on the http client
+func (api *API) instrument() {
+	if api.metrics == nil {
+		return
+	}
+
+	api.client.OnAfterResponse(func(c *resty.Client, resp *resty.Response) error {
+		api.countResponse(resp)
+		return nil
+	})
+
+	api.client.OnError(func(req *resty.Request, err error) {
+		var respErr *resty.ResponseError
+		if errors.As(err, &respErr) {
+			// the response was already counted
+			return
+		}
+		api.metrics.Requests.WithLabelValues(string(endpointGroup(req.URL)), req.Method, "error").Inc()
+	})
+
+	api.client.AddRetryHook(func(resp *resty.Response, err error) {
+		if resp != nil && resp.Request != nil {
+			api.metrics.Retries.WithLabelValues(string(endpointGroup(resp.Request.URL))).Inc()
+		}
+	})
+}
+
+// countResponse records a request attempt that received a response.
+// Streams do not let resty parse their response, which skips the
+// OnAfterResponse hooks, so they call it themselves.
+func (api *API) countResponse(resp *resty.Response) {
+	if api.metrics == nil {
+		return
+	}
+
+	group := string(endpointGroup(resp.Request.URL))
+	api.metrics.Requests.WithLabelValues(group, resp.Request.Method, strconv.Itoa(resp.StatusCode())).Inc()
+	api.metrics.RequestDuration.WithLabelValues(group, resp.Request.Method).Observe(resp.Time().Seconds())
+}
+
+// countTokenRefresh records the result of an access token refresh
+func (api *API) countTokenRefresh(err error) {
+	if api.metrics == nil {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	api.metrics.TokenRefreshes.WithLabelValues(result).Inc()
+}
+
+// ordersPlaced records orders accepted by TradeStation. Accepted orders are
+// tracked until they are seen filled or rejected by trackOrders.
+func (api *API) ordersPlaced(orders []*Order) {
+	if api.metrics == nil {
+		return
+	}
+
+	api.ordersMu.Lock()
+	defer api.ordersMu.Unlock()
+
+	if api.pendingOrders == nil {
+		api.pendingOrders = make(map[string]bool)
+	}
+
+	for _, order := range orders {
+		if order.Status == REJECTED {
+			api.metrics.Orders.WithLabelValues("rejected").Inc()
+			continue
+		}
+		api.metrics.Orders.WithLabelValues("placed").Inc()
+		api.pendingOrders[order.OrderID] = true
+	}
+}
+
+// ordersRejected records `count` orders as rejected if `err` is an order
+// rejection
+func (api *API) ordersRejected(err error, count int) {
+	if api.metrics == nil || !errors.Is(err, ErrOrderRejected) {
+		return
+	}
+	api.metrics.Orders.WithLabelValues("rejected").Add(float64(count))
+}
+
+// trackOrders records fills and rejections of previously placed orders
+func (api *API) trackOrders(orders []*Order) {
+	if api.metrics == nil {
+		return
+	}
+
+	api.ordersMu.Lock()
+	defer api.ordersMu.Unlock()
+
+	for _, order := range orders {
+		if !api.pendingOrders[order.OrderID] {
+			continue
+		}
+
+		switch order.Status {
+		case FILLED:
+			api.metrics.Orders.WithLabelValues("filled").Inc()
+		case REJECTED:
+			api.metrics.Orders.WithLabelValues("rejected").Inc()
+		default:
+			continue
+		}
+		delete(api.pendingOrders, order.OrderID)
+	}
+}
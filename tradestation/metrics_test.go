@@ -0,0 +1,66 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsCountStreams(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	metrics := tradestation.NewMetrics(prometheus.NewRegistry())
+	opts := srv.Options()
+	opts.Metrics = metrics
+	api := tradestation.NewWithOptions(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, err := api.StreamQuotes(ctx, []string{"SPY"})
+	if err != nil {
+		t.Fatalf("StreamQuotes: %v", err)
+	}
+	for event := range events {
+		if event.Type == tradestation.STREAM_DATA {
+			break
+		}
+		if event.Err != nil {
+			t.Fatalf("stream failed: %v", event.Err)
+		}
+	}
+	cancel()
+
+	// a single stream connection; the quote streams are in the market data
+	// group
+	requests := metrics.Requests.WithLabelValues(string(tradestation.MARKET_DATA), "GET", "200")
+	if count := testutil.ToFloat64(requests); count != 1 {
+		t.Errorf("%s requests counted %v times, want 1", tradestation.MARKET_DATA, count)
+	}
+	if count := testutil.CollectAndCount(metrics.RequestDuration); count != 1 {
+		t.Errorf("request durations have %d series, want 1", count)
+	}
+}
@@ -16,12 +16,13 @@
 package tradestation
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"strconv"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"github.com/shopspring/decimal"
 )
 
 type Action string
@@ -90,21 +91,21 @@ type OrderConfirm struct {
 	BaseCurrency             string
 	CounterCurrency          string
 	Currency                 string
-	DebitCreditEstimatedCost float64
-	EstimatedCommission      float64
-	EstimatedCost            float64
-	EstimatedPrice           float64
+	DebitCreditEstimatedCost decimal.Decimal
+	EstimatedCommission      decimal.Decimal
+	EstimatedCost            decimal.Decimal
+	EstimatedPrice           decimal.Decimal
 	InitialMarginDisplay     string
 	ExpirationDate           time.Time
 	Quantity                 int64
 	Symbol                   string
 	TradeAction              Action
-	LimitPrice               float64
+	LimitPrice               decimal.Decimal
 	OrderAssetCategory       string
 	OrderConfirmID           string
 	ProductCurrency          string
 	Route                    string
-	StopPrice                float64
+	StopPrice                decimal.Decimal
 	SummaryMessage           string
 	TimeInForceDur           TimeInForceDuration
 	TimeInForceExpiration    time.Time
@@ -133,14 +134,103 @@ type tsOrderRequest struct {
 
 type OrderRequest struct {
 	AccountID      string
-	LimitPrice     float64
+	LimitPrice     decimal.Decimal
 	OrderConfirmID string
 	OrderType      TSOrderType
 	Quantity       int64
-	StopPrice      float64
+	StopPrice      decimal.Decimal
 	Symbol         string
 	TimeInForceDur TimeInForceDuration
 	TradeAction    Action
+
+	// TickSize is the minimum price increment of the instrument. Prices are
+	// rounded to a multiple of TickSize before the order is sent; if zero
+	// the US equity tick size is used (see EquityTickSize). Options and
+	// futures orders must set it.
+	TickSize decimal.Decimal
+}
+
+var (
+	pennyTick    = decimal.New(1, -2)
+	subPennyTick = decimal.New(1, -4)
+)
+
+// EquityTickSize returns the minimum price increment of a US equity trading
+// at `price`: $0.01 at or above $1.00 and $0.0001 below
+func EquityTickSize(price decimal.Decimal) decimal.Decimal {
+	if price.LessThan(decimal.NewFromInt(1)) {
+		return subPennyTick
+	}
+	return pennyTick
+}
+
+// RoundToTick rounds `price` to a multiple of `tick`. If `up` is true the
+// price is rounded up, otherwise it is rounded down.
+func RoundToTick(price, tick decimal.Decimal, up bool) decimal.Decimal {
+	if !tick.IsPositive() {
+		return price
+	}
+	ticks := price.Div(tick)
+	if up {
+		return ticks.Ceil().Mul(tick)
+	}
+	return ticks.Floor().Mul(tick)
+}
+
+// tickSize returns the tick size used for `price`
+func (req *OrderRequest) tickSize(price decimal.Decimal) decimal.Decimal {
+	if req.TickSize.IsPositive() {
+		return req.TickSize
+	}
+	return EquityTickSize(price)
+}
+
+// buying returns true if the order increases a long position or covers a
+// short one
+func (req *OrderRequest) buying() bool {
+	return req.TradeAction == BUY || req.TradeAction == BUYTOCOVER
+}
+
+// formatPrice rounds `price` to the tick size of the order and formats it
+// with as many decimal places as the tick size. Limit prices are rounded so
+// that the order is never less favorable than requested: down for buys and
+// up for sells. Stop prices are rounded to the nearest tick.
+func (req *OrderRequest) formatPrice(price decimal.Decimal, limit bool) string {
+	tick := req.tickSize(price)
+
+	var rounded decimal.Decimal
+	if limit {
+		rounded = RoundToTick(price, tick, !req.buying())
+	} else {
+		rounded = price.Div(tick).Round(0).Mul(tick)
+	}
+
+	places := int32(0)
+	if tick.Exponent() < 0 {
+		places = -tick.Exponent()
+	}
+	return rounded.StringFixed(places)
+}
+
+// orderSubmitTimeout bounds how long an order submission may take once it
+// has been sent
+const orderSubmitTimeout = 30 * time.Second
+
+// detachedContext keeps the values of its parent but is never cancelled
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// submitContext returns the context used to send orders to TradeStation.
+// Cancelling a request that is already in flight leaves us unable to tell
+// whether the orders were accepted, so the submission is allowed to finish
+// (bounded by orderSubmitTimeout) even if `ctx` is cancelled.
+func submitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, orderSubmitTimeout)
 }
 
 type confirmOrderResponse struct {
@@ -148,22 +238,30 @@ type confirmOrderResponse struct {
 }
 
 func (req *OrderRequest) toTsOrderRequest() *tsOrderRequest {
-	return &tsOrderRequest{
+	tsReq := &tsOrderRequest{
 		AccountID:      req.AccountID,
-		LimitPrice:     fmt.Sprintf("%.2f", req.LimitPrice),
 		OrderConfirmID: req.OrderConfirmID,
 		OrderType:      req.OrderType,
 		Quantity:       fmt.Sprintf("%d", req.Quantity),
-		StopPrice:      fmt.Sprintf("%.2f", req.StopPrice),
 		Symbol:         req.Symbol,
 		TimeInForce: tsTimeInForce{
 			Duration: req.TimeInForceDur,
 		},
 		TradeAction: req.TradeAction,
 	}
+
+	if req.OrderType == LIMIT || req.OrderType == STOP_LIMIT {
+		tsReq.LimitPrice = req.formatPrice(req.LimitPrice, true)
+	}
+
+	if req.OrderType == STOP || req.OrderType == STOP_LIMIT {
+		tsReq.StopPrice = req.formatPrice(req.StopPrice, false)
+	}
+
+	return tsReq
 }
 
-func convertOrderConfirm(order *tsOrderConfirm) (*OrderConfirm, error) {
+func convertOrderConfirm(order *tsOrderConfirm, logger zerolog.Logger) (*OrderConfirm, error) {
 	var err error
 	confirm := &OrderConfirm{
 		AccountCurrency:      order.AccountCurrency,
@@ -181,50 +279,50 @@ func convertOrderConfirm(order *tsOrderConfirm) (*OrderConfirm, error) {
 	}
 
 	if order.DebitCreditEstimatedCost != "" {
-		if confirm.DebitCreditEstimatedCost, err = strconv.ParseFloat(order.DebitCreditEstimatedCost, 64); err != nil {
-			log.Error().Err(err).Msg("error converting DebitCreditEstimatedCost to float64")
+		if confirm.DebitCreditEstimatedCost, err = decimal.NewFromString(order.DebitCreditEstimatedCost); err != nil {
+			logger.Error().Err(err).Msg("error converting DebitCreditEstimatedCost to decimal")
 			return nil, err
 		}
 	}
 
 	if order.EstimatedCommission != "" {
-		if confirm.EstimatedCommission, err = strconv.ParseFloat(order.EstimatedCommission, 64); err != nil {
-			log.Error().Err(err).Msg("error converting EstimatedCommission to float64")
+		if confirm.EstimatedCommission, err = decimal.NewFromString(order.EstimatedCommission); err != nil {
+			logger.Error().Err(err).Msg("error converting EstimatedCommission to decimal")
 			return nil, err
 		}
 	}
 
 	if order.EstimatedCost != "" {
-		if confirm.EstimatedCost, err = strconv.ParseFloat(order.EstimatedCost, 64); err != nil {
-			log.Error().Err(err).Msg("error converting EstimatedCost to float64")
+		if confirm.EstimatedCost, err = decimal.NewFromString(order.EstimatedCost); err != nil {
+			logger.Error().Err(err).Msg("error converting EstimatedCost to decimal")
 			return nil, err
 		}
 	}
 
 	if order.EstimatedPrice != "" {
-		if confirm.EstimatedPrice, err = strconv.ParseFloat(order.EstimatedPrice, 64); err != nil {
-			log.Error().Err(err).Msg("error converting EstimatedPrice to float64")
+		if confirm.EstimatedPrice, err = decimal.NewFromString(order.EstimatedPrice); err != nil {
+			logger.Error().Err(err).Msg("error converting EstimatedPrice to decimal")
 			return nil, err
 		}
 	}
 
 	if order.LimitPrice != "" {
-		if confirm.LimitPrice, err = strconv.ParseFloat(order.LimitPrice, 64); err != nil {
-			log.Error().Err(err).Msg("error converting LimitPrice to float64")
+		if confirm.LimitPrice, err = decimal.NewFromString(order.LimitPrice); err != nil {
+			logger.Error().Err(err).Msg("error converting LimitPrice to decimal")
 			return nil, err
 		}
 	}
 
 	if order.StopPrice != "" {
-		if confirm.StopPrice, err = strconv.ParseFloat(order.StopPrice, 64); err != nil {
-			log.Error().Err(err).Msg("error converting StopPrice to float64")
+		if confirm.StopPrice, err = decimal.NewFromString(order.StopPrice); err != nil {
+			logger.Error().Err(err).Msg("error converting StopPrice to decimal")
 			return nil, err
 		}
 	}
 
 	if order.TimeInForce.Expiration != "" {
 		if confirm.TimeInForceExpiration, err = time.Parse("2006-01-02T15:04:05Z", order.TimeInForce.Expiration); err != nil {
-			log.Error().Err(err).Msg("error converting ExpirationDate to time")
+			logger.Error().Err(err).Msg("error converting ExpirationDate to time")
 			return nil, err
 		}
 	}
@@ -238,29 +336,51 @@ func convertOrderConfirm(order *tsOrderConfirm) (*OrderConfirm, error) {
 
 		if l.ExpirationDate != "" {
 			if confirm.ExpirationDate, err = time.Parse("2006-01-02T15:04:05Z", l.ExpirationDate); err != nil {
-				log.Error().Err(err).Msg("error converting ExpirationDate to time")
+				logger.Error().Err(err).Msg("error converting ExpirationDate to time")
 				return nil, err
 			}
 		}
 
 		if l.Quantity != "" {
 			if confirm.Quantity, err = strconv.ParseInt(l.Quantity, 0, 64); err != nil {
-				log.Error().Err(err).Msg("error converting Quantity to int64")
+				logger.Error().Err(err).Msg("error converting Quantity to int64")
 				return nil, err
 			}
 		}
 	default:
-		log.Error().Int("Len OrderLegs", len(order.Legs)).Msg("order legs unexpected size, should be 1")
+		logger.Error().Int("Len OrderLegs", len(order.Legs)).Msg("order legs unexpected size, should be 1")
 	}
 
 	return confirm, nil
 }
 
+// checkTrade fails with ErrReadOnly if the client may not use the order
+// execution endpoints, all of which require TradeScope
+func (account *Account) checkTrade() error {
+	if account.api.readOnly {
+		logger := account.logger()
+		logger.Error().Msg("order execution is disabled for read-only clients")
+		return ErrReadOnly
+	}
+	return nil
+}
+
 // ConfirmOrder returns estimated cost and commission information for an order
 // without the order actually being placed. Request valid for Market, Limit,
 // Stop Market, Stop Limit, Options, and Order Sends Order (OSO) order types.
 func (account *Account) ConfirmOrder(order *OrderRequest) (*OrderConfirm, error) {
-	account.api.CheckAuth()
+	return account.ConfirmOrderContext(context.Background(), order)
+}
+
+// ConfirmOrderContext is like ConfirmOrder but carries `ctx` into every request it makes
+func (account *Account) ConfirmOrderContext(ctx context.Context, order *OrderRequest) (*OrderConfirm, error) {
+	if err := account.checkTrade(); err != nil {
+		return nil, err
+	}
+
+	if err := account.api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
 
 	confirms := confirmOrderResponse{
 		Confirmations: make([]*tsOrderConfirm, 0, 1),
@@ -269,21 +389,25 @@ func (account *Account) ConfirmOrder(order *OrderRequest) (*OrderConfirm, error)
 	tsOrder := order.toTsOrderRequest()
 	tsOrder.AccountID = account.AccountID
 
-	resp, err := account.api.client.R().
+	req, logger := account.newRequest(ctx)
+	resp, err := req.
 		SetBody(tsOrder).
 		SetResult(&confirms).
 		Post("/orderexecution/orderconfirm")
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		log.Error().Int("StatusCode", resp.StatusCode()).Str("Body", string(resp.Body())).Msg("Received invalid status code")
-		return nil, fmt.Errorf("%s %d", resp.Request.URL, resp.StatusCode())
+	if err := checkResponse(resp, nil); err != nil {
+		logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("Received invalid status code")
+		return nil, err
+	}
+	if len(confirms.Confirmations) == 0 {
+		return nil, newAPIError(resp, nil)
 	}
 
 	// convert to OrderConfirm object
-	return convertOrderConfirm(confirms.Confirmations[0])
+	return convertOrderConfirm(confirms.Confirmations[0], logger)
 }
 
 // ConfirmGroupOrder returns estimated cost and commission information for a group of
@@ -291,7 +415,18 @@ func (account *Account) ConfirmOrder(order *OrderRequest) (*OrderConfirm, error)
 // Limit, Stop Market, Stop Limit, Options, and Order Sends Order (OSO) order
 // types.
 func (account *Account) ConfirmGroupOrder(orders []*OrderRequest) ([]*OrderConfirm, error) {
-	account.api.CheckAuth()
+	return account.ConfirmGroupOrderContext(context.Background(), orders)
+}
+
+// ConfirmGroupOrderContext is like ConfirmGroupOrder but carries `ctx` into every request it makes
+func (account *Account) ConfirmGroupOrderContext(ctx context.Context, orders []*OrderRequest) ([]*OrderConfirm, error) {
+	if err := account.checkTrade(); err != nil {
+		return nil, err
+	}
+
+	if err := account.api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
 
 	confirms := confirmOrderResponse{
 		Confirmations: make([]*tsOrderConfirm, 0, len(orders)),
@@ -303,7 +438,8 @@ func (account *Account) ConfirmGroupOrder(orders []*OrderRequest) ([]*OrderConfi
 		tsOrders[idx].AccountID = account.AccountID
 	}
 
-	resp, err := account.api.client.R().
+	req, logger := account.newRequest(ctx)
+	resp, err := req.
 		SetBody(map[string]any{
 			"Orders": tsOrders,
 			"Type":   "NORMAL",
@@ -311,17 +447,17 @@ func (account *Account) ConfirmGroupOrder(orders []*OrderRequest) ([]*OrderConfi
 		SetResult(&confirms).
 		Post("/orderexecution/ordergroupconfirm")
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		log.Error().Int("StatusCode", resp.StatusCode()).Msg("Received invalid status code")
-		return nil, fmt.Errorf("%s %d", resp.Request.URL, resp.StatusCode())
+	if err := checkResponse(resp, nil); err != nil {
+		logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("Received invalid status code")
+		return nil, err
 	}
 
 	res := make([]*OrderConfirm, len(confirms.Confirmations))
 	for idx, confirm := range confirms.Confirmations {
-		c, err := convertOrderConfirm(confirm)
+		c, err := convertOrderConfirm(confirm, logger)
 		if err != nil {
 			return nil, err
 		}
@@ -334,47 +470,83 @@ func (account *Account) ConfirmGroupOrder(orders []*OrderRequest) ([]*OrderConfi
 // valid for Market, Limit, Stop Market, Stop Limit, Options and Order Sends
 // Order (OSO) order types.
 func (account *Account) PlaceOrder(order *OrderRequest) (*Order, error) {
-	account.api.CheckAuth()
+	return account.PlaceOrderContext(context.Background(), order)
+}
+
+// PlaceOrderContext is like PlaceOrder but carries `ctx` into every request it makes.
+// Once the order has been sent it is no longer abandoned when `ctx` is
+// cancelled; see submitContext.
+func (account *Account) PlaceOrderContext(ctx context.Context, order *OrderRequest) (*Order, error) {
+	if err := account.checkTrade(); err != nil {
+		return nil, err
+	}
+
+	if err := account.api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
 
 	orderResp := orderResponse{
-		Errors: make([]*tsError, 0, 1),
+		Errors: make([]*ErrorDetail, 0, 1),
 		Orders: make([]*tsOrder, 0, 1),
 	}
 
 	tsOrder := order.toTsOrderRequest()
 	tsOrder.AccountID = account.AccountID
 
-	resp, err := account.api.client.R().
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	submitCtx, cancel := submitContext(ctx)
+	defer cancel()
+
+	req, logger := account.newRequest(submitCtx)
+	resp, err := req.
 		SetBody(tsOrder).
 		SetResult(&orderResp).
 		Post("/orderexecution/orders")
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		log.Error().Int("StatusCode", resp.StatusCode()).Msg("Received invalid status code")
-		return nil, fmt.Errorf("%s %d", resp.Request.URL, resp.StatusCode())
-	}
-	if len(orderResp.Errors) > 0 {
-		for _, err := range orderResp.Errors {
-			log.Error().Str("ErrorType", err.Error).Msg(err.Message)
-		}
-		return nil, errors.New("received errors in place order group")
+	if err := checkOrderResponse(resp, orderResp.Errors); err != nil {
+		logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("order was not accepted")
+		account.api.ordersRejected(err, 1)
+		return nil, err
 	}
 
-	res, err := convertOrders(orderResp.Orders)
-	return res[0], err
+	res, err := convertOrders(orderResp.Orders, logger)
+	if err != nil {
+		return nil, err
+	}
+	account.api.ordersPlaced(res)
+	if len(res) == 0 {
+		return nil, newAPIError(resp, nil)
+	}
+	return res[0], nil
 }
 
 // Creates a new brokerage order. Request valid for all account types. Request
 // valid for Market, Limit, Stop Market, Stop Limit, Options and Order Sends
 // Order (OSO) order types.
 func (account *Account) PlaceGroupOrder(orders []*OrderRequest) ([]*Order, error) {
-	account.api.CheckAuth()
+	return account.PlaceGroupOrderContext(context.Background(), orders)
+}
+
+// PlaceGroupOrderContext is like PlaceGroupOrder but carries `ctx` into every request it makes.
+// Once the order has been sent it is no longer abandoned when `ctx` is
+// cancelled; see submitContext.
+func (account *Account) PlaceGroupOrderContext(ctx context.Context, orders []*OrderRequest) ([]*Order, error) {
+	if err := account.checkTrade(); err != nil {
+		return nil, err
+	}
+
+	if err := account.api.CheckAuthContext(ctx); err != nil {
+		return nil, err
+	}
 
 	orderResp := orderResponse{
-		Errors: make([]*tsError, 0, 1),
+		Errors: make([]*ErrorDetail, 0, 1),
 		Orders: make([]*tsOrder, 0, len(orders)),
 	}
 
@@ -384,7 +556,15 @@ func (account *Account) PlaceGroupOrder(orders []*OrderRequest) ([]*Order, error
 		tsOrders[idx].AccountID = account.AccountID
 	}
 
-	resp, err := account.api.client.R().
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	submitCtx, cancel := submitContext(ctx)
+	defer cancel()
+
+	req, logger := account.newRequest(submitCtx)
+	resp, err := req.
 		SetBody(map[string]any{
 			"Orders": tsOrders,
 			"Type":   "NORMAL",
@@ -392,19 +572,19 @@ func (account *Account) PlaceGroupOrder(orders []*OrderRequest) ([]*Order, error
 		SetResult(&orderResp).
 		Post("/orderexecution/ordergroups")
 	if err != nil {
-		log.Error().Err(err).Msg("account request failed")
+		logger.Error().Err(err).Msg("account request failed")
 		return nil, err
 	}
-	if resp.StatusCode() >= 400 {
-		log.Error().Int("StatusCode", resp.StatusCode()).Msg("Received invalid status code")
-		return nil, fmt.Errorf("%s %d", resp.Request.URL, resp.StatusCode())
-	}
-	if len(orderResp.Errors) > 0 {
-		for _, err := range orderResp.Errors {
-			log.Error().Str("ErrorType", err.Error).Msg(err.Message)
-		}
-		return nil, errors.New("received errors in place order group")
+	if err := checkOrderResponse(resp, orderResp.Errors); err != nil {
+		logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("order was not accepted")
+		account.api.ordersRejected(err, len(orders))
+		return nil, err
 	}
 
-	return convertOrders(orderResp.Orders)
+	res, err := convertOrders(orderResp.Orders, logger)
+	if err != nil {
+		return nil, err
+	}
+	account.api.ordersPlaced(res)
+	return res, nil
 }
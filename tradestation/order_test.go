@@ -0,0 +1,132 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestEquityTickSize(t *testing.T) {
+	tests := []struct {
+		price string
+		want  string
+	}{
+		{"0.0001", "0.0001"},
+		{"0.9999", "0.0001"},
+		{"1", "0.01"},
+		{"1.00", "0.01"},
+		{"412.37", "0.01"},
+	}
+
+	for _, tt := range tests {
+		got := EquityTickSize(decimal.RequireFromString(tt.price))
+		if !got.Equal(decimal.RequireFromString(tt.want)) {
+			t.Errorf("EquityTickSize(%s) = %s, want %s", tt.price, got, tt.want)
+		}
+	}
+}
+
+func TestRoundToTick(t *testing.T) {
+	tests := []struct {
+		price string
+		tick  string
+		up    bool
+		want  string
+	}{
+		{"412.375", "0.01", false, "412.37"},
+		{"412.375", "0.01", true, "412.38"},
+		{"412.37", "0.01", false, "412.37"},
+		{"412.37", "0.01", true, "412.37"},
+		{"0.12345", "0.0001", false, "0.1234"},
+		{"0.12345", "0.0001", true, "0.1235"},
+		{"4512.30", "0.25", false, "4512.25"},
+		{"4512.30", "0.25", true, "4512.50"},
+		{"4512.50", "0.25", true, "4512.50"},
+		{"412.375", "0", true, "412.375"},
+	}
+
+	for _, tt := range tests {
+		got := RoundToTick(decimal.RequireFromString(tt.price), decimal.RequireFromString(tt.tick), tt.up)
+		if !got.Equal(decimal.RequireFromString(tt.want)) {
+			t.Errorf("RoundToTick(%s, %s, %t) = %s, want %s", tt.price, tt.tick, tt.up, got, tt.want)
+		}
+	}
+}
+
+func TestOrderPrices(t *testing.T) {
+	tests := []struct {
+		name      string
+		orderType TSOrderType
+		action    Action
+		limit     string
+		stop      string
+		tick      string
+		wantLimit string
+		wantStop  string
+	}{
+		{name: "limit buy rounds down", orderType: LIMIT, action: BUY, limit: "412.379", wantLimit: "412.37"},
+		{name: "limit buy to cover rounds down", orderType: LIMIT, action: BUYTOCOVER, limit: "412.371", wantLimit: "412.37"},
+		{name: "limit sell rounds up", orderType: LIMIT, action: SELL, limit: "412.371", wantLimit: "412.38"},
+		{name: "limit sell short rounds up", orderType: LIMIT, action: SELLSHORT, limit: "412.379", wantLimit: "412.38"},
+		{name: "limit on a tick", orderType: LIMIT, action: SELL, limit: "412.37", wantLimit: "412.37"},
+		{name: "whole dollar limit", orderType: LIMIT, action: BUY, limit: "412", wantLimit: "412.00"},
+		{name: "sub-dollar limit buy", orderType: LIMIT, action: BUY, limit: "0.56789", wantLimit: "0.5678"},
+		{name: "sub-dollar limit sell", orderType: LIMIT, action: SELL, limit: "0.56781", wantLimit: "0.5679"},
+		{name: "sub-dollar limit on a tick", orderType: LIMIT, action: BUY, limit: "0.5678", wantLimit: "0.5678"},
+		{name: "stop rounds down to nearest", orderType: STOP, action: SELL, stop: "398.124", wantStop: "398.12"},
+		{name: "stop rounds up to nearest", orderType: STOP, action: BUY, stop: "398.126", wantStop: "398.13"},
+		{name: "sub-dollar stop", orderType: STOP, action: SELL, stop: "0.45675", wantStop: "0.4568"},
+		{name: "stop limit", orderType: STOP_LIMIT, action: SELL, limit: "397.501", stop: "398.004",
+			wantLimit: "397.51", wantStop: "398.00"},
+		{name: "custom tick limit buy", orderType: LIMIT, action: BUY, limit: "4512.40", tick: "0.25", wantLimit: "4512.25"},
+		{name: "custom tick limit sell", orderType: LIMIT, action: SELL, limit: "4512.40", tick: "0.25", wantLimit: "4512.50"},
+		{name: "custom tick stop", orderType: STOP, action: SELL, stop: "4512.40", tick: "0.25", wantStop: "4512.50"},
+		{name: "custom tick below a dollar", orderType: LIMIT, action: BUY, limit: "0.57", tick: "0.05", wantLimit: "0.55"},
+		{name: "custom tick on a tick", orderType: LIMIT, action: SELL, limit: "4512.75", tick: "0.25", wantLimit: "4512.75"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &OrderRequest{
+				AccountID:      "SIM123",
+				OrderType:      tt.orderType,
+				Quantity:       1,
+				Symbol:         "SPY",
+				TimeInForceDur: DAY,
+				TradeAction:    tt.action,
+			}
+			if tt.limit != "" {
+				req.LimitPrice = decimal.RequireFromString(tt.limit)
+			}
+			if tt.stop != "" {
+				req.StopPrice = decimal.RequireFromString(tt.stop)
+			}
+			if tt.tick != "" {
+				req.TickSize = decimal.RequireFromString(tt.tick)
+			}
+
+			tsReq := req.toTsOrderRequest()
+			if tsReq.LimitPrice != tt.wantLimit {
+				t.Errorf("limit price is %q, want %q", tsReq.LimitPrice, tt.wantLimit)
+			}
+			if tsReq.StopPrice != tt.wantStop {
+				t.Errorf("stop price is %q, want %q", tsReq.StopPrice, tt.wantStop)
+			}
+		})
+	}
+}
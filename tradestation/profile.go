@@ -0,0 +1,243 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/spf13/viper"
+)
+
+// DefaultProfile is the name under which the token of the top level
+// settings is saved in a token database
+const DefaultProfile = "default"
+
+// ErrUnknownProfile is returned when a profile is not defined in the
+// configuration file
+var ErrUnknownProfile = errors.New("tradestation: unknown profile")
+
+// keySettings select the key that encrypts the secrets of a profile
+var keySettings = []string{"auth.key_source", "auth.key_file", "auth.kdf", "auth.kdf_salt"}
+
+// Profile reads the settings of one TradeStation login from the global
+// viper registry. A named profile is a [profiles.<name>] table of the
+// configuration file; settings it does not set fall back to the top level
+// of the file. The profile without a name uses the top level settings.
+type Profile struct {
+	Name string
+}
+
+// LookupProfile returns the profile `name`; an empty name selects the
+// profile chosen with --profile (the `profile` setting)
+func LookupProfile(name string) (*Profile, error) {
+	if name == "" {
+		name = viper.GetString("profile")
+	}
+
+	if name != "" && !viper.IsSet("profiles."+name) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+
+	return &Profile{Name: name}, nil
+}
+
+// CurrentProfile returns the profile chosen with --profile. Use
+// LookupProfile to find out if it exists.
+func CurrentProfile() *Profile {
+	return &Profile{Name: viper.GetString("profile")}
+}
+
+// Profiles returns the names of all profiles in the configuration file
+func Profiles() []string {
+	profiles := viper.GetStringMap("profiles")
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Setting returns the viper key that holds `key` for the profile: the key
+// in the profile table if it is set there, otherwise the top level key
+func (p *Profile) Setting(key string) string {
+	if p.Name != "" {
+		if profileKey := p.ownSetting(key); viper.IsSet(profileKey) {
+			return profileKey
+		}
+	}
+	return key
+}
+
+// ownSetting returns the viper key of `key` in the profile table
+func (p *Profile) ownSetting(key string) string {
+	return "profiles." + p.Name + "." + key
+}
+
+func (p *Profile) GetString(key string) string {
+	return viper.GetString(p.Setting(key))
+}
+
+func (p *Profile) GetBool(key string) bool {
+	return viper.GetBool(p.Setting(key))
+}
+
+func (p *Profile) GetStringSlice(key string) []string {
+	return viper.GetStringSlice(p.Setting(key))
+}
+
+func (p *Profile) GetDuration(key string) time.Duration {
+	return viper.GetDuration(p.Setting(key))
+}
+
+// OwnKey returns true if the profile selects its own encryption key rather
+// than the key of the top level settings
+func (p *Profile) OwnKey() bool {
+	if p.Name == "" {
+		return true
+	}
+	for _, key := range keySettings {
+		if viper.IsSet(p.ownSetting(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// StoreName is the name the token of the profile is saved under in a
+// token database
+func (p *Profile) StoreName() string {
+	if p.Name == "" {
+		return DefaultProfile
+	}
+	return p.Name
+}
+
+// StateFile returns the file the token of the profile is saved in. A
+// profile that does not set state_file itself uses the top level state_file
+// with the profile name appended, so profiles never share a token.
+func (p *Profile) StateFile() string {
+	if p.Name == "" || viper.IsSet(p.ownSetting("state_file")) {
+		return p.GetString("state_file")
+	}
+
+	stateFile := viper.GetString("state_file")
+	if stateFile == "" {
+		return ""
+	}
+
+	ext := filepath.Ext(stateFile)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(stateFile, ext), p.Name, ext)
+}
+
+// TokenStore returns the store the token of the profile is saved in: its
+// own state_file if it sets one, the token database if token_db is set, or
+// else StateFile. The token is encrypted with the key of the profile.
+func (p *Profile) TokenStore() TokenStore {
+	if p.Name != "" && viper.IsSet(p.ownSetting("state_file")) {
+		return &FileTokenStore{Path: p.StateFile(), KeySource: p}
+	}
+
+	if tokenDB := p.GetString("token_db"); tokenDB != "" {
+		return &BoltTokenStore{Path: tokenDB, Profile: p.StoreName(), KeySource: p}
+	}
+
+	return &FileTokenStore{Path: p.StateFile(), KeySource: p}
+}
+
+// KeySource returns the key source selected by auth.key_source,
+// auth.key_file, auth.kdf and auth.kdf_salt of the profile
+func (p *Profile) KeySource() (KeySource, error) {
+	keySource := p.GetString("auth.key_source")
+	switch KeySourceType(keySource) {
+	case SSH_KEY, "":
+		return &SSHKeySource{Path: p.GetString("auth.key_file")}, nil
+	case KEY_FILE:
+		if p.GetString("auth.key_file") == "" {
+			return nil, errors.New("tradestation: auth.key_file is required by the keyfile key source")
+		}
+		return &KeyFileSource{Path: p.GetString("auth.key_file")}, nil
+	case PASSPHRASE:
+		salt, err := base64.StdEncoding.DecodeString(p.GetString("auth.kdf_salt"))
+		if err != nil {
+			return nil, fmt.Errorf("tradestation: invalid auth.kdf_salt: %w", err)
+		}
+		return &PassphraseKeySource{KDF: KDF(p.GetString("auth.kdf")), Salt: salt}, nil
+	default:
+		return nil, fmt.Errorf("tradestation: unknown key source %q", keySource)
+	}
+}
+
+// ApiKey decrypts the auth.apikey of the profile into an enclave
+func (p *Profile) ApiKey() (*memguard.Enclave, error) {
+	return p.decryptSetting("auth.apikey")
+}
+
+// Secret decrypts the auth.secret of the profile into an enclave
+func (p *Profile) Secret() (*memguard.Enclave, error) {
+	return p.decryptSetting("auth.secret")
+}
+
+// decryptSetting decrypts the setting `key` with the key of the profile
+// straight into an enclave; the plaintext never lives in a Go string
+func (p *Profile) decryptSetting(key string) (*memguard.Enclave, error) {
+	encryptionKey, err := p.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openAES(encryptionKey, p.GetString(key))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt %s: %w", p.Setting(key), err)
+	}
+
+	// NewEnclave wipes plaintext
+	return memguard.NewEnclave(plaintext), nil
+}
+
+// Options returns client options configured from the settings of the
+// profile
+func (p *Profile) Options() Options {
+	opts := Options{
+		BaseURL:       p.GetString("sim"),
+		Environment:   SIM,
+		OfflineAccess: p.GetBool("auth.offline_access"),
+		Scopes:        p.GetStringSlice("auth.scopes"),
+		ReadOnly:      p.GetBool("auth.read_only"),
+		RedirectURL:   p.GetString("auth.redirect_url"),
+		Headless:      p.GetBool("auth.headless"),
+		LoginTimeout:  p.GetDuration("auth.login_timeout"),
+		PKCE:          p.GetBool("auth.pkce"),
+		Unattended:    p.GetBool("auth.unattended"),
+		VerifyToken:   p.GetBool("auth.verify_token"),
+		JWKSURL:       p.GetString("auth.jwks_url"),
+		TokenStore:    p.TokenStore(),
+		Debug:         viper.GetBool("debug"),
+	}
+	if p.GetString("mode") == "live" {
+		opts.BaseURL = p.GetString("live")
+		opts.Environment = LIVE
+	}
+
+	return opts
+}
@@ -0,0 +1,239 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/spf13/viper"
+)
+
+const profilesConfig = `
+mode = "sim"
+sim = "https://sim-api.tradestation.com/v3"
+live = "https://api.tradestation.com/v3"
+state_file = "/var/lib/pv/state.dat"
+
+[auth]
+key_source = "keyfile"
+key_file = "/etc/pv/main.key"
+read_only = true
+
+[profiles.smith]
+mode = "live"
+
+[profiles.smith.auth]
+key_source = "passphrase"
+kdf = "scrypt"
+kdf_salt = "c2FsdA=="
+
+[profiles.jones]
+state_file = "/srv/jones/token.dat"
+
+[profiles.jones.auth]
+read_only = false
+
+[profiles.lee.auth]
+key_source = "ssh"
+key_file = "/home/lee/.ssh/id_ed25519"
+
+[profiles.badsource.auth]
+key_source = "yubikey"
+
+[profiles.badsalt.auth]
+key_source = "passphrase"
+kdf_salt = "not base64!"
+`
+
+// loadConfig replaces the global viper settings with the TOML document
+// `config` for the rest of the test
+func loadConfig(t *testing.T, config string) {
+	t.Helper()
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	viper.SetConfigType("toml")
+	if err := viper.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+}
+
+// lookupProfile returns the profile `name` of the loaded configuration
+func lookupProfile(t *testing.T, name string) *tradestation.Profile {
+	t.Helper()
+
+	p, err := tradestation.LookupProfile(name)
+	if err != nil {
+		t.Fatalf("LookupProfile(%q): %v", name, err)
+	}
+	return p
+}
+
+func TestLookupProfile(t *testing.T) {
+	loadConfig(t, profilesConfig)
+
+	if p := lookupProfile(t, ""); p.Name != "" {
+		t.Errorf("LookupProfile without --profile returned %q, want the top level", p.Name)
+	}
+
+	viper.Set("profile", "smith")
+	if p := lookupProfile(t, ""); p.Name != "smith" {
+		t.Errorf("LookupProfile with --profile smith returned %q", p.Name)
+	}
+	if p := lookupProfile(t, "jones"); p.Name != "jones" {
+		t.Errorf("LookupProfile(jones) returned %q", p.Name)
+	}
+
+	// an unknown profile never falls back to the top level credentials
+	if _, err := tradestation.LookupProfile("nobody"); !errors.Is(err, tradestation.ErrUnknownProfile) {
+		t.Errorf("LookupProfile(nobody) returned %v, want %v", err, tradestation.ErrUnknownProfile)
+	}
+
+	want := []string{"badsalt", "badsource", "jones", "lee", "smith"}
+	if got := tradestation.Profiles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Profiles() = %q, want %q", got, want)
+	}
+}
+
+func TestProfileSettings(t *testing.T) {
+	loadConfig(t, profilesConfig)
+
+	tests := []struct {
+		profile     string
+		environment tradestation.Environment
+		baseURL     string
+		readOnly    bool
+	}{
+		{"", tradestation.SIM, "https://sim-api.tradestation.com/v3", true},
+		{"smith", tradestation.LIVE, "https://api.tradestation.com/v3", true},
+		{"jones", tradestation.SIM, "https://sim-api.tradestation.com/v3", false},
+	}
+
+	for _, tt := range tests {
+		opts := lookupProfile(t, tt.profile).Options()
+		if opts.Environment != tt.environment || opts.BaseURL != tt.baseURL {
+			t.Errorf("profile %q uses %s at %s, want %s at %s", tt.profile, opts.Environment, opts.BaseURL, tt.environment, tt.baseURL)
+		}
+		if opts.ReadOnly != tt.readOnly {
+			t.Errorf("profile %q has ReadOnly %t, want %t", tt.profile, opts.ReadOnly, tt.readOnly)
+		}
+	}
+
+	if key := lookupProfile(t, "smith").Setting("mode"); key != "profiles.smith.mode" {
+		t.Errorf("smith reads mode from %s, want its own table", key)
+	}
+	if key := lookupProfile(t, "jones").Setting("mode"); key != "mode" {
+		t.Errorf("jones reads mode from %s, want the top level", key)
+	}
+}
+
+func TestProfileStateFile(t *testing.T) {
+	loadConfig(t, profilesConfig)
+
+	tests := []struct {
+		profile   string
+		stateFile string
+		storeName string
+	}{
+		{"", "/var/lib/pv/state.dat", tradestation.DefaultProfile},
+		{"smith", "/var/lib/pv/state-smith.dat", "smith"},
+		{"lee", "/var/lib/pv/state-lee.dat", "lee"},
+		{"jones", "/srv/jones/token.dat", "jones"},
+	}
+	for _, tt := range tests {
+		p := lookupProfile(t, tt.profile)
+		if got := p.StateFile(); got != tt.stateFile {
+			t.Errorf("StateFile of %q = %s, want %s", tt.profile, got, tt.stateFile)
+		}
+		if got := p.StoreName(); got != tt.storeName {
+			t.Errorf("StoreName of %q = %s, want %s", tt.profile, got, tt.storeName)
+		}
+
+		store, ok := p.TokenStore().(*tradestation.FileTokenStore)
+		if !ok || store.Path != tt.stateFile {
+			t.Errorf("TokenStore of %q is %#v, want a file store at %s", tt.profile, p.TokenStore(), tt.stateFile)
+		}
+	}
+
+	viper.Set("state_file", "/var/lib/pv/state")
+	if got := lookupProfile(t, "smith").StateFile(); got != "/var/lib/pv/state-smith" {
+		t.Errorf("StateFile without an extension = %s, want /var/lib/pv/state-smith", got)
+	}
+	viper.Set("state_file", "")
+	if got := lookupProfile(t, "smith").StateFile(); got != "" {
+		t.Errorf("StateFile without a top level state_file = %s, want none", got)
+	}
+
+	// a token database holds every profile that does not set its own
+	// state_file
+	viper.Set("token_db", "/var/lib/pv/tokens.db")
+	for _, name := range []string{"", "smith"} {
+		p := lookupProfile(t, name)
+		store, ok := p.TokenStore().(*tradestation.BoltTokenStore)
+		if !ok || store.Path != "/var/lib/pv/tokens.db" || store.Profile != p.StoreName() {
+			t.Errorf("TokenStore of %q is %#v, want the token database", name, p.TokenStore())
+		}
+	}
+	if _, ok := lookupProfile(t, "jones").TokenStore().(*tradestation.FileTokenStore); !ok {
+		t.Errorf("TokenStore of jones is %#v, want its own state file", lookupProfile(t, "jones").TokenStore())
+	}
+}
+
+func TestProfileKeySource(t *testing.T) {
+	loadConfig(t, profilesConfig)
+
+	tests := []struct {
+		profile string
+		want    tradestation.KeySource
+		ownKey  bool
+	}{
+		{"", &tradestation.KeyFileSource{Path: "/etc/pv/main.key"}, true},
+		{"smith", &tradestation.PassphraseKeySource{KDF: tradestation.SCRYPT, Salt: []byte("salt")}, true},
+		{"jones", &tradestation.KeyFileSource{Path: "/etc/pv/main.key"}, false},
+		{"lee", &tradestation.SSHKeySource{Path: "/home/lee/.ssh/id_ed25519"}, true},
+	}
+	for _, tt := range tests {
+		p := lookupProfile(t, tt.profile)
+		got, err := p.KeySource()
+		if err != nil {
+			t.Errorf("KeySource of %q: %v", tt.profile, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("KeySource of %q = %#v, want %#v", tt.profile, got, tt.want)
+		}
+		if p.OwnKey() != tt.ownKey {
+			t.Errorf("OwnKey of %q = %t, want %t", tt.profile, p.OwnKey(), tt.ownKey)
+		}
+	}
+
+	for _, name := range []string{"badsource", "badsalt"} {
+		if src, err := lookupProfile(t, name).KeySource(); err == nil {
+			t.Errorf("KeySource of %q = %#v, want an error", name, src)
+		}
+	}
+
+	// the keyfile key source needs a file
+	viper.Set("auth.key_file", "")
+	if src, err := lookupProfile(t, "").KeySource(); err == nil {
+		t.Errorf("KeySource without auth.key_file = %#v, want an error", src)
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNoFixture is returned by a Replayer when no recorded interaction
+// matches a request
+var ErrNoFixture = errors.New("tradestation: no recorded response matches request")
+
+const redacted = "REDACTED"
+
+// sensitiveFields are redacted from JSON and form encoded bodies
+var sensitiveFields = map[string]bool{
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"client_secret": true,
+	"code":          true,
+}
+
+// Interaction is a recorded request and the response that was received for
+// it
+type Interaction struct {
+	Request  RecordedRequest
+	Response RecordedResponse
+}
+
+type RecordedRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   string
+}
+
+type RecordedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+// Recorder is an http.RoundTripper that records every request / response
+// pair to a fixture file that can be served by a Replayer. Bearer tokens,
+// OAuth secrets and account IDs are scrubbed before anything is written;
+// account IDs are replaced by stable placeholders (ACCOUNT1, ACCOUNT2, ...)
+// so the fixtures remain internally consistent. Use it as Options.Transport.
+//
+// Recorder buffers complete response bodies, so stream requests are sent
+// without being recorded.
+type Recorder struct {
+	// Path is the fixture file; it is rewritten after every request
+	Path string
+
+	// Transport sends the requests; defaults to http.DefaultTransport
+	Transport http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []*Interaction
+	accountIDs   map[string]string
+}
+
+// NewRecorder creates a Recorder that writes fixtures to `path`
+func NewRecorder(path string) *Recorder {
+	return &Recorder{
+		Path: path,
+	}
+}
+
+// RoundTrip sends `req` and records the request along with its response
+func (rec *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := rec.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// a stream does not end, so its body cannot be read before returning it
+	if req.Header.Get("Accept") == streamContentType {
+		return transport.RoundTrip(req)
+	}
+
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.accountIDs == nil {
+		rec.accountIDs = make(map[string]string)
+	}
+
+	// learn account IDs before scrubbing so that they are replaced
+	// everywhere they appear
+	rec.learnAccountIDs(req.URL.Path)
+	reqBodyStr := rec.scrubBody(reqBody)
+	respBodyStr := rec.scrubBody(respBody)
+
+	interaction := &Interaction{
+		Request: RecordedRequest{
+			Method: req.Method,
+			URL:    rec.scrubAccountIDs(req.URL.String()),
+			Header: scrubHeader(req.Header),
+			Body:   rec.scrubAccountIDs(reqBodyStr),
+		},
+		Response: RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     scrubHeader(resp.Header),
+			Body:       rec.scrubAccountIDs(respBodyStr),
+		},
+	}
+	rec.interactions = append(rec.interactions, interaction)
+
+	if err := rec.save(); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// save writes all interactions recorded so far; rec.mu must be held
+func (rec *Recorder) save() error {
+	data, err := json.MarshalIndent(rec.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(rec.Path, data, 0600)
+}
+
+// learnAccountIDs assigns placeholders to the account IDs in a
+// /brokerage/accounts/{accountIDs} path
+func (rec *Recorder) learnAccountIDs(path string) {
+	const prefix = "/brokerage/accounts/"
+	idx := strings.Index(path, prefix)
+	if idx == -1 {
+		return
+	}
+
+	ids, _, _ := strings.Cut(path[idx+len(prefix):], "/")
+	for _, id := range strings.Split(ids, ",") {
+		rec.placeholder(id)
+	}
+}
+
+// placeholder returns the placeholder used in place of the account `id`
+func (rec *Recorder) placeholder(id string) string {
+	if id == "" || id == redacted {
+		return id
+	}
+	if p, ok := rec.accountIDs[id]; ok {
+		return p
+	}
+	p := fmt.Sprintf("ACCOUNT%d", len(rec.accountIDs)+1)
+	rec.accountIDs[id] = p
+	return p
+}
+
+// scrubBody redacts OAuth secrets from a JSON or form encoded body and
+// learns the account IDs it contains
+func (rec *Recorder) scrubBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	if json.Valid(body) {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc any
+		if err := dec.Decode(&doc); err == nil {
+			doc = rec.scrubJSON(doc)
+			if scrubbed, err := json.Marshal(doc); err == nil {
+				return string(scrubbed)
+			}
+		}
+	}
+
+	if form, err := url.ParseQuery(string(body)); err == nil && len(form) > 0 {
+		changed := false
+		for key := range form {
+			if sensitiveFields[key] {
+				form.Set(key, redacted)
+				changed = true
+			}
+		}
+		if changed {
+			return form.Encode()
+		}
+	}
+
+	return string(body)
+}
+
+func (rec *Recorder) scrubJSON(doc any) any {
+	switch v := doc.(type) {
+	case map[string]any:
+		// visit keys in a fixed order so placeholders are assigned
+		// deterministically
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			val := v[key]
+			switch {
+			case sensitiveFields[key]:
+				v[key] = redacted
+			case key == "AccountID":
+				if id, ok := val.(string); ok {
+					v[key] = rec.placeholder(id)
+				}
+			default:
+				v[key] = rec.scrubJSON(val)
+			}
+		}
+		return v
+	case []any:
+		for idx, val := range v {
+			v[idx] = rec.scrubJSON(val)
+		}
+		return v
+	}
+	return doc
+}
+
+// scrubAccountIDs replaces every known account ID in `s` with its
+// placeholder
+func (rec *Recorder) scrubAccountIDs(s string) string {
+	ids := make([]string, 0, len(rec.accountIDs))
+	for id := range rec.accountIDs {
+		ids = append(ids, id)
+	}
+
+	// replace longer IDs first in case one ID contains another
+	sort.Slice(ids, func(i, j int) bool { return len(ids[i]) > len(ids[j]) })
+
+	for _, id := range ids {
+		s = strings.ReplaceAll(s, id, rec.accountIDs[id])
+	}
+	return s
+}
+
+// scrubHeader copies `header` without credentials or cookies
+func scrubHeader(header http.Header) http.Header {
+	res := header.Clone()
+	if res.Get("Authorization") != "" {
+		scheme, _, _ := strings.Cut(res.Get("Authorization"), " ")
+		res.Set("Authorization", scheme+" "+redacted)
+	}
+	res.Del("Cookie")
+	res.Del("Set-Cookie")
+
+	// bodies are rewritten when scrubbed
+	res.Del("Content-Length")
+	return res
+}
+
+// Replayer is an http.RoundTripper that serves the interactions recorded by
+// a Recorder instead of sending requests over the network. Requests are
+// matched on method, path and query; the host is ignored. Each interaction
+// is served once, in the order it was recorded, so repeated requests to the
+// same endpoint receive successive responses.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []*Interaction
+	used         []bool
+}
+
+// NewReplayer loads the fixture file written by a Recorder
+func NewReplayer(path string) (*Replayer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var interactions []*Interaction
+	if err := json.Unmarshal(data, &interactions); err != nil {
+		return nil, fmt.Errorf("tradestation: could not parse fixture file %s: %w", path, err)
+	}
+
+	return &Replayer{
+		interactions: interactions,
+		used:         make([]bool, len(interactions)),
+	}, nil
+}
+
+// RoundTrip returns the first unused recorded response matching `req`
+func (rep *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	for idx, interaction := range rep.interactions {
+		if rep.used[idx] || interaction.Request.Method != req.Method {
+			continue
+		}
+
+		recorded, err := url.Parse(interaction.Request.URL)
+		if err != nil || recorded.Path != req.URL.Path || recorded.RawQuery != req.URL.RawQuery {
+			continue
+		}
+
+		rep.used[idx] = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        interaction.Response.Header.Clone(),
+			Body:          io.NopCloser(strings.NewReader(interaction.Response.Body)),
+			ContentLength: int64(len(interaction.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s %s", ErrNoFixture, req.Method, req.URL.RequestURI())
+}
@@ -0,0 +1,151 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultRefreshLead is how long before the access token expires the
+	// background refresher replaces it
+	DefaultRefreshLead = 5 * time.Minute
+
+	minRefreshRetry = 15 * time.Second
+	maxRefreshRetry = 5 * time.Minute
+)
+
+// RefreshEvent reports the outcome of a token refresh attempted by the
+// background refresher
+type RefreshEvent struct {
+	Time time.Time
+
+	// Expiration of the new access token; zero if the refresh failed
+	Expiration time.Time
+
+	// Err is set if the refresh failed. Errors matching ErrUnauthorized
+	// mean that the refresh token is no longer accepted and the user has
+	// to log in again.
+	Err error
+}
+
+// RefreshToken exchanges the refresh token for a new token set right away
+// and saves it to the token store. It never asks the user to log in.
+func (api *API) RefreshToken(ctx context.Context) error {
+	api.authMu.Lock()
+	defer api.authMu.Unlock()
+
+	if api.currentToken() == nil {
+		api.loadStateFile()
+	}
+
+	current := api.currentToken()
+	if !hasRefreshToken(current) {
+		return fmt.Errorf("%w: no refresh token is available", ErrLoginRequired)
+	}
+
+	return api.refreshAuth(ctx, current)
+}
+
+// StartRefresher refreshes the access token in the background `lead`
+// before it expires (DefaultRefreshLead if `lead` is 0), so requests never
+// wait for a refresh. Failed refreshes are retried with backoff. Every
+// attempt is reported on the returned channel; events are dropped if the
+// channel is not drained. The refresher stops and closes the channel when
+// `ctx` is done.
+//
+// The refresher only uses the refresh token and never opens a browser;
+// request the offline_access scope (Options.OfflineAccess) to receive one.
+func (api *API) StartRefresher(ctx context.Context, lead time.Duration) <-chan RefreshEvent {
+	if lead <= 0 {
+		lead = DefaultRefreshLead
+	}
+
+	events := make(chan RefreshEvent, 16)
+	go func() {
+		defer close(events)
+
+		retry := minRefreshRetry
+		wait := api.nextRefresh(lead)
+		for {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			event := RefreshEvent{Time: time.Now()}
+			if err := api.RefreshToken(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				api.logger.Error().Err(err).Dur("Retry", retry).Msg("background token refresh failed")
+				event.Err = err
+				wait = retry
+				retry *= 2
+				if retry > maxRefreshRetry {
+					retry = maxRefreshRetry
+				}
+			} else {
+				event.Expiration, _ = tokenExpiration(api.currentToken())
+				api.logger.Debug().Time("Expiration", event.Expiration).Msg("refreshed access token in the background")
+				retry = minRefreshRetry
+
+				// a lead longer than the token lifetime must not turn
+				// into a busy loop
+				wait = api.nextRefresh(lead)
+				if wait < minRefreshRetry {
+					wait = minRefreshRetry
+				}
+			}
+
+			select {
+			case events <- event:
+			default:
+			}
+		}
+	}()
+
+	return events
+}
+
+// nextRefresh returns how long to wait before refreshing the current token
+func (api *API) nextRefresh(lead time.Duration) time.Duration {
+	current := api.currentToken()
+	if current == nil {
+		api.authMu.Lock()
+		api.loadStateFile()
+		api.authMu.Unlock()
+		current = api.currentToken()
+	}
+
+	expiration, err := tokenExpiration(current)
+	if err != nil {
+		// refresh right away; a missing token is reported as an event
+		return 0
+	}
+
+	wait := time.Until(expiration.Add(-lead))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
@@ -0,0 +1,233 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+	"github.com/shopspring/decimal"
+)
+
+// replayAccount returns account ACCOUNT1 of a client that is served the
+// interactions recorded in testdata/`fixture`.json
+func replayAccount(t *testing.T, fixture string) *tradestation.Account {
+	t.Helper()
+
+	replayer, err := tradestation.NewReplayer(filepath.Join("testdata", fixture+".json"))
+	if err != nil {
+		t.Fatalf("NewReplayer: %v", err)
+	}
+
+	// the fixtures were recorded without token verification; any unexpired
+	// token will do
+	srv := tradestationtest.NewServer()
+	token := srv.Token()
+	srv.Close()
+
+	api := tradestation.NewWithOptions(tradestation.Options{
+		BaseURL:     "https://sim-api.tradestation.com/v3",
+		Transport:   replayer,
+		TokenStore:  tradestation.NewMemoryTokenStore(token),
+		RetryPolicy: &tradestation.RetryPolicy{},
+		RateLimits:  map[tradestation.EndpointGroup]tradestation.RateLimit{},
+	})
+
+	account, err := api.GetAccount("ACCOUNT1")
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	return account
+}
+
+// requireDecimal fails the test if `got` is not equal to `want`
+func requireDecimal(t *testing.T, name string, got decimal.Decimal, want string) {
+	t.Helper()
+
+	if !got.Equal(decimal.RequireFromString(want)) {
+		t.Errorf("%s is %s, want %s", name, got, want)
+	}
+}
+
+func TestReplayOrders(t *testing.T) {
+	account := replayAccount(t, "orders")
+
+	orders, err := account.GetOrders()
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(orders) != 4 {
+		t.Fatalf("GetOrders returned %d orders, want 4", len(orders))
+	}
+
+	spy := orders[0]
+	if spy.OrderID != "100000001" || spy.Status != tradestation.FILLED {
+		t.Errorf("order %s has status %s, want 100000001 %s", spy.OrderID, spy.Status, tradestation.FILLED)
+	}
+	requireDecimal(t, "SPY FilledPrice", spy.FilledPrice, "411.15")
+	requireDecimal(t, "SPY CommissionFee", spy.CommissionFee, "1.00")
+	if spy.ClosedDateTime.IsZero() || spy.ClosedDateTime.Location().String() != "America/New_York" {
+		t.Errorf("SPY ClosedDateTime is %s, want a time in America/New_York", spy.ClosedDateTime)
+	}
+
+	// an order that is still working has no closed time
+	vti := orders[1]
+	if vti.Status != tradestation.PARTIAL_FILL_ALIVE {
+		t.Errorf("VTI order has status %s, want %s", vti.Status, tradestation.PARTIAL_FILL_ALIVE)
+	}
+	if !vti.ClosedDateTime.IsZero() {
+		t.Errorf("VTI ClosedDateTime is %s, want zero", vti.ClosedDateTime)
+	}
+	if len(vti.Legs) != 1 {
+		t.Fatalf("VTI order has %d legs, want 1", len(vti.Legs))
+	}
+	if leg := vti.Legs[0]; leg.QuantityOrdered != 100 || leg.ExecQuantity != 40 || leg.QuantityRemaining != 60 {
+		t.Errorf("VTI leg is %d ordered, %d executed, %d remaining; want 100, 40, 60",
+			leg.QuantityOrdered, leg.ExecQuantity, leg.QuantityRemaining)
+	}
+
+	// the second page
+	if bnd := orders[2]; bnd.Legs[0].Symbol != "BND" || bnd.Legs[0].BuyOrSell != "Sell" {
+		t.Errorf("third order is %s %s, want Sell BND", bnd.Legs[0].BuyOrSell, bnd.Legs[0].Symbol)
+	}
+
+	rejected := orders[3]
+	if rejected.Status != tradestation.REJECTED {
+		t.Errorf("BRK.B order has status %s, want %s", rejected.Status, tradestation.REJECTED)
+	}
+	if rejected.RejectReason != "Order failed: insufficient buying power" {
+		t.Errorf("BRK.B order has reject reason %q", rejected.RejectReason)
+	}
+	requireDecimal(t, "BRK.B FilledPrice", rejected.FilledPrice, "0")
+}
+
+func TestReplayBalances(t *testing.T) {
+	account := replayAccount(t, "balances")
+
+	balance, err := account.GetBalances()
+	if err != nil {
+		t.Fatalf("GetBalances: %v", err)
+	}
+	if balance.AccountID != "ACCOUNT1" || balance.AccountType != "Cash" {
+		t.Errorf("balance is of %s account %s, want Cash account ACCOUNT1", balance.AccountType, balance.AccountID)
+	}
+	requireDecimal(t, "BuyingPower", balance.BuyingPower, "42636.50")
+	requireDecimal(t, "CashBalance", balance.CashBalance, "42636.50")
+	requireDecimal(t, "Commission", balance.Commission, "2.00")
+	requireDecimal(t, "CostOfPositions", balance.CostOfPositions, "16163.80")
+	requireDecimal(t, "Equity", balance.Equity, "59073.20")
+	requireDecimal(t, "MarketValue", balance.MarketValue, "16436.70")
+	requireDecimal(t, "UnrealizedProfitLoss", balance.UnrealizedProfitLoss, "272.90")
+
+	bod, err := account.GetBalancesBOD()
+	if err != nil {
+		t.Fatalf("GetBalancesBOD: %v", err)
+	}
+	requireDecimal(t, "BOD CashBalance", bod.CashBalance, "40000.00")
+	requireDecimal(t, "BOD Equity", bod.Equity, "59077.00")
+	requireDecimal(t, "BOD MarketValue", bod.MarketValue, "19077.00")
+}
+
+func TestReplayPositions(t *testing.T) {
+	account := replayAccount(t, "positions")
+
+	positions, err := account.GetPositions()
+	if err != nil {
+		t.Fatalf("GetPositions: %v", err)
+	}
+	if len(positions) != 4 {
+		t.Fatalf("GetPositions returned %d positions, want 4", len(positions))
+	}
+
+	bySymbol := make(map[string]*tradestation.Position, len(positions))
+	for _, position := range positions {
+		bySymbol[position.Symbol] = position
+	}
+
+	vti := bySymbol["VTI"]
+	if vti == nil || vti.Quantity != 40 {
+		t.Fatalf("VTI position is %+v, want 40 shares", vti)
+	}
+	requireDecimal(t, "VTI AveragePrice", vti.AveragePrice, "198.52")
+	requireDecimal(t, "VTI Last", vti.Last, "205.35")
+	requireDecimal(t, "VTI TotalCost", vti.TotalCost, "7940.80")
+	requireDecimal(t, "VTI UnrealizedProfitLoss", vti.UnrealizedProfitLoss, "273.20")
+	if vti.Timestamp.IsZero() {
+		t.Error("VTI Timestamp is zero")
+	}
+
+	tlt := bySymbol["TLT"]
+	if tlt == nil || tlt.Quantity != -100 || tlt.LongShort != "Short" {
+		t.Fatalf("TLT position is %+v, want short 100 shares", tlt)
+	}
+	requireDecimal(t, "TLT MarketValue", tlt.MarketValue, "-9815.00")
+	requireDecimal(t, "TLT TotalCost", tlt.TotalCost, "-10140.25")
+	requireDecimal(t, "TLT UnrealizedProfitLossQty", tlt.UnrealizedProfitLossQty, "3.2525")
+
+	// fields TradeStation leaves empty are zero
+	bnd := bySymbol["BND"]
+	if bnd == nil || bnd.Quantity != 0 {
+		t.Fatalf("BND position is %+v, want 0 shares", bnd)
+	}
+	requireDecimal(t, "BND Last", bnd.Last, "0")
+	requireDecimal(t, "BND MarketValue", bnd.MarketValue, "0")
+	requireDecimal(t, "BND UnrealizedProfitLoss", bnd.UnrealizedProfitLoss, "0")
+}
+
+// TestRecorderStreams checks that streams are passed through without being
+// recorded; a stream does not end, so recording it would block forever
+func TestRecorderStreams(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	rec := tradestation.NewRecorder(path)
+	rec.Transport = srv.Client().Transport
+
+	// without verification only the requests of the test are recorded
+	opts := srv.Options()
+	opts.Transport = rec
+	opts.VerifyToken = false
+	if _, err := tradestation.NewWithOptions(opts).GetQuotes([]string{"SPY"}); err != nil {
+		t.Fatalf("GetQuotes: %v", err)
+	}
+
+	events := streamQuotes(t, opts, "SPY")
+	if event := nextQuote(t, events); event.Quote == nil {
+		t.Fatalf("first stream event has no quote: %+v", event)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var interactions []*tradestation.Interaction
+	if err := json.Unmarshal(data, &interactions); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(interactions) != 1 || strings.Contains(interactions[0].Request.URL, "/stream/") {
+		for _, interaction := range interactions {
+			t.Logf("recorded %s %s", interaction.Request.Method, interaction.Request.URL)
+		}
+		t.Fatalf("recorded %d interactions, want only the quotes request", len(interactions))
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"golang.org/x/time/rate"
+)
+
+// EndpointGroup identifies a set of endpoints that share a TradeStation
+// request quota
+type EndpointGroup string
+
+const (
+	ACCOUNTS        EndpointGroup = "accounts"
+	BALANCES        EndpointGroup = "balances"
+	POSITIONS       EndpointGroup = "positions"
+	ORDERS          EndpointGroup = "orders"
+	QUOTES          EndpointGroup = "quotes"
+	MARKET_DATA     EndpointGroup = "marketdata"
+	ORDER_EXECUTION EndpointGroup = "orderexecution"
+)
+
+// RateLimit allows `Requests` requests per `Per` interval with bursts of up
+// to `Burst` requests
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+// DefaultRateLimits stays below the per-endpoint quotas published by
+// TradeStation for the v3 API
+var DefaultRateLimits = map[EndpointGroup]RateLimit{
+	ACCOUNTS:        {Requests: 250, Per: 5 * time.Minute, Burst: 25},
+	BALANCES:        {Requests: 250, Per: 5 * time.Minute, Burst: 25},
+	POSITIONS:       {Requests: 250, Per: 5 * time.Minute, Burst: 25},
+	ORDERS:          {Requests: 250, Per: 5 * time.Minute, Burst: 25},
+	QUOTES:          {Requests: 500, Per: 5 * time.Minute, Burst: 50},
+	MARKET_DATA:     {Requests: 500, Per: 5 * time.Minute, Burst: 50},
+	ORDER_EXECUTION: {Requests: 250, Per: 5 * time.Minute, Burst: 25},
+}
+
+// RetryPolicy controls how failed requests are retried. Requests are retried
+// with capped exponential backoff and jitter starting at WaitTime; a
+// Retry-After header returned by TradeStation takes precedence.
+type RetryPolicy struct {
+	MaxRetries  int
+	WaitTime    time.Duration
+	MaxWaitTime time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:  3,
+	WaitTime:    500 * time.Millisecond,
+	MaxWaitTime: 30 * time.Second,
+}
+
+// endpointGroup returns the quota group of the request path `path`. `path`
+// may also be a full URL that includes the base path of the API.
+func endpointGroup(path string) EndpointGroup {
+	if u, err := url.Parse(path); err == nil {
+		path = u.Path
+	}
+
+	switch {
+	case strings.Contains(path, "/orderexecution/"):
+		return ORDER_EXECUTION
+	case strings.Contains(path, "/marketdata/quotes"):
+		return QUOTES
+	case strings.Contains(path, "/marketdata/"):
+		return MARKET_DATA
+	case strings.HasSuffix(path, "/balances"), strings.HasSuffix(path, "/bodbalances"):
+		return BALANCES
+	case strings.HasSuffix(path, "/positions"):
+		return POSITIONS
+	case strings.HasSuffix(path, "/orders"), strings.HasSuffix(path, "/historicalorders"):
+		return ORDERS
+	default:
+		return ACCOUNTS
+	}
+}
+
+// newLimiters creates a token bucket for every configured endpoint group
+func newLimiters(limits map[EndpointGroup]RateLimit) map[EndpointGroup]*rate.Limiter {
+	limiters := make(map[EndpointGroup]*rate.Limiter, len(limits))
+	for group, limit := range limits {
+		if limit.Requests <= 0 || limit.Per <= 0 {
+			continue
+		}
+		burst := limit.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		limiters[group] = rate.NewLimiter(rate.Every(limit.Per/time.Duration(limit.Requests)), burst)
+	}
+	return limiters
+}
+
+// waitForQuota blocks until the quota of the endpoint group of `req` allows
+// another request to be sent
+func (api *API) waitForQuota(c *resty.Client, req *resty.Request) error {
+	group := endpointGroup(req.URL)
+	limiter, ok := api.limiters[group]
+	if !ok {
+		return nil
+	}
+	return limiter.Wait(req.Context())
+}
+
+// isIdempotent returns true if sending `req` more than once has no
+// additional side effects
+func isIdempotent(req *resty.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		// order confirmations only estimate the cost of an order
+		return strings.HasSuffix(req.URL, "/orderconfirm") || strings.HasSuffix(req.URL, "/ordergroupconfirm")
+	}
+	return false
+}
+
+// notSent returns true if `err` shows that the request never reached the
+// server
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isStream returns true if `req` opens a stream. The body of a stream is
+// left open for the caller, so resty cannot discard a failed attempt.
+func isStream(req *resty.Request) bool {
+	return req.Header.Get("Accept") == streamContentType
+}
+
+// shouldRetry decides if a request should be attempted again. Reads are
+// retried on network errors, rate limiting and server errors. Requests that
+// place orders are only retried if TradeStation is known to not have acted on
+// them: the connection could not be established or the request was refused
+// because of the rate limit. Streams reconnect on their own and are never
+// retried here.
+func shouldRetry(resp *resty.Response, err error) bool {
+	if resp == nil || resp.Request == nil || isStream(resp.Request) {
+		return false
+	}
+
+	if !isIdempotent(resp.Request) {
+		return notSent(err) || (err == nil && resp.StatusCode() == http.StatusTooManyRequests)
+	}
+
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
+
+// retryAfter honors the Retry-After header sent with a response. Returning 0
+// tells resty to use its exponential backoff with jitter.
+func retryAfter(c *resty.Client, resp *resty.Response) (time.Duration, error) {
+	header := resp.Header().Get("Retry-After")
+	if header == "" {
+		return 0, nil
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when), nil
+	}
+
+	return 0, nil
+}
+
+// configureRetries installs the retry policy and rate limiter on the
+// shared http client
+func (api *API) configureRetries(policy RetryPolicy) {
+	api.client.OnBeforeRequest(api.waitForQuota)
+
+	api.client.SetRetryCount(policy.MaxRetries)
+	api.client.SetRetryWaitTime(policy.WaitTime)
+	api.client.SetRetryMaxWaitTime(policy.MaxWaitTime)
+	api.client.SetRetryAfter(retryAfter)
+	api.client.AddRetryCondition(shouldRetry)
+	api.client.AddRetryHook(func(resp *resty.Response, err error) {
+		subLog := api.logger.Warn().Err(err)
+		if resp != nil && resp.Request != nil {
+			subLog = subLog.Str("RequestID", resp.Request.Header.Get(RequestIDHeader)).Int("StatusCode", resp.StatusCode()).Str("Method", resp.Request.Method).Str("URL", resp.Request.URL).Int("Attempt", resp.Request.Attempt)
+		}
+		subLog.Msg("retrying tradestation request")
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// testResponse returns the response to a `method` request of `path` with
+// status `code`, or a failed request if `code` is 0
+func testResponse(method, path string, code int, header http.Header) *resty.Response {
+	req := resty.New().R()
+	req.Method = method
+	req.URL = "https://api.tradestation.com/v3" + path
+
+	resp := &resty.Response{Request: req}
+	if code != 0 {
+		resp.RawResponse = &http.Response{StatusCode: code, Header: header}
+	}
+	return resp
+}
+
+func TestShouldRetry(t *testing.T) {
+	dialErr := &url.Error{Op: "Post", URL: "https://api.tradestation.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	readErr := &url.Error{Op: "Post", URL: "https://api.tradestation.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+
+	const (
+		orders  = "/orderexecution/orders"
+		order   = "/orderexecution/orders/924243071"
+		confirm = "/orderexecution/orderconfirm"
+		quotes  = "/marketdata/quotes/SPY"
+	)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+		err    error
+		want   bool
+	}{
+		{"get ok", http.MethodGet, quotes, http.StatusOK, nil, false},
+		{"get bad request", http.MethodGet, quotes, http.StatusBadRequest, nil, false},
+		{"get rate limited", http.MethodGet, quotes, http.StatusTooManyRequests, nil, true},
+		{"get server error", http.MethodGet, quotes, http.StatusInternalServerError, nil, true},
+		{"get bad gateway", http.MethodGet, quotes, http.StatusBadGateway, nil, true},
+		{"get unavailable", http.MethodGet, quotes, http.StatusServiceUnavailable, nil, true},
+		{"get gateway timeout", http.MethodGet, quotes, http.StatusGatewayTimeout, nil, true},
+		{"get dial error", http.MethodGet, quotes, 0, dialErr, true},
+		{"get read error", http.MethodGet, quotes, 0, readErr, true},
+		{"get unexpected eof", http.MethodGet, quotes, 0, io.ErrUnexpectedEOF, true},
+
+		{"confirm server error", http.MethodPost, confirm, http.StatusServiceUnavailable, nil, true},
+		{"confirm read error", http.MethodPost, confirm, 0, readErr, true},
+
+		{"post ok", http.MethodPost, orders, http.StatusOK, nil, false},
+		{"post rate limited", http.MethodPost, orders, http.StatusTooManyRequests, nil, true},
+		{"post dial error", http.MethodPost, orders, 0, dialErr, true},
+		{"post server error", http.MethodPost, orders, http.StatusInternalServerError, nil, false},
+		{"post unavailable", http.MethodPost, orders, http.StatusServiceUnavailable, nil, false},
+		{"post gateway timeout", http.MethodPost, orders, http.StatusGatewayTimeout, nil, false},
+		{"post read error", http.MethodPost, orders, 0, readErr, false},
+		{"post unexpected eof", http.MethodPost, orders, 0, io.ErrUnexpectedEOF, false},
+
+		{"put rate limited", http.MethodPut, order, http.StatusTooManyRequests, nil, true},
+		{"put dial error", http.MethodPut, order, 0, dialErr, true},
+		{"put bad gateway", http.MethodPut, order, http.StatusBadGateway, nil, false},
+		{"put read error", http.MethodPut, order, 0, readErr, false},
+
+		{"delete rate limited", http.MethodDelete, order, http.StatusTooManyRequests, nil, true},
+		{"delete dial error", http.MethodDelete, order, 0, dialErr, true},
+		{"delete server error", http.MethodDelete, order, http.StatusInternalServerError, nil, false},
+		{"delete read error", http.MethodDelete, order, 0, readErr, false},
+	}
+
+	for _, tt := range tests {
+		resp := testResponse(tt.method, tt.path, tt.code, nil)
+		if got := shouldRetry(resp, tt.err); got != tt.want {
+			t.Errorf("%s: shouldRetry = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	if shouldRetry(nil, dialErr) {
+		t.Error("shouldRetry retried without a response")
+	}
+}
+
+// TestShouldRetryStream checks that failed attempts to open a stream are left
+// to the stream, which closes their bodies and reconnects with its own backoff
+func TestShouldRetryStream(t *testing.T) {
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		resp := testResponse(http.MethodGet, "/marketdata/stream/quotes/SPY", code, nil)
+		resp.Request.SetHeader("Accept", streamContentType)
+		if shouldRetry(resp, nil) {
+			t.Errorf("stream with status %d is retried", code)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"3", 3 * time.Second},
+		{"120", 2 * time.Minute},
+		{"soon", 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), time.Minute},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.header != "" {
+			header.Set("Retry-After", tt.header)
+		}
+
+		got, err := retryAfter(nil, testResponse(http.MethodGet, "/marketdata/quotes/SPY", http.StatusTooManyRequests, header))
+		if err != nil {
+			t.Errorf("retryAfter(%q): %v", tt.header, err)
+			continue
+		}
+
+		// an HTTP date has a resolution of one second
+		if diff := tt.want - got; diff < 0 || diff > time.Second {
+			t.Errorf("retryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"strings"
+
+	"github.com/awnumar/memguard"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// sealString copies `s` into an enclave; an empty string is sealed as nil
+func sealString(s string) *memguard.Enclave {
+	// NewEnclave wipes the copy made here
+	return memguard.NewEnclave([]byte(s))
+}
+
+// openedSecrets keeps enclaves opened for a single request. The strings it
+// returns reference locked memory and must not be used after destroy.
+type openedSecrets struct {
+	buffers []*memguard.LockedBuffer
+}
+
+// open returns the contents of `enclave`; a nil enclave is an empty string
+func (opened *openedSecrets) open(enclave *memguard.Enclave) (string, error) {
+	if enclave == nil {
+		return "", nil
+	}
+
+	buf, err := enclave.Open()
+	if err != nil {
+		return "", err
+	}
+	opened.buffers = append(opened.buffers, buf)
+	return buf.String(), nil
+}
+
+// destroy wipes every opened secret
+func (opened *openedSecrets) destroy() {
+	for _, buf := range opened.buffers {
+		buf.Destroy()
+	}
+	opened.buffers = nil
+}
+
+// sealedToken is the in-memory form of an OAuthToken. The access, refresh
+// and id tokens are kept in enclaves and only opened while a request is
+// built or the token is saved.
+type sealedToken struct {
+	access  *memguard.Enclave
+	refresh *memguard.Enclave
+	id      *memguard.Enclave
+
+	tokenType string
+	scope     string
+	expiresIn int
+
+	// claims of the access token, read without verification when the
+	// token is sealed; parseErr is set if the access token is not a JWT
+	claims   *TokenClaims
+	parseErr error
+}
+
+// sealToken moves the secrets of `token` into enclaves
+func sealToken(token *OAuthToken) *sealedToken {
+	if token == nil || token.AccessToken == "" {
+		return nil
+	}
+
+	sealed := &sealedToken{
+		access:    sealString(token.AccessToken),
+		id:        sealString(token.IDToken),
+		tokenType: token.TokenType,
+		scope:     token.Scope,
+		expiresIn: token.ExpiresIn,
+	}
+
+	// older state files hold "EOF" when no refresh token was issued
+	if token.RefreshToken != "EOF" {
+		sealed.refresh = sealString(token.RefreshToken)
+	}
+
+	parsed, err := jwt.Parse([]byte(token.AccessToken), jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		sealed.parseErr = err
+	} else {
+		sealed.claims = newTokenClaims(parsed)
+	}
+
+	return sealed
+}
+
+// open returns the token in plain text so it can be saved; the result must
+// not be kept
+func (token *sealedToken) open() (*OAuthToken, error) {
+	opened := &openedSecrets{}
+	defer opened.destroy()
+
+	access, err := opened.open(token.access)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := opened.open(token.refresh)
+	if err != nil {
+		return nil, err
+	}
+	id, err := opened.open(token.id)
+	if err != nil {
+		return nil, err
+	}
+
+	// copy; the opened buffers are wiped on return
+	return &OAuthToken{
+		AccessToken:  strings.Clone(access),
+		RefreshToken: strings.Clone(refresh),
+		IDToken:      strings.Clone(id),
+		TokenType:    token.tokenType,
+		Scope:        token.scope,
+		ExpiresIn:    token.expiresIn,
+	}, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/go-resty/resty/v2"
+)
+
+// AuthStatus describes the saved token of a client
+type AuthStatus struct {
+	Environment Environment
+
+	// Store describes where the token is saved
+	Store string
+
+	// Claims of the access token; nil if no token is saved
+	Claims *TokenClaims
+
+	// OfflineAccess is true if a refresh token is saved, so the access
+	// token can be renewed without logging in
+	OfflineAccess bool
+
+	// ReadOnly is true if the client cannot place orders
+	ReadOnly bool
+
+	// Err is set if the saved token cannot be used, e.g. because it is not
+	// a valid JWT or failed verification
+	Err error
+}
+
+// HasToken returns true if a token is saved
+func (status *AuthStatus) HasToken() bool {
+	return status.Claims != nil || status.Err != nil
+}
+
+// Expired returns true if the access token has expired
+func (status *AuthStatus) Expired() bool {
+	return status.Claims == nil || !status.Claims.Expiration.After(time.Now())
+}
+
+// Healthy returns true if requests can be made without logging in: the
+// access token is usable and either still valid or renewable with the
+// refresh token
+func (status *AuthStatus) Healthy() bool {
+	return status.HasToken() && status.Err == nil && (!status.Expired() || status.OfflineAccess)
+}
+
+// Login signs in to TradeStation interactively (in a browser, or by pasting
+// the redirect URL with Options.Headless) and saves the new token, even if
+// a usable token is already saved
+func (api *API) Login(ctx context.Context) error {
+	api.authMu.Lock()
+	defer api.authMu.Unlock()
+
+	if err := api.authenticate(ctx); err != nil {
+		return err
+	}
+
+	if api.verify {
+		verified, err := api.verifyToken(ctx, api.currentToken())
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+		}
+		api.setToken(verified)
+	}
+
+	return nil
+}
+
+// Status reports on the saved token without refreshing it or logging in.
+// With Options.VerifyToken the token is verified first.
+func (api *API) Status(ctx context.Context) *AuthStatus {
+	api.authMu.Lock()
+	defer api.authMu.Unlock()
+
+	status := &AuthStatus{
+		Environment: api.environment,
+		Store:       describeStore(api.store),
+		ReadOnly:    api.readOnly,
+	}
+
+	current := api.currentToken()
+	if current == nil {
+		current = api.loadStateFile()
+	}
+	if current == nil {
+		return status
+	}
+
+	status.OfflineAccess = hasRefreshToken(current)
+	if current.parseErr != nil {
+		status.Err = current.parseErr
+		return status
+	}
+
+	// report the unverified claims if verification fails
+	claims := *current.claims
+	status.Claims = &claims
+
+	// loadStateFile does not use a saved token that grants TradeScope in
+	// read-only mode
+	if api.readOnly && grantsScope(current, TradeScope) {
+		status.Err = ErrTradeScope
+		return status
+	}
+
+	if api.verify {
+		verified, err := api.verifyToken(ctx, current)
+		if err != nil {
+			status.Err = err
+			return status
+		}
+		api.setToken(verified)
+
+		claims := *verified.claims
+		status.Claims = &claims
+	}
+
+	return status
+}
+
+// Logout revokes the refresh token at the signin server and deletes the
+// saved token. If the refresh token cannot be revoked the saved token is
+// kept so logging out can be retried.
+func (api *API) Logout(ctx context.Context) error {
+	api.authMu.Lock()
+	defer api.authMu.Unlock()
+
+	if api.currentToken() == nil {
+		api.loadStateFile()
+	}
+
+	if current := api.currentToken(); hasRefreshToken(current) {
+		if err := api.revoke(ctx, current); err != nil {
+			return err
+		}
+		api.logger.Info().Msg("revoked refresh token")
+	}
+
+	if api.store != nil {
+		if err := api.store.Delete(); err != nil {
+			api.logger.Error().Err(err).Msg("could not delete saved token")
+			return err
+		}
+	}
+
+	api.setToken(nil)
+	return nil
+}
+
+// revoke revokes the refresh token of `token`
+func (api *API) revoke(ctx context.Context, token *sealedToken) error {
+	opened := &openedSecrets{}
+	defer opened.destroy()
+
+	body := make(map[string]string)
+	for field, enclave := range map[string]*memguard.Enclave{
+		"client_id":     api.clientID,
+		"client_secret": api.clientSecret,
+		"token":         token.refresh,
+	} {
+		value, err := opened.open(enclave)
+		if err != nil {
+			api.logger.Error().Err(err).Str("Field", field).Msg("could not open secret for token revocation")
+			return err
+		}
+		if value != "" {
+			body[field] = value
+		}
+	}
+
+	curl := resty.NewWithClient(api.client.GetClient())
+	resp, err := curl.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(api.signinUrl + "/oauth/revoke")
+	if err != nil {
+		api.logger.Error().Err(err).Msg("could not revoke refresh token")
+		return err
+	}
+	if err := checkResponse(resp, nil); err != nil {
+		api.logger.Error().Err(err).Int("StatusCode", resp.StatusCode()).Msg("refresh token revocation failed")
+		return err
+	}
+
+	return nil
+}
+
+// describeStore returns where `store` saves tokens
+func describeStore(store TokenStore) string {
+	switch store := store.(type) {
+	case nil:
+		return "none"
+	case *FileTokenStore:
+		return store.Path
+	case *BoltTokenStore:
+		return fmt.Sprintf("%s (profile %s)", store.Path, store.Profile)
+	case *MemoryTokenStore:
+		return "memory"
+	default:
+		return fmt.Sprintf("%T", store)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// StreamEventType identifies the events delivered by streams
+type StreamEventType string
+
+const (
+	// STREAM_DATA events carry a quote, an update of the current bar or
+	// other market data
+	STREAM_DATA StreamEventType = "Data"
+
+	// STREAM_BAR_CLOSED events carry a completed bar
+	STREAM_BAR_CLOSED StreamEventType = "BarClosed"
+
+	// STREAM_GO_AWAY events are sent when TradeStation asks the client to
+	// reconnect; the stream reconnects immediately
+	STREAM_GO_AWAY StreamEventType = "GoAway"
+
+	// STREAM_DISCONNECTED events are sent when the connection is lost or
+	// stalls; the stream reconnects with backoff. Err is the cause.
+	STREAM_DISCONNECTED StreamEventType = "Disconnected"
+
+	// STREAM_ERROR events carry a *StreamError sent by TradeStation, after
+	// which the stream continues, or the error that ended the stream, after
+	// which the channel is closed
+	STREAM_ERROR StreamEventType = "Error"
+)
+
+// streamContentType is the media type of TradeStation streams
+const streamContentType = "application/vnd.tradestation.streams.v2+json"
+
+// StreamPolicy controls how streams detect stalled connections and
+// reconnect. Reconnects back off exponentially from WaitTime to
+// MaxWaitTime; the backoff is reset once a connection delivers a message.
+type StreamPolicy struct {
+	// HeartbeatTimeout is how long a stream may be silent before it is
+	// considered stalled; TradeStation sends a heartbeat every 5 seconds
+	HeartbeatTimeout time.Duration
+	WaitTime         time.Duration
+	MaxWaitTime      time.Duration
+}
+
+var DefaultStreamPolicy = StreamPolicy{
+	HeartbeatTimeout: 15 * time.Second,
+	WaitTime:         time.Second,
+	MaxWaitTime:      30 * time.Second,
+}
+
+// streamMessage holds the fields of stream control messages; data messages
+// have none of them set
+type streamMessage struct {
+	Heartbeat    int
+	StreamStatus string
+	Error        string
+	Message      string
+	Symbol       string
+}
+
+// errGoAway ends a connection that TradeStation asked to be re-established
+var errGoAway = errors.New("tradestation: stream go away")
+
+// stream is a long-lived TradeStation stream that reconnects until its
+// context is cancelled or it fails permanently
+type stream struct {
+	api    *API
+	path   string
+	logger zerolog.Logger
+
+	// query returns the query parameters of the next connection; may be nil
+	query func() map[string]string
+
+	// onData delivers a data message; it only returns an error if the
+	// stream must end
+	onData func(ctx context.Context, raw json.RawMessage) error
+
+	// onEvent delivers every other event
+	onEvent func(ctx context.Context, eventType StreamEventType, err error)
+}
+
+// run connects and reconnects the stream until `ctx` is cancelled or the
+// stream fails permanently
+func (s *stream) run(ctx context.Context) {
+	policy := s.api.streamPolicy
+	wait := policy.WaitTime
+
+	for {
+		received, err := s.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if received {
+			wait = policy.WaitTime
+		}
+
+		switch {
+		case errors.Is(err, errGoAway):
+			s.logger.Info().Msg("stream asked to reconnect")
+			s.onEvent(ctx, STREAM_GO_AWAY, nil)
+			continue
+		case !retryableStreamError(err):
+			s.logger.Error().Err(err).Msg("stream failed")
+			s.onEvent(ctx, STREAM_ERROR, err)
+			return
+		}
+
+		s.logger.Warn().Err(err).Dur("Wait", wait).Msg("stream disconnected; reconnecting")
+		s.onEvent(ctx, STREAM_DISCONNECTED, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+		if wait > policy.MaxWaitTime {
+			wait = policy.MaxWaitTime
+		}
+	}
+}
+
+// retryableStreamError returns true if the stream should reconnect after
+// `err`
+func retryableStreamError(err error) bool {
+	if errors.Is(err, ErrUnauthorized) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	return true
+}
+
+// connect opens a single connection and reads messages until it fails.
+// `received` is true if at least one message was read.
+func (s *stream) connect(ctx context.Context) (received bool, err error) {
+	if err := s.api.CheckAuthContext(ctx); err != nil {
+		return false, err
+	}
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the watchdog closes the connection when no message arrives in time
+	timeout := s.api.streamPolicy.HeartbeatTimeout
+	var stalled atomic.Bool
+	watchdog := time.AfterFunc(timeout, func() {
+		stalled.Store(true)
+		cancel()
+	})
+	defer watchdog.Stop()
+
+	stalledErr := func(err error) error {
+		if stalled.Load() {
+			return ErrStreamStalled
+		}
+		return err
+	}
+
+	req, logger := s.api.newRequest(connCtx)
+	if s.query != nil {
+		req.SetQueryParams(s.query())
+	}
+	resp, err := req.
+		SetDoNotParseResponse(true).
+		SetHeader("Accept", streamContentType).
+		Get(s.path)
+	if err != nil {
+		return false, stalledErr(err)
+	}
+	s.api.countResponse(resp)
+
+	body := resp.RawBody()
+	defer body.Close()
+
+	if resp.StatusCode() >= 400 {
+		data, _ := io.ReadAll(io.LimitReader(body, 64*1024))
+		apiErr := &APIError{
+			StatusCode: resp.StatusCode(),
+			Method:     http.MethodGet,
+			Endpoint:   resp.Request.URL,
+			Message:    errorMessage(data),
+		}
+		logger.Error().Err(apiErr).Msg("could not open stream")
+		return false, apiErr
+	}
+
+	logger.Debug().Str("Path", s.path).Msg("stream connected")
+
+	dec := json.NewDecoder(body)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return received, stalledErr(err)
+		}
+		watchdog.Reset(timeout)
+		received = true
+
+		var msg streamMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			logger.Warn().Err(err).Msg("ignoring malformed stream message")
+			continue
+		}
+
+		switch {
+		case msg.Heartbeat != 0:
+			logger.Trace().Int("Heartbeat", msg.Heartbeat).Msg("stream heartbeat")
+		case msg.StreamStatus == "GoAway":
+			return received, errGoAway
+		case msg.StreamStatus != "":
+			logger.Debug().Str("StreamStatus", msg.StreamStatus).Msg("stream status")
+		case msg.Error != "":
+			streamErr := &StreamError{Symbol: msg.Symbol, Code: msg.Error, Message: msg.Message}
+			logger.Warn().Err(streamErr).Msg("stream reported an error")
+			watchdog.Stop()
+			s.onEvent(ctx, STREAM_ERROR, streamErr)
+			watchdog.Reset(timeout)
+		default:
+			// a slow consumer does not count as a stalled stream
+			watchdog.Stop()
+			err := s.onData(ctx, raw)
+			watchdog.Reset(timeout)
+			if err != nil {
+				return received, err
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+	"github.com/penny-vault/tradestation/tradestation/tradestationtest"
+	"github.com/shopspring/decimal"
+)
+
+// fastStreams makes streams reconnect without noticeable delay
+var fastStreams = tradestation.StreamPolicy{
+	HeartbeatTimeout: 5 * time.Second,
+	WaitTime:         time.Millisecond,
+	MaxWaitTime:      10 * time.Millisecond,
+}
+
+// TestStreamFailedConnects checks that streams, not the http client, retry
+// connections that TradeStation refuses, so the body of every refused
+// connection is closed
+func TestStreamFailedConnects(t *testing.T) {
+	const refused = 3
+
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	var mu sync.Mutex
+	var responses []*http.Response
+	opts := srv.Options()
+	opts.RetryPolicy = &tradestation.RetryPolicy{MaxRetries: 3, WaitTime: time.Millisecond, MaxWaitTime: 10 * time.Millisecond}
+	opts.StreamPolicy = &fastStreams
+	opts.Transport = &faultTransport{
+		next: srv.Client().Transport,
+		fault: func(req *http.Request) (*http.Response, error) {
+			if !strings.Contains(req.URL.Path, "/stream/") {
+				return nil, nil
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(responses) == refused {
+				return nil, nil
+			}
+			codes := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadGateway}
+			resp := faultResponse(req, codes[len(responses)%len(codes)], nil)
+			responses = append(responses, resp)
+			return resp, nil
+		},
+	}
+	api := tradestation.NewWithOptions(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, err := api.StreamQuotes(ctx, []string{"SPY"})
+	if err != nil {
+		t.Fatalf("StreamQuotes: %v", err)
+	}
+
+	disconnects := 0
+	for event := range events {
+		if event.Type == tradestation.STREAM_DATA {
+			break
+		}
+		if event.Type != tradestation.STREAM_DISCONNECTED {
+			t.Fatalf("received %s event: %v", event.Type, event.Err)
+		}
+
+		var apiErr *tradestation.APIError
+		if !errors.As(event.Err, &apiErr) {
+			t.Errorf("disconnected with %v, want an APIError", event.Err)
+		}
+		disconnects++
+	}
+	cancel()
+
+	if disconnects != refused {
+		t.Errorf("stream was disconnected %d times, want %d", disconnects, refused)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for idx, resp := range responses {
+		if !resp.Body.(*closeBody).closed.Load() {
+			t.Errorf("body of refused connection %d was not closed", idx+1)
+		}
+	}
+}
+
+// nextQuote returns the next event of `events`, or nil once the stream has
+// ended
+func nextQuote(t *testing.T, events <-chan *tradestation.QuoteEvent) *tradestation.QuoteEvent {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream event within 5s")
+		return nil
+	}
+}
+
+// streamQuotes opens a quote stream of `symbols` with `opts` that is closed
+// when the test ends
+func streamQuotes(t *testing.T, opts tradestation.Options, symbols ...string) <-chan *tradestation.QuoteEvent {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	events, err := tradestation.NewWithOptions(opts).StreamQuotes(ctx, symbols)
+	if err != nil {
+		t.Fatalf("StreamQuotes: %v", err)
+	}
+	return events
+}
+
+func TestStreamStalled(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+	srv.StreamHeartbeat = 20 * time.Millisecond
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	opts := srv.Options()
+	opts.StreamPolicy = &tradestation.StreamPolicy{HeartbeatTimeout: 200 * time.Millisecond, WaitTime: time.Millisecond, MaxWaitTime: 10 * time.Millisecond}
+	events := streamQuotes(t, opts, "SPY")
+
+	if event := nextQuote(t, events); event.Type != tradestation.STREAM_DATA {
+		t.Fatalf("first event is %s (%v), want %s", event.Type, event.Err, tradestation.STREAM_DATA)
+	}
+
+	// heartbeats keep a stream without data alive
+	select {
+	case event := <-events:
+		t.Fatalf("received %s event (%v) from a stream with heartbeats", event.Type, event.Err)
+	case <-time.After(2 * opts.StreamPolicy.HeartbeatTimeout):
+	}
+
+	srv.PauseStreams(true)
+	event := nextQuote(t, events)
+	if event.Type != tradestation.STREAM_DISCONNECTED || !errors.Is(event.Err, tradestation.ErrStreamStalled) {
+		t.Fatalf("received %s event (%v), want %s with %v", event.Type, event.Err, tradestation.STREAM_DISCONNECTED, tradestation.ErrStreamStalled)
+	}
+
+	// the stream reconnects until the server sends again
+	srv.PauseStreams(false)
+	for event := nextQuote(t, events); event.Type != tradestation.STREAM_DATA; event = nextQuote(t, events) {
+		if event.Type != tradestation.STREAM_DISCONNECTED {
+			t.Fatalf("received %s event (%v) while reconnecting", event.Type, event.Err)
+		}
+	}
+}
+
+func TestStreamGoAway(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	var connects atomic.Int32
+	opts := srv.Options()
+	opts.StreamPolicy = &tradestation.StreamPolicy{HeartbeatTimeout: 5 * time.Second, WaitTime: time.Hour, MaxWaitTime: time.Hour}
+	opts.Transport = &faultTransport{
+		next: srv.Client().Transport,
+		fault: func(req *http.Request) (*http.Response, error) {
+			if strings.Contains(req.URL.Path, "/stream/") {
+				connects.Add(1)
+			}
+			return nil, nil
+		},
+	}
+	events := streamQuotes(t, opts, "SPY")
+
+	if event := nextQuote(t, events); event.Type != tradestation.STREAM_DATA {
+		t.Fatalf("first event is %s (%v), want %s", event.Type, event.Err, tradestation.STREAM_DATA)
+	}
+
+	// the stream reconnects right away although the backoff is an hour
+	srv.GoAwayStreams()
+	if event := nextQuote(t, events); event.Type != tradestation.STREAM_GO_AWAY {
+		t.Fatalf("received %s event (%v), want %s", event.Type, event.Err, tradestation.STREAM_GO_AWAY)
+	}
+
+	event := nextQuote(t, events)
+	if event.Type != tradestation.STREAM_DATA {
+		t.Fatalf("received %s event (%v) after go away, want %s", event.Type, event.Err, tradestation.STREAM_DATA)
+	}
+	if event.Quote.Symbol != "SPY" || !event.Quote.Bid.Equal(decimal.RequireFromString("399.98")) {
+		t.Errorf("quote after go away is %s with bid %s, want the full quote of SPY", event.Quote.Symbol, event.Quote.Bid)
+	}
+	if n := connects.Load(); n != 2 {
+		t.Errorf("stream connected %d times, want 2", n)
+	}
+}
+
+// TestStreamBackoff checks that reconnects back off exponentially and that
+// the backoff starts over once a connection delivered a message
+func TestStreamBackoff(t *testing.T) {
+	const wait = 50 * time.Millisecond
+
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	var mu sync.Mutex
+	var attempts []time.Time
+	opts := srv.Options()
+	opts.StreamPolicy = &tradestation.StreamPolicy{HeartbeatTimeout: 5 * time.Second, WaitTime: wait, MaxWaitTime: time.Second}
+	opts.Transport = &faultTransport{
+		next: srv.Client().Transport,
+		fault: func(req *http.Request) (*http.Response, error) {
+			if !strings.Contains(req.URL.Path, "/stream/") {
+				return nil, nil
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, time.Now())
+			switch len(attempts) {
+			case 1, 2, 3, 5:
+				return faultResponse(req, http.StatusServiceUnavailable, nil), nil
+			case 4:
+				// a heartbeat, then the connection drops
+				resp := faultResponse(req, http.StatusOK, nil)
+				resp.Body = io.NopCloser(strings.NewReader(`{"Heartbeat":1,"Timestamp":"2023-03-01T15:00:00Z"}` + "\n"))
+				return resp, nil
+			}
+			return nil, nil
+		},
+	}
+	events := streamQuotes(t, opts, "SPY")
+
+	for event := nextQuote(t, events); event.Type != tradestation.STREAM_DATA; event = nextQuote(t, events) {
+		if event.Type != tradestation.STREAM_DISCONNECTED {
+			t.Fatalf("received %s event (%v) while reconnecting", event.Type, event.Err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 6 {
+		t.Fatalf("stream connected %d times, want 6", len(attempts))
+	}
+
+	// the waits before attempts 2 to 6
+	want := []time.Duration{wait, 2 * wait, 4 * wait, wait, 2 * wait}
+	for idx, min := range want {
+		got := attempts[idx+1].Sub(attempts[idx])
+		if got < min || got >= min+2*wait {
+			t.Errorf("waited %v before attempt %d, want %v", got, idx+2, min)
+		}
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	srv := tradestationtest.NewServer()
+	defer srv.Close()
+	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+
+	// an error message for one symbol does not end the stream
+	events := streamQuotes(t, srv.Options(), "NOPE", "SPY")
+
+	var streamErr *tradestation.StreamError
+	quoted := false
+	for !quoted || streamErr == nil {
+		event := nextQuote(t, events)
+		switch event.Type {
+		case tradestation.STREAM_DATA:
+			quoted = event.Quote.Symbol == "SPY"
+		case tradestation.STREAM_ERROR:
+			if !errors.As(event.Err, &streamErr) {
+				t.Fatalf("STREAM_ERROR event carries %v, want a StreamError", event.Err)
+			}
+		default:
+			t.Fatalf("received %s event (%v)", event.Type, event.Err)
+		}
+	}
+	if streamErr.Symbol != "NOPE" || streamErr.Code != "INVALID SYMBOL" {
+		t.Errorf("StreamError is %+v, want INVALID SYMBOL for NOPE", streamErr)
+	}
+
+	// an error that cannot be retried ends the stream
+	opts := srv.Options()
+	opts.Transport = &faultTransport{
+		next: srv.Client().Transport,
+		fault: func(req *http.Request) (*http.Response, error) {
+			if strings.Contains(req.URL.Path, "/stream/") {
+				return faultResponse(req, http.StatusBadRequest, nil), nil
+			}
+			return nil, nil
+		},
+	}
+	events = streamQuotes(t, opts, "SPY")
+
+	event := nextQuote(t, events)
+	var apiErr *tradestation.APIError
+	if event.Type != tradestation.STREAM_ERROR || !errors.As(event.Err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("received %s event (%v), want %s with status 400", event.Type, event.Err, tradestation.STREAM_ERROR)
+	}
+	if event := nextQuote(t, events); event != nil {
+		t.Errorf("received %s event (%v) after the stream failed", event.Type, event.Err)
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNoToken is returned by a TokenStore that has no saved token
+var ErrNoToken = errors.New("tradestation: no saved token")
+
+// TokenStore persists OAuth tokens between runs
+type TokenStore interface {
+	// Load returns the saved token or ErrNoToken if there is none
+	Load() (*OAuthToken, error)
+
+	// Save persists `token`, replacing any previously saved token
+	Save(token *OAuthToken) error
+
+	// Delete removes the saved token; it is not an error if there is none
+	Delete() error
+}
+
+// FileTokenStore saves tokens to an AES encrypted file. The file is replaced
+// atomically so a crash while saving never leaves a partially written token
+// behind.
+type FileTokenStore struct {
+	Path string
+
+	// KeySource provides the key the token is encrypted with; nil uses the
+	// key of the profile chosen with --profile
+	KeySource KeySource
+
+	mu sync.Mutex
+}
+
+func (store *FileTokenStore) Load() (*OAuthToken, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	state, err := os.ReadFile(store.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := storeKey(store.KeySource)
+	if err != nil {
+		return nil, err
+	}
+
+	stateData, err := DecryptAESWithKey(key, string(state))
+	if err != nil {
+		return nil, fmt.Errorf("tradestation: could not decrypt %s: %w", store.Path, err)
+	}
+
+	var token OAuthToken
+	if err := json.Unmarshal([]byte(stateData), &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (store *FileTokenStore) Save(token *OAuthToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	key, err := storeKey(store.KeySource)
+	if err != nil {
+		return err
+	}
+
+	encryptedData, err := EncryptAESWithKey(key, string(data))
+	if err != nil {
+		return fmt.Errorf("tradestation: could not encrypt token: %w", err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return WriteFileAtomic(store.Path, []byte(encryptedData), 0600)
+}
+
+// Delete removes the state file
+func (store *FileTokenStore) Delete() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := os.Remove(store.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Rekey re-encrypts the saved token, replacing `oldKey` with `newKey`. A
+// missing file is not an error.
+func (store *FileTokenStore) Rekey(oldKey, newKey *Key) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	state, err := os.ReadFile(store.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := DecryptAESWithKey(oldKey, string(state))
+	if err != nil {
+		return fmt.Errorf("tradestation: could not decrypt %s with the old key: %w", store.Path, err)
+	}
+
+	encrypted, err := EncryptAESWithKey(newKey, plaintext)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(store.Path, []byte(encrypted), 0600)
+}
+
+// storeKey returns the key of `src`, or the key of the profile chosen with
+// --profile if `src` is nil
+func storeKey(src KeySource) (*Key, error) {
+	if src == nil {
+		src = CurrentProfile()
+	}
+	return src.Key()
+}
+
+// MemoryTokenStore holds a single token in memory. The zero value is an
+// empty store.
+type MemoryTokenStore struct {
+	mu    sync.Mutex
+	token *OAuthToken
+}
+
+// NewMemoryTokenStore returns a store that holds `token`
+func NewMemoryTokenStore(token *OAuthToken) *MemoryTokenStore {
+	return &MemoryTokenStore{token: token}
+}
+
+func (store *MemoryTokenStore) Load() (*OAuthToken, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.token == nil {
+		return nil, ErrNoToken
+	}
+	return store.token, nil
+}
+
+func (store *MemoryTokenStore) Save(token *OAuthToken) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.token = token
+	return nil
+}
+
+func (store *MemoryTokenStore) Delete() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.token = nil
+	return nil
+}
+
+// tokenBucket holds the encrypted token of each profile in a BoltTokenStore
+var tokenBucket = []byte("tokens")
+
+// BoltTokenStore saves the tokens of many profiles in an embedded bbolt
+// database. Each token is AES encrypted before it is written and every save
+// is a single transaction, so a crash never corrupts a saved token. The
+// database is only opened for the duration of each call so several
+// processes can share it.
+type BoltTokenStore struct {
+	Path string
+
+	// Profile names the token that is loaded and saved
+	Profile string
+
+	// KeySource provides the key tokens are encrypted with; nil uses the
+	// key of the profile chosen with --profile
+	KeySource KeySource
+}
+
+// open opens the database, waiting at most a few seconds for other
+// processes to release it
+func (store *BoltTokenStore) open(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(store.Path, 0600, &bolt.Options{
+		Timeout:  5 * time.Second,
+		ReadOnly: readOnly,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tradestation: could not open token database %s: %w", store.Path, err)
+	}
+	return db, nil
+}
+
+func (store *BoltTokenStore) Load() (*OAuthToken, error) {
+	if _, err := os.Stat(store.Path); errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoToken
+	}
+
+	db, err := store.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var encrypted []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(tokenBucket); bucket != nil {
+			// the value is only valid for the life of the transaction
+			encrypted = append(encrypted, bucket.Get([]byte(store.Profile))...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encrypted) == 0 {
+		return nil, ErrNoToken
+	}
+
+	key, err := storeKey(store.KeySource)
+	if err != nil {
+		return nil, err
+	}
+
+	stateData, err := DecryptAESWithKey(key, string(encrypted))
+	if err != nil {
+		return nil, fmt.Errorf("tradestation: could not decrypt token of profile %s: %w", store.Profile, err)
+	}
+
+	var token OAuthToken
+	if err := json.Unmarshal([]byte(stateData), &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (store *BoltTokenStore) Save(token *OAuthToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	key, err := storeKey(store.KeySource)
+	if err != nil {
+		return err
+	}
+
+	encryptedData, err := EncryptAESWithKey(key, string(data))
+	if err != nil {
+		return fmt.Errorf("tradestation: could not encrypt token: %w", err)
+	}
+
+	db, err := store.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(tokenBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(store.Profile), []byte(encryptedData))
+	})
+}
+
+// Delete removes the token of the profile
+func (store *BoltTokenStore) Delete() error {
+	if _, err := os.Stat(store.Path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	db, err := store.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(tokenBucket); bucket != nil {
+			return bucket.Delete([]byte(store.Profile))
+		}
+		return nil
+	})
+}
+
+// Rekey re-encrypts the tokens of every profile, replacing `oldKey` with
+// `newKey`. All tokens are replaced in a single transaction.
+func (store *BoltTokenStore) Rekey(oldKey, newKey *Key) error {
+	return store.RekeyProfiles(oldKey, newKey)
+}
+
+// RekeyProfiles is like Rekey but only re-encrypts the tokens of `profiles`;
+// without profiles every token is re-encrypted
+func (store *BoltTokenStore) RekeyProfiles(oldKey, newKey *Key, profiles ...string) error {
+	selected := make(map[string]bool, len(profiles))
+	for _, profile := range profiles {
+		selected[profile] = true
+	}
+
+	if _, err := os.Stat(store.Path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	db, err := store.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokenBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		// collect first; a bucket must not be modified while iterating
+		rekeyed := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			if len(selected) > 0 && !selected[string(k)] {
+				return nil
+			}
+
+			plaintext, err := DecryptAESWithKey(oldKey, string(v))
+			if err != nil {
+				return fmt.Errorf("tradestation: could not decrypt token of profile %s with the old key: %w", k, err)
+			}
+			encrypted, err := EncryptAESWithKey(newKey, plaintext)
+			if err != nil {
+				return err
+			}
+			rekeyed[string(k)] = []byte(encrypted)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for profile, encrypted := range rekeyed {
+			if err := bucket.Put([]byte(profile), encrypted); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Profiles returns the sorted names of all profiles with a saved token
+func (store *BoltTokenStore) Profiles() ([]string, error) {
+	profiles := make([]string, 0)
+	if _, err := os.Stat(store.Path); errors.Is(err, os.ErrNotExist) {
+		return profiles, nil
+	}
+
+	db, err := store.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokenBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			profiles = append(profiles, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(profiles)
+	return profiles, nil
+}
+
+// WriteFileAtomic writes `data` to a temporary file in the same directory as
+// `filename` and then renames it over `filename`
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	// the temporary file is removed unless the rename succeeds
+	defer os.Remove(tmpName)
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, filename)
+}
@@ -0,0 +1,276 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestation_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/penny-vault/tradestation/tradestation"
+)
+
+// staticKey is a KeySource that always returns the same key
+type staticKey struct {
+	key *tradestation.Key
+}
+
+func (src staticKey) Key() (*tradestation.Key, error) {
+	return src.key, nil
+}
+
+func testToken(name string) *tradestation.OAuthToken {
+	return &tradestation.OAuthToken{
+		AccessToken:  "access-" + name,
+		RefreshToken: "refresh-" + name,
+		TokenType:    "Bearer",
+		Scope:        "openid MarketData",
+		ExpiresIn:    1200,
+	}
+}
+
+// requireToken fails the test unless `store` holds `want`
+func requireToken(t *testing.T, store tradestation.TokenStore, want *tradestation.OAuthToken) {
+	t.Helper()
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load returned %+v, want %+v", got, want)
+	}
+}
+
+// requireNoToken fails the test unless `store` is empty
+func requireNoToken(t *testing.T, store tradestation.TokenStore) {
+	t.Helper()
+
+	if token, err := store.Load(); !errors.Is(err, tradestation.ErrNoToken) {
+		t.Fatalf("Load returned %+v, %v; want %v", token, err, tradestation.ErrNoToken)
+	}
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	store := &tradestation.MemoryTokenStore{}
+	requireNoToken(t, store)
+
+	if err := store.Save(testToken("a")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	requireToken(t, store, testToken("a"))
+
+	if err := store.Delete(); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	requireNoToken(t, store)
+}
+
+func TestFileTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.dat")
+	store := &tradestation.FileTokenStore{Path: path, KeySource: staticKey{testKey(t, 1)}}
+	requireNoToken(t, store)
+
+	if err := store.Save(testToken("a")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	requireToken(t, store, testToken("a"))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("state file has mode %v, want 0600", perm)
+	}
+
+	// another key cannot read the token
+	other := &tradestation.FileTokenStore{Path: path, KeySource: staticKey{testKey(t, 2)}}
+	if _, err := other.Load(); !errors.Is(err, tradestation.ErrWrongKey) {
+		t.Errorf("Load with another key returned %v, want %v", err, tradestation.ErrWrongKey)
+	}
+
+	if err := store.Rekey(testKey(t, 1), testKey(t, 2)); err != nil {
+		t.Fatalf("Rekey: %v", err)
+	}
+	requireToken(t, other, testToken("a"))
+
+	for idx := 0; idx < 2; idx++ {
+		if err := other.Delete(); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	requireNoToken(t, other)
+
+	// a missing file is not an error
+	if err := other.Rekey(testKey(t, 2), testKey(t, 1)); err != nil {
+		t.Errorf("Rekey of a missing file: %v", err)
+	}
+}
+
+func TestBoltTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	oldKey := testKey(t, 1)
+
+	stores := make(map[string]*tradestation.BoltTokenStore)
+	for _, profile := range []string{tradestation.DefaultProfile, "paper", "live"} {
+		stores[profile] = &tradestation.BoltTokenStore{Path: path, Profile: profile, KeySource: staticKey{oldKey}}
+	}
+
+	// neither the database nor the token exist yet
+	requireNoToken(t, stores[tradestation.DefaultProfile])
+	if profiles, err := stores[tradestation.DefaultProfile].Profiles(); err != nil || len(profiles) != 0 {
+		t.Fatalf("Profiles returned %v, %v; want none", profiles, err)
+	}
+	if err := stores[tradestation.DefaultProfile].Delete(); err != nil {
+		t.Fatalf("Delete without a database: %v", err)
+	}
+
+	for profile, store := range stores {
+		if err := store.Save(testToken(profile)); err != nil {
+			t.Fatalf("Save %q: %v", profile, err)
+		}
+	}
+	for profile, store := range stores {
+		requireToken(t, store, testToken(profile))
+	}
+
+	profiles, err := stores[tradestation.DefaultProfile].Profiles()
+	if err != nil {
+		t.Fatalf("Profiles: %v", err)
+	}
+	if want := []string{tradestation.DefaultProfile, "live", "paper"}; !reflect.DeepEqual(profiles, want) {
+		t.Errorf("Profiles returned %q, want %q", profiles, want)
+	}
+
+	requireNoToken(t, &tradestation.BoltTokenStore{Path: path, Profile: "unknown", KeySource: staticKey{oldKey}})
+
+	// saving replaces only the token of the profile
+	replaced := testToken("paper")
+	replaced.AccessToken = "access-paper-2"
+	if err := stores["paper"].Save(replaced); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	requireToken(t, stores["paper"], replaced)
+	requireToken(t, stores["live"], testToken("live"))
+
+	if err := stores["live"].Delete(); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	requireNoToken(t, stores["live"])
+	requireToken(t, stores[tradestation.DefaultProfile], testToken(tradestation.DefaultProfile))
+	requireToken(t, stores["paper"], replaced)
+}
+
+func TestBoltTokenStoreRekeyProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	oldKey, newKey := testKey(t, 1), testKey(t, 2)
+
+	for _, profile := range []string{tradestation.DefaultProfile, "paper", "live"} {
+		store := &tradestation.BoltTokenStore{Path: path, Profile: profile, KeySource: staticKey{oldKey}}
+		if err := store.Save(testToken(profile)); err != nil {
+			t.Fatalf("Save %q: %v", profile, err)
+		}
+	}
+
+	store := &tradestation.BoltTokenStore{Path: path}
+	if err := store.RekeyProfiles(oldKey, newKey, "paper"); err != nil {
+		t.Fatalf("RekeyProfiles: %v", err)
+	}
+	requireToken(t, &tradestation.BoltTokenStore{Path: path, Profile: "paper", KeySource: staticKey{newKey}}, testToken("paper"))
+	requireToken(t, &tradestation.BoltTokenStore{Path: path, Profile: "live", KeySource: staticKey{oldKey}}, testToken("live"))
+	requireToken(t, &tradestation.BoltTokenStore{Path: path, Profile: tradestation.DefaultProfile, KeySource: staticKey{oldKey}}, testToken(tradestation.DefaultProfile))
+
+	// a profile that cannot be decrypted fails the whole transaction
+	if err := store.Rekey(oldKey, newKey); !errors.Is(err, tradestation.ErrWrongKey) {
+		t.Fatalf("Rekey with a profile under another key returned %v, want %v", err, tradestation.ErrWrongKey)
+	}
+	requireToken(t, &tradestation.BoltTokenStore{Path: path, Profile: "live", KeySource: staticKey{oldKey}}, testToken("live"))
+
+	if err := store.RekeyProfiles(oldKey, newKey, tradestation.DefaultProfile, "live"); err != nil {
+		t.Fatalf("RekeyProfiles: %v", err)
+	}
+	for _, profile := range []string{tradestation.DefaultProfile, "paper", "live"} {
+		requireToken(t, &tradestation.BoltTokenStore{Path: path, Profile: profile, KeySource: staticKey{newKey}}, testToken(profile))
+	}
+}
+
+// tempFiles returns the temporary files WriteFileAtomic left in `dir`
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+
+	for _, data := range []string{"a much longer first version\n", "second\n"} {
+		if err := tradestation.WriteFileAtomic(path, []byte(data), 0640); err != nil {
+			t.Fatalf("WriteFileAtomic: %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("file holds %q, want %q", got, data)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0640 {
+		t.Errorf("file has mode %v, want 0640", perm)
+	}
+	if left := tempFiles(t, dir); len(left) != 0 {
+		t.Errorf("temporary files left behind: %v", left)
+	}
+}
+
+func TestWriteFileAtomicFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	// the rename fails because the target is a directory that is not empty
+	target := filepath.Join(dir, "state.dat")
+	if err := os.MkdirAll(filepath.Join(target, "keep"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tradestation.WriteFileAtomic(target, []byte("token"), 0600); err == nil {
+		t.Fatal("WriteFileAtomic over a directory succeeded")
+	}
+	if left := tempFiles(t, dir); len(left) != 0 {
+		t.Errorf("temporary files left behind: %v", left)
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		t.Errorf("target was modified: %v", err)
+	}
+
+	// the directory of the file does not exist
+	if err := tradestation.WriteFileAtomic(filepath.Join(dir, "missing", "state.dat"), []byte("token"), 0600); err == nil {
+		t.Error("WriteFileAtomic into a missing directory succeeded")
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestationtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/penny-vault/tradestation/tradestation"
+)
+
+const defaultScope = "openid profile MarketData ReadAccount Trade offline_access"
+
+// authCode is an issued authorization code
+type authCode struct {
+	scope string
+
+	// challenge is the S256 PKCE code challenge sent with the authorize
+	// request, if any
+	challenge string
+}
+
+// Token issues a new access and refresh token that are accepted by the
+// server
+func (srv *Server) Token() *tradestation.OAuthToken {
+	return srv.issueToken(defaultScope, true, TokenLifetime)
+}
+
+// ExpiringToken is like Token but the access token expires after `lifetime`;
+// clients refresh tokens that expire within a minute before using them
+func (srv *Server) ExpiringToken(lifetime time.Duration) *tradestation.OAuthToken {
+	return srv.issueToken(defaultScope, true, lifetime)
+}
+
+// Refreshes returns the number of access tokens issued for a refresh token
+func (srv *Server) Refreshes() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.refreshes
+}
+
+// issueToken creates a signed access token for `scope` that is valid for
+// `lifetime`; a refresh token is only included if `refresh` is true
+func (srv *Server) issueToken(scope string, refresh bool, lifetime time.Duration) *tradestation.OAuthToken {
+	now := time.Now()
+	tok, err := jwt.NewBuilder().
+		Issuer(srv.SigninURL()+"/").
+		Audience([]string{tradestation.TokenAudience}).
+		Subject("tradestationtest|user").
+		IssuedAt(now).
+		Expiration(now.Add(lifetime)).
+		Claim("scope", scope).
+		Build()
+	if err != nil {
+		panic(err)
+	}
+
+	srv.mu.Lock()
+	key := srv.signingKey
+	srv.mu.Unlock()
+
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.ES256, key))
+	if err != nil {
+		panic(err)
+	}
+
+	token := &tradestation.OAuthToken{
+		AccessToken: string(signed),
+		IDToken:     string(signed),
+		TokenType:   "Bearer",
+		Scope:       scope,
+		ExpiresIn:   int(lifetime / time.Second),
+	}
+
+	if refresh {
+		token.RefreshToken = randomString(32)
+		srv.mu.Lock()
+		srv.refreshTokens[token.RefreshToken] = scope
+		srv.mu.Unlock()
+	}
+
+	return token
+}
+
+// RotateSigningKey replaces the key that signs access tokens. Tokens signed
+// with the old key are no longer accepted.
+func (srv *Server) RotateSigningKey() {
+	key := newSigningKey()
+	srv.mu.Lock()
+	srv.signingKey = key
+	srv.mu.Unlock()
+}
+
+// newSigningKey generates the ES256 key access tokens are signed with
+func newSigningKey() jwk.Key {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := jwk.FromRaw(private)
+	if err != nil {
+		panic(err)
+	}
+	key.Set(jwk.KeyIDKey, randomString(8))
+	key.Set(jwk.AlgorithmKey, jwa.ES256)
+	return key
+}
+
+// handleJWKS publishes the public signing key
+func (srv *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	key := srv.signingKey
+	srv.mu.Unlock()
+
+	public, err := key.PublicKey()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	set := jwk.NewSet()
+	set.AddKey(public)
+	writeJSON(w, http.StatusOK, set)
+}
+
+// authorized rejects requests that do not carry a valid access token
+func (srv *Server) authorized(next http.HandlerFunc) http.Handler {
+	return srv.scoped("", next)
+}
+
+// scoped is like authorized but also rejects access tokens that do not
+// grant `scope`
+func (srv *Server) scoped(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, accessToken, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || accessToken == "" {
+			writeError(w, http.StatusUnauthorized, "missing access token")
+			return
+		}
+
+		srv.mu.Lock()
+		key := srv.signingKey
+		srv.mu.Unlock()
+
+		public, err := key.PublicKey()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		token, err := jwt.Parse([]byte(accessToken), jwt.WithKey(jwa.ES256, public), jwt.WithValidate(true))
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if scope != "" {
+			claim, _ := token.Get("scope")
+			granted, _ := claim.(string)
+			if !hasScope(granted, scope) {
+				writeError(w, http.StatusForbidden, "access token does not grant the "+scope+" scope")
+				return
+			}
+		}
+
+		next(w, r)
+	})
+}
+
+// hasScope returns true if the space separated `granted` scopes include
+// `scope`
+func hasScope(granted, scope string) bool {
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAuthorize immediately approves the login and redirects back to the
+// client, as if the user had signed in to TradeStation
+func (srv *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if params.Get("client_id") != ClientID {
+		writeError(w, http.StatusBadRequest, "unknown client_id")
+		return
+	}
+
+	redirect, err := url.Parse(params.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		writeError(w, http.StatusBadRequest, "invalid redirect_uri")
+		return
+	}
+
+	code := randomString(16)
+	srv.mu.Lock()
+	srv.codes[code] = authCode{
+		scope:     params.Get("scope"),
+		challenge: params.Get("code_challenge"),
+	}
+	srv.mu.Unlock()
+
+	query := redirect.Query()
+	query.Set("code", code)
+	query.Set("state", params.Get("state"))
+	redirect.RawQuery = query.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// handleToken implements the authorization_code and refresh_token grants of
+// the TradeStation token endpoint
+func (srv *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "token requests must be POST")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// clients using PKCE may omit the client secret when exchanging a code
+	secret := r.PostForm.Get("client_secret")
+	publicClient := secret == "" && r.PostForm.Get("code_verifier") != ""
+	if r.PostForm.Get("client_id") != ClientID || (secret != ClientSecret && !publicClient) {
+		writeError(w, http.StatusUnauthorized, "invalid client credentials")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		srv.mu.Lock()
+		issued, ok := srv.codes[code]
+		delete(srv.codes, code)
+		srv.mu.Unlock()
+
+		if !ok {
+			writeError(w, http.StatusForbidden, "invalid authorization code")
+			return
+		}
+
+		if issued.challenge != "" || publicClient {
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if issued.challenge == "" || base64.RawURLEncoding.EncodeToString(sum[:]) != issued.challenge {
+				writeError(w, http.StatusForbidden, "invalid code_verifier")
+				return
+			}
+		}
+
+		scope := strings.Join(strings.Fields(issued.scope), " ")
+		writeJSON(w, http.StatusOK, srv.issueToken(scope, strings.Contains(scope, "offline_access"), TokenLifetime))
+	case "refresh_token":
+		srv.mu.Lock()
+		scope, ok := srv.refreshTokens[r.PostForm.Get("refresh_token")]
+		if ok && srv.RotateRefreshTokens {
+			delete(srv.refreshTokens, r.PostForm.Get("refresh_token"))
+		}
+		if ok {
+			srv.refreshes++
+		}
+		srv.mu.Unlock()
+
+		if !ok {
+			writeError(w, http.StatusForbidden, "invalid refresh token")
+			return
+		}
+
+		// TradeStation does not rotate refresh tokens by default
+		token := srv.issueToken(scope, srv.RotateRefreshTokens, TokenLifetime)
+		writeJSON(w, http.StatusOK, token)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported grant_type")
+	}
+}
+
+// handleRevoke implements the TradeStation refresh token revocation
+// endpoint
+func (srv *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "revoke requests must be POST")
+		return
+	}
+
+	var req struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		Token        string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// public clients revoke their tokens without a client secret
+	if req.ClientID != ClientID || (req.ClientSecret != ClientSecret && req.ClientSecret != "") {
+		writeError(w, http.StatusUnauthorized, "invalid client credentials")
+		return
+	}
+
+	srv.mu.Lock()
+	delete(srv.refreshTokens, req.Token)
+	srv.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
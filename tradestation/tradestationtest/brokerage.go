@@ -0,0 +1,315 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestationtest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type account struct {
+	id           string
+	cash         float64
+	bodCash      float64
+	positions    map[string]*position
+	bodPositions map[string]position
+	commission   float64
+}
+
+type position struct {
+	symbol       string
+	quantity     int64
+	averagePrice float64
+	openedAt     time.Time
+}
+
+// AddAccount opens a cash account with `cash` dollars available. Adding an
+// account that already exists resets it.
+func (srv *Server) AddAccount(accountID string, cash float64) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	acct := &account{
+		id:           accountID,
+		cash:         cash,
+		bodCash:      cash,
+		positions:    make(map[string]*position),
+		bodPositions: make(map[string]position),
+	}
+
+	for idx, existing := range srv.accounts {
+		if existing.id == accountID {
+			srv.accounts[idx] = acct
+			return
+		}
+	}
+	srv.accounts = append(srv.accounts, acct)
+}
+
+// SetPosition sets the number of shares of `symbol` held in the account.
+// Setting `quantity` to 0 closes the position. The position also becomes part
+// of the beginning of day balances.
+func (srv *Server) SetPosition(accountID, symbol string, quantity int64, averagePrice float64) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	acct := srv.account(accountID)
+	if acct == nil {
+		return fmt.Errorf("tradestationtest: unknown account %s", accountID)
+	}
+
+	if quantity == 0 {
+		delete(acct.positions, symbol)
+		delete(acct.bodPositions, symbol)
+		return nil
+	}
+
+	pos := &position{
+		symbol:       symbol,
+		quantity:     quantity,
+		averagePrice: averagePrice,
+		openedAt:     time.Now(),
+	}
+	acct.positions[symbol] = pos
+	acct.bodPositions[symbol] = *pos
+	return nil
+}
+
+// Cash returns the cash balance of the account
+func (srv *Server) Cash(accountID string) float64 {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if acct := srv.account(accountID); acct != nil {
+		return acct.cash
+	}
+	return 0
+}
+
+// Position returns the number of shares of `symbol` held in the account
+func (srv *Server) Position(accountID, symbol string) int64 {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if acct := srv.account(accountID); acct != nil {
+		if pos, ok := acct.positions[symbol]; ok {
+			return pos.quantity
+		}
+	}
+	return 0
+}
+
+// account returns the account with `accountID` or nil; srv.mu must be held
+func (srv *Server) account(accountID string) *account {
+	for _, acct := range srv.accounts {
+		if acct.id == accountID {
+			return acct
+		}
+	}
+	return nil
+}
+
+// marketValue values the positions in `positions` at the last price; srv.mu
+// must be held
+func (srv *Server) marketValue(positions map[string]*position) float64 {
+	value := 0.0
+	for _, pos := range positions {
+		value += float64(pos.quantity) * srv.lastPrice(pos.symbol, pos.averagePrice)
+	}
+	return value
+}
+
+// lookupAccounts splits the comma separated `ids` and returns the known
+// accounts along with errors for the unknown ones; srv.mu must be held
+func (srv *Server) lookupAccounts(ids string) ([]*account, []map[string]string) {
+	accounts := make([]*account, 0, 1)
+	errs := make([]map[string]string, 0)
+	for _, id := range strings.Split(ids, ",") {
+		if acct := srv.account(id); acct != nil {
+			accounts = append(accounts, acct)
+		} else {
+			errs = append(errs, map[string]string{
+				"AccountID": id,
+				"Error":     "FAILED",
+				"Message":   "Invalid account",
+			})
+		}
+	}
+	return accounts, errs
+}
+
+// handleAccounts serves GET /brokerage/accounts
+func (srv *Server) handleAccounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	accounts := make([]map[string]string, len(srv.accounts))
+	for idx, acct := range srv.accounts {
+		accounts[idx] = map[string]string{
+			"AccountID":   acct.id,
+			"Currency":    "USD",
+			"Status":      "Active",
+			"AccountType": "Cash",
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"Accounts": accounts})
+}
+
+// handleAccount serves the endpoints below /brokerage/accounts/{accountIDs}
+func (srv *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ids, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v3/brokerage/accounts/"), "/")
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	accounts, errs := srv.lookupAccounts(ids)
+
+	switch resource {
+	case "balances":
+		balances := make([]map[string]any, len(accounts))
+		for idx, acct := range accounts {
+			balances[idx] = srv.balance(acct, acct.cash, acct.positions)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"Balances": balances, "Errors": errs})
+	case "bodbalances":
+		// beginning of day balances are returned in the same format as the
+		// current balances
+		balances := make([]map[string]any, len(accounts))
+		for idx, acct := range accounts {
+			positions := make(map[string]*position, len(acct.bodPositions))
+			for symbol, pos := range acct.bodPositions {
+				pos := pos
+				positions[symbol] = &pos
+			}
+			balances[idx] = srv.balance(acct, acct.bodCash, positions)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"Balances": balances, "Errors": errs})
+	case "positions":
+		positions := make([]map[string]any, 0)
+		for _, acct := range accounts {
+			positions = append(positions, srv.positions(acct)...)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"Positions": positions, "Errors": errs})
+	case "orders":
+		srv.writeOrders(w, r, accounts, errs, false)
+	case "historicalorders":
+		srv.writeOrders(w, r, accounts, errs, true)
+	default:
+		writeError(w, http.StatusNotFound, "unknown resource")
+	}
+}
+
+// balance returns the balance of `acct` given `cash` and `positions`; srv.mu
+// must be held
+func (srv *Server) balance(acct *account, cash float64, positions map[string]*position) map[string]any {
+	marketValue := srv.marketValue(positions)
+
+	costOfPositions := 0.0
+	for _, pos := range positions {
+		costOfPositions += float64(pos.quantity) * pos.averagePrice
+	}
+
+	return map[string]any{
+		"AccountID":   acct.id,
+		"AccountType": "Cash",
+		"BalanceDetail": map[string]string{
+			"CostOfPositions":      formatMoney(costOfPositions),
+			"DayTrades":            "0",
+			"MaintenanceRate":      "0",
+			"OvernightBuyingPower": formatMoney(cash),
+			"RequiredMargin":       "0",
+			"RealizedProfitLoss":   "0",
+			"UnrealizedProfitLoss": formatMoney(marketValue - costOfPositions),
+			"UnsettledFunds":       "0",
+		},
+		"BuyingPower":      formatMoney(cash),
+		"CashBalance":      formatMoney(cash),
+		"Commission":       formatMoney(acct.commission),
+		"Equity":           formatMoney(cash + marketValue),
+		"MarketValue":      formatMoney(marketValue),
+		"TodaysProfitLoss": "0",
+		"UnclearedDeposit": "0",
+	}
+}
+
+// positions returns the open positions of `acct` sorted by symbol; srv.mu
+// must be held
+func (srv *Server) positions(acct *account) []map[string]any {
+	symbols := make([]string, 0, len(acct.positions))
+	for symbol := range acct.positions {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	res := make([]map[string]any, len(symbols))
+	for idx, symbol := range symbols {
+		pos := acct.positions[symbol]
+		q := srv.currentQuote(symbol)
+		last := srv.lastPrice(symbol, pos.averagePrice)
+		totalCost := float64(pos.quantity) * pos.averagePrice
+		marketValue := float64(pos.quantity) * last
+
+		unrealizedPct := 0.0
+		if totalCost != 0 {
+			unrealizedPct = (marketValue - totalCost) / totalCost * 100
+		}
+
+		res[idx] = map[string]any{
+			"AccountID":                   acct.id,
+			"AveragePrice":                formatPrice(pos.averagePrice),
+			"AssetType":                   "STOCK",
+			"Last":                        formatPrice(last),
+			"Bid":                         formatPrice(q.Bid),
+			"Ask":                         formatPrice(q.Ask),
+			"PositionID":                  fmt.Sprintf("%s-%s", acct.id, symbol),
+			"LongShort":                   "Long",
+			"Quantity":                    strconv.FormatInt(pos.quantity, 10),
+			"Symbol":                      symbol,
+			"Timestamp":                   pos.openedAt.UTC().Format(timeFormat),
+			"TodaysProfitLoss":            "0",
+			"TotalCost":                   formatMoney(totalCost),
+			"MarketValue":                 formatMoney(marketValue),
+			"MarkToMarketPrice":           formatPrice(pos.averagePrice),
+			"UnrealizedProfitLoss":        formatMoney(marketValue - totalCost),
+			"UnrealizedProfitLossPercent": strconv.FormatFloat(unrealizedPct, 'f', 2, 64),
+			"UnrealizedProfitLossQty":     formatMoney(last - pos.averagePrice),
+		}
+	}
+	return res
+}
+
+func formatMoney(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+func formatPrice(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
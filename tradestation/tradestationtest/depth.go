@@ -0,0 +1,179 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestationtest
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDepthLevels is the most levels a market depth stream may request
+const maxDepthLevels = 100
+
+// DepthQuote is a scripted market depth quote of a single participant
+type DepthQuote struct {
+	Price  float64
+	Size   int64
+	Orders int64
+	Name   string
+}
+
+type depthScript struct {
+	bids []DepthQuote
+	asks []DepthQuote
+	time time.Time
+}
+
+// SetDepth scripts the market depth of `symbol`. Quotes are listed best
+// price first; quotes at the same price are one level of the aggregated
+// book. Open market depth streams send the new book.
+func (srv *Server) SetDepth(symbol string, bids []DepthQuote, asks []DepthQuote) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.depth[symbol] = &depthScript{
+		bids: append([]DepthQuote(nil), bids...),
+		asks: append([]DepthQuote(nil), asks...),
+		time: time.Now(),
+	}
+	srv.notifyStreams()
+}
+
+// handleStreamMarketDepth serves GET
+// /marketdata/stream/marketdepth/{quotes,aggregates}/{symbol}. Every message
+// is the full book; a message is sent whenever the book changes.
+func (srv *Server) handleStreamMarketDepth(w http.ResponseWriter, r *http.Request) {
+	kind, symbol, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v3/marketdata/stream/marketdepth/"), "/")
+	if kind != "quotes" && kind != "aggregates" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	levels := 20
+	if value := r.URL.Query().Get("maxlevels"); value != "" {
+		var err error
+		if levels, err = strconv.Atoi(value); err != nil || levels < 1 || levels > maxDepthLevels {
+			writeError(w, http.StatusBadRequest, "invalid maxlevels")
+			return
+		}
+	}
+
+	srv.mu.Lock()
+	_, ok := srv.depth[symbol]
+	srv.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Symbol is invalid")
+		return
+	}
+
+	var last map[string]any
+	srv.serveStream(w, r, func() []any {
+		script, ok := srv.depth[symbol]
+		if !ok {
+			return nil
+		}
+
+		timeStamp := script.time.UTC().Format(timeFormat)
+		side := func(name string, quotes []DepthQuote) []map[string]any {
+			if kind == "quotes" {
+				return depthQuoteFields(name, quotes, levels, timeStamp)
+			}
+			return depthAggregateFields(name, quotes, levels, timeStamp)
+		}
+
+		book := map[string]any{
+			"Bids": side("Bid", script.bids),
+			"Asks": side("Ask", script.asks),
+		}
+		if reflect.DeepEqual(book, last) {
+			return nil
+		}
+		last = book
+		return []any{book}
+	})
+}
+
+// depthLevels groups `quotes` by price and returns at most `levels` groups
+func depthLevels(quotes []DepthQuote, levels int) [][]DepthQuote {
+	groups := make([][]DepthQuote, 0)
+	for _, quote := range quotes {
+		if n := len(groups); n > 0 && groups[n-1][0].Price == quote.Price {
+			groups[n-1] = append(groups[n-1], quote)
+			continue
+		}
+		if len(groups) == levels {
+			break
+		}
+		groups = append(groups, []DepthQuote{quote})
+	}
+	return groups
+}
+
+// depthQuoteFields returns the participant quotes of the first `levels`
+// price levels as TradeStation sends them
+func depthQuoteFields(side string, quotes []DepthQuote, levels int, timeStamp string) []map[string]any {
+	fields := make([]map[string]any, 0, len(quotes))
+	for _, group := range depthLevels(quotes, levels) {
+		for _, quote := range group {
+			fields = append(fields, map[string]any{
+				"TimeStamp":  timeStamp,
+				"Side":       side,
+				"Price":      formatPrice(quote.Price),
+				"Size":       strconv.FormatInt(quote.Size, 10),
+				"OrderCount": quote.Orders,
+				"Name":       quote.Name,
+			})
+		}
+	}
+	return fields
+}
+
+// depthAggregateFields returns the first `levels` price levels as
+// TradeStation sends them
+func depthAggregateFields(side string, quotes []DepthQuote, levels int, timeStamp string) []map[string]any {
+	groups := depthLevels(quotes, levels)
+	fields := make([]map[string]any, len(groups))
+	for idx, group := range groups {
+		var total, orders int64
+		biggest, smallest := group[0].Size, group[0].Size
+		for _, quote := range group {
+			total += quote.Size
+			orders += quote.Orders
+			if quote.Size > biggest {
+				biggest = quote.Size
+			}
+			if quote.Size < smallest {
+				smallest = quote.Size
+			}
+		}
+
+		fields[idx] = map[string]any{
+			"EarliestTime":    timeStamp,
+			"LatestTime":      timeStamp,
+			"Side":            side,
+			"Price":           formatPrice(group[0].Price),
+			"TotalSize":       strconv.FormatInt(total, 10),
+			"BiggestSize":     strconv.FormatInt(biggest, 10),
+			"SmallestSize":    strconv.FormatInt(smallest, 10),
+			"NumParticipants": len(group),
+			"TotalOrderCount": orders,
+		}
+	}
+	return fields
+}
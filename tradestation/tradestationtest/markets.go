@@ -0,0 +1,308 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestationtest
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quote is a scripted market quote
+type Quote struct {
+	Bid     float64
+	BidSize int64
+	Ask     float64
+	AskSize int64
+
+	// Last defaults to the midpoint of Bid and Ask
+	Last   float64
+	Volume int64
+}
+
+type quoteScript struct {
+	quotes []Quote
+	pos    int
+	time   time.Time
+}
+
+// SetQuotes scripts the quotes of `symbol`. The first quote is current
+// immediately; each call to Tick moves to the next one. Once the script is
+// exhausted the last quote stays current.
+func (srv *Server) SetQuotes(symbol string, quotes ...Quote) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if len(quotes) == 0 {
+		delete(srv.quotes, symbol)
+		return
+	}
+
+	srv.quotes[symbol] = &quoteScript{
+		quotes: quotes,
+		time:   time.Now(),
+	}
+	srv.fillOpenOrders()
+	srv.notifyStreams()
+}
+
+// Tick advances every scripted symbol to its next quote and fills the open
+// orders that are marketable at the new prices
+func (srv *Server) Tick() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	now := time.Now()
+	for _, script := range srv.quotes {
+		if script.pos < len(script.quotes)-1 {
+			script.pos++
+			script.time = now
+		}
+	}
+	srv.fillOpenOrders()
+	srv.notifyStreams()
+}
+
+// currentQuote returns the current quote of `symbol` or a zero quote if the
+// symbol is not scripted; srv.mu must be held
+func (srv *Server) currentQuote(symbol string) Quote {
+	script, ok := srv.quotes[symbol]
+	if !ok {
+		return Quote{}
+	}
+
+	q := script.quotes[script.pos]
+	if q.Last == 0 {
+		q.Last = (q.Bid + q.Ask) / 2
+	}
+	return q
+}
+
+// lastPrice returns the last price of `symbol`, or `fallback` if the symbol
+// is not scripted; srv.mu must be held
+func (srv *Server) lastPrice(symbol string, fallback float64) float64 {
+	if _, ok := srv.quotes[symbol]; !ok {
+		return fallback
+	}
+	return srv.currentQuote(symbol).Last
+}
+
+// quoteFields returns the current quote of the scripted `symbol` in the
+// format of the quotes endpoint; srv.mu must be held
+func (srv *Server) quoteFields(symbol string, script *quoteScript) map[string]any {
+	q := srv.currentQuote(symbol)
+	return map[string]any{
+		"Symbol":    symbol,
+		"Ask":       formatPrice(q.Ask),
+		"AskSize":   strconv.FormatInt(q.AskSize, 10),
+		"Bid":       formatPrice(q.Bid),
+		"BidSize":   strconv.FormatInt(q.BidSize, 10),
+		"Last":      formatPrice(q.Last),
+		"Volume":    strconv.FormatInt(q.Volume, 10),
+		"TradeTime": script.time.UTC().Format(timeFormat),
+		"Flags": map[string]bool{
+			"IsBats":         false,
+			"IsDelayed":      false,
+			"IsHalted":       false,
+			"IsHardToBorrow": false,
+		},
+	}
+}
+
+// handleQuotes serves GET /marketdata/quotes/{symbols}
+func (srv *Server) handleQuotes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	symbols := strings.Split(strings.TrimPrefix(r.URL.Path, "/v3/marketdata/quotes/"), ",")
+	if len(symbols) > 100 {
+		writeError(w, http.StatusBadRequest, "too many symbols, at most 100 symbols may be requested")
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	quotes := make([]map[string]any, 0, len(symbols))
+	errs := make([]map[string]string, 0)
+	for _, symbol := range symbols {
+		script, ok := srv.quotes[symbol]
+		if !ok {
+			errs = append(errs, map[string]string{
+				"Symbol": symbol,
+				"Error":  "Symbol is invalid",
+			})
+			continue
+		}
+
+		quotes = append(quotes, srv.quoteFields(symbol, script))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"Quotes": quotes, "Errors": errs})
+}
+
+// maxBars is the most bars served by a single barcharts request
+const maxBars = 57600
+
+// Bar is a scripted historical bar; Time is the end of the bar
+type Bar struct {
+	Time   time.Time
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume int64
+}
+
+// SetBars scripts the bar history of `symbol`. The same bars are served
+// whatever interval and unit are requested.
+func (srv *Server) SetBars(symbol string, bars ...Bar) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	sorted := append([]Bar(nil), bars...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+	srv.bars[symbol] = sorted
+	srv.notifyStreams()
+}
+
+// SetOpenBar scripts the bar that is currently being built for `symbol`;
+// bar streams send it with BarStatus Open
+func (srv *Server) SetOpenBar(symbol string, bar Bar) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.openBars[symbol] = &bar
+	srv.notifyStreams()
+}
+
+// CloseBar appends the open bar of `symbol` to its history; bar streams
+// send it with BarStatus Closed
+func (srv *Server) CloseBar(symbol string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	bar, ok := srv.openBars[symbol]
+	if !ok {
+		return
+	}
+	delete(srv.openBars, symbol)
+	srv.bars[symbol] = append(srv.bars[symbol], *bar)
+	srv.notifyStreams()
+}
+
+// handleBarCharts serves GET /marketdata/barcharts/{symbol}
+func (srv *Server) handleBarCharts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	symbol := strings.TrimPrefix(r.URL.Path, "/v3/marketdata/barcharts/")
+	params := r.URL.Query()
+
+	parseDate := func(name string) (time.Time, bool) {
+		value := params.Get(name)
+		if value == "" {
+			return time.Time{}, true
+		}
+		date, err := time.Parse(timeFormat, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid "+name)
+			return time.Time{}, false
+		}
+		return date, true
+	}
+
+	firstDate, ok := parseDate("firstdate")
+	if !ok {
+		return
+	}
+	lastDate, ok := parseDate("lastdate")
+	if !ok {
+		return
+	}
+
+	barsBack := 0
+	if value := params.Get("barsback"); value != "" {
+		var err error
+		if barsBack, err = strconv.Atoi(value); err != nil || barsBack < 1 || barsBack > maxBars {
+			writeError(w, http.StatusBadRequest, "invalid barsback")
+			return
+		}
+	}
+	if barsBack > 0 && !firstDate.IsZero() {
+		writeError(w, http.StatusBadRequest, "barsback and firstdate are mutually exclusive")
+		return
+	}
+	if barsBack == 0 && firstDate.IsZero() {
+		barsBack = 1
+	}
+
+	srv.mu.Lock()
+	history, ok := srv.bars[symbol]
+	srv.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "Symbol is invalid")
+		return
+	}
+
+	selected := make([]Bar, 0)
+	for _, bar := range history {
+		if (firstDate.IsZero() || !bar.Time.Before(firstDate)) && (lastDate.IsZero() || !bar.Time.After(lastDate)) {
+			selected = append(selected, bar)
+		}
+	}
+
+	endOfHistory := false
+	if barsBack > 0 && len(selected) > barsBack {
+		selected = selected[len(selected)-barsBack:]
+	} else if barsBack > 0 {
+		endOfHistory = true
+	}
+	if len(selected) > maxBars {
+		writeError(w, http.StatusBadRequest, "too many bars requested")
+		return
+	}
+
+	bars := make([]map[string]any, len(selected))
+	for idx, bar := range selected {
+		bars[idx] = barFields(bar, "Closed", endOfHistory && idx == 0)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"Bars": bars})
+}
+
+// barFields returns `bar` as TradeStation sends it
+func barFields(bar Bar, status string, endOfHistory bool) map[string]any {
+	return map[string]any{
+		"TimeStamp":      bar.Time.UTC().Format(timeFormat),
+		"Open":           formatPrice(bar.Open),
+		"High":           formatPrice(bar.High),
+		"Low":            formatPrice(bar.Low),
+		"Close":          formatPrice(bar.Close),
+		"TotalVolume":    strconv.FormatInt(bar.Volume, 10),
+		"OpenInterest":   "0",
+		"IsRealtime":     status == "Open",
+		"IsEndOfHistory": endOfHistory,
+		"BarStatus":      status,
+	}
+}
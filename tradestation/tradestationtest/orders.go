@@ -0,0 +1,556 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestationtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/penny-vault/tradestation/tradestation"
+)
+
+// defaultOrdersPageSize is the most orders returned by a single request of
+// the orders endpoints unless pageSize is set
+const defaultOrdersPageSize = 600
+
+// AgeOrders moves every order `days` days into the past, so that orders
+// placed by a test are served by the historical orders endpoint
+func (srv *Server) AgeOrders(days int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, o := range srv.orders {
+		o.openedAt = o.openedAt.AddDate(0, 0, -days)
+		if !o.closedAt.IsZero() {
+			o.closedAt = o.closedAt.AddDate(0, 0, -days)
+		}
+	}
+}
+
+// orderRequest is the body of a single order sent by the client
+type orderRequest struct {
+	AccountID      string
+	LimitPrice     string
+	OrderConfirmID string
+	OrderType      tradestation.TSOrderType
+	Quantity       string
+	StopPrice      string
+	Symbol         string
+	TimeInForce    struct {
+		Duration tradestation.TimeInForceDuration
+	}
+	TradeAction tradestation.Action
+}
+
+type orderGroupRequest struct {
+	Orders []*orderRequest
+	Type   string
+}
+
+type order struct {
+	id                string
+	accountID         string
+	symbol            string
+	action            tradestation.Action
+	orderType         tradestation.TSOrderType
+	duration          tradestation.TimeInForceDuration
+	quantity          int64
+	filled            int64
+	limitPrice        float64
+	filledPrice       float64
+	commission        float64
+	status            tradestation.OrderStatus
+	statusDescription string
+	rejectReason      string
+	openedAt          time.Time
+	closedAt          time.Time
+}
+
+// newOrder validates `req` and converts it to an open order; srv.mu must be
+// held
+func (srv *Server) newOrder(req *orderRequest) (*order, error) {
+	acct := srv.account(req.AccountID)
+	if acct == nil {
+		return nil, errors.New("Invalid account")
+	}
+
+	o := &order{
+		accountID:         req.AccountID,
+		symbol:            req.Symbol,
+		action:            req.TradeAction,
+		orderType:         req.OrderType,
+		duration:          req.TimeInForce.Duration,
+		status:            tradestation.OPEN,
+		statusDescription: "Received",
+		openedAt:          time.Now(),
+	}
+
+	quantity, err := strconv.ParseInt(req.Quantity, 10, 64)
+	if err != nil || quantity <= 0 {
+		return nil, fmt.Errorf("Invalid quantity %q", req.Quantity)
+	}
+	o.quantity = quantity
+
+	if _, ok := srv.quotes[req.Symbol]; !ok {
+		return nil, fmt.Errorf("Invalid symbol %q", req.Symbol)
+	}
+
+	switch req.OrderType {
+	case tradestation.MARKET:
+	case tradestation.LIMIT:
+		if o.limitPrice, err = strconv.ParseFloat(req.LimitPrice, 64); err != nil || o.limitPrice <= 0 {
+			return nil, fmt.Errorf("Invalid limit price %q", req.LimitPrice)
+		}
+	default:
+		return nil, fmt.Errorf("Order type %s is not supported", req.OrderType)
+	}
+
+	switch req.TradeAction {
+	case tradestation.BUY:
+		if cost := float64(o.quantity)*srv.estimatedPrice(o) + srv.Commission; cost > acct.cash {
+			return nil, errors.New("Insufficient buying power")
+		}
+	case tradestation.SELL:
+		held := int64(0)
+		if pos, ok := acct.positions[o.symbol]; ok {
+			held = pos.quantity
+		}
+		for _, other := range srv.orders {
+			if other.accountID == o.accountID && other.symbol == o.symbol && other.action == tradestation.SELL && other.status == tradestation.OPEN {
+				held -= other.quantity
+			}
+		}
+		if o.quantity > held {
+			return nil, errors.New("Insufficient shares to sell; short selling is not supported")
+		}
+	default:
+		return nil, fmt.Errorf("Trade action %s is not supported", req.TradeAction)
+	}
+
+	return o, nil
+}
+
+// estimatedPrice returns the price `o` is expected to fill at; srv.mu must be
+// held
+func (srv *Server) estimatedPrice(o *order) float64 {
+	if o.orderType == tradestation.LIMIT {
+		return o.limitPrice
+	}
+
+	q := srv.currentQuote(o.symbol)
+	if o.action == tradestation.BUY {
+		return q.Ask
+	}
+	return q.Bid
+}
+
+// place records `o` and fills it if it is marketable; srv.mu must be held
+func (srv *Server) place(o *order) {
+	srv.nextOrderID++
+	o.id = strconv.Itoa(srv.nextOrderID)
+	srv.orders = append(srv.orders, o)
+	srv.fill(o)
+}
+
+// reject records an order that could not be accepted; srv.mu must be held
+func (srv *Server) reject(req *orderRequest, reason error) *order {
+	srv.nextOrderID++
+	o := &order{
+		id:                strconv.Itoa(srv.nextOrderID),
+		accountID:         req.AccountID,
+		symbol:            req.Symbol,
+		action:            req.TradeAction,
+		orderType:         req.OrderType,
+		duration:          req.TimeInForce.Duration,
+		status:            tradestation.REJECTED,
+		statusDescription: "Rejected",
+		rejectReason:      reason.Error(),
+		openedAt:          time.Now(),
+		closedAt:          time.Now(),
+	}
+	o.quantity, _ = strconv.ParseInt(req.Quantity, 10, 64)
+	srv.orders = append(srv.orders, o)
+	return o
+}
+
+// fillOpenOrders attempts to fill every open order at the current quotes;
+// srv.mu must be held
+func (srv *Server) fillOpenOrders() {
+	for _, o := range srv.orders {
+		if o.status == tradestation.OPEN {
+			srv.fill(o)
+		}
+	}
+}
+
+// fill executes `o` in full if the current quote crosses its limit price.
+// Buys fill at the ask and sells at the bid. srv.mu must be held.
+func (srv *Server) fill(o *order) {
+	acct := srv.account(o.accountID)
+	if acct == nil {
+		return
+	}
+
+	q := srv.currentQuote(o.symbol)
+	price := q.Bid
+	if o.action == tradestation.BUY {
+		price = q.Ask
+	}
+
+	if price <= 0 {
+		return
+	}
+
+	if o.orderType == tradestation.LIMIT {
+		if o.action == tradestation.BUY && price > o.limitPrice {
+			return
+		}
+		if o.action == tradestation.SELL && price < o.limitPrice {
+			return
+		}
+	}
+
+	amount := price * float64(o.quantity)
+	pos, ok := acct.positions[o.symbol]
+
+	switch o.action {
+	case tradestation.BUY:
+		if amount+srv.Commission > acct.cash {
+			o.status = tradestation.REJECTED
+			o.statusDescription = "Rejected"
+			o.rejectReason = "Insufficient buying power"
+			o.closedAt = time.Now()
+			return
+		}
+
+		acct.cash -= amount
+		if !ok {
+			pos = &position{symbol: o.symbol, openedAt: time.Now()}
+			acct.positions[o.symbol] = pos
+		}
+		pos.averagePrice = (pos.averagePrice*float64(pos.quantity) + amount) / float64(pos.quantity+o.quantity)
+		pos.quantity += o.quantity
+	case tradestation.SELL:
+		if !ok || pos.quantity < o.quantity {
+			o.status = tradestation.REJECTED
+			o.statusDescription = "Rejected"
+			o.rejectReason = "Insufficient shares to sell"
+			o.closedAt = time.Now()
+			return
+		}
+
+		acct.cash += amount
+		pos.quantity -= o.quantity
+		if pos.quantity == 0 {
+			delete(acct.positions, o.symbol)
+		}
+	}
+
+	acct.cash -= srv.Commission
+	acct.commission += srv.Commission
+
+	o.filled = o.quantity
+	o.filledPrice = price
+	o.commission = srv.Commission
+	o.status = tradestation.FILLED
+	o.statusDescription = "Filled"
+	o.closedAt = time.Now()
+}
+
+// confirmation returns the order confirmation of `o`; srv.mu must be held
+func (srv *Server) confirmation(o *order) map[string]any {
+	price := srv.estimatedPrice(o)
+	cost := price * float64(o.quantity)
+
+	confirm := map[string]any{
+		"AccountID":                o.accountID,
+		"AccountCurrency":          "USD",
+		"Currency":                 "USD",
+		"DebitCreditEstimatedCost": formatMoney(cost + srv.Commission),
+		"EstimatedCommission":      formatMoney(srv.Commission),
+		"EstimatedCost":            formatMoney(cost),
+		"EstimatedPrice":           formatPrice(price),
+		"Legs": []map[string]any{
+			{
+				"Quantity":    strconv.FormatInt(o.quantity, 10),
+				"Symbol":      o.symbol,
+				"TradeAction": o.action,
+			},
+		},
+		"OrderAssetCategory": "EQUITY",
+		"OrderConfirmID":     randomString(12),
+		"Route":              "Intelligent",
+		"SummaryMessage":     summary(o),
+		"TimeInForce": map[string]any{
+			"Duration": o.duration,
+		},
+	}
+
+	if o.orderType == tradestation.LIMIT {
+		confirm["LimitPrice"] = formatPrice(o.limitPrice)
+	}
+
+	return confirm
+}
+
+func summary(o *order) string {
+	if o.orderType == tradestation.LIMIT {
+		return fmt.Sprintf("%s %d %s @ %s %s", o.action, o.quantity, o.symbol, formatMoney(o.limitPrice), o.orderType)
+	}
+	return fmt.Sprintf("%s %d %s @ %s", o.action, o.quantity, o.symbol, o.orderType)
+}
+
+// orderJSON returns `o` in the format of the orders endpoints
+func orderJSON(o *order) map[string]any {
+	buyOrSell := "Buy"
+	if o.action == tradestation.SELL {
+		buyOrSell = "Sell"
+	}
+
+	res := map[string]any{
+		"AccountID":         o.accountID,
+		"CommissionFee":     formatMoney(o.commission),
+		"Currency":          "USD",
+		"Duration":          o.duration,
+		"FilledPrice":       formatPrice(o.filledPrice),
+		"OpenedDateTime":    o.openedAt.UTC().Format(timeFormat),
+		"OrderID":           o.id,
+		"OrderType":         o.orderType,
+		"Routing":           "Intelligent",
+		"Status":            o.status,
+		"StatusDescription": o.statusDescription,
+		"Legs": []map[string]any{
+			{
+				"AssetType":         "STOCK",
+				"BuyOrSell":         buyOrSell,
+				"ExecQuantity":      strconv.FormatInt(o.filled, 10),
+				"OpenOrClose":       "Open",
+				"QuantityOrdered":   strconv.FormatInt(o.quantity, 10),
+				"QuantityRemaining": strconv.FormatInt(o.quantity-o.filled, 10),
+				"Symbol":            o.symbol,
+			},
+		},
+	}
+
+	if o.orderType == tradestation.LIMIT {
+		res["LimitPrice"] = formatPrice(o.limitPrice)
+	}
+	if !o.closedAt.IsZero() {
+		res["ClosedDateTime"] = o.closedAt.UTC().Format(timeFormat)
+	}
+	if o.rejectReason != "" {
+		res["RejectReason"] = o.rejectReason
+	}
+
+	return res
+}
+
+// writeOrders serves the orders of `accounts`. Todays orders are returned
+// unless `historical` is set, in which case the orders placed between the
+// since parameter and the start of today are returned. srv.mu must be held.
+func (srv *Server) writeOrders(w http.ResponseWriter, r *http.Request, accounts []*account, errs []map[string]string, historical bool) {
+	params := r.URL.Query()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	var since time.Time
+	if historical {
+		var err error
+		if since, err = time.Parse("2006-01-02", params.Get("since")); err != nil {
+			writeError(w, http.StatusBadRequest, "since must be a date formatted as YYYY-MM-DD")
+			return
+		}
+	}
+
+	pageSize := srv.OrdersPageSize
+	if pageSize <= 0 {
+		pageSize = defaultOrdersPageSize
+	}
+	if params.Get("pageSize") != "" {
+		var err error
+		if pageSize, err = strconv.Atoi(params.Get("pageSize")); err != nil || pageSize <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid pageSize")
+			return
+		}
+	}
+
+	offset := 0
+	if params.Get("nextToken") != "" {
+		var err error
+		if offset, err = strconv.Atoi(params.Get("nextToken")); err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "invalid nextToken")
+			return
+		}
+	}
+
+	ids := make(map[string]bool, len(accounts))
+	for _, acct := range accounts {
+		ids[acct.id] = true
+	}
+
+	matched := make([]map[string]any, 0)
+	for _, o := range srv.orders {
+		if !ids[o.accountID] {
+			continue
+		}
+		if historical && (o.openedAt.Before(since) || !o.openedAt.Before(today)) {
+			continue
+		}
+		if !historical && o.openedAt.Before(today) {
+			continue
+		}
+		matched = append(matched, orderJSON(o))
+	}
+
+	nextToken := ""
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+	end := offset + pageSize
+	if end < len(matched) {
+		nextToken = strconv.Itoa(end)
+	} else {
+		end = len(matched)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"Orders":    matched[offset:end],
+		"Errors":    errs,
+		"NextToken": nextToken,
+	})
+}
+
+// handleOrderConfirm serves POST /orderexecution/orderconfirm
+func (srv *Server) handleOrderConfirm(w http.ResponseWriter, r *http.Request) {
+	var req orderRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	o, err := srv.newOrder(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"Confirmations": []map[string]any{srv.confirmation(o)},
+	})
+}
+
+// handleOrderGroupConfirm serves POST /orderexecution/ordergroupconfirm
+func (srv *Server) handleOrderGroupConfirm(w http.ResponseWriter, r *http.Request) {
+	var req orderGroupRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	confirms := make([]map[string]any, len(req.Orders))
+	for idx, orderReq := range req.Orders {
+		o, err := srv.newOrder(orderReq)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		confirms[idx] = srv.confirmation(o)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"Confirmations": confirms})
+}
+
+// handlePlaceOrder serves POST /orderexecution/orders
+func (srv *Server) handlePlaceOrder(w http.ResponseWriter, r *http.Request) {
+	var req orderRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	orders, errs := srv.placeOrders([]*orderRequest{&req})
+	writeJSON(w, http.StatusOK, map[string]any{"Orders": orders, "Errors": errs})
+}
+
+// handlePlaceOrderGroup serves POST /orderexecution/ordergroups
+func (srv *Server) handlePlaceOrderGroup(w http.ResponseWriter, r *http.Request) {
+	var req orderGroupRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if req.Type != "NORMAL" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("order group type %q is not supported", req.Type))
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	orders, errs := srv.placeOrders(req.Orders)
+	writeJSON(w, http.StatusOK, map[string]any{"Orders": orders, "Errors": errs})
+}
+
+// placeOrders places each order in `reqs` independently; srv.mu must be held
+func (srv *Server) placeOrders(reqs []*orderRequest) ([]map[string]string, []map[string]string) {
+	orders := make([]map[string]string, 0, len(reqs))
+	errs := make([]map[string]string, 0)
+	for _, req := range reqs {
+		o, err := srv.newOrder(req)
+		if err != nil {
+			rejected := srv.reject(req, err)
+			errs = append(errs, map[string]string{
+				"AccountID": req.AccountID,
+				"OrderID":   rejected.id,
+				"Error":     "FAILED",
+				"Message":   err.Error(),
+			})
+			continue
+		}
+
+		srv.place(o)
+		orders = append(orders, map[string]string{
+			"OrderID": o.id,
+			"Message": fmt.Sprintf("Sent order: %s", summary(o)),
+		})
+	}
+	return orders, errs
+}
+
+// decodeBody decodes the JSON body of a POST request into `v`, writing an
+// error response and returning false if it cannot
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,213 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tradestationtest provides an in-memory TradeStation API server for
+// tests and rehearsals. The server implements the v3 endpoints used by the
+// tradestation package along with the signin token endpoint, keeps account
+// state in memory and fills orders from scripted quotes.
+//
+//	srv := tradestationtest.NewServer()
+//	defer srv.Close()
+//
+//	srv.AddAccount("SIM123", 10000)
+//	srv.SetQuotes("SPY", tradestationtest.Quote{Bid: 399.98, Ask: 400.02})
+//
+//	api := srv.NewAPI()
+package tradestationtest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/penny-vault/tradestation/tradestation"
+)
+
+const (
+	// ClientID and ClientSecret are the only credentials accepted by the
+	// token endpoint of the server
+	ClientID     = "tradestationtest"
+	ClientSecret = "tradestationtest-secret"
+
+	// TokenLifetime is how long access tokens issued by the server are valid
+	TokenLifetime = 20 * time.Minute
+
+	timeFormat = "2006-01-02T15:04:05Z"
+)
+
+// Server is a fake TradeStation API. Its methods are safe for concurrent use
+// with requests being served.
+type Server struct {
+	*httptest.Server
+
+	// Commission is charged for every filled order
+	Commission float64
+
+	// RotateRefreshTokens issues a new refresh token with every refresh and
+	// revokes the one that was used, as TradeStation does for API keys
+	// configured with rotating refresh tokens
+	RotateRefreshTokens bool
+
+	// StreamHeartbeat is the interval of stream heartbeats; defaults to 5
+	// seconds
+	StreamHeartbeat time.Duration
+
+	// OrdersPageSize is the most orders returned by a single request of the
+	// orders endpoints; defaults to 600
+	OrdersPageSize int
+
+	mu            sync.Mutex
+	signingKey    jwk.Key
+	accounts      []*account
+	quotes        map[string]*quoteScript
+	bars          map[string][]Bar
+	openBars      map[string]*Bar
+	depth         map[string]*depthScript
+	orders        []*order
+	nextOrderID   int
+	codes         map[string]authCode
+	refreshTokens map[string]string // refresh token -> scope
+	refreshes     int
+
+	closing       chan struct{} // closed by Close to end open streams
+	changed       chan struct{} // closed when market data changes
+	goAway        chan struct{} // closed to send GoAway on open streams
+	streamsPaused bool
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	srv := &Server{
+		signingKey:    newSigningKey(),
+		quotes:        make(map[string]*quoteScript),
+		bars:          make(map[string][]Bar),
+		openBars:      make(map[string]*Bar),
+		depth:         make(map[string]*depthScript),
+		nextOrderID:   100000000,
+		codes:         make(map[string]authCode),
+		refreshTokens: make(map[string]string),
+		closing:       make(chan struct{}),
+		changed:       make(chan struct{}),
+		goAway:        make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", srv.handleAuthorize)
+	mux.HandleFunc("/oauth/token", srv.handleToken)
+	mux.HandleFunc("/oauth/revoke", srv.handleRevoke)
+	mux.HandleFunc("/.well-known/jwks.json", srv.handleJWKS)
+	mux.Handle("/v3/brokerage/accounts", srv.authorized(srv.handleAccounts))
+	mux.Handle("/v3/brokerage/accounts/", srv.authorized(srv.handleAccount))
+	mux.Handle("/v3/marketdata/quotes/", srv.authorized(srv.handleQuotes))
+	mux.Handle("/v3/marketdata/barcharts/", srv.authorized(srv.handleBarCharts))
+	mux.Handle("/v3/marketdata/stream/quotes/", srv.authorized(srv.handleStreamQuotes))
+	mux.Handle("/v3/marketdata/stream/barcharts/", srv.authorized(srv.handleStreamBarCharts))
+	mux.Handle("/v3/marketdata/stream/marketdepth/", srv.authorized(srv.handleStreamMarketDepth))
+	mux.Handle("/v3/orderexecution/orderconfirm", srv.scoped(tradestation.TradeScope, srv.handleOrderConfirm))
+	mux.Handle("/v3/orderexecution/ordergroupconfirm", srv.scoped(tradestation.TradeScope, srv.handleOrderGroupConfirm))
+	mux.Handle("/v3/orderexecution/orders", srv.scoped(tradestation.TradeScope, srv.handlePlaceOrder))
+	mux.Handle("/v3/orderexecution/ordergroups", srv.scoped(tradestation.TradeScope, srv.handlePlaceOrderGroup))
+
+	srv.Server = httptest.NewServer(mux)
+	return srv
+}
+
+// Close ends open streams, shuts down the server and blocks until all
+// outstanding requests have completed
+func (srv *Server) Close() {
+	srv.mu.Lock()
+	select {
+	case <-srv.closing:
+	default:
+		close(srv.closing)
+	}
+	srv.mu.Unlock()
+
+	srv.Server.Close()
+}
+
+// BaseURL returns the root URL of the v3 API served by the server
+func (srv *Server) BaseURL() string {
+	return srv.URL + "/v3"
+}
+
+// SigninURL returns the root URL of the OAuth endpoints served by the server
+func (srv *Server) SigninURL() string {
+	return srv.URL
+}
+
+// JWKSURL returns the URL of the signing keys of the tokens issued by the
+// server
+func (srv *Server) JWKSURL() string {
+	return srv.URL + "/.well-known/jwks.json"
+}
+
+// Options returns client options that connect to the server with a valid
+// access token. Retries and client side rate limiting are disabled so tests
+// run quickly and deterministically.
+func (srv *Server) Options() tradestation.Options {
+	return tradestation.Options{
+		BaseURL:       srv.BaseURL(),
+		SigninURL:     srv.SigninURL(),
+		ClientID:      ClientID,
+		ClientSecret:  ClientSecret,
+		OfflineAccess: true,
+		VerifyToken:   true,
+		JWKSURL:       srv.JWKSURL(),
+		HTTPClient:    srv.Client(),
+		TokenStore:    tradestation.NewMemoryTokenStore(srv.Token()),
+		RetryPolicy:   &tradestation.RetryPolicy{},
+		RateLimits:    map[tradestation.EndpointGroup]tradestation.RateLimit{},
+	}
+}
+
+// NewAPI returns a client created with srv.Options()
+func (srv *Server) NewAPI() *tradestation.API {
+	return tradestation.NewWithOptions(srv.Options())
+}
+
+// writeJSON writes `body` as the JSON response of a request
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes an error response in the format used by TradeStation
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{
+		"Error":   strings.ReplaceAll(http.StatusText(status), " ", ""),
+		"Message": message,
+	})
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func randomString(n int) string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(n))
+}
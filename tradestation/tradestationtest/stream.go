@@ -0,0 +1,238 @@
+// Copyright 2021-2023
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tradestationtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStreamHeartbeat = 5 * time.Second
+	streamContentType      = "application/vnd.tradestation.streams.v2+json"
+)
+
+// GoAwayStreams sends GoAway on every open stream and closes it, as
+// TradeStation does before maintenance
+func (srv *Server) GoAwayStreams() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	close(srv.goAway)
+	srv.goAway = make(chan struct{})
+}
+
+// PauseStreams stops sending anything, including heartbeats, on open
+// streams until it is called with false; clients see the streams stall
+func (srv *Server) PauseStreams(paused bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.streamsPaused = paused
+	srv.notifyStreams()
+}
+
+// notifyStreams wakes up open streams to send updates; srv.mu must be held
+func (srv *Server) notifyStreams() {
+	close(srv.changed)
+	srv.changed = make(chan struct{})
+}
+
+// serveStream writes the messages returned by `poll` and heartbeats in
+// between until the client disconnects, GoAwayStreams is called or the
+// server is closed. `poll` is called with srv.mu held, right away and
+// whenever market data changes.
+func (srv *Server) serveStream(w http.ResponseWriter, r *http.Request, poll func() []any) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", streamContentType)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	write := func(messages []any) bool {
+		for _, msg := range messages {
+			if err := enc.Encode(msg); err != nil {
+				return false
+			}
+		}
+		flusher.Flush()
+		return true
+	}
+
+	// a stream goes away on the first GoAwayStreams after it was opened,
+	// even if it is busy sending updates at the time
+	srv.mu.Lock()
+	interval := srv.StreamHeartbeat
+	goAway := srv.goAway
+	srv.mu.Unlock()
+	if interval <= 0 {
+		interval = defaultStreamHeartbeat
+	}
+
+	heartbeat := time.NewTicker(interval)
+	defer heartbeat.Stop()
+
+	beats := 0
+	for {
+		srv.mu.Lock()
+		changed, paused := srv.changed, srv.streamsPaused
+		var messages []any
+		if !paused {
+			messages = poll()
+		}
+		srv.mu.Unlock()
+
+		if !write(messages) {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-srv.closing:
+			return
+		case <-goAway:
+			write([]any{map[string]string{"StreamStatus": "GoAway"}})
+			return
+		case <-changed:
+		case now := <-heartbeat.C:
+			if paused {
+				continue
+			}
+			beats++
+			if !write([]any{map[string]any{"Heartbeat": beats, "Timestamp": now.UTC().Format(timeFormat)}}) {
+				return
+			}
+		}
+	}
+}
+
+// handleStreamQuotes serves GET /marketdata/stream/quotes/{symbols}. The
+// first message of each symbol is its full quote, later messages only carry
+// the fields that changed.
+func (srv *Server) handleStreamQuotes(w http.ResponseWriter, r *http.Request) {
+	symbols := strings.Split(strings.TrimPrefix(r.URL.Path, "/v3/marketdata/stream/quotes/"), ",")
+	if len(symbols) > 100 {
+		writeError(w, http.StatusBadRequest, "too many symbols, at most 100 symbols may be streamed")
+		return
+	}
+
+	sent := make(map[string]map[string]any, len(symbols))
+	invalid := make(map[string]bool)
+
+	srv.serveStream(w, r, func() []any {
+		messages := make([]any, 0, len(symbols))
+		for _, symbol := range symbols {
+			script, ok := srv.quotes[symbol]
+			if !ok {
+				if !invalid[symbol] {
+					invalid[symbol] = true
+					messages = append(messages, map[string]string{"Symbol": symbol, "Error": "INVALID SYMBOL"})
+				}
+				continue
+			}
+
+			fields := srv.quoteFields(symbol, script)
+			last, ok := sent[symbol]
+			sent[symbol] = fields
+			if !ok {
+				messages = append(messages, fields)
+				continue
+			}
+
+			update := map[string]any{"Symbol": symbol}
+			for key, value := range fields {
+				if !reflect.DeepEqual(last[key], value) {
+					update[key] = value
+				}
+			}
+			if len(update) > 1 {
+				messages = append(messages, update)
+			}
+		}
+		return messages
+	})
+}
+
+// handleStreamBarCharts serves GET /marketdata/stream/barcharts/{symbol}.
+// The last barsback closed bars and the open bar are sent first, then every
+// bar closed by CloseBar and every change of the open bar.
+func (srv *Server) handleStreamBarCharts(w http.ResponseWriter, r *http.Request) {
+	symbol := strings.TrimPrefix(r.URL.Path, "/v3/marketdata/stream/barcharts/")
+
+	barsBack := 1
+	if value := r.URL.Query().Get("barsback"); value != "" {
+		var err error
+		if barsBack, err = strconv.Atoi(value); err != nil || barsBack < 1 || barsBack > maxBars {
+			writeError(w, http.StatusBadRequest, "invalid barsback")
+			return
+		}
+	}
+
+	srv.mu.Lock()
+	_, ok := srv.bars[symbol]
+	if !ok {
+		_, ok = srv.openBars[symbol]
+	}
+	srv.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Symbol is invalid")
+		return
+	}
+
+	started := false
+	sent := 0
+	var lastOpen *Bar
+
+	srv.serveStream(w, r, func() []any {
+		history := srv.bars[symbol]
+		if !started && len(history) > barsBack {
+			sent = len(history) - barsBack
+		}
+		started = true
+
+		messages := make([]any, 0, len(history)-sent+1)
+		for _, bar := range history[sent:] {
+			messages = append(messages, barFields(bar, "Closed", false))
+		}
+		sent = len(history)
+
+		open, ok := srv.openBars[symbol]
+		switch {
+		case !ok:
+			lastOpen = nil
+		case lastOpen == nil || *open != *lastOpen:
+			bar := *open
+			lastOpen = &bar
+			messages = append(messages, barFields(bar, "Open", false))
+		}
+		return messages
+	})
+}